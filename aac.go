@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os/exec"
+	"sync"
+)
+
+/*
+Learning note: Decoding AAC with an external process
+====================================================
+
+Mobile SDKs and RTMP sources usually produce AAC in ADTS framing rather than
+raw PCM. There is no maintained pure-Go AAC decoder, so aacDecoder pipes the
+compressed bytes through ffmpeg and reads back s16le PCM in the session format
+(16kHz mono):
+
+	Decode(frame) --> ffmpeg stdin
+	                  ffmpeg stdout --> output goroutine --> pending samples --> next Decode/Flush
+
+Reading happens in its own goroutine on purpose: ffmpeg buffers internally,
+so writing and reading from the same goroutine could deadlock with both pipes
+full. Each Decode returns whatever ffmpeg has produced so far, which lags the
+input a little. Flush closes stdin, which makes ffmpeg drain and exit, and
+returns the rest.
+
+The same decoder handles MP3, the format of most Icecast and SHOUTcast
+streams. MP3 has no framing that needs checking up front: ffmpeg finds the
+next frame header itself, so a stream may start in the middle of a frame.
+*/
+
+const (
+	// FormatAAC is AAC audio in ADTS framing.
+	FormatAAC = "aac"
+	// FormatMP3 is MPEG-1/2 Layer III audio.
+	FormatMP3 = "mp3"
+)
+
+func init() {
+	RegisterDecoder(FormatAAC, func(ctx context.Context, opts DecoderOptions) (Decoder, error) {
+		return newFFmpegDecoder(ctx, FormatAAC, opts)
+	})
+	RegisterDecoder(FormatMP3, func(ctx context.Context, opts DecoderOptions) (Decoder, error) {
+		return newFFmpegDecoder(ctx, FormatMP3, opts)
+	})
+}
+
+var adtsSampleRates = [...]int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// adtsHeader holds the fields of an ADTS frame header that matter to us.
+type adtsHeader struct {
+	SampleRate  int
+	Channels    int
+	FrameLength int // including the header
+}
+
+var errNoADTSSync = errors.New("no ADTS syncword")
+
+// parseADTSHeader decodes the fixed part of the ADTS header at the start of b.
+func parseADTSHeader(b []byte) (adtsHeader, error) {
+	if len(b) < 7 {
+		return adtsHeader{}, io.ErrUnexpectedEOF
+	}
+	if b[0] != 0xFF || b[1]&0xF0 != 0xF0 {
+		return adtsHeader{}, errNoADTSSync
+	}
+	rateIdx := int(b[2]>>2) & 0x0F
+	if rateIdx >= len(adtsSampleRates) {
+		return adtsHeader{}, fmt.Errorf("invalid ADTS sampling frequency index %d", rateIdx)
+	}
+	return adtsHeader{
+		SampleRate:  adtsSampleRates[rateIdx],
+		Channels:    int(b[2]&0x01)<<2 | int(b[3]>>6),
+		FrameLength: int(b[3]&0x03)<<11 | int(b[4])<<3 | int(b[5]>>5),
+	}, nil
+}
+
+// aacDecoder decodes an ADTS AAC or an MP3 stream by running it through
+// ffmpeg.
+type aacDecoder struct {
+	format string // FormatAAC or FormatMP3
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	// synced is set once a frame starting with an ADTS header was seen;
+	// anything before that is rejected. MP3 needs no sync.
+	synced bool
+
+	mu      sync.Mutex
+	pending []byte // decoded s16le not yet returned
+	readErr error
+	done    chan struct{} // closed when ffmpeg's output ends
+
+	samples []int16
+}
+
+// newFFmpegDecoder starts ffmpeg for one session, reading format. The process
+// is killed when ctx is canceled.
+func newFFmpegDecoder(ctx context.Context, format string, opts DecoderOptions) (Decoder, error) {
+	cmd := exec.CommandContext(ctx, opts.FFmpegPath,
+		"-hide_banner", "-loglevel", "error",
+		"-f", format, "-i", "pipe:0",
+		"-f", "s16le", "-ac", fmt.Sprint(numChannels), "-ar", fmt.Sprint(sampleRateHz), "pipe:1")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", format, err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", format, err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("%s: start ffmpeg: %w", format, err)
+	}
+	slog.Info("ffmpeg: decoder started", slog.String("format", format), slog.Int("pid", cmd.Process.Pid))
+
+	d := &aacDecoder{format: format, cmd: cmd, stdin: stdin, done: make(chan struct{}), synced: format != FormatAAC}
+	go d.readOutput(stdout)
+	return d, nil
+}
+
+// readOutput collects ffmpeg's PCM output until it ends.
+func (d *aacDecoder) readOutput(stdout io.Reader) {
+	defer close(d.done)
+	buf := make([]byte, pcmBufferSize)
+	for {
+		n, err := stdout.Read(buf)
+		d.mu.Lock()
+		d.pending = append(d.pending, buf[:n]...)
+		if err != nil && !errors.Is(err, io.EOF) {
+			d.readErr = err
+		}
+		d.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// take returns the complete samples decoded so far.
+func (d *aacDecoder) take() []int16 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.samples = d.samples[:0]
+	n := len(d.pending) / bytesPerSample
+	for i := range n {
+		d.samples = append(d.samples, int16(binary.LittleEndian.Uint16(d.pending[i*bytesPerSample:])))
+	}
+	d.pending = append(d.pending[:0], d.pending[n*bytesPerSample:]...)
+	return d.samples
+}
+
+func (d *aacDecoder) Info() DecoderInfo {
+	return DecoderInfo{Name: d.format}
+}
+
+func (d *aacDecoder) Decode(data []byte) ([]int16, error) {
+	if !d.synced {
+		h, err := parseADTSHeader(data)
+		if err != nil {
+			return nil, fmt.Errorf("not ADTS AAC: %w", err)
+		}
+		d.synced = true
+		slog.Info("aac: stream detected", slog.Int("sample_rate", h.SampleRate), slog.Int("channels", h.Channels))
+	}
+	if _, err := d.stdin.Write(data); err != nil {
+		return d.take(), fmt.Errorf("%s: write to ffmpeg: %w", d.format, err)
+	}
+	return d.take(), nil
+}
+
+// Flush ends ffmpeg's input and returns the remaining decoded audio.
+func (d *aacDecoder) Flush() ([]int16, error) {
+	_ = d.stdin.Close()
+	<-d.done
+	d.mu.Lock()
+	err := d.readErr
+	d.mu.Unlock()
+	return d.take(), err
+}
+
+// Close stops ffmpeg and waits for it to exit.
+func (d *aacDecoder) Close() error {
+	_ = d.stdin.Close()
+	<-d.done
+	err := d.cmd.Wait()
+	slog.Info("ffmpeg: decoder finished", slog.String("format", d.format))
+	return err
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// requireAdmin lets only requests carrying "Authorization: Bearer <token>"
+// through to next. With an empty token, admin endpoints are disabled and
+// every request is refused.
+func requireAdmin(token string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token == "" {
+			http.Error(w, "admin endpoints are disabled; start the server with -admin-token", http.StatusForbidden)
+			return
+		}
+		if !isAdmin(token, r) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// isAdmin reports whether r carries "Authorization: Bearer <token>". No
+// request does while token is empty.
+func isAdmin(token string, r *http.Request) bool {
+	given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return token != "" && ok && subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+// errNoCredentials is returned for requests that carry neither the admin
+// token nor an API key where one of them is required.
+var errNoCredentials = fmt.Errorf("%w: admin token or API key required", ErrAuth)
+
+// callerOf returns who r acts for: the admin (see isAdmin), with zero
+// entitlements, or the tenant of its API key. Requests with neither fail with
+// errNoCredentials, unknown keys with errUnknownAPIKey.
+func callerOf(token string, keys *APIKeys, r *http.Request) (e Entitlements, admin bool, err error) {
+	if isAdmin(token, r) {
+		return Entitlements{}, true, nil
+	}
+	e, err = keys.Lookup(r)
+	if err == nil && e.Tenant == "" {
+		err = errNoCredentials
+	}
+	return e, false, err
+}
+
+// sessionOwner returns the tenant session id was started for, "" if it was
+// started without an API key; ok is false for sessions it does not know.
+type sessionOwner func(id string) (tenant string, ok bool)
+
+// sessionOwners looks sessions up among the running ones, then the ended
+// ones whose transcript store still keeps, then the recorded ones (rec may
+// be nil).
+func sessionOwners(sessions *SessionRegistry, store *TranscriptStore, rec *Recorder) sessionOwner {
+	return func(id string) (string, bool) {
+		if s, ok := sessions.Get(id); ok {
+			return s.Tenant, true
+		}
+		if tenant, ok := store.Tenant(id); ok {
+			return tenant, true
+		}
+		return rec.Tenant(id)
+	}
+}
+
+// requireSessionAccess lets a request for session {id} through to next if it
+// carries the admin token (see requireAdmin) or an API key of the tenant the
+// session belongs to. Sessions started without a key are the admin's only.
+// A session of another tenant is not found, so its ID cannot be probed.
+func requireSessionAccess(token string, keys *APIKeys, owner sessionOwner, next http.HandlerFunc) http.HandlerFunc {
+	return requireOwner(token, keys, owner, "session not found", next)
+}
+
+// requireJobAccess is requireSessionAccess for job {id}: the tenant a job
+// was started for (see Job.Tenant) and the admin may read it.
+func requireJobAccess(token string, keys *APIKeys, jobs *JobStore, next http.HandlerFunc) http.HandlerFunc {
+	return requireOwner(token, keys, jobs.Tenant, "job not found", next)
+}
+
+// requireOwner lets a request for {id} through to next if it carries the
+// admin token or an API key of the tenant owner returns for {id}; otherwise
+// it answers 404 with notFound.
+func requireOwner(token string, keys *APIKeys, owner sessionOwner, notFound string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		entitlements, admin, err := callerOf(token, keys, r)
+		if err != nil {
+			rejectAPIKey(w, err)
+			return
+		}
+		if admin {
+			next(w, r)
+			return
+		}
+		if tenant, ok := owner(r.PathValue("id")); !ok || tenant != entitlements.Tenant {
+			http.Error(w, notFound, http.StatusNotFound)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// KillSessionEndpoint serves DELETE /sessions/{id}: it ends a running
+// session the way a limit does, so the transcript so far is flushed and the
+// client gets a closing event with reason "session_terminated" (and the
+// optional ?message=). It answers 202; the session ends shortly after.
+func KillSessionEndpoint(sessions *SessionRegistry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, ok := sessions.Get(r.PathValue("id"))
+		if !ok {
+			http.Error(w, "session not found", http.StatusNotFound)
+			return
+		}
+		message := r.URL.Query().Get("message")
+		if message == "" {
+			message = "the session was ended by an administrator"
+		}
+		if !session.Kill(closeReason{Code: "session_terminated", Message: message}) {
+			http.Error(w, "session is already ending", http.StatusConflict)
+			return
+		}
+		slog.Info("admin: session killed", slog.Any("session", session), slog.String("remote", r.RemoteAddr))
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// endOnKill is a pipeline stage that forwards audio until session is killed
+// (see Session.Kill). Then it sends a Final chunk, so Transcribe flushes the
+// rest of the transcript and the stream is closed, and calls onKill with the
+// reason. Any audio arriving afterwards is released and dropped.
+func endOnKill(ctx context.Context, in <-chan AudioChunk, session *Session, onKill func(closeReason)) <-chan AudioChunk {
+	out := make(chan AudioChunk, cap(in))
+	killed, reason := session.Killed()
+
+	go func() {
+		defer close(out)
+		var (
+			tsMs  int64
+			ended bool // a Final chunk went out
+		)
+		for {
+			var kill <-chan struct{}
+			if !ended {
+				kill = killed
+			}
+			var ch AudioChunk
+			select {
+			case next, ok := <-in:
+				if !ok {
+					return
+				}
+				if ended {
+					next.Release()
+					continue
+				}
+				ch, tsMs, ended = next, next.TsMs, next.Final
+			case <-kill:
+				ended = true
+				onKill(reason())
+				ch = AudioChunk{Final: true, TsMs: tsMs}
+			case <-ctx.Done():
+				return
+			}
+
+			select {
+			case out <- ch:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+/*
+Learning note: API keys and entitlements
+========================================
+
+With -api-keys the server knows its clients by key. The file maps every key
+to the tenant it belongs to and what sessions started with it may use:
+
+	{
+	  "k_3f9a...": {"tenant": "acme", "max_audio_minutes": 60, "max_cost_usd": 2,
+	                "monthly_minutes": 10000, "max_sessions": 20, "over_quota": "finals_only",
+	                "qos": "realtime"},
+	  "k_77c1...": {"tenant": "globex"}
+	}
+
+A client sends its key as "Authorization: Bearer <key>" or, where it cannot
+set headers (a browser's WebSocket), as ?api_key=<key>. Requests without a
+key get the server's defaults; a key that is not in the file is refused with
+401 before anything is started.
+
+Entitlements that are zero fall back to the flags (-max-audio-duration,
+-session-max-cost, -qos, and the quotas of quota.go), so the file only lists
+what differs per tenant.
+*/
+
+// errUnknownAPIKey is returned for keys that are not in the API key file.
+var errUnknownAPIKey = fmt.Errorf("%w: unknown API key", ErrAuth)
+
+// Entitlements are what the sessions of an API key may use; zero values
+// fall back to the server's configuration.
+type Entitlements struct {
+	Tenant          string   `json:"tenant"`
+	MaxAudioMinutes float64  `json:"max_audio_minutes,omitempty"`
+	MaxCostUSD      float64  `json:"max_cost_usd,omitempty"`
+	QoS             QoSClass `json:"qos,omitempty"` // the highest class, see qos.go
+
+	// Tenant quotas, see quota.go.
+	DailyMinutes   float64 `json:"daily_minutes,omitempty"`
+	MonthlyMinutes float64 `json:"monthly_minutes,omitempty"`
+	MaxSessions    int     `json:"max_sessions,omitempty"`
+	OverQuota      string  `json:"over_quota,omitempty"` // "reject" or "finals_only"
+}
+
+// APIKeys maps API keys to their entitlements. A nil *APIKeys accepts only
+// requests without a key. It is read-only after loading.
+type APIKeys struct {
+	keys map[string]Entitlements
+}
+
+// LoadAPIKeys reads the API key file at path (see the note above).
+func LoadAPIKeys(path string) (*APIKeys, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("api keys: %w", err)
+	}
+	var keys map[string]Entitlements
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("api keys: %s: %w", path, err)
+	}
+	for key, e := range keys {
+		if e.Tenant == "" {
+			return nil, fmt.Errorf("api keys: key %s…: tenant is required", key[:min(len(key), 4)])
+		}
+		if e.OverQuota != "" && e.OverQuota != overQuotaReject && e.OverQuota != overQuotaFinalsOnly {
+			return nil, fmt.Errorf("api keys: key %s…: over_quota must be %q or %q", key[:min(len(key), 4)], overQuotaReject, overQuotaFinalsOnly)
+		}
+		if e.QoS != "" {
+			if _, err := parseQoSClass(string(e.QoS)); err != nil {
+				return nil, fmt.Errorf("api keys: key %s…: %w", key[:min(len(key), 4)], err)
+			}
+		}
+	}
+	return &APIKeys{keys: keys}, nil
+}
+
+// apiKeyOf returns the API key a request carries, if any.
+func apiKeyOf(r *http.Request) string {
+	if key, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return key
+	}
+	return r.URL.Query().Get("api_key")
+}
+
+// Lookup returns the entitlements of the request's API key: zero
+// Entitlements for requests without one, errUnknownAPIKey for keys that are
+// not known.
+func (k *APIKeys) Lookup(r *http.Request) (Entitlements, error) {
+	key := apiKeyOf(r)
+	if key == "" {
+		return Entitlements{}, nil
+	}
+	if k == nil {
+		return Entitlements{}, errUnknownAPIKey
+	}
+	e, ok := k.keys[key]
+	if !ok {
+		return Entitlements{}, errUnknownAPIKey
+	}
+	return e, nil
+}
+
+// rejectAPIKey answers a request whose API key was refused.
+func rejectAPIKey(w http.ResponseWriter, err error) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="transcribe"`)
+	writeError(w, "unauthorized", err)
+}
@@ -2,12 +2,15 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	transcribe "github.com/aws/aws-sdk-go-v2/service/transcribestreaming"
 	tstypes "github.com/aws/aws-sdk-go-v2/service/transcribestreaming/types"
+	"golang.org/x/sync/errgroup"
 )
 
 /*
@@ -47,14 +50,41 @@ select over channels
 - This is key for coordinating independent goroutines without busy waiting or
   fragile timing logic.
 
-Non-blocking send with default
-------------------------------
-- `select { case errCh <- err: default: }` attempts to send once, and if the
-  buffer is full (or no goroutine is receiving), it drops the value. We use
-  this pattern for one-shot error channels where only the first error matters
-  and we do not want to block and leak goroutines.
+Closing a channel with several goroutines around it
+---------------------------------------------------
+- Only the goroutine that sends on a channel may close it, and only once it
+  will never send again: a send on a closed channel panics.
+- The session has a sender (audio to AWS) and a receiver (transcripts from
+  AWS) that finish independently. They run in an errgroup
+  (golang.org/x/sync/errgroup): the first to fail cancels the group's
+  context, which stops the other, and the closer's g.Wait() returns that
+  first error once both are done. Only then are the output channels closed.
+- A goroutine that ends without error makes the other stop as well (the
+  sender closes the AWS stream, the receiver closes recvDone), so the wait
+  always ends.
+- The error channel is buffered, so the closer's one send never blocks.
+
+Deadlines on calls that can hang
+--------------------------------
+- The sender's Send to AWS blocks while the HTTP/2 connection does not take
+  the frame. A connection that hangs without breaking would wedge the sender,
+  and behind it forwardAudio, the stages and the reader. Every Send gets its
+  own deadline (-aws-send-timeout); one that expires fails the session like
+  any other send error, which releases the whole pipeline.
+
+What a stream depends on
+------------------------
+- Streams are started through a TranscribeClient, built by main from the
+  Config: the Transcribe API itself, how many times a start is tried (see
+  retry.go), the send deadline, the circuit breaker (breaker.go), the fault
+  injector (chaos.go) and the warm pool (warm.go). Nothing of it is global,
+  so a test can run sessions against a fake TranscribeAPI whose streams are
+  built with transcribe.NewStartStreamTranscriptionEventStream.
 */
 
+// errSendTimeout fails a session whose audio AWS stopped taking.
+var errSendTimeout = fmt.Errorf("%w: send to Transcribe", ErrTimeout)
+
 const (
 	// chunkMs controls pacing of audio chunks to simulate microphone cadence
 	chunkMs = 100
@@ -67,13 +97,78 @@ const (
 
 type AudioChunk struct {
 	PCM   []byte // raw PCM bytes (decoded)
-	TsMs  int64  // simulated timestamp
+	TsMs  int64  // session timestamp: client capture time with ?framing=seq, simulated otherwise
 	Final bool   // mark end-of-stream
+
+	Seq       uint32 // client sequence number (?framing=seq only)
+	CaptureMs int64  // client capture timestamp (?framing=seq only)
+
+	Received time.Time // arrival on the server, for live audio only (see latency.go)
+
+	pooled *[]byte // backing buffer from pcmPool, see newPooledChunk
 }
 
+// transcribeLanguage is the language sessions are transcribed in.
+const transcribeLanguage = tstypes.LanguageCodeEnUs
+
+// TranscriptPiece is one result of Transcribe. StartMs and EndMs are offsets
+// into the audio of the session; Speaker is the label Transcribe's speaker
+// partitioning gave the first word ("0", "1", ...), empty if there is none.
 type TranscriptPiece struct {
-	Text    string
-	Partial bool
+	Text    string `json:"text"`
+	Partial bool   `json:"partial"`
+	StartMs int64  `json:"start_ms"`
+	EndMs   int64  `json:"end_ms"`
+	Speaker string `json:"speaker,omitempty"`
+	// Confidence is the average confidence of the piece's words, 0 if AWS
+	// gave none (it does not for partials).
+	Confidence float64 `json:"confidence,omitempty"`
+	// ResultID is the ID of the AWS result the piece belongs to: its partials
+	// and its final share it.
+	ResultID string `json:"result_id,omitempty"`
+}
+
+// TranscribeAPI starts Transcribe Streaming streams: the AWS SDK's client
+// (see sdkTranscribeAPI), or a fake in tests.
+type TranscribeAPI interface {
+	StartStreamTranscription(ctx context.Context, input *transcribe.StartStreamTranscriptionInput) (*transcribe.StartStreamTranscriptionEventStream, error)
+}
+
+// sdkTranscribeAPI is the TranscribeAPI of the AWS SDK's client.
+type sdkTranscribeAPI struct {
+	client *transcribe.Client
+}
+
+func (a sdkTranscribeAPI) StartStreamTranscription(ctx context.Context, input *transcribe.StartStreamTranscriptionInput) (*transcribe.StartStreamTranscriptionEventStream, error) {
+	out, err := a.client.StartStreamTranscription(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	return out.GetStream(), nil
+}
+
+// TranscribeClient starts the Transcribe streams of sessions, with what every
+// start and send goes through (see the note above).
+type TranscribeClient struct {
+	api         TranscribeAPI
+	attempts    int             // tries per start, at least 1
+	sendTimeout time.Duration   // bounds one Send; 0 = no bound
+	breaker     *circuitBreaker // nil unless cfg.BreakerThreshold is set
+	chaos       *faultInjector  // nil unless a cfg.Chaos field is set
+	pool        *TranscribePool // nil unless cfg.WarmSessions is set
+}
+
+// NewTranscribeClient returns the client of api configured by cfg. Its warm
+// pool, if any, keeps streams open until ctx is done.
+func NewTranscribeClient(ctx context.Context, api TranscribeAPI, cfg Config) *TranscribeClient {
+	c := &TranscribeClient{api: api, attempts: max(cfg.StartAttempts, 1), sendTimeout: cfg.SendTimeout, chaos: newFaultInjector(cfg)}
+	if cfg.BreakerThreshold > 0 {
+		c.breaker = newCircuitBreaker(cfg.BreakerThreshold, cfg.BreakerCooldown)
+	}
+	if cfg.WarmSessions > 0 {
+		c.pool = NewTranscribePool(ctx, c, cfg.WarmSessions, cfg.Usage, cfg.PricePerMinute)
+	}
+	return c
 }
 
 // runTranscribeStream starts an AWS Transcribe Streaming session and wires it
@@ -104,8 +199,9 @@ type TranscriptPiece struct {
 //   - Caller owns audioInputChannel in the sense of sending values. Do NOT close
 //     it directly. To signal completion, send an AudioChunk with Final=true. The
 //     sender goroutine will close the underlying AWS stream.
-//   - transcriptOutputChannel is closed by this function when the AWS receive side
-//     completes (normal or error). Consumers can range over it to detect end.
+//   - transcriptOutputChannel is closed by this function once both the sender and
+//     the receiver have finished (normal or error). Consumers can range over it
+//     to detect end.
 //   - errOutputChannel is closed by this function when the session fully ends.
 //
 // Cancellation:
@@ -113,22 +209,60 @@ type TranscriptPiece struct {
 //     when a WebSocket disconnects). Cancellation stops both send and receive
 //     loops.
 
-func runTranscribeStream(ctx context.Context, client *transcribe.Client) (chan<- AudioChunk, <-chan TranscriptPiece, <-chan error, error) {
+func runTranscribeStream(ctx context.Context, client *TranscribeClient) (chan<- AudioChunk, <-chan TranscriptPiece, <-chan error, error) {
+	return runTranscribeStreamWith(ctx, client, TranscribeOptions{})
+}
+
+// TranscribeOptions are the settings of a Transcribe stream that may differ
+// between streams; zero values are the server's defaults.
+type TranscribeOptions struct {
+	Language   string `json:"language,omitempty"`   // e.g. "en-GB"; default transcribeLanguage
+	Vocabulary string `json:"vocabulary,omitempty"` // name of a custom vocabulary in the account
+	Speakers   bool   `json:"speakers,omitempty"`   // label who speaks in each piece (?speakers=1)
+}
 
-	slog.Info("transcribe: starting session")
-	stream, err := client.StartStreamTranscription(ctx, &transcribe.StartStreamTranscriptionInput{
-		LanguageCode:         tstypes.LanguageCodeEnUs,
+// runTranscribeStreamWith is runTranscribeStream with opts.
+func runTranscribeStreamWith(ctx context.Context, client *TranscribeClient, opts TranscribeOptions) (chan<- AudioChunk, <-chan TranscriptPiece, <-chan error, error) {
+	input := &transcribe.StartStreamTranscriptionInput{
+		LanguageCode:         transcribeLanguage,
 		MediaEncoding:        tstypes.MediaEncodingPcm,
 		MediaSampleRateHertz: aws.Int32(sampleRateHz),
+		ShowSpeakerLabel:     opts.Speakers,
 		// EnablePartialResultsStabilization: true,
 		// PartialResultsStability:           tstypes.PartialResultsStabilityHigh,
+	}
+	if opts.Language != "" {
+		input.LanguageCode = tstypes.LanguageCode(opts.Language)
+	}
+	if opts.Vocabulary != "" {
+		input.VocabularyName = aws.String(opts.Vocabulary)
+	}
+
+	// The sender and the receiver run in an errgroup: the first of them to
+	// fail cancels ctx, which the stream lives on, so the other stops too, and
+	// Wait reports that first error. cancel covers the paths where nobody
+	// waits for the group.
+	ctx, cancel := context.WithCancel(ctx)
+	g, ctx := errgroup.WithContext(ctx)
+	log := loggerFrom(ctx)
+	log.Info("transcribe: starting session", slog.String("language", string(input.LanguageCode)))
+	started, err := client.breaker.Allow()
+	if err != nil {
+		cancel()
+		return nil, nil, nil, err
+	}
+	stream, err := withRetry(ctx, client.attempts, func() (*transcribe.StartStreamTranscriptionEventStream, error) {
+		return client.api.StartStreamTranscription(ctx, input)
 	})
+	started(err)
 	if err != nil {
-		slog.Error("transcribe: start failed", slog.String("error", err.Error()))
+		cancel()
+		metrics.awsError(err)
+		log.Error("transcribe: start failed", slog.String("error", err.Error()))
 		return nil, nil, nil, err
 	}
 
-	slog.Info("transcribe: session started")
+	log.Info("transcribe: session started")
 
 	// Channel where the caller will PRODUCE audio chunks for Transcribe.
 	audioInputChannel := make(chan AudioChunk, 16)
@@ -139,101 +273,215 @@ func runTranscribeStream(ctx context.Context, client *transcribe.Client) (chan<-
 	// Channel where the caller will CONSUME errors emitted by this session.
 	errOutputChannel := make(chan error, 1)
 
-	// Signal channels for internal coordination of completion.
-	sendDone := make(chan error, 1)
-	recvDone := make(chan error, 1)
+	// recvDone tells the sender that nobody listens to AWS any more.
+	recvDone := make(chan struct{})
+
+	// clock remembers when the audio went out, for the latency of the
+	// pieces that come back (see metrics.go).
+	var clock sendClock
 
 	// Sender goroutine: reads AudioChunk from audioInputChannel and send to AWS Transcribe API.
 	// Running this code won't block the execution, as it is running in a goroutine. There is no way of reading the return value of a function
 	// running as a goroutine. That's what channels are for. The function communicates with other processes via channels.
-	go func() {
-		slog.Info("sender: started")
-		defer close(sendDone)
-		for ch := range audioInputChannel {
+	g.Go(func() (err error) {
+		defer recoverPanic("sender", func(perr error) { err = perr })
+		log.Info("sender: started")
+		// Whatever ends the sender, the AWS stream is closed so the receiver
+		// gets the last events and finishes.
+		defer func() { _ = stream.Close() }()
+		for {
+			var ch AudioChunk
+			select {
+			case c, ok := <-audioInputChannel:
+				if !ok {
+					// The producer closed audioInputChannel without sending Final.
+					log.Info("sender: input channel closed; closing aws stream")
+					return nil
+				}
+				ch = c
+			case <-recvDone:
+				// AWS ended the stream; there is nobody to send to.
+				log.Info("sender: receiver finished; stopping")
+				return nil
+			case <-ctx.Done():
+				return nil
+			}
+
 			// Final=true signals end-of-stream from the producer (e.g., client closed)
 			if ch.Final {
-				slog.Info("sender: received final", slog.Int64("ts_ms", ch.TsMs))
-				_ = stream.GetStream().Close()
-				return
+				log.Info("sender: received final", slog.Int64("ts_ms", ch.TsMs))
+				return nil
 			}
 
 			// Forward PCM payload to AWS. We wrap the AudioEvent in the union type that
 			// the SDK expects for the event stream.
-			if err := stream.GetStream().Send(ctx, &tstypes.AudioStreamMemberAudioEvent{Value: tstypes.AudioEvent{AudioChunk: ch.PCM}}); err != nil {
-				slog.Error("sender: send failed", slog.String("error", err.Error()))
-				sendDone <- fmt.Errorf("send audio: %w", err)
-				return
+			if err := client.sendAudio(ctx, stream, ch.PCM); err != nil {
+				log.Error("sender: send failed", slog.String("error", err.Error()))
+				// The error cancels ctx: the receiver would wait for events
+				// that never come.
+				return fmt.Errorf("send audio: %w", err)
 			}
-			slog.Debug("sender: chunk sent", slog.Int("bytes", len(ch.PCM)), slog.Int64("ts_ms", ch.TsMs))
+			clock.sent(ch)
+			log.Debug("sender: chunk sent", slog.Int("bytes", len(ch.PCM)), slog.Int64("ts_ms", ch.TsMs))
+
+			// Once Send reports success the SDK has encoded the payload, so the
+			// buffer can go back to the pool. On failure we skip the release: the
+			// SDK may still hold the slice, and the GC will reclaim it instead.
+			ch.Release()
 		}
-		// If the producer closes audioInputChannel without sending Final, we still
-		// close the AWS stream to release resources.
-		slog.Info("sender: input channel closed; closing aws stream")
-		_ = stream.GetStream().Close()
-	}()
+	})
 
 	// Receiver goroutine: reads transcript events from the AWS transcribe stream and sends them to the transcriptOutputChannel.
 	// It is interesting to note that sender has no idea who the receiver is, and receiver has no idea who the sender is.
-	go func() {
-		slog.Info("receiver: started")
+	// It is the only goroutine writing to transcriptOutputChannel, which is
+	// why the closer can close that channel once the receiver is done.
+	g.Go(func() (err error) {
 		defer close(recvDone)
-		for ev := range stream.GetStream().Events() {
+		defer recoverPanic("receiver", func(perr error) { err = perr })
+		log.Info("receiver: started")
+		partials := partialFilter{log: log}
+		events := stream.Events()
+	loop:
+		for {
+			// The SDK closes events once the stream ends; a canceled session
+			// does not wait for that.
+			var ev tstypes.TranscriptResultStream
+			select {
+			case e, ok := <-events:
+				if !ok {
+					break loop
+				}
+				ev = e
+			case <-ctx.Done():
+				log.Info("receiver: context done; stopping")
+				return nil
+			}
+			client.chaos.beforeEvent(ctx)
 			switch te := ev.(type) {
 			case *tstypes.TranscriptResultStreamMemberTranscriptEvent:
 				if te.Value.Transcript == nil {
-					slog.Debug("receiver: event without transcript")
+					log.Debug("receiver: event without transcript")
 					continue
 				}
 				for _, res := range te.Value.Transcript.Results {
 					for _, alt := range res.Alternatives {
-						if alt.Transcript != nil {
-							slog.Debug("receiver: transcript piece", slog.Bool("partial", res.IsPartial))
-							transcriptOutputChannel <- TranscriptPiece{Text: *alt.Transcript, Partial: res.IsPartial}
+						if alt.Transcript == nil {
+							continue
+						}
+						piece := TranscriptPiece{
+							Text:       *alt.Transcript,
+							Partial:    res.IsPartial,
+							StartMs:    int64(res.StartTime * 1000),
+							EndMs:      int64(res.EndTime * 1000),
+							Speaker:    firstSpeaker(alt.Items),
+							Confidence: averageConfidence(alt.Items),
+							ResultID:   aws.ToString(res.ResultId),
+						}
+						if !partials.keep(piece) {
+							continue
+						}
+						audioLatency, transcriptLatency, ok := clock.cover(piece.EndMs, metrics.audioLatency.observe)
+						if ok {
+							metrics.transcriptLatency.observe(transcriptLatency)
+						}
+						log.Debug("receiver: transcript piece", slog.Bool("partial", piece.Partial), slog.Int64("end_ms", piece.EndMs),
+							slog.Duration("audio_latency", audioLatency), slog.Duration("transcript_latency", transcriptLatency))
+						select {
+						case transcriptOutputChannel <- piece:
+						case <-ctx.Done():
+							// Nobody reads any more; the canceled context
+							// ends the event stream as well.
 						}
 					}
 				}
 			default:
 				// ignore non-transcript events
-				slog.Info("receiver: non-transcript event ignored", slog.String("type", fmt.Sprintf("%T", ev)))
+				log.Info("receiver: non-transcript event ignored", slog.String("type", fmt.Sprintf("%T", ev)))
 			}
 		}
-		if err := stream.GetStream().Err(); err != nil {
-			slog.Error("receiver: stream error", slog.String("error", err.Error()))
-			recvDone <- fmt.Errorf("receive: %w", err)
-			return
+		if err := stream.Err(); err != nil {
+			log.Error("receiver: stream error", slog.String("error", err.Error()))
+			return fmt.Errorf("receive: %w", err)
 		}
-		slog.Info("receiver: finished; no more events")
-	}()
+		log.Info("receiver: finished; no more events")
+		return nil
+	})
 
-	// Closer goroutine: waits for either sender or receiver to finish, reports the
-	// first error (if any), then closes transcriptOutputChannel and errOutputChannel
-	// to signal completion to the caller.
+	// Closer goroutine: waits for both the sender and the receiver to finish,
+	// reports the first error (if any), then closes transcriptOutputChannel and
+	// errOutputChannel to signal completion to the caller. Neither goroutine
+	// can write to a channel after it is closed. The shutdown order is always
+	// the same: sender and receiver, then ctx, then the output channels.
 	go func() {
-		slog.Info("closer: waiting for completion")
-		var firstErr error
-		select {
-		case e := <-sendDone:
-			slog.Info("closer: sender finished", slog.Bool("error", e != nil))
-			firstErr = e
-		case e := <-recvDone:
-			slog.Info("closer: receiver finished", slog.Bool("error", e != nil))
-			firstErr = e
-		}
-		if firstErr != nil {
+		defer close(errOutputChannel)
+		defer close(transcriptOutputChannel)
+		defer recoverPanic("closer", func(err error) {
 			select {
-			case errOutputChannel <- firstErr:
+			case errOutputChannel <- err:
 			default:
 			}
+		})
+		log.Info("closer: waiting for completion")
+		err := g.Wait()
+		cancel()
+		if err != nil {
+			metrics.awsError(err)
+			errOutputChannel <- err
 		}
-		slog.Info("closer: closing output channels")
-		close(transcriptOutputChannel)
-		close(errOutputChannel)
+		log.Info("closer: closing output channels", slog.Bool("error", err != nil))
 	}()
 
 	// Return the channels to the caller:
 	// - audioInputChannel: caller sends AudioChunk values
 	// - transcriptOutputChannel: caller receives TranscriptPiece values
 	// - errOutputChannel: caller receives a terminal error (if any)
-	slog.Info("transcribe: channels ready")
+	log.Info("transcribe: channels ready")
 	return audioInputChannel, transcriptOutputChannel, errOutputChannel, nil
 }
+
+// sendAudio sends pcm on stream within c.sendTimeout. An expired deadline is
+// reported as such, not as the cancellation of ctx. In chaos mode the send
+// may be delayed or fail (see chaos.go).
+func (c *TranscribeClient) sendAudio(ctx context.Context, stream *transcribe.StartStreamTranscriptionEventStream, pcm []byte) error {
+	sendCtx := ctx
+	if c.sendTimeout > 0 {
+		var cancel context.CancelFunc
+		sendCtx, cancel = context.WithTimeout(ctx, c.sendTimeout)
+		defer cancel()
+	}
+	err := c.chaos.beforeSend(sendCtx)
+	if err == nil {
+		err = stream.Send(sendCtx, &tstypes.AudioStreamMemberAudioEvent{Value: tstypes.AudioEvent{AudioChunk: pcm}})
+	}
+	if err != nil && ctx.Err() == nil && errors.Is(sendCtx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("no progress for %s: %w", c.sendTimeout, errSendTimeout)
+	}
+	return err
+}
+
+// firstSpeaker returns the speaker label of the first labeled item.
+func firstSpeaker(items []tstypes.Item) string {
+	for _, it := range items {
+		if it.Speaker != nil {
+			return *it.Speaker
+		}
+	}
+	return ""
+}
+
+// averageConfidence returns the average confidence of the items that have
+// one, 0 if none does.
+func averageConfidence(items []tstypes.Item) float64 {
+	var sum float64
+	var n int
+	for _, it := range items {
+		if it.Confidence != nil {
+			sum += *it.Confidence
+			n++
+		}
+	}
+	if n == 0 {
+		return 0
+	}
+	return sum / float64(n)
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	transcribe "github.com/aws/aws-sdk-go-v2/service/transcribestreaming"
+	tstypes "github.com/aws/aws-sdk-go-v2/service/transcribestreaming/types"
+	"github.com/aws/smithy-go"
+)
+
+// fakeTranscribe is the TranscribeAPI of tests: it starts fakeStreams. Every stream it starts is sent on started, for the test to
+// drive.
+type fakeTranscribe struct {
+	sendErr error // if set, every Send of its streams fails with it
+	started chan *fakeStream
+
+	mu    sync.Mutex
+	limit int // streams open at once before starts fail as AWS's do; 0 = no limit
+	open  int
+}
+
+func newFakeTranscribe() *fakeTranscribe {
+	return &fakeTranscribe{started: make(chan *fakeStream, 16)}
+}
+
+// setLimit makes f refuse streams beyond limit open at once, as an account
+// at its concurrency quota does.
+func (f *fakeTranscribe) setLimit(limit int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.limit = limit
+}
+
+func (f *fakeTranscribe) StartStreamTranscription(ctx context.Context, input *transcribe.StartStreamTranscriptionInput) (*transcribe.StartStreamTranscriptionEventStream, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.limit > 0 && f.open >= f.limit {
+		return nil, &smithy.GenericAPIError{Code: "LimitExceededException", Message: "concurrent stream limit reached"}
+	}
+	f.open++
+	s := &fakeStream{
+		input:   input,
+		sendErr: f.sendErr,
+		audio:   make(chan []byte, 64),
+		events:  make(chan tstypes.TranscriptResultStream, 32),
+		closed: func() {
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			f.open--
+		},
+	}
+	select {
+	case f.started <- s:
+	default:
+	}
+	return transcribe.NewStartStreamTranscriptionEventStream(func(es *transcribe.StartStreamTranscriptionEventStream) {
+		es.Writer = fakeWriter{s}
+		es.Reader = fakeReader{s}
+	}), nil
+}
+
+// stream returns the next stream f starts.
+func (f *fakeTranscribe) stream(t *testing.T) *fakeStream {
+	t.Helper()
+	select {
+	case s := <-f.started:
+		return s
+	case <-time.After(5 * time.Second):
+		t.Fatal("no Transcribe stream started")
+		return nil
+	}
+}
+
+// fakeStream plays AWS's side of one stream. Like AWS, it ends its events
+// once the audio ends, and it ends them with an error when told to fail.
+type fakeStream struct {
+	input   *transcribe.StartStreamTranscriptionInput // the stream was started with
+	sendErr error
+	audio   chan []byte // the audio sent, dropped once full
+	closed  func()      // called once the stream ended
+
+	mu     sync.Mutex
+	events chan tstypes.TranscriptResultStream
+	ended  bool
+	err    error
+}
+
+// transcript sends a result of text, as AWS does when it hears some.
+func (s *fakeStream) transcript(id, text string, partial bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ended {
+		return
+	}
+	s.events <- &tstypes.TranscriptResultStreamMemberTranscriptEvent{Value: tstypes.TranscriptEvent{
+		Transcript: &tstypes.Transcript{Results: []tstypes.Result{{
+			ResultId:     aws.String(id),
+			IsPartial:    partial,
+			Alternatives: []tstypes.Alternative{{Transcript: aws.String(text)}},
+		}}},
+	}}
+}
+
+// end ends the events, with err if AWS failed the stream.
+func (s *fakeStream) end(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ended {
+		return
+	}
+	s.ended, s.err = true, err
+	close(s.events)
+	s.closed()
+}
+
+func (s *fakeStream) isEnded() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ended
+}
+
+type fakeWriter struct{ s *fakeStream }
+
+func (w fakeWriter) Send(ctx context.Context, event tstypes.AudioStream) error {
+	if w.s.sendErr != nil {
+		return w.s.sendErr
+	}
+	if ev, ok := event.(*tstypes.AudioStreamMemberAudioEvent); ok {
+		select {
+		case w.s.audio <- ev.Value.AudioChunk:
+		default:
+		}
+	}
+	return nil
+}
+
+func (w fakeWriter) Close() error { w.s.end(nil); return nil }
+func (w fakeWriter) Err() error   { return nil }
+
+type fakeReader struct{ s *fakeStream }
+
+func (r fakeReader) Events() <-chan tstypes.TranscriptResultStream { return r.s.events }
+func (r fakeReader) Close() error                                  { r.s.end(nil); return nil }
+
+func (r fakeReader) Err() error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	return r.s.err
+}
+
+// waitStreamEnd reads pieces until the stream's outputs close and returns
+// the error it reported, nil if none.
+func waitStreamEnd(t *testing.T, pieces <-chan TranscriptPiece, errs <-chan error) error {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for pieces != nil {
+		select {
+		case _, ok := <-pieces:
+			if !ok {
+				pieces = nil
+			}
+		case <-timeout:
+			t.Fatal("transcript channel not closed")
+		}
+	}
+	select {
+	case err := <-errs:
+		return err
+	case <-timeout:
+		t.Fatal("error channel not closed")
+		return nil
+	}
+}
+
+func TestTranscribeStreamFinal(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fake := newFakeTranscribe()
+	audio, pieces, errs, err := runTranscribeStream(ctx, NewTranscribeClient(ctx, fake, Config{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := fake.stream(t)
+
+	audio <- AudioChunk{PCM: make([]byte, 320)}
+	<-s.audio
+	s.transcript("r1", "hello", false)
+	if p := <-pieces; p.Text != "hello" || p.Partial {
+		t.Fatalf("got piece %+v, want final %q", p, "hello")
+	}
+	audio <- AudioChunk{Final: true}
+	if err := waitStreamEnd(t, pieces, errs); err != nil {
+		t.Fatalf("stream ended with %v", err)
+	}
+	if !s.isEnded() {
+		t.Fatal("AWS stream not closed")
+	}
+}
+
+func TestTranscribeStreamSendError(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fake := newFakeTranscribe()
+	fake.sendErr = errors.New("connection reset")
+	audio, pieces, errs, err := runTranscribeStream(ctx, NewTranscribeClient(ctx, fake, Config{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := fake.stream(t)
+
+	audio <- AudioChunk{PCM: make([]byte, 320)}
+	if err := waitStreamEnd(t, pieces, errs); !errors.Is(err, fake.sendErr) {
+		t.Fatalf("stream ended with %v, want %v", err, fake.sendErr)
+	}
+	if !s.isEnded() {
+		t.Fatal("AWS stream not closed")
+	}
+}
+
+func TestTranscribeStreamReceiveError(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fake := newFakeTranscribe()
+	_, pieces, errs, err := runTranscribeStream(ctx, NewTranscribeClient(ctx, fake, Config{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := fake.stream(t)
+
+	awsErr := errors.New("BadRequestException: audio too slow")
+	s.end(awsErr)
+	if err := waitStreamEnd(t, pieces, errs); !errors.Is(err, awsErr) {
+		t.Fatalf("stream ended with %v, want %v", err, awsErr)
+	}
+}
+
+func TestTranscribeStreamCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	fake := newFakeTranscribe()
+	audio, pieces, errs, err := runTranscribeStream(ctx, NewTranscribeClient(ctx, fake, Config{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := fake.stream(t)
+
+	audio <- AudioChunk{PCM: make([]byte, 320)}
+	<-s.audio
+	cancel()
+	if err := waitStreamEnd(t, pieces, errs); err != nil {
+		t.Fatalf("canceled stream ended with %v", err)
+	}
+	if !s.isEnded() {
+		t.Fatal("AWS stream not closed")
+	}
+}
+
+func TestRestartableTranscribeStreamReplays(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fake := newFakeTranscribe()
+	client := NewTranscribeClient(ctx, fake, Config{})
+	start := func(ctx context.Context, opts TranscribeOptions) (chan<- AudioChunk, <-chan TranscriptPiece, <-chan error, error) {
+		return runTranscribeStreamWith(ctx, client, opts)
+	}
+	changes := make(chan optionChange)
+	audio, pieces, errs, err := runRestartableTranscribeStream(ctx, start, changes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s1 := fake.stream(t)
+
+	speech := bytes.Repeat([]byte{0x40}, 3200)
+	audio <- AudioChunk{PCM: speech, TsMs: 0}
+	<-s1.audio
+	done := make(chan error, 1)
+	changes <- optionChange{opts: TranscribeOptions{Language: "es-US"}, done: func(tsMs int64, err error) { done <- err }}
+	// A silence boundary: the session moves to a new stream before this chunk.
+	silence := make([]byte, int(restartSilence.Milliseconds())*sampleRateHz/1000*bytesPerSample*numChannels)
+	audio <- AudioChunk{PCM: silence, TsMs: 100}
+	if err := <-done; err != nil {
+		t.Fatalf("restart failed: %v", err)
+	}
+	s2 := fake.stream(t)
+	if lang := s2.input.LanguageCode; lang != "es-US" {
+		t.Fatalf("new stream started with language %q, want es-US", lang)
+	}
+
+	var replayed []byte
+	for len(replayed) < len(speech) {
+		replayed = append(replayed, <-s2.audio...)
+	}
+	if !bytes.Equal(replayed, speech) {
+		t.Fatal("new stream did not get the recent audio first")
+	}
+	if live := <-s2.audio; !bytes.Equal(live, silence) {
+		t.Fatal("new stream did not get the live audio after the replay")
+	}
+
+	audio <- AudioChunk{Final: true, TsMs: 400}
+	if err := waitStreamEnd(t, pieces, errs); err != nil {
+		t.Fatalf("stream ended with %v", err)
+	}
+	if !s1.isEnded() || !s2.isEnded() {
+		t.Fatal("AWS streams not closed")
+	}
+}
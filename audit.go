@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+Learning note: Audit log
+========================
+
+The application log says what the server did, in whatever detail the log
+level asks for, and is rotated away. A compliance review asks different
+questions, about people rather than goroutines: who transcribed what, from
+where, for how long, and where the words went. With -audit-log every session
+appends two records to a file of its own, one JSON document per line:
+
+	{"time":"...","event":"session_started","session":"9f2c...","tenant":"acme",
+	 "remote":"10.0.0.7:51234","qos":"standard","options":{"format":"pcm","framing":"seq"}}
+	{"time":"...","event":"session_ended","session":"9f2c...","tenant":"acme",
+	 "remote":"10.0.0.7:51234","duration_ms":81200,"audio_ms":80000,"finals":12,
+	 "words":214,"cost_usd":0.032,"labels":{"call":"42"},"sinks":["mqtt","recording"]}
+
+options are the query parameters the client connected with, credentials
+left out; sinks are the destinations configured for transcripts besides the
+client (see configuredSinks); error is set when the session failed.
+
+The file is opened for appending only and created with mode 0600; every
+record is synced to disk before the session goes on. Nothing in the server
+reads, rewrites or rotates it: rotation and retention belong to the system
+(logrotate with copytruncate, or a log shipper), so that the server cannot
+alter what it recorded.
+*/
+
+// auditRecord is a line of the audit log.
+type auditRecord struct {
+	Time       time.Time         `json:"time"`
+	Event      string            `json:"event"` // session_started or session_ended
+	Session    string            `json:"session"`
+	Tenant     string            `json:"tenant,omitempty"`
+	Remote     string            `json:"remote,omitempty"`
+	QoS        QoSClass          `json:"qos,omitempty"`
+	Options    map[string]string `json:"options,omitempty"`
+	DurationMs int64             `json:"duration_ms,omitempty"`
+	AudioMs    int64             `json:"audio_ms,omitempty"`
+	Finals     int64             `json:"finals,omitempty"`
+	Words      int64             `json:"words,omitempty"`
+	CostUSD    float64           `json:"cost_usd,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	Sinks      []string          `json:"sinks,omitempty"`
+	Error      string            `json:"error,omitempty"`
+}
+
+// AuditLog appends a record of every session to a file (see the note
+// above). It is a SessionObserver and safe for concurrent use.
+type AuditLog struct {
+	sinks []string
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewAuditLog opens the audit log at path for appending, creating it if
+// needed. sinks are recorded as the destinations of every session's
+// transcripts.
+func NewAuditLog(path string, sinks []string) (*AuditLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("audit: %w", err)
+	}
+	slog.Info("audit: logging sessions", slog.String("file", path), slog.Any("sinks", sinks))
+	return &AuditLog{sinks: sinks, file: f}, nil
+}
+
+func (a *AuditLog) SessionStarted(s *Session) {
+	a.append(auditRecord{Event: "session_started", Session: s.ID, Tenant: s.Tenant, Remote: s.Remote, QoS: s.QoS, Options: s.Options})
+}
+
+func (a *AuditLog) SessionEnded(s *Session) {
+	summary := s.Summary()
+	a.append(auditRecord{
+		Event: "session_ended", Session: s.ID, Tenant: s.Tenant, Remote: s.Remote,
+		DurationMs: summary.DurationMs, AudioMs: summary.Stats.AudioMs,
+		Finals: summary.Transcript.Finals, Words: summary.Transcript.Words, CostUSD: summary.CostUSD,
+		Labels: summary.Labels, Sinks: a.sinks, Error: summary.Error,
+	})
+}
+
+// append writes rec as a line and syncs it to disk. A record that cannot be
+// written is logged, so that at least the application log has it.
+func (a *AuditLog) append(rec auditRecord) {
+	rec.Time = time.Now().UTC()
+	line, err := json.Marshal(rec)
+	if err == nil {
+		a.mu.Lock()
+		if _, err = a.file.Write(append(line, '\n')); err == nil {
+			err = a.file.Sync()
+		}
+		a.mu.Unlock()
+	}
+	if err != nil {
+		slog.Error("audit: record not written", slog.String("event", rec.Event), slog.String("session", rec.Session), slog.String("error", err.Error()))
+	}
+}
+
+// Close closes the file.
+func (a *AuditLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.file.Close()
+}
+
+// configuredSinks names the destinations cfg sends transcripts to besides
+// the client, for the audit log.
+func configuredSinks(cfg Config) []string {
+	var sinks []string
+	for _, s := range []struct {
+		name string
+		on   bool
+	}{
+		{"mqtt", cfg.MQTTBroker != ""},
+		{"redis", cfg.RedisURL != ""},
+		{"nats", cfg.NATSURL != ""},
+		{"sqs", cfg.SQSQueueURL != ""},
+		{"sns", cfg.SNSTopicARN != ""},
+		{"hooks", len(sessionHooks) > 0},
+		{"dynamodb", cfg.DynamoDBTable != ""},
+		{"recording", cfg.RecordDir != ""},
+		{"dead_letter_dir", cfg.DeadLetterDir != ""},
+		{"dead_letter_queue", cfg.DeadLetterQueueURL != ""},
+	} {
+		if s.on {
+			sinks = append(sinks, s.name)
+		}
+	}
+	return sinks
+}
+
+// requestOptions returns the query parameters of r for the audit log, the
+// API key and the resume token left out.
+func requestOptions(r *http.Request) map[string]string {
+	options := make(map[string]string)
+	for k, v := range r.URL.Query() {
+		if k == "api_key" || k == "resume" || len(v) == 0 {
+			continue
+		}
+		options[k] = v[0]
+	}
+	return options
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+/*
+Learning note: session results on SQS and SNS
+=============================================
+
+Post-processing a call (summaries, CRM updates, analytics) is a natural fit
+for a Lambda function, but a Lambda cannot hold a WebSocket open or poll the
+server. So the server pushes the interesting moments of every session to AWS
+messaging instead:
+
+	session_started --+
+	transcript -------+--> SQS queue  --> Lambda / worker (pulls, retries)
+	session_ended ----+--> SNS topic  --> Lambda, e-mail, other queues (fan-out)
+
+Only final transcript pieces are sent; partials change several times a second
+and are of no use after the fact. Every message is JSON with a "type" field,
+which is also set as the message attribute "type" so SNS subscription filter
+policies and consumers can pick the events they care about.
+
+Both services still speak the classic query protocol (form-encoded POST,
+Action=...), which is called with a SigV4-signed request (see doAWSRequest).
+A queue whose URL ends in .fifo gets the session ID as message group, so the
+events of one session are delivered in order.
+*/
+
+// awsNotifyQueue is the number of messages waiting to be sent.
+const awsNotifyQueue = 1024
+
+// SessionNotification is the body of the messages sent by AWSNotifier.
+type SessionNotification struct {
+	Type      string              `json:"type"` // session_started, transcript, session_ended
+	SessionID string              `json:"session_id"`
+	Time      time.Time           `json:"time"`
+	Remote    string              `json:"remote,omitempty"`
+	Labels    map[string]string   `json:"labels,omitempty"`
+	Text      string              `json:"text,omitempty"`    // transcript
+	Stats     *AudioStatsSnapshot `json:"stats,omitempty"`   // session_ended
+	Summary   *SummaryEvent       `json:"summary,omitempty"` // session_ended
+}
+
+// AWSNotifier sends session lifecycle events and final transcripts to an SQS
+// queue and/or an SNS topic. It is both a SessionObserver and a
+// TranscriptSink; sending happens in the background.
+type AWSNotifier struct {
+	aws      aws.Config
+	http     *http.Client
+	queueURL string
+	topicARN string
+	queue    chan SessionNotification
+	dropped  atomic.Int64
+
+	mu       sync.Mutex
+	sessions map[string]*Session // running, for the labels of transcripts
+}
+
+// NewAWSNotifier returns a notifier for the given SQS queue URL and SNS topic
+// ARN (either may be empty) and starts its sender, which runs until ctx is
+// done.
+func NewAWSNotifier(ctx context.Context, awsCfg aws.Config, queueURL, topicARN string) *AWSNotifier {
+	n := &AWSNotifier{
+		aws:      awsCfg,
+		http:     &http.Client{Timeout: 10 * time.Second},
+		queueURL: queueURL,
+		topicARN: topicARN,
+		queue:    make(chan SessionNotification, awsNotifyQueue),
+		sessions: make(map[string]*Session),
+	}
+	go n.run(ctx)
+	return n
+}
+
+func (n *AWSNotifier) SessionStarted(s *Session) {
+	n.mu.Lock()
+	n.sessions[s.ID] = s
+	n.mu.Unlock()
+	n.enqueue(SessionNotification{Type: "session_started", SessionID: s.ID, Time: s.Started, Remote: s.Remote, Labels: s.Labels()}, false)
+}
+
+func (n *AWSNotifier) SessionEnded(s *Session) {
+	n.mu.Lock()
+	delete(n.sessions, s.ID)
+	n.mu.Unlock()
+	summary := s.Summary()
+	n.enqueue(SessionNotification{Type: "session_ended", SessionID: s.ID, Time: time.Now(), Remote: s.Remote, Labels: s.Labels(), Stats: &summary.Stats, Summary: &summary}, false)
+}
+
+// Publish sends final pieces, with the labels of their session; partials are
+// ignored.
+func (n *AWSNotifier) Publish(sessionID string, piece TranscriptPiece) {
+	if piece.Partial {
+		return
+	}
+	var labels map[string]string
+	n.mu.Lock()
+	if s, ok := n.sessions[sessionID]; ok {
+		labels = s.Labels()
+	}
+	n.mu.Unlock()
+	n.enqueue(SessionNotification{Type: "transcript", SessionID: sessionID, Time: time.Now(), Labels: labels, Text: piece.Text}, true)
+}
+
+// enqueue queues msg, dropping it if the queue is full, with wait (finals)
+// only after sinkFinalWait. Session events do not wait: they are sent from
+// the session's start and end, which must not stall on SQS.
+func (n *AWSNotifier) enqueue(msg SessionNotification, wait bool) {
+	if !enqueueSinkMessage(n.queue, msg, wait) {
+		dropped := n.dropped.Add(1)
+		if wait {
+			slog.Error("aws-notify: queue full; dropping a final", slog.String("session", msg.SessionID), slog.Int64("dropped", dropped))
+		} else if dropped%100 == 1 {
+			slog.Warn("aws-notify: queue full; dropping messages", slog.Int64("dropped", dropped))
+		}
+	}
+}
+
+// run sends queued messages until ctx is done.
+func (n *AWSNotifier) run(ctx context.Context) {
+	for {
+		select {
+		case msg := <-n.queue:
+			body, err := json.Marshal(msg)
+			if err != nil {
+				continue
+			}
+			if n.queueURL != "" {
+				if err := n.sendSQS(ctx, msg, string(body)); err != nil {
+					slog.Error("aws-notify: sqs send failed", slog.String("type", msg.Type), slog.String("session", msg.SessionID), slog.String("error", err.Error()))
+				}
+			}
+			if n.topicARN != "" {
+				if err := n.publishSNS(ctx, msg, string(body)); err != nil {
+					slog.Error("aws-notify: sns publish failed", slog.String("type", msg.Type), slog.String("session", msg.SessionID), slog.String("error", err.Error()))
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// sendSQS calls SQS SendMessage.
+func (n *AWSNotifier) sendSQS(ctx context.Context, msg SessionNotification, body string) error {
+	form := url.Values{
+		"Action":                               {"SendMessage"},
+		"Version":                              {"2012-11-05"},
+		"MessageBody":                          {body},
+		"MessageAttribute.1.Name":              {"type"},
+		"MessageAttribute.1.Value.DataType":    {"String"},
+		"MessageAttribute.1.Value.StringValue": {msg.Type},
+	}
+	if strings.HasSuffix(n.queueURL, ".fifo") {
+		form.Set("MessageGroupId", msg.SessionID)
+		form.Set("MessageDeduplicationId", newSessionID())
+	}
+	// Queue URLs look like https://sqs.<region>.amazonaws.com/<account>/<name>.
+	region := n.aws.Region
+	if u, err := url.Parse(n.queueURL); err == nil {
+		if parts := strings.Split(u.Hostname(), "."); len(parts) > 2 && parts[0] == "sqs" {
+			region = parts[1]
+		}
+	}
+	return n.post(ctx, n.queueURL, form, "sqs", region)
+}
+
+// publishSNS calls SNS Publish.
+func (n *AWSNotifier) publishSNS(ctx context.Context, msg SessionNotification, body string) error {
+	form := url.Values{
+		"Action":                         {"Publish"},
+		"Version":                        {"2010-03-31"},
+		"TopicArn":                       {n.topicARN},
+		"Message":                        {body},
+		"MessageAttributes.entry.1.Name": {"type"},
+		"MessageAttributes.entry.1.Value.DataType":    {"String"},
+		"MessageAttributes.entry.1.Value.StringValue": {msg.Type},
+	}
+	if strings.HasSuffix(n.topicARN, ".fifo") {
+		form.Set("MessageGroupId", msg.SessionID)
+		form.Set("MessageDeduplicationId", newSessionID())
+	}
+	// Topic ARNs look like arn:aws:sns:<region>:<account>:<name>.
+	region := n.aws.Region
+	if parts := strings.Split(n.topicARN, ":"); len(parts) == 6 {
+		region = parts[3]
+	}
+	return n.post(ctx, fmt.Sprintf("https://sns.%s.amazonaws.com/", region), form, "sns", region)
+}
+
+// post sends a signed query-protocol request.
+func (n *AWSNotifier) post(ctx context.Context, endpoint string, form url.Values, service, region string) error {
+	payload := []byte(form.Encode())
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := doAWSRequest(ctx, n.aws, n.http, req, payload, service, region)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
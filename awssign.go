@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+)
+
+// doAWSRequest signs req with SigV4 for service in region and sends it. It
+// is used for the AWS APIs whose SDK modules the server does without (Kinesis
+// Video, SQS, SNS): they are simple enough to call directly. payload must be
+// the request body. A non-200 response is returned as an error carrying the
+// start of its body; otherwise the caller must close the response body.
+func doAWSRequest(ctx context.Context, awsCfg aws.Config, client *http.Client, req *http.Request, payload []byte, service, region string) (*http.Response, error) {
+	creds, err := awsCfg.Credentials.Retrieve(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%s: credentials: %w", service, err)
+	}
+	hash := sha256.Sum256(payload)
+	if err := v4.NewSigner().SignHTTP(ctx, creds, req, hex.EncodeToString(hash[:]), service, region, time.Now()); err != nil {
+		return nil, fmt.Errorf("%s: sign: %w", service, err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", service, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: %s: %s", service, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
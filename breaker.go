@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/smithy-go"
+)
+
+/*
+Learning note: Circuit breaker
+==============================
+
+When Transcribe is down, every new session still tries to start a stream,
+retries it (see retry.go), and holds its connection, goroutines and buffers
+while it waits. During an outage that piles up quickly, and it keeps
+hammering a service that is already struggling. A circuit breaker stops
+trying for a while once failures show the service is down:
+
+	closed --threshold failures in a row--> open --cooldown--> half-open
+	   ^                                      ^                   |
+	   |                                      +---probe failed----+
+	   +-------------------probe succeeded-------------------------+
+
+  - closed: starts go through; -breaker-threshold consecutive failed starts
+    open the breaker.
+  - open: sessions are refused at once, before the upgrade, with 503 and
+    reason "service_degraded", and a Retry-After for the rest of the
+    -breaker-cooldown. Streams that already run are left alone.
+  - half-open: after the cooldown one session is let through as a probe. If
+    its stream starts, the breaker closes; if not, it opens for another
+    cooldown. Other sessions are refused while the probe runs.
+
+Only failures that say something about AWS count: throttling, 5xx and
+network errors. A session with a bad language code, or whose client left
+before its stream started, tells nothing about the service.
+*/
+
+// errServiceDegraded is returned for sessions refused by an open breaker.
+var errServiceDegraded = fmt.Errorf("%w: the service is degraded; try again later", ErrUpstream)
+
+// circuitBreaker is the breaker described in the note above. A nil breaker
+// lets everything through.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	failures int       // consecutive failed starts
+	openedAt time.Time // zero while closed
+	probing  bool      // a half-open probe runs
+}
+
+// newCircuitBreaker returns a closed breaker that opens after threshold
+// consecutive failures, for cooldown.
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+// Allow asks to start a stream. It fails with errServiceDegraded while the
+// breaker is open or a probe runs; otherwise the caller reports the outcome
+// of the start to done.
+func (b *circuitBreaker) Allow() (done func(err error), err error) {
+	if b == nil {
+		return func(error) {}, nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.openedAt.IsZero() {
+		return b.record(false), nil
+	}
+	if time.Since(b.openedAt) < b.cooldown || b.probing {
+		return nil, errServiceDegraded
+	}
+	b.probing = true
+	slog.Info("breaker: half-open; probing Transcribe")
+	return b.record(true), nil
+}
+
+// record returns the done func of a start; probe says whether it is the
+// half-open probe.
+func (b *circuitBreaker) record(probe bool) func(err error) {
+	return func(err error) {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if probe {
+			b.probing = false
+		}
+		switch {
+		case err == nil:
+			if !b.openedAt.IsZero() {
+				slog.Info("breaker: closed; Transcribe is back")
+			}
+			b.failures, b.openedAt = 0, time.Time{}
+		case isAWSFailure(err):
+			b.failures++
+			if probe || (b.openedAt.IsZero() && b.failures >= b.threshold) {
+				b.openedAt = time.Now()
+				slog.Warn("breaker: open; refusing new sessions", slog.Int("failures", b.failures), slog.Duration("cooldown", b.cooldown), slog.String("error", err.Error()))
+			}
+		}
+	}
+}
+
+// RetryAfter reports how long new sessions are refused for, if the breaker
+// is open; a half-open breaker with a probe running counts as open.
+func (b *circuitBreaker) RetryAfter() (time.Duration, bool) {
+	if b == nil {
+		return 0, false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.openedAt.IsZero() {
+		return 0, false
+	}
+	left := b.cooldown - time.Since(b.openedAt)
+	switch {
+	case left > 0:
+		return left, true
+	case b.probing:
+		return time.Second, true
+	}
+	return 0, false
+}
+
+// isAWSFailure reports whether a failed start says the service is in
+// trouble (see the note above).
+func isAWSFailure(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var apiErr smithy.APIError
+	return isRetryable(err) || !errors.As(err, &apiErr)
+}
+
+// rejectServiceDegraded answers a request for a session while the breaker
+// is open, like rejectTooManySessions does when the server is full.
+func rejectServiceDegraded(w http.ResponseWriter, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(max(int(retryAfter.Seconds()), 1)))
+	writeErrorBody(w, http.StatusServiceUnavailable, errorBody{Error: errorKinds[ErrUpstream].Name, Reason: "service_degraded", Message: errServiceDegraded.Error(), Retryable: true})
+}
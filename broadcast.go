@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+)
+
+/*
+Learning note: One transcript, many consumers
+=============================================
+
+A Go channel hands every value to exactly one receiver: two goroutines
+ranging over the transcript channel of a session would each get some of the
+pieces, and neither all of them. A session's transcript has several
+consumers, though: the client's writer loop, the sinks (MQTT, the transcript
+store, webhooks, ...) and in-process observers (the hub behind /watch and
+GraphQL, session hooks). So the channel from Transcribe has exactly one
+receiver, the broadcaster, which copies every piece to each consumer:
+
+	transcriptOut --> broadcaster --+--> subscription: client writer (waits)
+	                                +--> tap: MQTT sink    (drops partials when behind)
+	                                +--> tap: store        (drops partials when behind)
+	                                +--> tap: ...
+
+Consumers differ in what they may cost the others:
+
+  - A subscription gets every piece; the broadcaster waits for it, and with
+    it Transcribe's receiver waits too, as before. That is the client: it is
+    why the session runs, so its pace is the session's pace.
+  - A tap is a queue of its own, so a slow broker or webhook never holds up
+    the client or another sink. Every sink runs on a tap, with a goroutine
+    calling its Publish. Once the queue is broadcastTapBuffer pieces long
+    the tap drops partials, which a later piece supersedes anyway, but
+    never finals: the transcript store, DynamoDB or the notifier missing a
+    final would keep a wrong transcript for good. A sink that stays behind
+    only costs the memory of the finals it has yet to publish.
+
+The tap is where the guarantee ends; what a sink does with a final is up to
+the sink. The transcript store and the hooks (see hooks.go) take it
+synchronously. The network sinks (MQTT, Redis, NATS, the AWS notifier) queue
+it for their connection and, while the broker is away and that queue is
+full, wait sinkFinalWait for room before dropping it, with an error logged.
+The hub behind /watch and GraphQL drops pieces, finals too, for a viewer
+that does not read them: those are live views, not deliveries.
+
+When Transcribe closes its channel, the taps are drained first and the
+subscriptions closed after, so every sink has seen the last final before the
+client's writer ends the session and the observers learn it ended. A sink
+stuck in Publish holds this up for broadcastSinkWait at most; the session
+then ends without it, and the sink publishes the rest in the background.
+*/
+
+// broadcastTapBuffer is the number of pieces a tap may lag behind before
+// partials are dropped for it.
+const broadcastTapBuffer = 64
+
+// broadcastSinkWait is how long the end of a session waits for its sinks to
+// publish what their taps still hold.
+const broadcastSinkWait = 10 * time.Second
+
+// transcriptConsumer is a subscription: a channel the broadcaster copies
+// every piece to.
+type transcriptConsumer struct {
+	name string
+	ch   chan TranscriptPiece
+}
+
+// transcriptTap is the queue of pieces a sink has yet to publish. Once it
+// holds broadcastTapBuffer pieces, its partials are dropped, queued or new:
+// a later piece of the same speech supersedes them. Finals are never
+// dropped; they wait their turn however far behind the sink is.
+type transcriptTap struct {
+	name string
+
+	mu      sync.Mutex
+	pieces  []TranscriptPiece
+	closed  bool
+	dropped int64
+	ready   chan struct{} // signalled after every change
+}
+
+func newTranscriptTap(name string) *transcriptTap {
+	return &transcriptTap{name: name, ready: make(chan struct{}, 1)}
+}
+
+// push queues piece. It returns how many partials the tap had dropped
+// before and has dropped now.
+func (t *transcriptTap) push(piece TranscriptPiece) (before, dropped int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	before = t.dropped
+	if len(t.pieces) >= broadcastTapBuffer {
+		n := len(t.pieces)
+		t.pieces = slices.DeleteFunc(t.pieces, func(p TranscriptPiece) bool { return p.Partial })
+		t.dropped += int64(n - len(t.pieces))
+	}
+	if piece.Partial && len(t.pieces) >= broadcastTapBuffer {
+		t.dropped++
+	} else {
+		t.pieces = append(t.pieces, piece)
+	}
+	t.signal()
+	return before, t.dropped
+}
+
+// close tells the reader no more pieces come.
+func (t *transcriptTap) close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closed = true
+	t.signal()
+}
+
+func (t *transcriptTap) signal() {
+	select {
+	case t.ready <- struct{}{}:
+	default:
+	}
+}
+
+// next waits for the next piece; ok is false once the tap is closed and
+// empty.
+func (t *transcriptTap) next() (piece TranscriptPiece, ok bool) {
+	for {
+		t.mu.Lock()
+		if len(t.pieces) > 0 {
+			piece, t.pieces = t.pieces[0], t.pieces[1:]
+			t.mu.Unlock()
+			return piece, true
+		}
+		closed := t.closed
+		t.mu.Unlock()
+		if closed {
+			return TranscriptPiece{}, false
+		}
+		<-t.ready
+	}
+}
+
+// transcriptBroadcaster copies the transcript pieces of one session to all
+// its consumers (see the note above). Consumers are added before run; it is
+// safe for concurrent use.
+type transcriptBroadcaster struct {
+	sessionID string
+
+	mu        sync.Mutex
+	consumers []*transcriptConsumer
+	taps      []*transcriptTap
+	sinks     sync.WaitGroup // the goroutines of AttachSink
+}
+
+func newTranscriptBroadcaster(sessionID string) *transcriptBroadcaster {
+	return &transcriptBroadcaster{sessionID: sessionID}
+}
+
+// Subscribe returns a channel receiving every piece, closed after the last
+// one. The broadcaster waits for the subscriber until run's context is done.
+func (b *transcriptBroadcaster) Subscribe(name string, buffer int) <-chan TranscriptPiece {
+	c := &transcriptConsumer{name: name, ch: make(chan TranscriptPiece, buffer)}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.consumers = append(b.consumers, c)
+	return c.ch
+}
+
+// AttachSink publishes the pieces to sink from a tap of its own. A list of
+// sinks (transcriptSinks) gets a tap per sink.
+func (b *transcriptBroadcaster) AttachSink(sink TranscriptSink) {
+	if list, ok := sink.(transcriptSinks); ok {
+		for _, s := range list {
+			b.AttachSink(s)
+		}
+		return
+	}
+	tap := newTranscriptTap(fmt.Sprintf("%T", sink))
+	b.mu.Lock()
+	b.taps = append(b.taps, tap)
+	b.mu.Unlock()
+	b.sinks.Add(1)
+	go func() {
+		defer b.sinks.Done()
+		for piece, ok := tap.next(); ok; piece, ok = tap.next() {
+			sink.Publish(b.sessionID, piece)
+		}
+	}()
+}
+
+// run copies the pieces from in to the consumers until in is closed. Once
+// ctx is done, subscribers no longer get pieces, but in is still drained
+// (and the taps fed), so the Transcribe receiver never blocks.
+func (b *transcriptBroadcaster) run(ctx context.Context, in <-chan TranscriptPiece) {
+	b.mu.Lock()
+	consumers, taps := b.consumers, b.taps
+	b.mu.Unlock()
+
+	for piece := range in {
+		for _, t := range taps {
+			// Logged on the first drop and every hundredth after.
+			if before, dropped := t.push(piece); dropped > before && (before == 0 || dropped/100 != before/100) {
+				slog.Warn("broadcast: sink behind; dropping partials", slog.String("session", b.sessionID), slog.String("sink", t.name), slog.Int64("dropped", dropped))
+			}
+		}
+		for _, c := range consumers {
+			select {
+			case c.ch <- piece:
+			case <-ctx.Done():
+			}
+		}
+	}
+
+	// Sinks finish first, so they have everything before the session ends.
+	for _, t := range taps {
+		t.close()
+	}
+	drained := make(chan struct{})
+	go func() {
+		b.sinks.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(broadcastSinkWait):
+		slog.Warn("broadcast: sinks still publishing; ending the session without them", slog.String("session", b.sessionID))
+	}
+	for _, c := range consumers {
+		close(c.ch)
+	}
+}
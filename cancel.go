@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+/*
+Learning note: Session cancellation
+===================================
+
+Every goroutine of a session (the reader, the stages in between, the
+sender and receiver of audio.go, the writer loop) selects on the session's
+context, so canceling it stops them all. The request context alone is not
+enough: the server cancels it only once the handler returns, and the
+handler returns only once the writer loop does, which may be waiting for
+transcripts that never come.
+
+So the handler derives a context of its own for the session and cancels it
+on any terminal event:
+
+  - the writer loop returns, for whatever reason (the deferred cancel runs
+    before the rest of the clean-up);
+  - the reader stops, because the client ended the audio, closed the
+    connection, broke it or did not resume: from then on the session has
+    drainTimeout to deliver its last transcripts, and is canceled with
+    errDrainTimeout if it did not;
+  - the request context is done, when the server shuts down.
+
+Canceled, each loop returns within one iteration; a goroutine blocked in a
+send to a full channel leaves through the same select.
+*/
+
+// drainTimeout bounds how long a session keeps running once its reader has
+// stopped, for Transcribe to return the transcripts of the last audio.
+const drainTimeout = 20 * time.Second
+
+// errDrainTimeout cancels a session whose last transcripts did not arrive
+// within drainTimeout.
+var errDrainTimeout = fmt.Errorf("%w: final transcripts did not arrive within %v", ErrTimeout, drainTimeout)
+
+// cancelAfterDrain cancels ctx with errDrainTimeout unless it is done within
+// drainTimeout.
+func cancelAfterDrain(ctx context.Context, cancel context.CancelCauseFunc) {
+	timer := time.AfterFunc(drainTimeout, func() { cancel(errDrainTimeout) })
+	context.AfterFunc(ctx, func() { timer.Stop() })
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+/*
+Learning note: Live WebVTT captions
+===================================
+
+WebVTT is the caption format of the web: HTML5 <track> elements load it, and
+HLS packagers cut it into segments next to the video. A file is a header
+followed by cues, each a time range and the text to show during it:
+
+	WEBVTT
+
+	00:00:01.200 --> 00:00:03.850
+	<v 0>Hello and welcome.
+
+GET /sessions/{id}/captions.vtt turns the final pieces of a session into
+cues, with the times Transcribe gives them (offsets into the session's audio)
+and the speaker as a voice tag. While the session runs, the response does not
+end: a cue is written and flushed as soon as its final piece arrives, so a
+muxer reading the body gets captions in near real time. Partials are left
+out, because a cue cannot be taken back once written.
+
+Players that want a complete file, and muxers that re-fetch instead of
+reading a stream, ask with ?follow=false and get the cues so far.
+*/
+
+// CaptionsEndpoint serves GET /sessions/{id}/captions.vtt (see the note
+// above).
+func CaptionsEndpoint(store *TranscriptStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		follow := r.URL.Query().Get("follow") != "false"
+		pieces, done, changed, ok := store.After(id, 0)
+		if !ok {
+			http.Error(w, "session not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/vtt; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		rc := http.NewResponseController(w)
+		if _, err := io.WriteString(w, "WEBVTT\n\n"); err != nil {
+			return
+		}
+
+		var cursor int64
+		for {
+			for _, p := range pieces {
+				if p.Partial {
+					continue
+				}
+				cursor = p.Seq
+				if _, err := io.WriteString(w, formatCue(p.TranscriptPiece)); err != nil {
+					slog.Debug("http: captions write failed", slog.String("session", id), slog.String("error", err.Error()))
+					return
+				}
+			}
+			if done || !follow {
+				return
+			}
+			_ = rc.Flush()
+			select {
+			case <-changed:
+			case <-r.Context().Done():
+				return
+			}
+			// Partials are never cues; only ask for what follows the last final.
+			if pieces, done, changed, ok = store.After(id, cursor); !ok {
+				return
+			}
+		}
+	}
+}
+
+// formatCue renders piece as a WebVTT cue followed by a blank line.
+func formatCue(piece TranscriptPiece) string {
+	text := strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(piece.Text)
+	if piece.Speaker != "" {
+		text = "<v " + piece.Speaker + ">" + text
+	}
+	return fmt.Sprintf("%s --> %s\n%s\n\n", vttTime(piece.StartMs), vttTime(max(piece.EndMs, piece.StartMs)), text)
+}
+
+// vttTime formats ms as a WebVTT timestamp, hh:mm:ss.ttt.
+func vttTime(ms int64) string {
+	d := time.Duration(ms) * time.Millisecond
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", int(d.Hours()), int(d.Minutes())%60, int(d.Seconds())%60, ms%1000)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"time"
+)
+
+/*
+Learning note: Fault injection
+==============================
+
+Retries, the circuit breaker, send deadlines, resumable sessions: none of
+them runs while AWS behaves, which is almost always, so none of them is
+exercised until the day it is needed. The -chaos-* flags make the Transcribe
+stream misbehave on purpose, in CI or on a staging server:
+
+  - -chaos-send-failure P: each send of audio fails with probability P, as a
+    dropped connection to AWS would.
+  - -chaos-stall P: each event from Transcribe is held back with probability
+    P, for -chaos-stall-duration, as if AWS stopped answering for a while.
+  - -chaos-latency D: every send and every event is delayed by a random time
+    up to D.
+
+Faults are injected where the server meets the SDK (sendAudio and the
+receiver in audio.go), so everything above sees them as it would see the
+real thing. The flags are off by default and the server logs a warning at
+start-up when any is on; they have no place in production.
+*/
+
+// errInjectedFault is the failure -chaos-send-failure injects.
+var errInjectedFault = fmt.Errorf("%w: injected fault (chaos mode)", ErrUpstream)
+
+// faultInjector is what the -chaos-* flags configure (see the note above). A
+// nil injector injects nothing.
+type faultInjector struct {
+	sendFailure   float64       // probability that a send fails
+	stall         float64       // probability that an event is held back
+	stallDuration time.Duration // for that long
+	latency       time.Duration // maximum delay of every send and event
+}
+
+// newFaultInjector returns the injector cfg asks for, or nil if it asks for
+// none.
+func newFaultInjector(cfg Config) *faultInjector {
+	if cfg.ChaosSendFailure <= 0 && cfg.ChaosStall <= 0 && cfg.ChaosLatency <= 0 {
+		return nil
+	}
+	slog.Warn("chaos: injecting faults into Transcribe streams; not for production",
+		slog.Float64("send_failure", cfg.ChaosSendFailure), slog.Float64("stall", cfg.ChaosStall),
+		slog.Duration("stall_duration", cfg.ChaosStallDuration), slog.Duration("latency", cfg.ChaosLatency))
+	return &faultInjector{sendFailure: cfg.ChaosSendFailure, stall: cfg.ChaosStall, stallDuration: cfg.ChaosStallDuration, latency: cfg.ChaosLatency}
+}
+
+// beforeSend delays a send of audio and decides whether it fails.
+func (f *faultInjector) beforeSend(ctx context.Context) error {
+	if f == nil {
+		return nil
+	}
+	if err := f.delay(ctx); err != nil {
+		return err
+	}
+	if rand.Float64() < f.sendFailure {
+		slog.Warn("chaos: failing send")
+		return errInjectedFault
+	}
+	return nil
+}
+
+// beforeEvent delays an event from Transcribe, stalling now and then. It
+// returns early if ctx is done.
+func (f *faultInjector) beforeEvent(ctx context.Context) {
+	if f == nil {
+		return
+	}
+	if rand.Float64() < f.stall {
+		slog.Warn("chaos: stalling receiver", slog.Duration("for", f.stallDuration))
+		sleepCtx(ctx, f.stallDuration)
+	}
+	_ = f.delay(ctx)
+}
+
+// delay waits for a random time up to f.latency.
+func (f *faultInjector) delay(ctx context.Context) error {
+	if f.latency <= 0 {
+		return nil
+	}
+	return sleepCtx(ctx, rand.N(f.latency))
+}
+
+// sleepCtx waits for d, or until ctx is done, which it then returns the
+// error of.
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
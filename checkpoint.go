@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/*
+Learning note: Checkpoints and crash recovery
+=============================================
+
+A recorded session (see recording.go) gets its <id>.json when it ends. If
+the server crashes before that, the audio is on disk in <id>.wav but the
+transcript is gone with the process. So every -checkpoint-interval the
+recorder also writes
+
+	<id>.checkpoint.json  {"session_id":"...","transcript":["...",...],
+	                       "offset_ms":81200,"audio_bytes":2611200,...}
+
+holding the finals so far and offset_ms, the end of the last of them in
+the audio. The WAV is flushed to disk first, so the audio a checkpoint
+covers is never missing. A session that ends normally removes its
+checkpoint.
+
+On start-up, every checkpoint left behind is a session the server did not
+finish. For each, a recovery job (see upload.go; its ID is logged)
+transcribes the recording from offset_ms on, appends its finals to those of
+the checkpoint, and writes the <id>.json the session would have written,
+with "recovered":true and without a summary. Sessions that were paused are
+recovered from a point a little off: the recording leaves the pauses out,
+the offsets count them.
+*/
+
+// checkpointSuffix names the checkpoint of a session in the record
+// directory.
+const checkpointSuffix = ".checkpoint.json"
+
+// sessionCheckpoint is the content of <id>.checkpoint.json.
+type sessionCheckpoint struct {
+	SessionID  string    `json:"session_id"`
+	Tenant     string    `json:"tenant,omitempty"`
+	Started    time.Time `json:"started"`
+	Time       time.Time `json:"time"`
+	Transcript []string  `json:"transcript"`
+	OffsetMs   int64     `json:"offset_ms"`   // end of the last final
+	AudioBytes int64     `json:"audio_bytes"` // in the WAV, when written
+}
+
+// checkpoint flushes the recording of s to disk and writes its checkpoint.
+// The file is replaced atomically, so a crash leaves the previous one.
+func (rec *Recorder) checkpoint(s *Session, wav *wavWriter) {
+	if err := wav.Sync(); err != nil {
+		slog.Error("record: checkpoint failed", slog.Any("session", s), slog.String("error", err.Error()))
+		return
+	}
+	finals, offsetMs := s.Checkpoint()
+	cp := sessionCheckpoint{SessionID: s.ID, Tenant: s.Tenant, Started: s.Started, Time: time.Now(), Transcript: finals, OffsetMs: offsetMs, AudioBytes: wav.bytes}
+	data, err := json.Marshal(cp)
+	if err == nil {
+		path, _ := rec.path(s.ID, checkpointSuffix)
+		tmp := path + ".tmp"
+		if err = os.WriteFile(tmp, data, 0o644); err == nil {
+			err = os.Rename(tmp, path)
+		}
+	}
+	if err != nil {
+		slog.Error("record: checkpoint failed", slog.Any("session", s), slog.String("error", err.Error()))
+		return
+	}
+	slog.Debug("record: checkpoint written", slog.Any("session", s), slog.Int("finals", len(finals)), slog.Int64("offset_ms", offsetMs))
+}
+
+// removeCheckpoint removes the checkpoint of session id, if any.
+func (rec *Recorder) removeCheckpoint(id string) {
+	path, _ := rec.path(id, checkpointSuffix)
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		slog.Warn("record: checkpoint not removed", slog.String("session", id), slog.String("error", err.Error()))
+	}
+}
+
+// Recover starts a recovery job of jobs for every session left with a
+// checkpoint (see the note above).
+func (rec *Recorder) Recover(jobs *JobStore) {
+	files, err := filepath.Glob(filepath.Join(rec.dir, "*"+checkpointSuffix))
+	if err != nil {
+		slog.Error("record: recovery failed", slog.String("error", err.Error()))
+		return
+	}
+	for _, file := range files {
+		id := strings.TrimSuffix(filepath.Base(file), checkpointSuffix)
+		transcript, ok := rec.path(id, ".json")
+		if !ok {
+			continue
+		}
+		if _, err := os.Stat(transcript); err == nil {
+			// It ended after all; only the removal was lost.
+			rec.removeCheckpoint(id)
+			continue
+		}
+		var cp sessionCheckpoint
+		if err := readRecorded(file, &cp); err != nil {
+			slog.Error("record: unreadable checkpoint", slog.String("file", file), slog.String("error", err.Error()))
+			continue
+		}
+		job := jobs.add("recovery of "+id, cp.Tenant)
+		slog.Info("record: recovering session", slog.String("session", id), slog.String("job", job.ID), slog.Int("finals", len(cp.Transcript)), slog.Int64("offset_ms", cp.OffsetMs))
+		go func() {
+			jobs.finish(job, rec.recover(jobs, job, cp))
+		}()
+	}
+}
+
+// recover completes the transcript of the checkpointed session cp from its
+// recording and stores it as <id>.json.
+func (rec *Recorder) recover(jobs *JobStore, job *Job, cp sessionCheckpoint) error {
+	wav, _ := rec.path(cp.SessionID, ".wav")
+	for _, text := range cp.Transcript {
+		job.addFinal(text)
+	}
+	rest, err := transcribeRecording(jobs, job, cp.SessionID, wav, cp.OffsetMs, TranscribeOptions{})
+	if err != nil {
+		return fmt.Errorf("recover %s: %w", cp.SessionID, err)
+	}
+	rec.write(cp.SessionID+".json", recordedTranscript{
+		SessionID: cp.SessionID, Tenant: cp.Tenant, Started: cp.Started,
+		Transcript: append(cp.Transcript, rest...), Recovered: true,
+	})
+	rec.removeCheckpoint(cp.SessionID)
+	slog.Info("record: session recovered", slog.String("session", cp.SessionID), slog.Int("finals", len(cp.Transcript)+len(rest)))
+	return nil
+}
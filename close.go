@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"github.com/aws/smithy-go"
+	"github.com/gorilla/websocket"
+)
+
+// Application close codes sent in the WebSocket close frame when the server
+// ends a session, so clients can react without parsing text: retry later,
+// re-authenticate, reconnect elsewhere, ... They live in the 4000-4999 range
+// reserved for applications and mirror the matching HTTP status (4000 +
+// status). The close frame's text is the reason code, and the ClosingEvent
+// written before it repeats both.
+const (
+	CloseBadRequest    = 4400 // protocol violation, e.g. unsupported_version
+	CloseAuthFailed    = 4401 // AWS rejected the server's credentials
+	CloseBudget        = 4402 // the session's cost budget is used up
+	CloseNotFound      = 4404 // e.g. resuming a session that is gone
+	CloseTerminated    = 4410 // ended by an administrator
+	CloseIdleTimeout   = 4408 // nothing received, or a client not reading, for too long
+	CloseLimitExceeded = 4413 // frame size or audio duration limit
+	CloseQuotaExceeded = 4429 // rate limit or AWS quota
+	CloseInternalError = 4500 // server-side failure, e.g. decoder_unavailable
+	CloseAWSError      = 4502 // Transcribe failed
+	CloseAWSTimeout    = 4504 // Transcribe stopped responding
+	CloseUnavailable   = 4503 // the server is going down, full or degraded; reconnect later
+)
+
+// closeCodes maps closeReason codes to close codes.
+var closeCodes = map[string]int{
+	"unsupported_version":   CloseBadRequest,
+	"auth_failed":           CloseAuthFailed,
+	"session_not_found":     CloseNotFound,
+	"session_terminated":    CloseTerminated,
+	"idle_timeout":          CloseIdleTimeout,
+	"frame_too_large":       CloseLimitExceeded,
+	"max_duration":          CloseLimitExceeded,
+	"budget_exceeded":       CloseBudget,
+	"max_session_duration":  CloseLimitExceeded,
+	"rate_exceeded":         CloseQuotaExceeded,
+	"quota_exceeded":        CloseQuotaExceeded,
+	"tenant_quota_exceeded": CloseQuotaExceeded,
+	"decoder_unavailable":   CloseInternalError,
+	"internal_error":        CloseInternalError,
+	"slow_client":           CloseIdleTimeout,
+	"aws_error":             CloseAWSError,
+	"upstream_timeout":      CloseAWSTimeout,
+	"server_shutdown":       CloseUnavailable,
+	"too_many_sessions":     CloseUnavailable,
+	"service_degraded":      CloseUnavailable,
+}
+
+// closeCode returns the close code of r; reasons without an entry in
+// closeCodes close normally.
+func (r closeReason) closeCode() int {
+	if code, ok := closeCodes[r.Code]; ok {
+		return code
+	}
+	return websocket.CloseNormalClosure
+}
+
+// errServerShutdown is the cancellation cause of the server context once the
+// server is going down; see isServerShutdown.
+var errServerShutdown = errors.New("server shutdown")
+
+// isServerShutdown reports whether ctx was canceled because the server is
+// shutting down rather than because the client left.
+func isServerShutdown(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), errServerShutdown)
+}
+
+// awsCloseReason classifies an error from Transcribe by its kind (see
+// errors.go). A panic recovered in the session's goroutines (see panic.go)
+// is the server's fault, not AWS's; an open circuit breaker (see breaker.go)
+// means AWS was not even asked.
+func awsCloseReason(err error) closeReason {
+	if errors.Is(err, errServiceDegraded) {
+		return closeReason{Code: "service_degraded", Message: err.Error()}
+	}
+	message := err.Error()
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		message = apiErr.ErrorMessage()
+	}
+	kind, ok := classifyError(err)
+	switch {
+	case !ok:
+		return closeReason{Code: "internal_error", Message: err.Error()}
+	case kind == ErrAuth:
+		return closeReason{Code: "auth_failed", Message: message}
+	case kind == ErrQuota:
+		return closeReason{Code: "quota_exceeded", Message: message}
+	case kind == ErrTimeout:
+		return closeReason{Code: "upstream_timeout", Message: err.Error()}
+	}
+	return closeReason{Code: "aws_error", Message: err.Error()}
+}
+
+// isTimeout reports whether err is a deadline expiring, such as the read
+// deadline keepAlive maintains.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
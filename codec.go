@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/gorilla/websocket"
+)
+
+// TranscriptEvent carries a transcript piece to the client.
+type TranscriptEvent struct {
+	Text     string  `json:"text"`
+	Partial  bool    `json:"partial"`
+	Replayed bool    `json:"replayed,omitempty"`  // resent on a replay request
+	ReplayOf uint64  `json:"replay_of,omitempty"` // seq it was first sent with, see sequence.go
+	Stream   *uint16 `json:"stream,omitempty"`    // ?framing=mux only
+	// Piece is the piece the event was made of, not sent: the frameLog
+	// keeps it whole for the dead letters of finals never acknowledged.
+	Piece TranscriptPiece `json:"-"`
+}
+
+func (e TranscriptEvent) EventType() string { return "transcript" }
+
+// MarshalJSON adds the "type" field every JSON message carries.
+func (e TranscriptEvent) MarshalJSON() ([]byte, error) {
+	type fields TranscriptEvent // without this method
+	return json.Marshal(struct {
+		Type string `json:"type"`
+		fields
+	}{e.EventType(), fields(e)})
+}
+
+// messageVersion is the version of the JSON message envelope: every text
+// frame the server writes is an object with "v" (this version), "seq" (see
+// sequence.go) and "type" next to the fields of its event, e.g.
+//
+//	{"v":1,"seq":7,"type":"transcript","text":"hello \"world\"","partial":false}
+//
+// Fields are only ever added within a version; clients ignore those they
+// do not know.
+const messageVersion = 1
+
+// messageCodec turns outbound events into WebSocket frames. A connection uses
+// jsonCodec unless the client negotiated protobufSubprotocol.
+type messageCodec interface {
+	// encode returns the frame type and payload for ev, numbered seq; 0
+	// leaves the number out.
+	encode(ev Event, seq uint64) (int, []byte, error)
+}
+
+// jsonCodec writes every event as a JSON text frame in the message envelope
+// (see messageVersion).
+type jsonCodec struct{}
+
+func (jsonCodec) encode(ev Event, seq uint64) (int, []byte, error) {
+	fields, err := json.Marshal(ev)
+	if err != nil {
+		return 0, nil, fmt.Errorf("encode %s event: %w", ev.EventType(), err)
+	}
+	if len(fields) < 2 || fields[0] != '{' {
+		return 0, nil, fmt.Errorf("encode %s event: not a JSON object", ev.EventType())
+	}
+	// Events marshal to objects with their "type"; the version and the
+	// sequence number go first.
+	msg := fmt.Appendf(nil, `{"v":%d`, messageVersion)
+	if seq > 0 {
+		msg = fmt.Appendf(msg, `,"seq":%d`, seq)
+	}
+	if len(fields) > 2 {
+		msg = append(msg, ',')
+	}
+	msg = append(msg, fields[1:]...)
+	return websocket.TextMessage, msg, nil
+}
+
+// codecFor returns the codec for the subprotocol negotiated on conn.
+func codecFor(conn *websocket.Conn) messageCodec {
+	if conn.Subprotocol() == protobufSubprotocol {
+		return protobufCodec{}
+	}
+	return jsonCodec{}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+/*
+Learning note: The control protocol
+===================================
+
+Binary frames carry audio; text frames carry control messages. Every control
+message is a JSON object with a "type" field, and optionally "version", the
+protocol version the client speaks (controlProtocolVersion):
+
+	{"type":"start","version":1}          optional, must come before any audio
+	{"type":"config","labels":{"k":"v"}}  attach labels to the session
+	{"type":"config","language":"es-US"}  restart with new options (see restart.go)
+	{"type":"pause"}                      discard audio until "resume" (see pause.go)
+	{"type":"resume"}
+	{"type":"ping","id":"42"}             answered with {"type":"pong","id":"42"}
+	{"type":"replay"}                     resend the final transcript so far
+	{"type":"replay","after":42}          resend the transcript frames after seq 42 (see sequence.go)
+	{"type":"ack","seq":44}               frames up to 44 arrived (?ack=1 only, see sequence.go)
+	{"type":"end"}                        no more audio; flush and close
+
+With ?framing=mux, config and end may name a stream ("stream":N; see
+multiplex.go).
+
+"replay" is for a client that lost what it displayed, e.g. after a UI refresh
+on a connection that stayed open: every final piece of the session so far is
+sent again as a transcript frame with "replayed":true, in order, before any
+new transcript. Partials are not replayed; the next one supersedes them anyway.
+
+Unknown types, unknown fields, malformed JSON and messages over
+maxControlBytes are rejected with a "invalid_control" warning and otherwise
+ignored, so a buggy client does not lose its session over a bad message. A version the server does not speak is
+different: the client would misread whatever comes next, so the session is
+closed with reason "unsupported_version".
+
+Transcribe ends a stream that has not received audio for 15 seconds, so
+while a session is paused the server sends silence in place of the audio.
+*/
+
+// controlProtocolVersion is the version of the control protocol implemented
+// by the server.
+const controlProtocolVersion = 1
+
+// ControlType identifies a control message.
+type ControlType string
+
+const (
+	ControlStart  ControlType = "start"
+	ControlConfig ControlType = "config"
+	ControlEnd    ControlType = "end"
+	ControlPause  ControlType = "pause"
+	ControlResume ControlType = "resume"
+	ControlPing   ControlType = "ping"
+	ControlReplay ControlType = "replay"
+	ControlAck    ControlType = "ack"
+)
+
+// ControlMessage is a control frame sent by the client. Only the fields that
+// belong to Type may be set.
+type ControlMessage struct {
+	Type    ControlType `json:"type"`
+	Version int         `json:"version,omitempty"`
+
+	ID     string            `json:"id,omitempty"`     // ping
+	After  *uint64           `json:"after,omitempty"`  // replay
+	Seq    uint64            `json:"seq,omitempty"`    // ack
+	Labels map[string]string `json:"labels,omitempty"` // config
+	Stream *uint16           `json:"stream,omitempty"` // config, end (?framing=mux)
+
+	// config; either one restarts the Transcribe stream with both.
+	Language   string `json:"language,omitempty"`
+	Vocabulary string `json:"vocabulary,omitempty"`
+}
+
+// PongEvent answers a ping control message.
+type PongEvent struct {
+	Type string `json:"type"`
+	ID   string `json:"id,omitempty"`
+}
+
+func (e PongEvent) EventType() string { return e.Type }
+
+var (
+	errInvalidControl     = errors.New("invalid control message")
+	errUnsupportedVersion = errors.New("unsupported control protocol version")
+)
+
+// parseControlMessage decodes and validates a control frame. The error wraps
+// errUnsupportedVersion or errInvalidControl.
+func parseControlMessage(data []byte) (ControlMessage, error) {
+	if len(data) > maxControlBytes {
+		return ControlMessage{}, fmt.Errorf("%w: %d bytes exceeds the limit of %d", errInvalidControl, len(data), maxControlBytes)
+	}
+	var msg ControlMessage
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&msg); err != nil {
+		return ControlMessage{}, fmt.Errorf("%w: %v", errInvalidControl, err)
+	}
+	if msg.Version != 0 && msg.Version != controlProtocolVersion {
+		return ControlMessage{}, fmt.Errorf("%w %d (server speaks %d)", errUnsupportedVersion, msg.Version, controlProtocolVersion)
+	}
+
+	switch msg.Type {
+	case ControlStart:
+		if msg.Version == 0 {
+			return ControlMessage{}, fmt.Errorf("%w: start requires a version", errInvalidControl)
+		}
+	case ControlConfig:
+		if len(msg.Labels) == 0 && !msg.changesOptions() {
+			return ControlMessage{}, fmt.Errorf("%w: config without settings", errInvalidControl)
+		}
+	case ControlAck:
+		if msg.Seq == 0 {
+			return ControlMessage{}, fmt.Errorf("%w: ack requires a seq", errInvalidControl)
+		}
+	case ControlEnd, ControlPause, ControlResume, ControlPing, ControlReplay:
+	case "":
+		return ControlMessage{}, fmt.Errorf("%w: missing type", errInvalidControl)
+	default:
+		return ControlMessage{}, fmt.Errorf("%w: unknown type %q", errInvalidControl, msg.Type)
+	}
+	if msg.Type != ControlPing && msg.ID != "" || msg.Type != ControlReplay && msg.After != nil || msg.Type != ControlAck && msg.Seq != 0 || msg.Type != ControlConfig && (msg.Labels != nil || msg.changesOptions()) ||
+		msg.Type != ControlConfig && msg.Type != ControlEnd && msg.Stream != nil {
+		return ControlMessage{}, fmt.Errorf("%w: field not allowed in %s", errInvalidControl, msg.Type)
+	}
+	return msg, nil
+}
+
+// changesOptions reports whether a config message sets Transcribe options.
+func (msg ControlMessage) changesOptions() bool {
+	return msg.Language != "" || msg.Vocabulary != ""
+}
+
+// options returns the Transcribe options a config message sets.
+func (msg ControlMessage) options() TranscribeOptions {
+	return TranscribeOptions{Language: msg.Language, Vocabulary: msg.Vocabulary}
+}
+
+// controlHandler handles one type of control message. Returning
+// errStreamEnded makes the reader stop.
+type controlHandler func(msg ControlMessage) error
+
+// errStreamEnded is returned by a controlHandler after the end of the audio
+// stream has been signaled.
+var errStreamEnded = errors.New("stream ended")
+
+// controlRouter dispatches control frames to their handlers by type.
+type controlRouter map[ControlType]controlHandler
+
+// dispatch parses data and runs the handler registered for its type.
+func (r controlRouter) dispatch(data []byte) error {
+	msg, err := parseControlMessage(data)
+	if err != nil {
+		return err
+	}
+	handle, ok := r[msg.Type]
+	if !ok {
+		return fmt.Errorf("%w: %s not supported here", errInvalidControl, msg.Type)
+	}
+	return handle(msg)
+}
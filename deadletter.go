@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+/*
+Learning note: Dead letters
+===========================
+
+A client that closes its connection, or does not come back within
+-resume-grace, still has audio in flight: Transcribe keeps producing final
+pieces for it for a moment, and a resumable session may have kept pieces the
+client never got. The sinks see all of them, but a client without a sink
+loses words it spoke. So those undelivered finals are stored as a dead
+letter instead of being dropped:
+
+	{"session_id":"...","tenant":"acme","reason":"client_closed",
+	 "time":"...","pieces":[{"text":"and that's all.","partial":false,
+	 "start_ms":81200,"end_ms":82900,"confidence":0.97,"result_id":"..."}]}
+
+Each piece is stored whole, as the sinks get it (see TranscriptPiece).
+
+-dead-letter-dir keeps one <session>.json per session with undelivered
+pieces; -dead-letter-queue-url sends the same JSON to an SQS queue (message
+attribute "type" = "dead_letter"), for a worker that mails or re-posts them.
+Sessions that delivered everything leave no dead letter. Partials are never
+stored: a final follows every one of them.
+*/
+
+// deadLetterTimeout bounds storing one dead letter.
+const deadLetterTimeout = 10 * time.Second
+
+// DeadLetter holds the final pieces of a session its client never received.
+type DeadLetter struct {
+	SessionID string            `json:"session_id"`
+	Tenant    string            `json:"tenant,omitempty"`
+	Reason    string            `json:"reason"` // client_closed, resume_timeout
+	Time      time.Time         `json:"time"`
+	Pieces    []TranscriptPiece `json:"pieces"`
+}
+
+// DeadLetterStore keeps dead letters somewhere a human or a worker finds them.
+type DeadLetterStore interface {
+	StoreDeadLetter(ctx context.Context, dl DeadLetter) error
+}
+
+// storeDeadLetter stores the final pieces among pieces in store in the
+// background, if there are any and store is not nil, logging to log.
+func storeDeadLetter(log *slog.Logger, store DeadLetterStore, session *Session, reason string, pieces []TranscriptPiece) {
+	if store == nil {
+		return
+	}
+	dl := DeadLetter{SessionID: session.ID, Tenant: session.Tenant, Reason: reason, Time: time.Now()}
+	for _, p := range pieces {
+		if !p.Partial {
+			dl.Pieces = append(dl.Pieces, p)
+		}
+	}
+	if len(dl.Pieces) == 0 {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), deadLetterTimeout)
+		defer cancel()
+		if err := store.StoreDeadLetter(ctx, dl); err != nil {
+			log.Error("dead-letter: store failed", slog.String("session", dl.SessionID), slog.Int("pieces", len(dl.Pieces)), slog.String("error", err.Error()))
+			return
+		}
+		log.Info("dead-letter: stored", slog.String("session", dl.SessionID), slog.String("reason", reason), slog.Int("pieces", len(dl.Pieces)))
+	}()
+}
+
+// deadLetterStores stores a dead letter in all of its stores.
+type deadLetterStores []DeadLetterStore
+
+func (s deadLetterStores) StoreDeadLetter(ctx context.Context, dl DeadLetter) error {
+	var errs []error
+	for _, store := range s {
+		errs = append(errs, store.StoreDeadLetter(ctx, dl))
+	}
+	return errors.Join(errs...)
+}
+
+// deadLetterDir writes every dead letter to <dir>/<session>.json.
+type deadLetterDir string
+
+// newDeadLetterDir returns a store writing to dir, which is created if
+// needed.
+func newDeadLetterDir(dir string) (deadLetterDir, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", fmt.Errorf("dead-letter: %w", err)
+	}
+	return deadLetterDir(dir), nil
+}
+
+func (d deadLetterDir) StoreDeadLetter(_ context.Context, dl DeadLetter) error {
+	data, err := json.MarshalIndent(dl, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(string(d), dl.SessionID+".json"), data, 0o644)
+}
+
+// deadLetterQueue sends every dead letter to an SQS queue, the way
+// AWSNotifier sends session events.
+type deadLetterQueue struct {
+	notifier *AWSNotifier
+}
+
+// newDeadLetterQueue returns a store sending to the SQS queue at queueURL.
+func newDeadLetterQueue(awsCfg aws.Config, queueURL string) deadLetterQueue {
+	return deadLetterQueue{notifier: &AWSNotifier{aws: awsCfg, http: &http.Client{Timeout: deadLetterTimeout}, queueURL: queueURL}}
+}
+
+func (q deadLetterQueue) StoreDeadLetter(ctx context.Context, dl DeadLetter) error {
+	body, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+	return q.notifier.sendSQS(ctx, SessionNotification{Type: "dead_letter", SessionID: dl.SessionID}, string(body))
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/pprof"
+	"reflect"
+	"runtime"
+	"time"
+)
+
+/*
+Learning note: Profiling and runtime stats
+==========================================
+
+When the server is slow or its memory grows, the questions are where the CPU
+time goes, what is allocated, and which goroutines wait for what. Go answers
+them itself with net/http/pprof:
+
+	go tool pprof http://127.0.0.1:6060/debug/pprof/profile?seconds=30   CPU
+	go tool pprof http://127.0.0.1:6060/debug/pprof/heap                 memory
+	curl http://127.0.0.1:6060/debug/pprof/goroutine?debug=2             stacks
+
+and GET /debug/runtime sums up the process and its sessions:
+
+	{"goroutines":212,"heap":{"alloc_bytes":...,"objects":...,"gc_runs":41,...},
+	 "sessions":[{"id":"9f2c...","channels":{"raw_audio":{"len":3,"cap":32},
+	              "audio_in":{"len":16,"cap":16},...}}]}
+
+A channel that stays full (len == cap) is where a session's pipeline backs
+up: everything before it waits, everything after it is starved. GET
+/debug/sessions/{id} goes further into one session: its goroutines, last
+error and recent events (see dump.go).
+
+These endpoints show stacks, memory and session IDs, and a CPU profile costs
+CPU, so they are not on the public listener. -debug-addr serves them on an
+address of their own, meant to be reachable only from the host or an
+operations network, e.g. -debug-addr 127.0.0.1:6060. There is no token: the
+listener is the gate, and pprof clients cannot send one.
+*/
+
+// ChannelDepth is how full a channel is.
+type ChannelDepth struct {
+	Len int `json:"len"`
+	Cap int `json:"cap"`
+}
+
+// watchedChannel is a channel of a session, watched for GET /debug/runtime.
+type watchedChannel struct {
+	name string
+	ch   reflect.Value
+}
+
+// depth returns how full c is now.
+func (c watchedChannel) depth() ChannelDepth {
+	return ChannelDepth{Len: c.ch.Len(), Cap: c.ch.Cap()}
+}
+
+// runtimeStats is the body of GET /debug/runtime.
+type runtimeStats struct {
+	Goroutines int                   `json:"goroutines"`
+	Heap       heapStats             `json:"heap"`
+	Sessions   []sessionRuntimeStats `json:"sessions"`
+}
+
+type heapStats struct {
+	AllocBytes   uint64 `json:"alloc_bytes"`    // in live objects
+	SysBytes     uint64 `json:"sys_bytes"`      // obtained from the OS
+	Objects      uint64 `json:"objects"`        // live
+	GCRuns       uint32 `json:"gc_runs"`        // since start-up
+	GCPauseTotal string `json:"gc_pause_total"` // since start-up
+}
+
+type sessionRuntimeStats struct {
+	ID       string                  `json:"id"`
+	Channels map[string]ChannelDepth `json:"channels,omitempty"`
+}
+
+// RuntimeStatsEndpoint serves GET /debug/runtime (see the note above).
+func RuntimeStatsEndpoint(sessions *SessionRegistry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var mem runtime.MemStats
+		runtime.ReadMemStats(&mem)
+		stats := runtimeStats{
+			Goroutines: runtime.NumGoroutine(),
+			Heap: heapStats{
+				AllocBytes: mem.HeapAlloc, SysBytes: mem.Sys, Objects: mem.HeapObjects,
+				GCRuns: mem.NumGC, GCPauseTotal: time.Duration(mem.PauseTotalNs).String(),
+			},
+			Sessions: []sessionRuntimeStats{},
+		}
+		for _, s := range sessions.List() {
+			stats.Sessions = append(stats.Sessions, sessionRuntimeStats{ID: s.ID, Channels: s.ChannelDepths()})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(stats)
+	}
+}
+
+// ServeDebug serves pprof, GET /debug/runtime and GET /debug/sessions/{id}
+// on addr until ctx is done (see the note above).
+func ServeDebug(ctx context.Context, addr string, sessions *SessionRegistry) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("GET /debug/runtime", RuntimeStatsEndpoint(sessions))
+	mux.HandleFunc("GET /debug/sessions/{id}", SessionDumpEndpoint(sessions))
+
+	server := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: readHeaderTimeout}
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+	}()
+	slog.Info("debug: server start", slog.String("addr", addr))
+	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"strings"
+)
+
+// Decoder turns the payload of inbound audio frames into 16-bit samples in
+// the session format (sampleRateHz, numChannels). A Decoder belongs to a
+// single session and is only used from one goroutine, so it may keep state
+// between calls, e.g. a partial sample at the end of a frame.
+type Decoder interface {
+	// Decode consumes one frame and returns the samples that became
+	// available. It may return no samples when it needs more input. The
+	// returned slice is only valid until the next call.
+	Decode(data []byte) ([]int16, error)
+
+	// Info describes the input the decoder accepts.
+	Info() DecoderInfo
+}
+
+// Flusher is implemented by decoders that hold audio back internally; Flush
+// is called once the input has ended and returns whatever is left.
+type Flusher interface {
+	Flush() ([]int16, error)
+}
+
+// DecoderInfo is the metadata of a decoder's input format.
+type DecoderInfo struct {
+	Name string
+	// SampleSize is the number of bytes per sample of the input, or zero for
+	// compressed formats.
+	SampleSize int
+}
+
+// DecoderOptions are the per-connection settings passed to decoder factories.
+type DecoderOptions struct {
+	ByteOrder  ByteOrderMode // ?endian=...
+	FFmpegPath string        // for decoders backed by ffmpeg
+}
+
+// DecoderFactory creates a decoder for one session. ctx is canceled when the
+// session ends; decoders holding external resources must release them then.
+type DecoderFactory func(ctx context.Context, opts DecoderOptions) (Decoder, error)
+
+// decoders maps ?format= names to their factories. Built-in formats register
+// themselves in init functions next to their implementation.
+var decoders = map[string]DecoderFactory{}
+
+// RegisterDecoder makes a format available under name. It is meant to be
+// called from init functions and panics on duplicate names.
+func RegisterDecoder(name string, factory DecoderFactory) {
+	if _, dup := decoders[name]; dup {
+		panic("decoder already registered: " + name)
+	}
+	decoders[name] = factory
+}
+
+// lookupDecoder returns the factory of the format called name. The error
+// wraps ErrAudioFormat if no such format is registered.
+func lookupDecoder(name string) (DecoderFactory, error) {
+	factory, ok := decoders[name]
+	if !ok {
+		names := make([]string, 0, len(decoders))
+		for n := range decoders {
+			names = append(names, n)
+		}
+		slices.Sort(names)
+		return nil, fmt.Errorf("%w %q (want one of %s)", ErrAudioFormat, name, strings.Join(names, ", "))
+	}
+	return factory, nil
+}
+
+// NewDecoder creates a decoder for the format called name.
+func NewDecoder(ctx context.Context, name string, opts DecoderOptions) (Decoder, error) {
+	factory, err := lookupDecoder(name)
+	if err != nil {
+		return nil, err
+	}
+	return factory(ctx, opts)
+}
+
+// decodeAudio is the pipeline stage that runs dec over every inbound chunk
+// and forwards the resulting s16le audio, keeping each chunk's timestamps.
+// Frames that fail to decode are dropped and counted in stats; the first
+// failure is also reported to the client as a "decode_error" warning. On
+// Final the decoder is flushed before Final is passed on.
+func decodeAudio(ctx context.Context, in <-chan AudioChunk, dec Decoder, stats *AudioStats, events chan<- Event) <-chan AudioChunk {
+	out := make(chan AudioChunk, cap(in))
+
+	go func() {
+		defer close(out)
+		if c, ok := dec.(io.Closer); ok {
+			defer c.Close()
+		}
+		send := func(ch AudioChunk) bool {
+			select {
+			case out <- ch:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		// withSamples replaces the chunk's payload with samples as s16le.
+		withSamples := func(ch AudioChunk, samples []int16) AudioChunk {
+			buf := getPCMBuffer()
+			for _, s := range samples {
+				*buf = binary.LittleEndian.AppendUint16(*buf, uint16(s))
+			}
+			return ch.withPooledPCM(buf)
+		}
+		warned := false
+		fail := func(err error, tsMs int64) {
+			stats.addDecodeError()
+			loggerFrom(ctx).Warn("decoder: frame dropped", slog.String("format", dec.Info().Name), slog.String("error", err.Error()))
+			if !warned {
+				warned = true
+				emitEvent(events, WarningEvent{Type: "warning", Code: "decode_error", Message: "audio could not be decoded: " + err.Error(), TsMs: tsMs})
+			}
+		}
+
+		for ch := range in {
+			if ch.Final {
+				if f, ok := dec.(Flusher); ok {
+					samples, err := f.Flush()
+					if err != nil {
+						fail(err, ch.TsMs)
+					}
+					if len(samples) > 0 && !send(withSamples(AudioChunk{TsMs: ch.TsMs}, samples)) {
+						return
+					}
+				}
+				if !send(ch) {
+					return
+				}
+				continue
+			}
+
+			samples, err := dec.Decode(ch.PCM)
+			if err != nil {
+				fail(err, ch.TsMs)
+			}
+			if len(samples) == 0 {
+				ch.Release()
+				continue
+			}
+			if !send(withSamples(ch, samples)) {
+				return
+			}
+		}
+	}()
+
+	return out
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+)
+
+/*
+Learning note: Finals first
+===========================
+
+Transcribe sends a partial for every few hundred milliseconds of speech and
+a final when a result is done, and every partial of a result is replaced by
+the next one. A client that reads slowly (a phone on a bad network, a busy
+browser tab) holds up the session with "in-order" delivery, the default:
+every piece waits for it, partials included, and the finals it actually
+needs come late.
+
+With -transcript-delivery finals-first a stage in front of the client's
+writer keeps the pieces it cannot hand over yet:
+
+	broadcaster --> [finals: f1 f2 f3 ...] [latest partial: p] --> client writer
+	                 all, in order           one slot, replaced
+
+  - Finals are never dropped and leave in the order they came.
+  - Partials are coalesced: only the latest is kept, and it is sent once no
+    final waits. A final makes the partial before it obsolete (it is the
+    final text of the same result), so that partial is dropped.
+
+A client that keeps up sees no difference: every piece passes straight
+through. Sinks are fed before the stage (see broadcast.go) and get every
+piece either way.
+*/
+
+// DeliveryPolicy decides how transcripts reach a client that reads them more
+// slowly than they come (see the note above).
+type DeliveryPolicy string
+
+const (
+	DeliveryInOrder     DeliveryPolicy = "in-order"
+	DeliveryFinalsFirst DeliveryPolicy = "finals-first"
+)
+
+// parseDeliveryPolicy validates a policy name given on the command line.
+func parseDeliveryPolicy(s string) (DeliveryPolicy, error) {
+	switch p := DeliveryPolicy(s); p {
+	case DeliveryInOrder, DeliveryFinalsFirst:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown transcript delivery policy %q (want %s or %s)", s, DeliveryInOrder, DeliveryFinalsFirst)
+	}
+}
+
+// deliverTranscripts applies policy to the pieces of in on their way to the
+// client.
+func deliverTranscripts(ctx context.Context, in <-chan TranscriptPiece, policy DeliveryPolicy) <-chan TranscriptPiece {
+	if policy != DeliveryFinalsFirst {
+		return in
+	}
+	return prioritizeFinals(ctx, in)
+}
+
+// prioritizeFinals passes on the pieces of in, keeping all finals and only
+// the latest partial while out is not read (see the note above).
+//
+// Like forwardAudio it uses the nil-channel idiom: send is nil while there is
+// nothing to send.
+func prioritizeFinals(ctx context.Context, in <-chan TranscriptPiece) <-chan TranscriptPiece {
+	out := make(chan TranscriptPiece)
+	go func() {
+		defer close(out)
+		var (
+			finals     []TranscriptPiece
+			partial    TranscriptPiece
+			hasPartial bool
+			coalesced  int
+		)
+		defer func() {
+			if coalesced > 0 {
+				loggerFrom(ctx).Info("delivery: partials coalesced for a slow client", slog.Int("dropped", coalesced))
+			}
+		}()
+		for in != nil || len(finals) > 0 || hasPartial {
+			var (
+				send chan<- TranscriptPiece
+				next TranscriptPiece
+			)
+			switch {
+			case len(finals) > 0:
+				send, next = out, finals[0]
+			case hasPartial:
+				send, next = out, partial
+			}
+
+			select {
+			case piece, ok := <-in:
+				if !ok {
+					in = nil
+					continue
+				}
+				if hasPartial {
+					coalesced++
+				}
+				if piece.Partial {
+					partial, hasPartial = piece, true
+					continue
+				}
+				hasPartial = false
+				finals = append(finals, piece)
+			case send <- next:
+				if len(finals) > 0 {
+					finals = finals[1:]
+				} else {
+					hasPartial = false
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
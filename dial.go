@@ -0,0 +1,482 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+/*
+Learning note: Dialing out to audio sources
+===========================================
+
+Every other source waits for audio to come in. Some audio only ever goes out:
+a radio feed, an encoder publishing a stream for whoever connects. For those
+the server is the client: it opens the stream itself and transcribes what it
+reads, as a job like the RTP and KVS sources (GET /jobs/{id}).
+
+Two kinds of stream are understood:
+
+  - ws:// and wss:// URLs: every binary message is one frame of audio, as if
+    a client had sent it to /ws; text messages are ignored.
+  - http:// and https:// URLs: the response body is read as one long stream
+    of audio, as with Icecast-style feeds.
+
+The audio is in any registered format (?format= on /ws; "aac" or "mp3" for
+radio feeds, see icecast.go) and goes through decodeAudio like a client's.
+The source is expected to be live: nothing slows a stream that is served
+faster than real time down.
+
+A stream is opened with POST /sources/dial, once or, with "follow": true, as
+a managed source that is reopened with backoff whenever it ends, so a
+monitored feed keeps being transcribed across encoder restarts. Managed
+sources are listed by GET /sources/dial and stopped by DELETE
+/sources/dial/{id}. -dial-url starts one at start-up.
+
+The endpoints take the admin token or an API key. A stream opened with a key
+is a session of its tenant, admitted and limited like one on /ws, and its
+managed source is listed and stopped by that tenant only. Because the server
+connects wherever the URL says, a URL could also reach what only the server
+can: its own ports, the cloud metadata endpoint at 169.254.169.254, the
+private network it runs in. So streams of the API do not connect to
+loopback, link-local or private addresses, unless -dial-allow lists them.
+The check is made on the address actually connected to, after DNS, and no
+proxy is used, so neither a name resolving to a private address nor a
+redirect gets around it. -dial-url is the operator's and is not checked.
+*/
+
+// dialReadSize is how much of an HTTP stream is read per chunk.
+const dialReadSize = 4096
+
+// DialRequest is the body of POST /sources/dial.
+type DialRequest struct {
+	URL    string `json:"url"`
+	Format string `json:"format"` // default: from the Content-Type, else s16le
+	Endian string `json:"endian"` // as ?endian= on /ws
+	Follow bool   `json:"follow"` // reopen the stream whenever it ends
+}
+
+func (r DialRequest) validate() error {
+	if r.URL == "" {
+		return fmt.Errorf("%w: url is required", errInvalidDialRequest)
+	}
+	if r.Format != "" {
+		if _, err := lookupDecoder(r.Format); err != nil {
+			return fmt.Errorf("%w: %v", errInvalidDialRequest, err)
+		}
+	}
+	if _, err := parseByteOrderMode(r.Endian); err != nil {
+		return fmt.Errorf("%w: %v", errInvalidDialRequest, err)
+	}
+	return nil
+}
+
+// errInvalidDialRequest marks errors in a DialRequest.
+var errInvalidDialRequest = errors.New("invalid request")
+
+// errDialForbidden is returned for streams on addresses the API may not
+// connect to (see the note above).
+var errDialForbidden = errors.New("address not allowed")
+
+// trustedDialKey marks the context of a stream opened for the operator,
+// whose addresses are not checked.
+type trustedDialKey struct{}
+
+// dialGuard refuses connections of API streams to loopback, link-local and
+// private addresses outside allow.
+type dialGuard struct {
+	allow []netip.Prefix
+}
+
+// permits reports whether addr may be connected to.
+func (g dialGuard) permits(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsLoopback() && !addr.IsLinkLocalUnicast() && !addr.IsLinkLocalMulticast() &&
+		!addr.IsPrivate() && !addr.IsUnspecified() {
+		return true
+	}
+	for _, p := range g.allow {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// control is the net.Dialer hook that checks the address, after DNS, of
+// every connection.
+func (g dialGuard) control(ctx context.Context, network, address string, _ syscall.RawConn) error {
+	if trusted, _ := ctx.Value(trustedDialKey{}).(bool); trusted {
+		return nil
+	}
+	ap, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	if !g.permits(ap.Addr()) {
+		return fmt.Errorf("%w: %s", errDialForbidden, ap.Addr())
+	}
+	return nil
+}
+
+// dialedStream is an opened remote audio stream.
+type dialedStream interface {
+	// next returns the next piece of audio, valid until the next call.
+	next() ([]byte, error)
+	Close() error
+}
+
+// wsStream reads the binary messages of a WebSocket.
+type wsStream struct{ conn *websocket.Conn }
+
+func (s wsStream) next() ([]byte, error) {
+	for {
+		mt, data, err := s.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				return nil, io.EOF
+			}
+			return nil, err
+		}
+		if mt == websocket.BinaryMessage {
+			return data, nil
+		}
+	}
+}
+
+func (s wsStream) Close() error { return s.conn.Close() }
+
+// httpStream reads a response body in dialReadSize pieces.
+type httpStream struct {
+	body io.ReadCloser
+	icy  *icyReader // strips the ICY metadata, if the server sends any
+	buf  []byte
+}
+
+func (s *httpStream) next() ([]byte, error) {
+	var r io.Reader = s.body
+	if s.icy != nil {
+		r = s.icy
+	}
+	n, err := r.Read(s.buf)
+	if n > 0 {
+		return s.buf[:n], nil
+	}
+	if err == nil {
+		err = io.ErrNoProgress
+	}
+	return nil, err
+}
+
+func (s *httpStream) Close() error { return s.body.Close() }
+
+// DialSource transcribes remote audio streams the server connects to.
+type DialSource struct {
+	client   *TranscribeClient
+	cfg      Config
+	jobs     *JobStore
+	sessions *SessionRegistry
+	http     *http.Client
+	ws       *websocket.Dialer
+
+	mu       sync.Mutex
+	followed map[string]*dialFollower // managed sources by ID
+}
+
+// dialFollower is a managed source.
+type dialFollower struct {
+	ID     string `json:"id"`
+	URL    string `json:"url"`
+	Tenant string `json:"tenant,omitempty"` // of the API key that started it
+	Job    string `json:"job,omitempty"`    // transcribing the stream right now
+	cancel context.CancelFunc
+}
+
+func NewDialSource(client *TranscribeClient, cfg Config, jobs *JobStore, sessions *SessionRegistry) *DialSource {
+	netDialer := &net.Dialer{Timeout: 10 * time.Second, ControlContext: dialGuard{allow: cfg.DialAllow}.control}
+	ws := &websocket.Dialer{NetDialContext: netDialer.DialContext, HandshakeTimeout: 45 * time.Second}
+	return &DialSource{client: client, cfg: cfg, jobs: jobs, sessions: sessions, http: newICYClient(netDialer), ws: ws, followed: make(map[string]*dialFollower)}
+}
+
+// open connects to the stream at rawURL. contentType is the Content-Type of
+// http(s) streams.
+func (d *DialSource) open(ctx context.Context, rawURL string) (stream dialedStream, contentType string, err error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, "", err
+	}
+	switch u.Scheme {
+	case "ws", "wss":
+		conn, _, err := d.ws.DialContext(ctx, rawURL, nil)
+		if err != nil {
+			return nil, "", err
+		}
+		return wsStream{conn: conn}, "", nil
+	case "http", "https":
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+		if err != nil {
+			return nil, "", err
+		}
+		req.Header.Set("Icy-MetaData", "1")
+		resp, err := d.http.Do(req)
+		if err != nil {
+			return nil, "", err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, "", fmt.Errorf("GET %s: %s", rawURL, resp.Status)
+		}
+		s := &httpStream{body: resp.Body, buf: make([]byte, dialReadSize)}
+		if metaint := icyMetaint(resp); metaint > 0 {
+			s.icy = newICYReader(resp.Body, metaint)
+		}
+		return s, resp.Header.Get("Content-Type"), nil
+	default:
+		return nil, "", fmt.Errorf("unsupported URL scheme %q (want ws, wss, http or https)", u.Scheme)
+	}
+}
+
+// start opens the stream described by r and transcribes it in the
+// background as a session of the tenant of e. The returned channel receives
+// the outcome once the stream has ended.
+func (d *DialSource) start(ctx context.Context, r DialRequest, e Entitlements) (*Job, <-chan error, error) {
+	if err := r.validate(); err != nil {
+		return nil, nil, err
+	}
+	stream, contentType, err := d.open(ctx, r.URL)
+	if err != nil {
+		return nil, nil, err
+	}
+	format := r.Format
+	if format == "" {
+		format = formatForContentType(contentType)
+	}
+	endian, _ := parseByteOrderMode(r.Endian)
+	decoder, err := NewDecoder(ctx, format, DecoderOptions{ByteOrder: endian, FFmpegPath: d.cfg.FFmpegPath})
+	if err != nil {
+		stream.Close()
+		return nil, nil, err
+	}
+
+	job := d.jobs.add("dial "+r.URL, e.Tenant)
+	session := &Session{ID: job.ID, Remote: r.URL, Started: time.Now(), Stats: &AudioStats{}, Tenant: e.Tenant}
+	session.SetLabels(map[string]string{"source": r.URL, "format": format})
+	if hs, ok := stream.(*httpStream); ok && hs.icy != nil {
+		hs.icy.onTitle = func(title string) {
+			slog.Info("dial: stream title", slog.String("job", job.ID), slog.String("title", title))
+			session.SetLabels(map[string]string{"title": title})
+		}
+	}
+	raw := make(chan AudioChunk, 16)
+	go d.jobs.transcribe(ctx, d.client, d.cfg, decodeAudio(ctx, raw, decoder, session.Stats, nil), false, session, job, d.sessions, e)
+	slog.Info("dial: stream opened", slog.String("url", r.URL), slog.String("job", job.ID))
+
+	errc := make(chan error, 1)
+	go func() {
+		defer close(raw)
+		defer stream.Close()
+		// Closing the stream is the only way to interrupt a read.
+		stop := context.AfterFunc(ctx, func() { stream.Close() })
+		defer stop()
+
+		// PCM reads are timed by their length; compressed frames count as
+		// chunkMs each, as on /ws.
+		var tsMs int64
+		sampleSize := decoder.Info().SampleSize
+		duration := func(n int) int64 {
+			if sampleSize == 0 {
+				return chunkMs
+			}
+			return int64(n/(sampleSize*numChannels)) * 1000 / sampleRateHz
+		}
+		send := func(ch AudioChunk) bool {
+			select {
+			case raw <- ch:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		for {
+			data, err := stream.next()
+			if err != nil {
+				if errors.Is(err, io.EOF) || ctx.Err() != nil {
+					err = nil
+				}
+				send(AudioChunk{Final: true, TsMs: tsMs})
+				slog.Info("dial: stream ended", slog.String("url", r.URL), slog.String("job", job.ID))
+				errc <- err
+				return
+			}
+			session.Stats.addFrame(len(data))
+			if !send(newLiveChunk(data, tsMs)) {
+				errc <- ctx.Err()
+				return
+			}
+			tsMs += duration(len(data))
+		}
+	}()
+	return job, errc, nil
+}
+
+// follow transcribes the stream described by r for the tenant of e until ctx
+// is done, reopening it whenever it ends. onJob, if set, is told about every
+// job it starts.
+func (d *DialSource) follow(ctx context.Context, r DialRequest, e Entitlements, onJob func(*Job)) {
+	runConnected(ctx, "dial", r.URL, func(ctx context.Context) error {
+		job, errc, err := d.start(ctx, r, e)
+		if err != nil {
+			return err
+		}
+		if onJob != nil {
+			onJob(job)
+		}
+		if err := <-errc; err != nil {
+			return err
+		}
+		return errors.New("stream ended")
+	})
+}
+
+// manage follows the stream described by r for the tenant of e as a managed
+// source until ctx is done or it is stopped, and returns the source's ID.
+func (d *DialSource) manage(ctx context.Context, r DialRequest, e Entitlements) string {
+	ctx, cancel := context.WithCancel(ctx)
+	f := &dialFollower{ID: newSessionID(), URL: r.URL, Tenant: e.Tenant, cancel: cancel}
+	d.mu.Lock()
+	d.followed[f.ID] = f
+	d.mu.Unlock()
+	go func() {
+		defer func() {
+			d.mu.Lock()
+			delete(d.followed, f.ID)
+			d.mu.Unlock()
+		}()
+		d.follow(ctx, r, e, func(job *Job) {
+			d.mu.Lock()
+			f.Job = job.ID
+			d.mu.Unlock()
+		})
+	}()
+	slog.Info("dial: managed source started", slog.String("id", f.ID), slog.String("url", r.URL))
+	return f.ID
+}
+
+// stop stops the managed source id if it belongs to tenant, or to anyone
+// for the admin. It reports false if there is no such source.
+func (d *DialSource) stop(id, tenant string, admin bool) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	f, ok := d.followed[id]
+	ok = ok && (admin || f.Tenant == tenant)
+	if ok {
+		f.cancel()
+		delete(d.followed, id)
+	}
+	return ok
+}
+
+// managed returns the managed sources of tenant, or all of them for the
+// admin.
+func (d *DialSource) managed(tenant string, admin bool) []dialFollower {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	list := make([]dialFollower, 0, len(d.followed))
+	for _, f := range d.followed {
+		if admin || f.Tenant == tenant {
+			list = append(list, dialFollower{ID: f.ID, URL: f.URL, Tenant: f.Tenant, Job: f.Job})
+		}
+	}
+	return list
+}
+
+// DialSourceEndpoint serves POST /sources/dial: it connects to the audio
+// stream described by the DialRequest body and answers 202 with the job
+// transcribing it, e.g. {"job":"..."}. With "follow" it answers 202 with the
+// ID of the managed source instead, {"source":"..."}; connecting happens in
+// the background.
+func DialSourceEndpoint(ctx context.Context, source *DialSource) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		entitlements, _, err := callerOf(source.cfg.AdminToken, source.cfg.APIKeys, r)
+		if err != nil {
+			rejectAPIKey(w, err)
+			return
+		}
+		var req DialRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Follow {
+			if err := req.validate(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusAccepted)
+			_ = json.NewEncoder(w).Encode(map[string]any{"source": source.manage(ctx, req, entitlements)})
+			return
+		}
+		// The transcription outlives this request; ctx is the server's.
+		job, _, err := source.start(ctx, req, entitlements)
+		switch {
+		case errors.Is(err, errInvalidDialRequest):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		case errors.Is(err, errDialForbidden):
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			slog.Error("dial: start failed", slog.String("url", req.URL), slog.String("error", err.Error()))
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		_ = json.NewEncoder(w).Encode(map[string]any{"job": job.ID})
+	}
+}
+
+// DialSourcesEndpoint serves GET /sources/dial, the managed sources of the
+// caller's tenant, or all of them for the admin.
+func DialSourcesEndpoint(source *DialSource) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		entitlements, admin, err := callerOf(source.cfg.AdminToken, source.cfg.APIKeys, r)
+		if err != nil {
+			rejectAPIKey(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(source.managed(entitlements.Tenant, admin))
+	}
+}
+
+// StopDialSourceEndpoint serves DELETE /sources/dial/{id}: it stops a managed
+// source. The job transcribing it right now finishes with what it got.
+func StopDialSourceEndpoint(source *DialSource) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		entitlements, admin, err := callerOf(source.cfg.AdminToken, source.cfg.APIKeys, r)
+		if err != nil {
+			rejectAPIKey(w, err)
+			return
+		}
+		if !source.stop(r.PathValue("id"), entitlements.Tenant, admin) {
+			http.Error(w, "source not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
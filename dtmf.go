@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math"
+)
+
+/*
+Learning note: Goertzel DTMF detection
+======================================
+
+A DTMF key press is the sum of two sine waves: one "row" tone below 1kHz and
+one "column" tone above it. To find them we do not need a full FFT, only the
+energy at 8 known frequencies, which is exactly what the Goertzel algorithm
+computes cheaply: a second-order filter run over a block of samples per
+frequency.
+
+For every block we pick the strongest row and column tones and accept the
+pair as a digit when together they carry most of the block's energy and each
+clearly dominates the other tones of its group. A digit has to be seen in
+dtmfMinBlocks consecutive blocks before it is reported, and it is reported
+only once per key press.
+*/
+
+const (
+	// dtmfBlockSize is the number of samples per Goertzel block (~25ms at
+	// 16kHz), the same duration as the classic 205 samples at 8kHz.
+	dtmfBlockSize = 410
+
+	// dtmfMinBlocks is how many consecutive blocks must agree on a digit
+	// before it is reported (~50ms, below the 65ms minimum tone length).
+	dtmfMinBlocks = 2
+
+	// dtmfMinEnergy is the minimum mean square (normalized) of a block for it
+	// to be considered at all, so silence and hiss never trigger.
+	dtmfMinEnergy = 1e-4
+
+	// dtmfMinToneRatio is the share of the block energy the row and column
+	// tones must carry together.
+	dtmfMinToneRatio = 0.6
+
+	// dtmfDominance is how much stronger (in power) the best tone of a group
+	// must be than the runner-up of the same group.
+	dtmfDominance = 4.0
+)
+
+var (
+	dtmfRowFreqs = [4]float64{697, 770, 852, 941}
+	dtmfColFreqs = [4]float64{1209, 1336, 1477, 1633}
+	dtmfKeys     = [4][4]string{
+		{"1", "2", "3", "A"},
+		{"4", "5", "6", "B"},
+		{"7", "8", "9", "C"},
+		{"*", "0", "#", "D"},
+	}
+)
+
+// DTMFEvent reports a telephone keypad press detected in the audio.
+type DTMFEvent struct {
+	Type  string `json:"type"`
+	Digit string `json:"digit"`
+	TsMs  int64  `json:"ts_ms"`
+}
+
+func (e DTMFEvent) EventType() string { return e.Type }
+
+// goertzel returns the power of freq within block.
+func goertzel(block []float64, freq float64) float64 {
+	coeff := 2 * math.Cos(2*math.Pi*freq/sampleRateHz)
+	var s1, s2 float64
+	for _, x := range block {
+		s1, s2 = x+coeff*s1-s2, s1
+	}
+	return s1*s1 + s2*s2 - coeff*s1*s2
+}
+
+// strongestTone returns the index of the strongest of freqs in block, its
+// power, and whether it dominates the other tones of the group.
+func strongestTone(block []float64, freqs [4]float64) (int, float64, bool) {
+	var powers [4]float64
+	best := 0
+	for i, f := range freqs {
+		powers[i] = goertzel(block, f)
+		if powers[i] > powers[best] {
+			best = i
+		}
+	}
+	for i, p := range powers {
+		if i != best && p*dtmfDominance > powers[best] {
+			return best, powers[best], false
+		}
+	}
+	return best, powers[best], true
+}
+
+// detectDigit returns the DTMF digit present in block, if any.
+func detectDigit(block []float64) (string, bool) {
+	var energy float64
+	for _, x := range block {
+		energy += x * x
+	}
+	if energy/float64(len(block)) < dtmfMinEnergy {
+		return "", false
+	}
+
+	row, rowPower, rowOK := strongestTone(block, dtmfRowFreqs)
+	col, colPower, colOK := strongestTone(block, dtmfColFreqs)
+	if !rowOK || !colOK {
+		return "", false
+	}
+
+	// A pure tone of amplitude A yields a Goertzel power of (A*N/2)^2 while
+	// contributing N*A^2/2 to the energy, hence the N/2 scaling.
+	ratio := (rowPower + colPower) / (energy * float64(len(block)) / 2)
+	if ratio < dtmfMinToneRatio {
+		return "", false
+	}
+	return dtmfKeys[row][col], true
+}
+
+// detectDTMF is a pass-through pipeline stage that runs a Goertzel DTMF
+// detector over the audio and pushes a DTMFEvent to events for every key
+// press, alongside the transcript stream.
+func detectDTMF(ctx context.Context, in <-chan AudioChunk, events chan<- Event) <-chan AudioChunk {
+	out := make(chan AudioChunk, cap(in))
+
+	go func() {
+		defer close(out)
+		var (
+			block     = make([]float64, 0, dtmfBlockSize)
+			candidate string // digit seen in the previous blocks
+			seen      int    // consecutive blocks with candidate
+			reported  bool   // whether the current press was already reported
+		)
+		for ch := range in {
+			for i := range sampleCount(ch.PCM) {
+				block = append(block, float64(sampleAt(ch.PCM, i))/math.MaxInt16)
+				if len(block) < dtmfBlockSize {
+					continue
+				}
+
+				digit, ok := detectDigit(block)
+				block = block[:0]
+				switch {
+				case !ok:
+					candidate, seen, reported = "", 0, false
+				case digit != candidate:
+					candidate, seen, reported = digit, 1, false
+				default:
+					seen++
+				}
+
+				if ok && seen >= dtmfMinBlocks && !reported {
+					reported = true
+					tsMs := ch.TsMs + int64(i*1000/sampleRateHz)
+					loggerFrom(ctx).Info("dtmf: digit detected", slog.String("digit", digit), slog.Int64("ts_ms", tsMs))
+					emitEvent(events, DTMFEvent{Type: "dtmf", Digit: digit, TsMs: tsMs})
+				}
+			}
+
+			select {
+			case out <- ch:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime"
+	"runtime/pprof"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Learning note: Session dumps
+============================
+
+When one session of many misbehaves in production (its transcripts stop,
+its client says it hangs) there is no debugger to attach, and a full
+goroutine dump of a busy server is thousands of stacks, nearly all of them
+other sessions'. GET /debug/sessions/{id}, on the -debug-addr listener next to
+pprof (see debug.go), answers with that one session's state:
+
+	{"session":{"id":"9f2c...","remote":"10.0.0.7:51234",...},
+	 "transcript":{"partials":240,"finals":12,...},
+	 "channels":{"audio_in":{"len":16,"cap":16},...},
+	 "goroutines":[{"count":1,"state":"chan send",
+	                "stack":["main.forwardAudio /src/overload.go:142",...]},...],
+	 "last_error":{"time":"...","kind":"quota","message":"..."},
+	 "events":[{"time":"...","type":"transcript","event":{...}},...]}
+
+goroutines are the session's own. Go can tell which those are: pprof labels
+(runtime/pprof) set on a goroutine are inherited by every goroutine it starts,
+so the connection's goroutine is labelled session=<id> before it starts any
+(labelGoroutines), and the reader, the writer, the pipeline stages and the
+Transcribe sender and receiver all carry the label. Goroutines shared between
+sessions, such as the HTTP/2 connections to AWS, carry none. Goroutines
+running the same code and waiting in the same place are grouped, with the
+state they wait in (select, chan send, IO wait, ...) read off their stack.
+The labels also tag CPU profiles: go tool pprof -tagfocus session=<id> shows
+where one session's CPU time goes.
+
+events are the last recentEvents frames written to the client, partials
+included (for a stream of a multiplexed connection, the ones of that stream
+handed to the connection's writer); last_error is the latest error the
+session saw, which ended it or broke its connection (see NoteError).
+
+The dump shows what the client said and where it connects from, so it is on
+the debug listener only, like the rest of debug.go.
+*/
+
+// recentEvents is how many of the events written to its client a session
+// remembers for GET /debug/sessions/{id}.
+const recentEvents = 64
+
+// sessionLabel is the pprof label of a session's goroutines.
+const sessionLabel = "session"
+
+// labelGoroutines labels the calling goroutine, and every goroutine it
+// starts from now on, as running for session id (see the note above);
+// restore takes the label off again.
+func labelGoroutines(ctx context.Context, id string) (restore func()) {
+	pprof.SetGoroutineLabels(pprof.WithLabels(ctx, pprof.Labels(sessionLabel, id)))
+	return func() { pprof.SetGoroutineLabels(ctx) }
+}
+
+// notedEvent is an event written to a session's client.
+type notedEvent struct {
+	Time  time.Time `json:"time"`
+	Type  string    `json:"type"`
+	Event Event     `json:"event"`
+}
+
+// notedError is the latest error a session saw.
+type notedError struct {
+	Time    time.Time `json:"time"`
+	Kind    string    `json:"kind,omitempty"` // see errors.go
+	Message string    `json:"message"`
+}
+
+// goroutineGroup is goroutines of a session running the same code and
+// waiting in the same place.
+type goroutineGroup struct {
+	Count int      `json:"count"`
+	State string   `json:"state"`
+	Stack []string `json:"stack"` // innermost call first, runtime internals left out
+}
+
+// sessionDump is the body of GET /debug/sessions/{id}.
+type sessionDump struct {
+	Session    SessionInfo             `json:"session"`
+	Transcript TranscriptCounts        `json:"transcript"`
+	Channels   map[string]ChannelDepth `json:"channels,omitempty"`
+	Goroutines []goroutineGroup        `json:"goroutines"`
+	LastError  *notedError             `json:"last_error,omitempty"`
+	Events     []notedEvent            `json:"events"`
+}
+
+// SessionDumpEndpoint serves GET /debug/sessions/{id} (see the note above).
+func SessionDumpEndpoint(sessions *SessionRegistry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, ok := sessions.Get(r.PathValue("id"))
+		if !ok {
+			http.Error(w, "session not found", http.StatusNotFound)
+			return
+		}
+		goroutines, err := sessionGoroutines(session.ID)
+		if err != nil {
+			slog.Error("debug: goroutine profile failed", slog.String("error", err.Error()))
+		}
+		lastErr, events := session.Noted()
+		dump := sessionDump{
+			Session:    session.Info(),
+			Transcript: session.Summary().Transcript,
+			Channels:   session.ChannelDepths(),
+			Goroutines: goroutines,
+			LastError:  lastErr,
+			Events:     events,
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(dump); err != nil {
+			slog.Error("debug: session dump encode failed", slog.String("error", err.Error()))
+		}
+	}
+}
+
+// sessionGoroutines returns the goroutines labelled with session id, from
+// the goroutine profile in its text form, grouped as the profile groups
+// them: a line "<count> @ <pc> <pc> ...", then "# labels: {...}" and the
+// symbolized frames, then a blank line.
+func sessionGoroutines(id string) ([]goroutineGroup, error) {
+	var buf bytes.Buffer
+	if err := pprof.Lookup("goroutine").WriteTo(&buf, 1); err != nil {
+		return nil, err
+	}
+	label := fmt.Sprintf("%q:%q", sessionLabel, id)
+	groups := []goroutineGroup{}
+	var (
+		count int
+		pcs   []uintptr
+	)
+	sc := bufio.NewScanner(&buf)
+	for sc.Scan() {
+		line := sc.Text()
+		switch {
+		case line == "":
+			count, pcs = 0, nil
+		case strings.HasPrefix(line, "# labels: "):
+			if pcs != nil && strings.Contains(line, label) {
+				groups = append(groups, newGoroutineGroup(count, pcs))
+			}
+		case !strings.HasPrefix(line, "#"):
+			head, stack, ok := strings.Cut(line, " @ ")
+			if !ok {
+				continue
+			}
+			count, _ = strconv.Atoi(head)
+			pcs = nil
+			for _, f := range strings.Fields(stack) {
+				pc, err := strconv.ParseUint(f, 0, 64)
+				if err == nil {
+					pcs = append(pcs, uintptr(pc))
+				}
+			}
+		}
+	}
+	return groups, sc.Err()
+}
+
+// waitStates are the functions a goroutine waits in, innermost first as
+// they are looked for, and the states the runtime reports for them in
+// goroutine dumps.
+var waitStates = []struct{ fn, state string }{
+	{"runtime.selectgo", "select"},
+	{"runtime.chanrecv", "chan receive"},
+	{"runtime.chansend", "chan send"},
+	{"internal/poll.runtime_pollWait", "IO wait"},
+	{"sync.runtime_notifyListWait", "sync.Cond.Wait"},
+	{"sync.runtime_Semacquire", "semacquire"},
+	{"internal/sync.runtime_Semacquire", "semacquire"},
+	{"time.Sleep", "sleep"},
+}
+
+// newGoroutineGroup symbolizes the stack pcs of count goroutines.
+func newGoroutineGroup(count int, pcs []uintptr) goroutineGroup {
+	g := goroutineGroup{Count: count}
+	parked := false
+	frames := runtime.CallersFrames(pcs)
+	for more := true; more; {
+		var f runtime.Frame
+		f, more = frames.Next()
+		// What a goroutine waits in is below the first call of its own.
+		if g.Stack == nil && g.State == "" {
+			parked = parked || strings.HasPrefix(f.Function, "runtime.gopark")
+			g.State = waitState(f.Function)
+		}
+		if f.Function != "" && !isRuntimeInternal(f.Function) {
+			g.Stack = append(g.Stack, fmt.Sprintf("%s %s:%d", f.Function, f.File, f.Line))
+		}
+	}
+	switch {
+	case g.State != "":
+	case parked:
+		g.State = "waiting"
+	default:
+		g.State = "running"
+	}
+	return g
+}
+
+// waitState returns the state of a goroutine waiting in fn, or "" if fn is
+// not one of waitStates.
+func waitState(fn string) string {
+	for _, w := range waitStates {
+		if strings.HasPrefix(fn, w.fn) {
+			return w.state
+		}
+	}
+	return ""
+}
+
+// isRuntimeInternal reports whether fn is a function of the runtime or of
+// the packages it waits in, which says nothing about what the session does.
+func isRuntimeInternal(fn string) bool {
+	return strings.HasPrefix(fn, "runtime.") || strings.HasPrefix(fn, "internal/") ||
+		strings.HasPrefix(fn, "sync.runtime_")
+}
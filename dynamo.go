@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+/*
+Learning note: Session records in DynamoDB
+==========================================
+
+The session registry only knows the sessions running in this process; once
+one ends, or the server restarts, GET /sessions/{id} answers 404. With
+-dynamodb-table every session also gets a record in DynamoDB:
+
+	id (partition key) | status  | tenant | started | ended | instance | summary | transcript
+	-------------------+---------+--------+---------+-------+----------+---------+-----------
+	3f9a...            | ended   | acme   | 2026-…  | 2026-…| host:8080| {...}   | /sessions/3f9a.../transcript.jsonl
+
+A record is written when the session starts (status "running") and replaced
+when it ends ("ended", or "failed" with the error), with the session summary
+as JSON. The transcript itself is not stored: an item is at most 400 KB, and
+a long session's transcript is more. "transcript" points to where it is kept
+(-dynamodb-transcript-url, {session} is replaced by the ID).
+
+Records that are still "running" when this instance starts belonged to its
+previous run, which did not get to end them; they are marked "interrupted".
+
+The table needs only the partition key "id" (string). GET /sessions/{id}
+falls back to the record of sessions that are not running, and
+GET /sessions/history lists records with a Scan, filtered by ?tenant=,
+?status= and ?since=; on large tables a global secondary index on
+tenant+started would be the next step.
+
+DynamoDB speaks JSON over HTTP (X-Amz-Target names the operation), so like
+SQS and SNS (see awsnotify.go) it is called with SigV4-signed requests instead
+of another SDK module. Writes are queued and sent in the background.
+*/
+
+const (
+	// dynamoQueue is the number of records waiting to be written.
+	dynamoQueue = 1024
+	// dynamoHistoryLimit caps the records GET /sessions/history returns.
+	dynamoHistoryLimit = 1000
+)
+
+// SessionRecord is a session as stored in DynamoDB.
+type SessionRecord struct {
+	ID         string        `json:"id"`
+	Status     string        `json:"status"` // running, ended, failed, interrupted
+	Tenant     string        `json:"tenant,omitempty"`
+	Remote     string        `json:"remote,omitempty"`
+	Instance   string        `json:"instance"`
+	Started    time.Time     `json:"started"`
+	Ended      time.Time     `json:"ended,omitzero"`
+	Error      string        `json:"error,omitempty"`
+	Transcript string        `json:"transcript,omitempty"` // where the transcript is kept
+	Summary    *SummaryEvent `json:"summary,omitempty"`
+}
+
+// dynamoValue is a DynamoDB attribute value; only strings are used.
+type dynamoValue struct {
+	S string `json:"S"`
+}
+
+// item returns the record as a DynamoDB item.
+func (r SessionRecord) item() map[string]dynamoValue {
+	item := map[string]dynamoValue{
+		"id":       {r.ID},
+		"status":   {r.Status},
+		"instance": {r.Instance},
+		"started":  {r.Started.UTC().Format(time.RFC3339Nano)},
+	}
+	for name, v := range map[string]string{"tenant": r.Tenant, "remote": r.Remote, "error": r.Error, "transcript": r.Transcript} {
+		if v != "" {
+			item[name] = dynamoValue{v}
+		}
+	}
+	if !r.Ended.IsZero() {
+		item["ended"] = dynamoValue{r.Ended.UTC().Format(time.RFC3339Nano)}
+	}
+	if r.Summary != nil {
+		if data, err := json.Marshal(r.Summary); err == nil {
+			item["summary"] = dynamoValue{string(data)}
+		}
+	}
+	return item
+}
+
+// recordFromItem is the reverse of SessionRecord.item.
+func recordFromItem(item map[string]dynamoValue) SessionRecord {
+	r := SessionRecord{
+		ID:         item["id"].S,
+		Status:     item["status"].S,
+		Tenant:     item["tenant"].S,
+		Remote:     item["remote"].S,
+		Instance:   item["instance"].S,
+		Error:      item["error"].S,
+		Transcript: item["transcript"].S,
+	}
+	r.Started, _ = time.Parse(time.RFC3339Nano, item["started"].S)
+	r.Ended, _ = time.Parse(time.RFC3339Nano, item["ended"].S)
+	if s := item["summary"].S; s != "" {
+		var summary SummaryEvent
+		if json.Unmarshal([]byte(s), &summary) == nil {
+			r.Summary = &summary
+		}
+	}
+	return r
+}
+
+// DynamoSessionStore keeps a record of every session in a DynamoDB table
+// (see the note above). It is a SessionObserver; writing happens in the
+// background.
+type DynamoSessionStore struct {
+	aws        aws.Config
+	http       *http.Client
+	table      string
+	instance   string
+	transcript string // URL template, {session} = ID
+	queue      chan SessionRecord
+	dropped    atomic.Int64
+}
+
+// NewDynamoSessionStore returns a store for table, marks the records this
+// instance left running as interrupted, and starts its writer, which runs
+// until ctx is done. instance names this server in the records.
+func NewDynamoSessionStore(ctx context.Context, awsCfg aws.Config, table, instance, transcriptURL string) (*DynamoSessionStore, error) {
+	if instance == "" {
+		instance, _ = os.Hostname()
+	}
+	s := &DynamoSessionStore{
+		aws:        awsCfg,
+		http:       &http.Client{Timeout: 10 * time.Second},
+		table:      table,
+		instance:   instance,
+		transcript: transcriptURL,
+		queue:      make(chan SessionRecord, dynamoQueue),
+	}
+	left, err := s.History(ctx, historyFilter{Status: "running", Instance: instance})
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range left {
+		r.Status, r.Ended = "interrupted", time.Now()
+		if err := s.put(ctx, r); err != nil {
+			return nil, err
+		}
+	}
+	go s.run(ctx)
+	slog.Info("dynamodb: session store started", slog.String("table", table), slog.String("instance", instance), slog.Int("interrupted", len(left)))
+	return s, nil
+}
+
+// record returns the record of session s in the given status.
+func (s *DynamoSessionStore) record(session *Session, status string) SessionRecord {
+	return SessionRecord{
+		ID:         session.ID,
+		Status:     status,
+		Tenant:     session.Tenant,
+		Remote:     session.Remote,
+		Instance:   s.instance,
+		Started:    session.Started,
+		Transcript: strings.ReplaceAll(s.transcript, "{session}", session.ID),
+	}
+}
+
+func (s *DynamoSessionStore) SessionStarted(session *Session) {
+	s.enqueue(s.record(session, "running"))
+}
+
+func (s *DynamoSessionStore) SessionEnded(session *Session) {
+	r := s.record(session, "ended")
+	summary := session.Summary()
+	if summary.Error != "" {
+		r.Status, r.Error = "failed", summary.Error
+	}
+	r.Ended, r.Summary = time.Now(), &summary
+	s.enqueue(r)
+}
+
+func (s *DynamoSessionStore) enqueue(r SessionRecord) {
+	select {
+	case s.queue <- r:
+	default:
+		if s.dropped.Add(1)%100 == 1 {
+			slog.Warn("dynamodb: queue full; dropping records", slog.Int64("dropped", s.dropped.Load()))
+		}
+	}
+}
+
+// run writes queued records until ctx is done.
+func (s *DynamoSessionStore) run(ctx context.Context) {
+	for {
+		select {
+		case r := <-s.queue:
+			if err := s.put(ctx, r); err != nil {
+				slog.Error("dynamodb: put failed", slog.String("session", r.ID), slog.String("status", r.Status), slog.String("error", err.Error()))
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// put calls PutItem.
+func (s *DynamoSessionStore) put(ctx context.Context, r SessionRecord) error {
+	return s.call(ctx, "PutItem", map[string]any{"TableName": s.table, "Item": r.item()}, nil)
+}
+
+// Get returns the record of the session with the given ID.
+func (s *DynamoSessionStore) Get(ctx context.Context, id string) (SessionRecord, bool, error) {
+	var out struct {
+		Item map[string]dynamoValue
+	}
+	err := s.call(ctx, "GetItem", map[string]any{
+		"TableName":      s.table,
+		"Key":            map[string]dynamoValue{"id": {id}},
+		"ConsistentRead": true,
+	}, &out)
+	if err != nil || out.Item == nil {
+		return SessionRecord{}, false, err
+	}
+	return recordFromItem(out.Item), true, nil
+}
+
+// historyFilter selects records; empty fields match all.
+type historyFilter struct {
+	Tenant   string
+	Status   string
+	Instance string
+	Since    time.Time
+}
+
+// History returns the records matching f, at most dynamoHistoryLimit, in
+// no particular order.
+func (s *DynamoSessionStore) History(ctx context.Context, f historyFilter) ([]SessionRecord, error) {
+	var (
+		conds  []string
+		names  = map[string]string{}
+		values = map[string]dynamoValue{}
+	)
+	for _, c := range []struct{ attr, value, op string }{
+		{"tenant", f.Tenant, "="},
+		{"status", f.Status, "="},
+		{"instance", f.Instance, "="},
+		{"started", formatSince(f.Since), ">="},
+	} {
+		if c.value == "" {
+			continue
+		}
+		names["#"+c.attr] = c.attr
+		values[":"+c.attr] = dynamoValue{c.value}
+		conds = append(conds, fmt.Sprintf("#%s %s :%s", c.attr, c.op, c.attr))
+	}
+
+	var records []SessionRecord
+	var start map[string]dynamoValue
+	for {
+		in := map[string]any{"TableName": s.table}
+		if len(conds) > 0 {
+			in["FilterExpression"] = strings.Join(conds, " AND ")
+			in["ExpressionAttributeNames"] = names
+			in["ExpressionAttributeValues"] = values
+		}
+		if start != nil {
+			in["ExclusiveStartKey"] = start
+		}
+		var out struct {
+			Items            []map[string]dynamoValue
+			LastEvaluatedKey map[string]dynamoValue
+		}
+		if err := s.call(ctx, "Scan", in, &out); err != nil {
+			return nil, err
+		}
+		for _, item := range out.Items {
+			records = append(records, recordFromItem(item))
+		}
+		if out.LastEvaluatedKey == nil || len(records) >= dynamoHistoryLimit {
+			return records[:min(len(records), dynamoHistoryLimit)], nil
+		}
+		start = out.LastEvaluatedKey
+	}
+}
+
+// formatSince formats t like the "started" attribute, "" for the zero time.
+func formatSince(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// call sends a signed DynamoDB request and decodes the response into out,
+// if not nil.
+func (s *DynamoSessionStore) call(ctx context.Context, op string, in, out any) error {
+	payload, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	endpoint := fmt.Sprintf("https://dynamodb.%s.amazonaws.com/", s.aws.Region)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.0")
+	req.Header.Set("X-Amz-Target", "DynamoDB_20120810."+op)
+	resp, err := doAWSRequest(ctx, s.aws, s.http, req, payload, "dynamodb", s.aws.Region)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// SessionHistoryEndpoint serves GET /sessions/history: the records of past
+// and running sessions, filtered by ?tenant=, ?status= and ?since=
+// (RFC 3339), newest first.
+func SessionHistoryEndpoint(store *DynamoSessionStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		f := historyFilter{Tenant: q.Get("tenant"), Status: q.Get("status")}
+		if v := q.Get("since"); v != "" {
+			since, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				http.Error(w, "since must be an RFC 3339 time", http.StatusBadRequest)
+				return
+			}
+			f.Since = since
+		}
+		records, err := store.History(r.Context(), f)
+		if err != nil {
+			slog.Error("dynamodb: history failed", slog.String("error", err.Error()))
+			http.Error(w, "session history unavailable", http.StatusBadGateway)
+			return
+		}
+		slices.SortFunc(records, func(a, b SessionRecord) int { return b.Started.Compare(a.Started) })
+		if records == nil {
+			records = []SessionRecord{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(records); err != nil {
+			slog.Error("http: session history encode failed", slog.String("error", err.Error()))
+		}
+	}
+}
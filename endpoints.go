@@ -1,11 +1,16 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
 
-	transcribe "github.com/aws/aws-sdk-go-v2/service/transcribestreaming"
 	"github.com/gorilla/websocket"
 )
 
@@ -15,17 +20,158 @@ func ServeIndexPage() http.HandlerFunc {
 	}
 }
 
+// SessionStatsEndpoint serves GET /sessions/{id}/stats: the audio statistics
+// of a running session as JSON, or 404 if no such session is running.
+func SessionStatsEndpoint(sessions *SessionRegistry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, ok := sessions.Get(r.PathValue("id"))
+		if !ok {
+			http.Error(w, "session not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(session.Stats.Snapshot()); err != nil {
+			slog.Error("http: stats encode failed", slog.String("error", err.Error()))
+		}
+	}
+}
+
+// SessionsEndpoint serves GET /sessions: the running sessions, oldest first.
+func SessionsEndpoint(sessions *SessionRegistry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		list := []SessionInfo{}
+		for _, s := range sessions.List() {
+			list = append(list, s.Info())
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(list); err != nil {
+			slog.Error("http: sessions encode failed", slog.String("error", err.Error()))
+		}
+	}
+}
+
+// SessionEndpoint serves GET /sessions/{id}: the state of a running session,
+// or, with a session store (history may be nil), the record of one that is
+// not running here (see dynamo.go).
+func SessionEndpoint(sessions *SessionRegistry, history *DynamoSessionStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var v any
+		if session, ok := sessions.Get(r.PathValue("id")); ok {
+			v = session.Info()
+		} else if history != nil {
+			record, ok, err := history.Get(r.Context(), r.PathValue("id"))
+			if err != nil {
+				slog.Error("dynamodb: get failed", slog.String("error", err.Error()))
+				http.Error(w, "session history unavailable", http.StatusBadGateway)
+				return
+			}
+			if ok {
+				v = record
+			}
+		}
+		if v == nil {
+			http.Error(w, "session not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(v); err != nil {
+			slog.Error("http: session encode failed", slog.String("error", err.Error()))
+		}
+	}
+}
+
 // StreamAudioEndpoint upgrades to WebSocket and bridges each connection to a new
 // AWS Transcribe streaming session created via runTranscribeStream.
 //
 // Per-connection flow:
-//   - Client sends binary audio frames (PCM 44.1kHz, stereo, 16-bit). We forward
-//     them as AudioChunk values to the audioInput channel.
+//   - Client sends binary audio frames (PCM 16kHz, mono, 16-bit by default). Other
+//     formats registered with RegisterDecoder (s24le, f32le, aac, ...) can be
+//     declared with ?format=..., big-endian input with ?endian=be or ?endian=auto;
+//     decodeAudio turns everything into s16le. We forward them as AudioChunk values
+//     to the audioInput channel.
 //   - We read TranscriptPiece values from transcriptOutput and write them back to
-//     the WebSocket as text frames (you can wrap as JSON if preferred).
-//   - A text frame with content "END" tells the server no more audio will come; we
-//     send a Final=true chunk and close the session.
-//   - Any error on the Transcribe session is logged and the connection is closed.
+//     the WebSocket as JSON text frames, or as protobuf binary frames when the
+//     client negotiated the "gochannels.protobuf.v1" subprotocol (see protobuf.go).
+//   - Text frames are JSON control messages (start, config, pause, resume, ping, replay,
+//     end; see control.go) dispatched by a controlRouter. {"type":"end"} tells the server
+//     no more audio will come; we send a Final=true chunk and close the session.
+//     A normal close frame from the client (1000) counts as "end" too: the audio
+//     already sent is still transcribed and its final transcripts delivered to the
+//     sinks (for up to closeFlushTimeout) before the Transcribe session goes away.
+//   - Any other loss of the connection keeps the session running for cfg.ResumeGrace:
+//     the client can reconnect with the token of its {"type":"session",...} frame
+//     (?resume=<token>) and continue where it left off (see resume.go).
+//   - Every transcript piece is also handed to sink (MQTT, ...; see sink.go),
+//     each sink on a copy of its own (see broadcast.go).
+//   - Any error on the Transcribe session is logged and the connection is closed
+//     with a reason: auth_failed, quota_exceeded, upstream_timeout or aws_error
+//     (see awsCloseReason); the closing event names the kind of failure and whether
+//     it is worth a retry (see errors.go).
+//   - The server pings the client every cfg.PingInterval; a client silent for
+//     cfg.PongTimeout counts as gone and its session is finalized (see keepAlive).
+//     Writes that take longer than writeWait fail as well.
+//   - Frames go out through one writer goroutine per connection with a bounded
+//     queue (see wswriter.go); cfg.SlowClient decides whether a client that does
+//     not keep up is waited for or disconnected with "slow_client".
+//     With cfg.TranscriptDelivery finals-first, such a client gets every final in
+//     order but only the latest partial (see delivery.go).
+//   - Audio passes through the analysis stages (meterAudio, checkAudioQuality) on
+//     its way to Transcribe; the level and warning events they produce are written
+//     to the WebSocket as {"type":"level",...} / {"type":"warning",...} frames.
+//   - Connections opened with ?mix=<room> share one Transcribe session: their audio
+//     is mixed server-side (see mixRooms) and every member receives the transcripts.
+//     "end" only stops that member's audio; the room ends when all members are done,
+//     or when serverCtx, the server's context, is canceled.
+//   - Connections opened with ?framing=seq prefix every binary frame with a sequence
+//     number and capture timestamp; a jitter buffer restores the order (reorderAudio).
+//     ?framing=envelope adds a frame type byte in front (see envelope.go); the gaps
+//     the jitter buffer skips are counted in the session stats.
+//   - Connections opened with ?framing=mux carry several audio streams, each with
+//     its own Transcribe session; frames and transcripts name their stream (see
+//     multiplex.go).
+//   - Connections opened with ?speakers=1 have Transcribe label who speaks; the
+//     labels reach the sinks, dead letters and captions (see captions.go), not
+//     the transcript frames. Without it, no labels are asked for.
+//   - With cfg.DetectDTMF, keypad presses are reported as {"type":"dtmf",...} frames.
+//   - With cfg.DetectMusic, speech/music changes are reported as {"type":"segment",...}
+//     frames; cfg.SuppressMusic also keeps music from being transcribed.
+//   - When AWS falls behind, the session's QoS class (?qos=, the API key's or
+//     cfg.QoS; see qos.go) decides how much audio is buffered and whether the
+//     pipeline blocks or discards queued audio (see forwardAudio); standard
+//     sessions follow cfg.DropPolicy. Before it comes to that, once the queue is
+//     half full, the client gets a {"type":"slow_down","backlog_ms":...} frame.
+//   - A client sending faster than cfg.MaxRateFactor times real time (beyond a
+//     short burst) gets a {"type":"backoff","retry_after_ms":...} frame; if it keeps
+//     going, the rate limit below applies.
+//   - Once cfg.MaxAudioDuration of audio has been streamed, the session ran for
+//     cfg.MaxSessionDuration (unless it rolls over, see rollover.go), no audio
+//     arrived for cfg.IdleTimeout, a frame violates the size/rate limits
+//     (cfg.MaxFrameBytes, cfg.MaxRateFactor), or an administrator ended the
+//     session (DELETE /sessions/{id}, see admin.go), the session is
+//     finalized as if "end" was received; after the last transcript a
+//     {"type":"closing",...} frame and a close frame carrying the reason code are sent.
+//     A message far beyond cfg.MaxFrameBytes is not even read (see readLimit):
+//     gorilla closes the connection with 1009 and the session is finalized.
+//   - Connections opened with ?ack=1 acknowledge the frames they receive with
+//     {"type":"ack","seq":N}; finals not acknowledged are sent again after a
+//     resume and stored as a dead letter if the client never comes back (see
+//     sequence.go).
+//   - With cfg.AdmissionQueue, a connection whose stream AWS refuses with a
+//     LimitExceededException waits for capacity, told its place by
+//     {"type":"queued","position":N,...} frames (see waitqueue.go).
+//   - With cfg.MaxSessions, a connection that would start a Transcribe session
+//     beyond the limit is refused with 503 and Retry-After before the upgrade;
+//     a mix room that cannot start closes the socket with "too_many_sessions".
+//   - A Transcribe stream start that AWS refuses with a throttling or 5xx error
+//     is retried with backoff (see retry.go). While starts keep failing, the
+//     circuit breaker (see breaker.go) refuses connections with 503 and reason
+//     "service_degraded" before the upgrade.
+//   - An API key (see apikeys.go) ties the session to a tenant. A tenant over
+//     a quota (see quota.go) is refused with 429 before the upgrade, or gets
+//     final transcripts only, as its key says.
+//   - Close frames sent by the server carry an application close code (4000 + the
+//     matching HTTP status, see close.go) so clients can tell a quota problem from
+//     an idle timeout or a server shutdown without parsing text.
 //
 // Learning notes (applied here):
 //   - We create a per-connection goroutine to READ from the socket and SEND into
@@ -48,62 +194,587 @@ func ServeIndexPage() http.HandlerFunc {
 //  3. Backpressure Management: Using a goroutine with channels creates natural
 //     backpressure - if the audioIn channel gets full, the reader will block
 //     until there's space, without blocking the transcript writing path.
-func StreamAudioEndpoint(client *transcribe.Client) http.HandlerFunc {
+func StreamAudioEndpoint(serverCtx context.Context, client *TranscribeClient, cfg Config, sessions *SessionRegistry, sink TranscriptSink) http.HandlerFunc {
 	upgrader := websocket.Upgrader{
-		CheckOrigin: func(r *http.Request) bool { return true },
+		CheckOrigin:  func(r *http.Request) bool { return true },
+		Subprotocols: []string{protobufSubprotocol},
 	}
+	resumes := newResumeRegistry()
+	admissions := newAdmissionQueue(cfg.AdmissionQueue, cfg.AdmissionWait, sessions)
+	rooms := newMixRooms(serverCtx, client, cfg, sessions, admissions)
 
 	return func(w http.ResponseWriter, r *http.Request) {
-		slog.Info("ws: connection upgrading", slog.String("remote", r.RemoteAddr))
+		// A reconnect with ?resume=<token> is handed over to the session it
+		// belongs to, whose handler serves it from then on (see resume.go).
+		if token := r.URL.Query().Get("resume"); token != "" {
+			if !resumes.has(token) {
+				http.Error(w, "unknown or expired resume token", http.StatusNotFound)
+				return
+			}
+			conn, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				slog.Error("ws: upgrade failed", slog.String("error", err.Error()))
+				return
+			}
+			conn.SetReadLimit(readLimit(cfg))
+			att := resumeAttachment{conn: conn, codec: codecFor(conn)}
+			if !resumes.resume(token, att) {
+				closeWithReason(slog.Default(), conn, att.codec, nil, closeReason{Code: "session_not_found", Message: "the session has ended"})
+				conn.Close()
+			}
+			return
+		}
+
+		// The input format and byte order are declared in the handshake
+		// (?format=...&endian=...). Reject unknown values before upgrading so the
+		// client gets a plain 400.
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = FormatS16LE
+		}
+		newDecoder, err := lookupDecoder(format)
+		if err != nil {
+			writeError(w, "unsupported_format", err)
+			return
+		}
+		endian, err := parseByteOrderMode(r.URL.Query().Get("endian"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		framing, err := parseFraming(r.URL.Query().Get("framing"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if framing == FramingMux && r.URL.Query().Get("mix") != "" {
+			http.Error(w, "framing=mux cannot be combined with mix", http.StatusBadRequest)
+			return
+		}
+		// ?ack=1 asks for acknowledged delivery (see sequence.go).
+		var acks bool
+		if v := r.URL.Query().Get("ack"); v != "" {
+			if acks, err = strconv.ParseBool(v); err != nil {
+				http.Error(w, "invalid ack: want 0 or 1", http.StatusBadRequest)
+				return
+			}
+		}
+		if acks && framing == FramingMux {
+			http.Error(w, "framing=mux cannot be combined with ack", http.StatusBadRequest)
+			return
+		}
+		// ?speakers=1 asks Transcribe to label who speaks in each piece. It
+		// is off by default: labeling speakers delays the results.
+		var speakers bool
+		if v := r.URL.Query().Get("speakers"); v != "" {
+			if speakers, err = strconv.ParseBool(v); err != nil {
+				http.Error(w, "invalid speakers: want 0 or 1", http.StatusBadRequest)
+				return
+			}
+		}
+		if speakers && r.URL.Query().Get("mix") != "" {
+			http.Error(w, "speakers cannot be combined with mix", http.StatusBadRequest)
+			return
+		}
+		entitlements, err := cfg.APIKeys.Lookup(r)
+		if err != nil {
+			rejectAPIKey(w, err)
+			return
+		}
+		qos, err := qosFor(cfg, entitlements, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// While Transcribe is down (see breaker.go) there is no point in
+		// upgrading.
+		if wait, open := client.breaker.RetryAfter(); open {
+			slog.Warn("ws: Transcribe degraded; rejecting", slog.String("remote", r.RemoteAddr))
+			rejectServiceDegraded(w, wait)
+			return
+		}
+		// A connection of its own needs the tenant's admission and a session
+		// slot; a member of a mix room is admitted too, but the room holds the
+		// slot. Multiplexed streams get theirs when they start.
+		admission := tenantAdmission{release: func() {}}
+		if framing != FramingMux {
+			if admission, err = sessions.Admit(entitlements); err != nil {
+				rejectQuota(w, err)
+				return
+			}
+			defer admission.release()
+		}
+		if framing != FramingMux && r.URL.Query().Get("mix") == "" {
+			release, err := sessions.ReserveQoS(qos.Class)
+			if err != nil {
+				slog.Warn("ws: session limit reached; rejecting", slog.String("remote", r.RemoteAddr), slog.String("qos", string(qos.Class)))
+				rejectTooManySessions(w)
+				return
+			}
+			defer release()
+		}
+
+		// The session's ID is fixed here, so that every line logged for it
+		// carries it (see logging.go). A multiplexed connection has none: its
+		// streams are sessions of their own.
+		var id string
+		if framing != FramingMux {
+			id = newSessionID()
+		}
+		log := sessionLogger(id, r.RemoteAddr, entitlements.Tenant)
+		// Every goroutine of the session is labelled with its ID, to be found
+		// in GET /debug/sessions/{id} and profiles (see dump.go).
+		if id != "" {
+			defer labelGoroutines(r.Context(), id)()
+		}
+		log.Info("ws: connection upgrading", slog.String("format", format), slog.String("endian", string(endian)))
 		conn, err := upgrader.Upgrade(w, r, nil)
 		if err != nil {
-			slog.Error("Error upgrading to WebSocket:", slog.String("error", err.Error()))
+			log.Error("Error upgrading to WebSocket:", slog.String("error", err.Error()))
 			return
 		}
-		defer conn.Close()
-		slog.Info("ws: connection established", slog.String("remote", r.RemoteAddr))
+		// conn is replaced when the client resumes and nil while it is away.
+		defer func() {
+			if conn != nil {
+				conn.Close()
+			}
+		}()
+		log.Info("ws: connection established", slog.String("subprotocol", conn.Subprotocol()))
+		conn.SetReadLimit(readLimit(cfg))
+
+		// Outbound events are encoded as negotiated; with protobuf the inbound
+		// binary frames are AudioFrame messages, whatever ?framing= says.
+		codec := codecFor(conn)
+		if conn.Subprotocol() == protobufSubprotocol {
+			framing = FramingProtobuf
+		}
 
-		// Use the request context for cancellation when the client disconnects.
-		ctx := r.Context()
+		// The session lives on ctx, canceled on any terminal event (see
+		// cancel.go).
+		ctx, cancel := context.WithCancelCause(withLogger(r.Context(), log))
+		defer cancel(nil)
+		keepAlive(ctx, conn, cfg.PingInterval, cfg.PongTimeout)
 
-		// Start a per-connection Transcribe session and obtain channels.
-		audioIn, transcriptOut, errOut, err := runTranscribeStream(ctx, client)
+		// A multiplexed connection runs a session per stream (see multiplex.go).
+		if framing == FramingMux {
+			m := &multiplexer{client: client, cfg: cfg, sessions: sessions, sink: sink, newDecoder: newDecoder, entitlements: entitlements, qos: qos, speakers: speakers,
+				decOpts: DecoderOptions{ByteOrder: endian, FFmpegPath: cfg.FFmpegPath}, remote: r.RemoteAddr}
+			m.serve(ctx, conn, codec)
+			return
+		}
+
+		// Start a per-connection Transcribe session and obtain channels, or join
+		// the shared session of a mix room when ?mix=<room> is given.
+		var (
+			audioIn       chan<- AudioChunk
+			transcriptOut <-chan TranscriptPiece
+			errOut        <-chan error
+			// optionChanges restarts the stream with new options (see
+			// restart.go); nil in a mix room.
+			optionChanges chan optionChange
+		)
+		// With cfg.AdmissionQueue, a full AWS account means waiting in line
+		// rather than being turned away (see waitqueue.go).
+		var waited bool
+		queued := func(position int) {
+			waited = true
+			ev := QueuedEvent{Type: "queued", Position: position, Message: "waiting for Transcribe capacity"}
+			if werr := writeEvent(conn, codec, nil, ev); werr != nil {
+				log.Debug("ws: queued event not sent", slog.String("error", werr.Error()))
+			}
+		}
+		if room := r.URL.Query().Get("mix"); room != "" {
+			var leave func()
+			audioIn, transcriptOut, errOut, leave, err = rooms.join(ctx, room, queued)
+			if err == nil {
+				defer leave()
+			}
+		} else {
+			optionChanges = make(chan optionChange)
+			start := func() error {
+				audioIn, transcriptOut, errOut, err = runRestartableTranscribeStream(ctx, func(ctx context.Context, opts TranscribeOptions) (chan<- AudioChunk, <-chan TranscriptPiece, <-chan error, error) {
+					// Speaker labels stay on through option changes.
+					opts.Speakers = speakers
+					return startTranscribeWith(ctx, client, cfg, opts)
+				}, optionChanges)
+				return err
+			}
+			if err = start(); isConcurrencyLimit(err) {
+				err = admissions.wait(ctx, err, queued, start)
+			}
+		}
+		if waited && err == nil && cfg.PingInterval > 0 {
+			// Nothing was read while waiting.
+			extendReadDeadline(conn, cfg.PongTimeout)
+		}
+		if errors.Is(err, errTooManySessions) {
+			closeWithReason(log, conn, codec, nil, closeReason{Code: "too_many_sessions", Message: err.Error()})
+			return
+		}
+		if err != nil {
+			log.Error("ws: transcribe stream error", slog.String("error", err.Error()))
+			closeWithReason(log, conn, codec, nil, awsCloseReason(err))
+			return
+		}
+
+		// Register the session so its stats can be queried while it runs, and
+		// tell the client its ID.
+		// A resumable session survives its connection for cfg.ResumeGrace.
+		session := &Session{ID: id, Remote: r.RemoteAddr, Started: time.Now(), Stats: &AudioStats{}, Tenant: entitlements.Tenant, QoS: qos.Class, Options: requestOptions(r)}
+		var attach <-chan resumeAttachment
+		resumable := cfg.ResumeGrace > 0
+		if resumable {
+			var release func()
+			session.ResumeToken, attach, release = resumes.register()
+			defer release()
+		}
+		sessions.Add(session)
+		defer sessions.Remove(session.ID)
+		if admission.finalsOnly {
+			transcriptOut = dropPartials(ctx, transcriptOut)
+		}
+		transcriptOut = deliverTranscripts(ctx, publishTranscripts(ctx, transcriptOut, session.ID, sink), cfg.TranscriptDelivery)
+		log.Info("ws: session started")
+
+		// frames numbers the session's frames across reconnects (see
+		// sequence.go).
+		frames := newFrameLog()
+		if acks {
+			frames.trackAcks()
+		}
+		sessionEvent := SessionEvent{Type: "session", ID: session.ID, Token: session.ResumeToken, Ack: acks}
+		if err := writeEvent(conn, codec, frames, sessionEvent); err != nil {
+			log.Error("ws-writer: write failed", slog.String("error", err.Error()))
+			return
+		}
+		session.NoteEvent(sessionEvent)
+
+		// The reader feeds rawAudio; from there chunks go through the analysis
+		// stages and are finally pumped into audioIn. Side events (levels, ...)
+		// are collected on events and written out by the writer loop.
+		rawAudio := make(chan AudioChunk, qos.AudioBuffer)
+		events := make(chan Event, eventBuffer)
+		if admission.finalsOnly {
+			emitEvent(events, finalsOnlyWarning)
+		}
+		// How full they are shows in GET /debug/runtime (see debug.go).
+		session.WatchChannel("raw_audio", rawAudio)
+		session.WatchChannel("events", events)
+		session.WatchChannel("audio_in", audioIn)
+		session.WatchChannel("transcript_out", transcriptOut)
+
+		// closing holds the reason when a stage ends the session on the server's
+		// initiative; the writer reports it to the client once transcripts are flushed.
+		closing := make(chan closeReason, 1)
+		// clientClosed is closed by the reader when the client closed the
+		// connection normally; the writer then stops writing but lets the
+		// session finish (see flushFinals).
+		clientClosed := make(chan struct{})
+		// replayRequests tells the writer to resend the session's finals, or
+		// the transcript frames after a sequence number.
+		replayRequests := make(chan ControlMessage, 1)
+		// The reader reports a broken connection of a resumable session on
+		// dropped and receives the connection to continue with on
+		// readerConns, which the writer closes when the client did not come
+		// back in time.
+		dropped := make(chan *websocket.Conn)
+		readerConns := make(chan *websocket.Conn, 1)
+		endSession := func(reason closeReason) {
+			select {
+			case closing <- reason:
+			default:
+			}
+		}
+
+		// With ?framing=seq or ?framing=envelope every binary frame carries a
+		// sequence number and a capture timestamp (see parseSeqFrame and
+		// parseEnvelope), and chunks are put back in order by a jitter buffer
+		// before anything else looks at them.
+		// The decoder is created last so that every path past this point hands
+		// it to decodeAudio, which closes it.
+		decoder, err := newDecoder(ctx, DecoderOptions{ByteOrder: endian, FFmpegPath: cfg.FFmpegPath})
 		if err != nil {
-			slog.Error("ws: transcribe stream error", slog.String("error", err.Error()))
+			log.Error("ws: decoder setup failed", slog.String("format", format), slog.String("error", err.Error()))
+			closeWithReason(log, conn, codec, frames, closeReason{Code: "decoder_unavailable", Message: err.Error()})
 			return
 		}
 
+		// paused is set by the reader on "pause" (see pause.go).
+		var paused atomic.Bool
+		staged := endIdleAudio(ctx, rawAudio, cfg.IdleTimeout, &paused, endSession)
+		if framing.sequenced() {
+			staged = reorderAudio(ctx, staged, session.Stats)
+		}
+		staged = decodeAudio(ctx, staged, decoder, session.Stats, events)
+		staged = trackAudioStats(ctx, staged, session.Stats)
+		staged = meterAudio(ctx, staged, events)
+		staged = checkAudioQuality(ctx, staged, events)
+		if cfg.DetectDTMF {
+			staged = detectDTMF(ctx, staged, events)
+		}
+		if cfg.DetectMusic || cfg.SuppressMusic {
+			staged = classifyAudio(ctx, staged, cfg.SuppressMusic, events)
+		}
+		staged = capAudioDuration(ctx, staged, budgetFor(cfg, entitlements).withQuota(admission.remaining), endSession)
+		staged = capSessionDuration(ctx, staged, cfg, endSession)
+		staged = endOnKill(ctx, staged, session, endSession)
+		staged = recordSession(ctx, staged, cfg.Recorder, session)
+		staged = padPauses(ctx, staged, &paused)
+
+		go forwardAudio(ctx, staged, audioIn, qos.DropPolicy, qos.QueueLen, &session.Stats.Drops, func(ev SlowDownEvent) { emitEvent(events, ev) })
+
+		// awaitResume reports the lost connection to the writer and waits for
+		// the next one; it reports false if there is none.
+		awaitResume := func(lost *websocket.Conn) (*websocket.Conn, bool) {
+			select {
+			case dropped <- lost:
+			case next, ok := <-readerConns: // taken over already
+				return next, ok
+			case <-ctx.Done():
+				return nil, false
+			}
+			select {
+			case next, ok := <-readerConns:
+				return next, ok
+			case <-ctx.Done():
+				return nil, false
+			}
+		}
+
+		readerConn := conn
 		go func() {
-			slog.Info("ws-reader: started", slog.String("remote", r.RemoteAddr))
+			// Once the reader stops, no audio comes any more: the session
+			// gets drainTimeout to finish.
+			defer cancelAfterDrain(ctx, cancel)
+			defer close(rawAudio)
+			defer recoverPanic("ws-reader", func(err error) {
+				sessions.Fail(session.ID, err)
+				endSession(closeReason{Code: "internal_error", Message: err.Error()})
+			})
+			log.Info("ws-reader: started")
 			var tsMs int64 = 0
+			validator := newFrameValidator(cfg, decoder.Info().SampleSize)
+
+			// With sequenced framing TsMs comes from the client's capture clock,
+			// relative to the first frame, instead of being synthesized.
+			var (
+				captureBase int64
+				hasBase     bool
+			)
+
+			// Text frames are control messages (see the note in control.go).
+			var (
+				gotAudio bool
+				started  bool
+			)
+			router := controlRouter{
+				ControlStart: func(msg ControlMessage) error {
+					if started || gotAudio {
+						return fmt.Errorf("%w: start must be the first message", errInvalidControl)
+					}
+					started = true
+					log.Info("ws-reader: client started", slog.Int("version", msg.Version))
+					return nil
+				},
+				ControlConfig: func(msg ControlMessage) error {
+					if msg.Stream != nil {
+						return fmt.Errorf("%w: stream requires framing=mux", errInvalidControl)
+					}
+					if msg.changesOptions() && optionChanges == nil {
+						return fmt.Errorf("%w: options cannot change in a mix room", errInvalidControl)
+					}
+					session.SetLabels(msg.Labels)
+					log.Info("ws-reader: session configured", slog.Any("labels", msg.Labels))
+					if !msg.changesOptions() {
+						return nil
+					}
+					opts := msg.options()
+					change := optionChange{opts: opts, done: func(tsMs int64, err error) {
+						if err != nil {
+							emitEvent(events, WarningEvent{Type: "warning", Code: "options_failed", Message: err.Error(), TsMs: tsMs})
+							return
+						}
+						session.SetStreamOptions(opts)
+						emitEvent(events, OptionsEvent{Type: "options", Language: opts.Language, Vocabulary: opts.Vocabulary, TsMs: tsMs})
+					}}
+					select {
+					case optionChanges <- change:
+					case <-ctx.Done():
+					}
+					return nil
+				},
+				ControlPause: func(ControlMessage) error {
+					paused.Store(true)
+					log.Info("ws-reader: paused")
+					return nil
+				},
+				ControlResume: func(ControlMessage) error {
+					paused.Store(false)
+					log.Info("ws-reader: resumed")
+					return nil
+				},
+				ControlPing: func(msg ControlMessage) error {
+					emitEvent(events, PongEvent{Type: "pong", ID: msg.ID})
+					return nil
+				},
+				ControlReplay: func(msg ControlMessage) error {
+					select {
+					case replayRequests <- msg:
+					default: // a replay is already pending
+					}
+					return nil
+				},
+				ControlEnd: func(msg ControlMessage) error {
+					if msg.Stream != nil {
+						return fmt.Errorf("%w: stream requires framing=mux", errInvalidControl)
+					}
+					sendChunk(ctx, rawAudio, AudioChunk{Final: true, TsMs: tsMs})
+					log.Info("ws-reader: received end; signaling final and stopping")
+					return errStreamEnded
+				},
+			}
+			if acks {
+				router[ControlAck] = func(msg ControlMessage) error {
+					if !frames.ack(msg.Seq) {
+						return fmt.Errorf("%w: frame %d was not sent", errInvalidControl, msg.Seq)
+					}
+					return nil
+				}
+			}
 			for {
-				mt, data, err := conn.ReadMessage()
+				mt, data, err := readerConn.ReadMessage()
+				if isClientClose(err) {
+					// A normal close is the client's way of saying "end": its
+					// pending audio is still transcribed, for the sinks.
+					log.Info("ws-reader: client closed; signaling final")
+					close(clientClosed)
+					sendChunk(ctx, rawAudio, AudioChunk{Final: true, TsMs: tsMs})
+					return
+				}
+				if errors.Is(err, websocket.ErrReadLimit) {
+					// Not a broken connection to resume: the client sent more
+					// than it may. gorilla has closed the connection already.
+					log.Warn("ws-reader: frame over the read limit; signaling final", slog.Int64("limit", readLimit(cfg)))
+					endSession(frameTooLarge(cfg))
+					sendChunk(ctx, rawAudio, AudioChunk{Final: true, TsMs: tsMs})
+					return
+				}
+				if err != nil && resumable {
+					log.Info("ws-reader: connection lost; waiting for the client to resume", slog.String("error", err.Error()))
+					next, ok := awaitResume(readerConn)
+					if ok {
+						readerConn = next
+						log.Info("ws-reader: client resumed")
+						continue
+					}
+					if ctx.Err() != nil {
+						return
+					}
+					log.Info("ws-reader: client did not resume; signaling final")
+					sendChunk(ctx, rawAudio, AudioChunk{Final: true, TsMs: tsMs})
+					return
+				}
 				if err != nil {
-					slog.Warn("ws-reader: read error; signaling final", slog.String("error", err.Error()))
-					audioIn <- AudioChunk{Final: true, TsMs: tsMs}
+					log.Warn("ws-reader: read error; signaling final", slog.String("error", err.Error()))
+					// The read deadline only expires when keepAlive got no pong
+					// (nor anything else) in time; the client is told, if it still listens.
+					if isTimeout(err) {
+						endSession(closeReason{Code: "idle_timeout", Message: "no data or pong received in time"})
+					}
+					sendChunk(ctx, rawAudio, AudioChunk{Final: true, TsMs: tsMs})
 					return
 				}
+				if cfg.PingInterval > 0 {
+					extendReadDeadline(readerConn, cfg.PongTimeout)
+				}
 				switch mt {
 
 				// If the client sends binary data (the audio chunks we are looking for),
-				// we copy it to a new slice and send it to the audioInput channel.
+				// we copy it to a pooled buffer and send it to the audioInput channel.
 				case websocket.BinaryMessage:
-					// We must copy the binary data to a new slice because WebSocket's ReadMessage()
+					session.Stats.addFrame(len(data))
+					gotAudio = true
+
+					// Oversized frames or audio arriving much faster than real time
+					// end the session; the client is told why once it is flushed.
+					if reason, ok := validator.check(len(data), time.Now()); !ok {
+						log.Warn("ws-reader: frame rejected; signaling final", slog.String("reason", reason.Code), slog.Int("bytes", len(data)))
+						endSession(reason)
+						sendChunk(ctx, rawAudio, AudioChunk{Final: true, TsMs: tsMs})
+						return
+					}
+					if ev, ok := validator.backoffDue(); ok {
+						log.Warn("ws-reader: client ahead of the rate limit; asking it to back off", slog.Int64("retry_after_ms", ev.RetryAfterMs))
+						emitEvent(events, ev)
+					}
+
+					if paused.Load() {
+						continue
+					}
+
+					var (
+						seq       uint32
+						captureMs int64
+					)
+					if framing.sequenced() {
+						frameType := frameTypeAudio
+						switch framing {
+						case FramingEnvelope:
+							var env frameEnvelope
+							env, err = parseEnvelope(data)
+							frameType, seq, captureMs, data = env.Type, env.Seq, env.CaptureMs, env.Payload
+						case FramingProtobuf:
+							seq, captureMs, data, err = parseAudioFrame(data)
+						default:
+							seq, captureMs, data, err = parseSeqFrame(data)
+						}
+						if err != nil {
+							session.Stats.addDecodeError()
+							log.Warn("ws-reader: malformed frame ignored", slog.String("error", err.Error()))
+							continue
+						}
+						if frameType != frameTypeAudio {
+							log.Debug("ws-reader: frame of unknown type ignored", slog.Int("type", int(frameType)), slog.Uint64("seq", uint64(seq)))
+							continue
+						}
+						if !hasBase {
+							captureBase, hasBase = captureMs, true
+						}
+						tsMs = captureMs - captureBase
+						// Transit time is only as accurate as the client's clock, but it
+						// is a good first indicator of network or client-side lag.
+						log.Debug("ws-reader: frame received", slog.Uint64("seq", uint64(seq)), slog.Int64("ts_ms", tsMs), slog.Int64("transit_ms", time.Now().UnixMilli()-captureMs))
+					}
+
+					// We must copy the binary data because WebSocket's ReadMessage()
 					// reuses its internal buffer. If we sent 'data' directly to the channel,
 					// the next ReadMessage() call would overwrite the bytes before they're processed.
-					// By copying to a new slice, we ensure each AudioChunk owns its PCM data.
-					payload := make([]byte, len(data))
-					copy(payload, data)
-					audioIn <- AudioChunk{PCM: payload, TsMs: tsMs}
+					// The copy lives in a buffer borrowed from pcmPool, which the sender
+					// releases once the chunk has been forwarded to AWS.
+					chunk := newLiveChunk(data, tsMs)
+					chunk.Seq, chunk.CaptureMs = seq, captureMs
+					if !sendChunk(ctx, rawAudio, chunk) {
+						return
+					}
 					tsMs += chunkMs
 
-				// If the client sends "END", we signal the end of the stream with a Final=true AudioChunk.
-				// We break the loop and return, finishing the goroutine.
+				// Text frames are control messages. On "end" the router signals the
+				// end of the stream with a Final=true AudioChunk and we return,
+				// finishing the goroutine.
 				case websocket.TextMessage:
-					if string(data) == "END" {
-						audioIn <- AudioChunk{Final: true, TsMs: tsMs}
-						slog.Info("ws-reader: received END; signaling final and stopping")
+					err := router.dispatch(data)
+					switch {
+					case err == nil:
+					case errors.Is(err, errStreamEnded):
 						return
+					case errors.Is(err, errUnsupportedVersion):
+						log.Warn("ws-reader: unsupported protocol version; signaling final", slog.String("error", err.Error()))
+						endSession(closeReason{Code: "unsupported_version", Message: err.Error()})
+						sendChunk(ctx, rawAudio, AudioChunk{Final: true, TsMs: tsMs})
+						return
+					default:
+						log.Warn("ws-reader: control message rejected", slog.String("error", err.Error()))
+						emitEvent(events, WarningEvent{Type: "warning", Code: "invalid_control", Message: err.Error(), TsMs: tsMs})
 					}
 				default:
 					// Ignore WebSocket control frames like ping/pong
@@ -112,31 +783,302 @@ func StreamAudioEndpoint(client *transcribe.Client) http.HandlerFunc {
 			}
 		}()
 
-		// Writer loop: transcriptOut/errOut -> WS
-		slog.Info("ws-writer: started", slog.String("remote", r.RemoteAddr))
+		// From here on every frame goes through writer (see wswriter.go); it is
+		// replaced along with conn when the client resumes.
+		// While the client is away (conn == nil) the transcript pieces it misses
+		// are kept in missed and side events are dropped; grace fires when it
+		// has been away too long.
+		var (
+			missed []TranscriptPiece
+			grace  <-chan time.Time
+			writer = newWSWriter(conn, codec, frames, cfg.SlowClient, log, session)
+		)
+		defer func() {
+			if writer != nil {
+				writer.Stop()
+			}
+		}()
+		// writerDone is closed when the current writer stopped on its own.
+		writerDone := func() <-chan struct{} {
+			if writer == nil {
+				return nil
+			}
+			return writer.Done()
+		}
+		// drop closes the connection and waits for its writer to give up.
+		drop := func() {
+			conn.Close()
+			writer.Stop()
+			conn, writer = nil, nil
+		}
+		detach := func() {
+			drop()
+			grace = time.After(cfg.ResumeGrace)
+			log.Info("ws-writer: connection lost; keeping session for resume", slog.Duration("grace", cfg.ResumeGrace))
+		}
+
+		// broken handles the writer failing with err. It reports false when
+		// the session should end because the connection broke for good.
+		broken := func(err error) bool {
+			if errors.Is(err, errSlowClient) {
+				log.Warn("ws-writer: client too slow; disconnecting")
+				writer.Abort(closeReason{Code: "slow_client", Message: "the client did not read its transcripts in time"})
+				conn, writer = nil, nil
+				return false
+			}
+			select {
+			case <-clientClosed:
+				// The writer loop flushes the session next.
+				drop()
+				return true
+			default:
+			}
+			if resumable {
+				log.Warn("ws-writer: write failed", slog.String("error", err.Error()))
+				detach()
+				return true
+			}
+			log.Error("ws-writer: write failed", slog.String("error", err.Error()))
+			return false
+		}
+
+		// send queues ev for the client, if it is there. It reports false when
+		// the writer should stop because the connection broke for good.
+		send := func(ev Event) bool {
+			if writer == nil {
+				return true
+			}
+			if err := writer.Send(ev); err != nil {
+				return broken(err)
+			}
+			return true
+		}
+
+		// finish sends the session summary and reports a server-initiated close
+		// reason, if any, after the session ended without error.
+		finish := func() {
+			if writer == nil {
+				return
+			}
+			if err := writer.Send(session.Summary()); err != nil {
+				log.Error("ws-writer: write failed", slog.String("error", err.Error()))
+				return
+			}
+			select {
+			case reason := <-closing:
+				writer.Close(reason)
+			default:
+				if isServerShutdown(ctx) {
+					writer.Close(closeReason{Code: "server_shutdown", Message: "the server is shutting down"})
+				}
+			}
+		}
+
+		// flushFinals waits, at most closeFlushTimeout, for the transcripts of
+		// the audio the client sent before it closed the connection or failed to
+		// resume. Nobody reads them on the socket any more, but consuming
+		// transcriptOut hands them to the sinks; the Transcribe session is torn
+		// down only after that. They are stored as a dead letter (see
+		// deadletter.go) along with the missed pieces, under reason.
+		flushFinals := func(reason string) {
+			log.Info("ws-writer: client gone; waiting for final transcripts")
+			var undelivered []TranscriptPiece
+			for _, f := range frames.unackedFinals() {
+				undelivered = append(undelivered, f.Event.Piece)
+			}
+			undelivered = append(undelivered, missed...)
+			defer func() { storeDeadLetter(log, cfg.DeadLetters, session, reason, undelivered) }()
+			timeout := time.NewTimer(closeFlushTimeout)
+			defer timeout.Stop()
+			for {
+				select {
+				case piece, ok := <-transcriptOut:
+					if !ok {
+						log.Info("ws-writer: final transcripts delivered")
+						return
+					}
+					undelivered = append(undelivered, piece)
+				case <-timeout.C:
+					log.Warn("ws-writer: gave up waiting for final transcripts")
+					return
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+
+		// Writer loop: transcriptOut/events/errOut -> WS
+		// Whatever ends it cancels the session before the clean-up above
+		// runs, so the other goroutines are on their way out already.
+		defer cancel(nil)
+		log.Info("ws-writer: started")
 		for {
 			select {
 			case piece, ok := <-transcriptOut:
 				if !ok {
-					slog.Info("ws-writer: transcript channel closed; stopping")
+					log.Info("ws-writer: transcript channel closed; stopping")
+					finish()
+					return
+				}
+				session.AddPiece(piece)
+				if conn == nil {
+					// A client that acknowledges gets every final, and no
+					// partials that are stale by the time it is back.
+					switch {
+					case acks && piece.Partial:
+						continue
+					case !acks && len(missed) == resumeBuffer:
+						missed = missed[1:]
+					}
+					missed = append(missed, piece)
+					continue
+				}
+				// Send transcript with partial flag
+				if !send(TranscriptEvent{Text: piece.Text, Partial: piece.Partial, Piece: piece}) {
 					return
 				}
-				// Send transcript as JSON with partial flag
-				jsonMsg := fmt.Sprintf(`{"text":"%s","partial":%t}`, piece.Text, piece.Partial)
-				if err := conn.WriteMessage(websocket.TextMessage, []byte(jsonMsg)); err != nil {
-					slog.Error("ws-writer: write failed", slog.String("error", err.Error()))
+				log.Info("ws-writer: transcript sent", slog.Bool("partial", piece.Partial), slog.String("text", piece.Text))
+			case ev := <-events:
+				// Side events are advisory; a full queue drops them.
+				if writer != nil {
+					writer.Offer(ev)
+				}
+			case <-writerDone():
+				if !broken(writer.Err()) {
 					return
 				}
-				slog.Info("ws-writer: transcript sent", slog.Bool("partial", piece.Partial), slog.String("text", piece.Text))
+			case <-clientClosed:
+				flushFinals("client_closed")
+				return
+			case req := <-replayRequests:
+				if req.After != nil {
+					if sent, ok := frames.since(*req.After); ok {
+						log.Info("ws-writer: replaying transcript frames", slog.Uint64("after", *req.After), slog.Int("frames", len(sent)))
+						for _, f := range sent {
+							ev := f.Event
+							ev.Replayed, ev.ReplayOf = true, f.Seq
+							if !send(ev) {
+								return
+							}
+						}
+						continue
+					}
+					log.Info("ws-writer: replay reaches past the kept frames; replaying all finals", slog.Uint64("after", *req.After))
+				}
+				finals := session.Finals()
+				log.Info("ws-writer: replaying transcript", slog.Int("pieces", len(finals)))
+				for _, text := range finals {
+					if !send(TranscriptEvent{Text: text, Replayed: true}) {
+						return
+					}
+				}
+			case lost := <-dropped:
+				// Reports about a connection that was replaced already are stale.
+				if lost == conn {
+					detach()
+				}
+			case att := <-attach:
+				if conn != nil {
+					// Taken over; the reader gives up the old connection.
+					drop()
+				}
+				conn, codec, grace = att.conn, att.codec, nil
+				writer = newWSWriter(conn, codec, frames, cfg.SlowClient, log, session)
+				keepAlive(ctx, conn, cfg.PingInterval, cfg.PongTimeout)
+				select {
+				case <-readerConns: // not picked up, replaced
+				default:
+				}
+				readerConns <- conn
+				log.Info("ws-writer: client resumed", slog.Int("missed", len(missed)))
+				pending := missed
+				missed = nil
+				if !send(SessionEvent{Type: "session", ID: session.ID, Token: session.ResumeToken, Resumed: true, Ack: acks}) {
+					return
+				}
+				for _, f := range frames.unackedFinals() {
+					ev := f.Event
+					ev.Replayed, ev.ReplayOf = true, f.Seq
+					if !send(ev) {
+						return
+					}
+				}
+				for _, piece := range pending {
+					if !send(TranscriptEvent{Text: piece.Text, Partial: piece.Partial, Piece: piece}) {
+						return
+					}
+				}
+			case <-grace:
+				log.Info("ws-writer: client did not resume")
+				close(readerConns)
+				flushFinals("resume_timeout")
+				return
 			case err, ok := <-errOut:
 				if ok && err != nil {
-					slog.Error("ws-writer: transcribe error", slog.String("error", err.Error()))
+					log.Error("ws-writer: transcribe error", slog.String("error", err.Error()))
+					sessions.Fail(session.ID, err)
+					if writer != nil {
+						_ = writer.Send(session.Summary())
+						writer.Close(awsCloseReason(err))
+					}
+					return
 				}
+				finish()
 				return
 			case <-ctx.Done():
-				slog.Info("ws-writer: context done; closing connection")
+				if errors.Is(context.Cause(ctx), errDrainTimeout) {
+					log.Warn("ws-writer: final transcripts did not arrive in time; ending session", slog.Duration("timeout", drainTimeout))
+					sessions.Fail(session.ID, errDrainTimeout)
+					if writer != nil {
+						_ = writer.Send(session.Summary())
+						writer.Close(awsCloseReason(errDrainTimeout))
+					}
+					return
+				}
+				log.Info("ws-writer: context done; closing connection")
+				if writer != nil && isServerShutdown(ctx) {
+					writer.Close(closeReason{Code: "server_shutdown", Message: "the server is shutting down"})
+				}
 				return
 			}
 		}
 	}
 }
+
+// writeEvent encodes ev with codec and writes it as one frame, numbered by
+// frames (which may be nil). It must only be called from the connection's
+// writer: a wsWriter once the session runs.
+func writeEvent(conn *websocket.Conn, codec messageCodec, frames *frameLog, ev Event) error {
+	seq := frames.next()
+	mt, msg, err := codec.encode(ev, seq)
+	if err != nil {
+		return err
+	}
+	frames.sent(seq, ev)
+	_ = conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return conn.WriteMessage(mt, msg)
+}
+
+// closeFlushTimeout bounds how long a session whose client closed the
+// connection keeps running to collect its final transcripts.
+const closeFlushTimeout = 5 * time.Second
+
+// isClientClose reports whether a read error is the client closing the
+// connection normally, which ends its audio like {"type":"end"}.
+func isClientClose(err error) bool {
+	return websocket.IsCloseError(err, websocket.CloseNormalClosure)
+}
+
+// closeWithReason tells the client why the server is ending the session: a
+// ClosingEvent frame with the details, followed by a close frame with the
+// reason's application close code (see close.go) whose text is the reason code.
+// It logs to log, the session's logger where there is one.
+func closeWithReason(log *slog.Logger, conn *websocket.Conn, codec messageCodec, frames *frameLog, reason closeReason) {
+	log.Info("ws-writer: closing connection", slog.String("reason", reason.Code))
+	code := reason.closeCode()
+	if err := writeEvent(conn, codec, frames, reason.event()); err != nil {
+		log.Error("ws-writer: write failed", slog.String("error", err.Error()))
+		return
+	}
+	_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason.Code), time.Now().Add(writeWait))
+}
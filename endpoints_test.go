@@ -0,0 +1,365 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsHarness serves /ws on a test server, with a fake Transcribe behind it.
+// It stops the server when the test ends; main_test.go then checks that no
+// session left a goroutine behind.
+type wsHarness struct {
+	fake     *fakeTranscribe
+	sessions *SessionRegistry
+	server   *httptest.Server
+	shutdown context.CancelCauseFunc // cancels the server context, as on SIGTERM
+}
+
+func newWSHarness(t *testing.T, cfg Config) *wsHarness {
+	t.Helper()
+	ctx, shutdown := context.WithCancelCause(context.Background())
+	h := &wsHarness{fake: newFakeTranscribe(), sessions: NewSessionRegistry(0), shutdown: shutdown}
+	client := NewTranscribeClient(ctx, h.fake, cfg)
+	h.server = httptest.NewUnstartedServer(StreamAudioEndpoint(ctx, client, cfg, h.sessions, transcriptSinks(nil)))
+	h.server.Config.BaseContext = func(net.Listener) context.Context { return ctx }
+	h.server.Start()
+	t.Cleanup(func() {
+		h.server.Close()
+		h.shutdown(nil)
+	})
+	return h
+}
+
+// connect opens a WebSocket to /ws with query.
+func (h *wsHarness) connect(t *testing.T, query string) *websocket.Conn {
+	t.Helper()
+	url := "ws" + strings.TrimPrefix(h.server.URL, "http") + "/ws?" + query
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// dial opens a session and returns its connection once the server has
+// said hello, with the hello and the session's Transcribe stream.
+func (h *wsHarness) dial(t *testing.T, query string) (*websocket.Conn, map[string]any, *fakeStream) {
+	t.Helper()
+	conn := h.connect(t, query)
+	hello := readEvent(t, conn)
+	if hello["type"] != "session" {
+		t.Fatalf("got %v, want the session event", hello)
+	}
+	return conn, hello, h.fake.stream(t)
+}
+
+// waitSessionsEnd waits until no session is registered any more.
+func (h *wsHarness) waitSessionsEnd(t *testing.T) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(h.sessions.List()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("session still registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// readEvent reads the next event the server sent.
+func readEvent(t *testing.T, conn *websocket.Conn) map[string]any {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ev map[string]any
+	if err := json.Unmarshal(data, &ev); err != nil {
+		t.Fatal(err)
+	}
+	return ev
+}
+
+// readUntil reads events until one has key set to value.
+func readUntil(t *testing.T, conn *websocket.Conn, key string, value any) map[string]any {
+	t.Helper()
+	for {
+		if ev := readEvent(t, conn); ev[key] == value {
+			return ev
+		}
+	}
+}
+
+// readClose reads events until the server closes the connection and
+// returns the close frame.
+func readClose(t *testing.T, conn *websocket.Conn) *websocket.CloseError {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, _, err := conn.ReadMessage()
+		if err == nil {
+			continue
+		}
+		var closeErr *websocket.CloseError
+		if !errors.As(err, &closeErr) {
+			t.Fatalf("connection ended with %v, want a close frame", err)
+		}
+		return closeErr
+	}
+}
+
+// sendFrame sends frame and waits until its audio reached s.
+func sendFrame(t *testing.T, conn *websocket.Conn, s *fakeStream, frame []byte) {
+	t.Helper()
+	if err := conn.WriteMessage(websocket.BinaryMessage, frame); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-s.audio:
+	case <-time.After(5 * time.Second):
+		t.Fatal("audio did not reach Transcribe")
+	}
+}
+
+// closeNormally sends a normal close frame, as a client that is done does.
+func closeNormally(t *testing.T, conn *websocket.Conn) {
+	t.Helper()
+	if err := conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// muxFrame is a ?framing=mux frame of 100ms of silence for stream.
+func muxFrame(stream uint16, seq uint32) []byte {
+	frame := make([]byte, muxHeaderLen+3200)
+	binary.BigEndian.PutUint16(frame[0:2], stream)
+	binary.BigEndian.PutUint32(frame[2:6], seq)
+	binary.BigEndian.PutUint64(frame[6:14], uint64(seq)*100)
+	return frame
+}
+
+func TestStreamAudioEndpointClose(t *testing.T) {
+	h := newWSHarness(t, Config{})
+	conn, _, s := h.dial(t, "")
+
+	sendFrame(t, conn, s, make([]byte, 3200))
+	s.transcript("r1", "hello", false)
+	readUntil(t, conn, "text", "hello")
+	closeNormally(t, conn)
+	if closeErr := readClose(t, conn); closeErr.Code != websocket.CloseNormalClosure {
+		t.Fatalf("closed with %v, want a normal closure", closeErr)
+	}
+	h.waitSessionsEnd(t)
+}
+
+func TestStreamAudioEndpointClientGone(t *testing.T) {
+	h := newWSHarness(t, Config{})
+	conn, _, s := h.dial(t, "")
+
+	sendFrame(t, conn, s, make([]byte, 3200))
+	// No close frame: the connection just breaks.
+	conn.NetConn().Close()
+	h.waitSessionsEnd(t)
+}
+
+func TestStreamAudioEndpointTranscribeError(t *testing.T) {
+	h := newWSHarness(t, Config{})
+	conn, _, s := h.dial(t, "")
+
+	s.end(errors.New("stream reset by AWS"))
+	if closeErr := readClose(t, conn); closeErr.Text != "aws_error" {
+		t.Fatalf("closed with %v, want aws_error", closeErr)
+	}
+	h.waitSessionsEnd(t)
+}
+
+func TestStreamAudioEndpointShutdown(t *testing.T) {
+	h := newWSHarness(t, Config{})
+	conn, _, _ := h.dial(t, "")
+
+	h.shutdown(errServerShutdown)
+	if closeErr := readClose(t, conn); closeErr.Text != "server_shutdown" {
+		t.Fatalf("closed with %v, want server_shutdown", closeErr)
+	}
+	h.waitSessionsEnd(t)
+}
+
+func TestStreamAudioEndpointKill(t *testing.T) {
+	h := newWSHarness(t, Config{})
+	conn, hello, s := h.dial(t, "")
+
+	sendFrame(t, conn, s, make([]byte, 3200))
+	session, ok := h.sessions.Get(hello["id"].(string))
+	if !ok {
+		t.Fatal("session not registered")
+	}
+	session.Kill(closeReason{Code: "session_terminated", Message: "ended by an administrator"})
+	if closeErr := readClose(t, conn); closeErr.Text != "session_terminated" {
+		t.Fatalf("closed with %v, want session_terminated", closeErr)
+	}
+	h.waitSessionsEnd(t)
+}
+
+func TestStreamAudioEndpointResumeGraceExpires(t *testing.T) {
+	h := newWSHarness(t, Config{ResumeGrace: 50 * time.Millisecond})
+	conn, hello, s := h.dial(t, "")
+	if hello["token"] == nil {
+		t.Fatal("no resume token")
+	}
+
+	sendFrame(t, conn, s, make([]byte, 3200))
+	// The client never comes back: once the grace is over the session ends.
+	conn.NetConn().Close()
+	h.waitSessionsEnd(t)
+	if !s.isEnded() {
+		t.Fatal("AWS stream not closed")
+	}
+}
+
+// deadLetterChan is a DeadLetterStore that hands dead letters to the test.
+type deadLetterChan chan DeadLetter
+
+func (c deadLetterChan) StoreDeadLetter(ctx context.Context, dl DeadLetter) error {
+	c <- dl
+	return nil
+}
+
+func TestStreamAudioEndpointDeadLetter(t *testing.T) {
+	stored := make(deadLetterChan, 1)
+	h := newWSHarness(t, Config{DeadLetters: stored})
+	conn, _, s := h.dial(t, "ack=1")
+
+	sendFrame(t, conn, s, make([]byte, 3200))
+	s.transcript("r1", "never acknowledged", false)
+	readUntil(t, conn, "text", "never acknowledged")
+	closeNormally(t, conn)
+	readClose(t, conn)
+	select {
+	case dl := <-stored:
+		if len(dl.Pieces) != 1 || dl.Pieces[0].Text != "never acknowledged" || dl.Pieces[0].ResultID != "r1" {
+			t.Fatalf("dead letter holds %+v, want the whole final", dl.Pieces)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no dead letter stored")
+	}
+	h.waitSessionsEnd(t)
+}
+
+func TestStreamAudioEndpointSpeakers(t *testing.T) {
+	h := newWSHarness(t, Config{})
+	for query, want := range map[string]bool{"": false, "speakers=1": true} {
+		conn, _, s := h.dial(t, query)
+		if s.input.ShowSpeakerLabel != want {
+			t.Errorf("?%s: ShowSpeakerLabel = %v, want %v", query, s.input.ShowSpeakerLabel, want)
+		}
+		closeNormally(t, conn)
+		readClose(t, conn)
+	}
+	h.waitSessionsEnd(t)
+}
+
+func TestStreamAudioEndpointMux(t *testing.T) {
+	h := newWSHarness(t, Config{})
+	conn := h.connect(t, "framing=mux")
+
+	var streams []*fakeStream
+	for id := range uint16(2) {
+		if err := conn.WriteMessage(websocket.BinaryMessage, muxFrame(id, 0)); err != nil {
+			t.Fatal(err)
+		}
+		readUntil(t, conn, "type", "stream")
+		streams = append(streams, h.fake.stream(t))
+	}
+	streams[1].transcript("r1", "second", false)
+	readUntil(t, conn, "text", "second")
+	if err := conn.WriteJSON(map[string]any{"type": "end"}); err != nil {
+		t.Fatal(err)
+	}
+	if closeErr := readClose(t, conn); closeErr.Code != websocket.CloseNormalClosure {
+		t.Fatalf("closed with %v, want a normal closure", closeErr)
+	}
+	h.waitSessionsEnd(t)
+}
+
+func TestStreamAudioEndpointMix(t *testing.T) {
+	h := newWSHarness(t, Config{})
+	first, _, s := h.dial(t, "mix=room")
+	second := h.connect(t, "mix=room")
+	readUntil(t, second, "type", "session")
+
+	s.transcript("r1", "both hear this", false)
+	readUntil(t, first, "text", "both hear this")
+	readUntil(t, second, "text", "both hear this")
+	// One member leaves; the room goes on for the other until it is done too.
+	second.NetConn().Close()
+	closeNormally(t, first)
+	if closeErr := readClose(t, first); closeErr.Code != websocket.CloseNormalClosure {
+		t.Fatalf("closed with %v, want a normal closure", closeErr)
+	}
+	h.waitSessionsEnd(t)
+	if !s.isEnded() {
+		t.Fatal("the room's AWS stream not closed")
+	}
+}
+
+func TestStreamAudioEndpointAdmissionQueue(t *testing.T) {
+	h := newWSHarness(t, Config{AdmissionQueue: 1, AdmissionWait: 5 * time.Second})
+	h.fake.setLimit(1)
+	first, _, _ := h.dial(t, "")
+	second := h.connect(t, "")
+	if ev := readEvent(t, second); ev["type"] != "queued" {
+		t.Fatalf("got %v, want the queued event", ev)
+	}
+
+	// The first session ending frees the slot the second one waits for.
+	closeNormally(t, first)
+	readClose(t, first)
+	readUntil(t, second, "type", "session")
+	h.fake.stream(t)
+	closeNormally(t, second)
+	readClose(t, second)
+	h.waitSessionsEnd(t)
+}
+
+func TestStreamAudioEndpointMixAdmissionQueue(t *testing.T) {
+	h := newWSHarness(t, Config{AdmissionQueue: 1, AdmissionWait: 5 * time.Second})
+	h.fake.setLimit(1)
+	first, _, _ := h.dial(t, "")
+	member := h.connect(t, "mix=room")
+	if ev := readEvent(t, member); ev["type"] != "queued" {
+		t.Fatalf("got %v, want the queued event", ev)
+	}
+
+	closeNormally(t, first)
+	readClose(t, first)
+	readUntil(t, member, "type", "session")
+	s := h.fake.stream(t)
+	s.transcript("r1", "the room runs", false)
+	readUntil(t, member, "text", "the room runs")
+	closeNormally(t, member)
+	readClose(t, member)
+	h.waitSessionsEnd(t)
+}
+
+func TestStreamAudioEndpointAdmissionTimeout(t *testing.T) {
+	h := newWSHarness(t, Config{AdmissionQueue: 1, AdmissionWait: 50 * time.Millisecond})
+	h.fake.setLimit(1)
+	h.dial(t, "")
+	second := h.connect(t, "")
+	if ev := readEvent(t, second); ev["type"] != "queued" {
+		t.Fatalf("got %v, want the queued event", ev)
+	}
+	if closeErr := readClose(t, second); closeErr.Text != "quota_exceeded" {
+		t.Fatalf("closed with %v, want quota_exceeded", closeErr)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/aws/smithy-go"
+)
+
+/*
+Learning note: Error taxonomy
+=============================
+
+A client deciding whether to retry needs to know what kind of failure it
+got, not its text. Every failure a client sees belongs to one of five kinds,
+and each kind looks the same on every surface:
+
+	kind           HTTP  close reasons (code)                        retry?
+	auth           401   auth_failed (4401)                          no
+	quota          429   quota_exceeded, rate_exceeded, ... (4429)   later
+	audio_format   415   -                                           no
+	upstream       502   aws_error (4502), service_degraded (4503)   yes
+	timeout        504   upstream_timeout (4504), idle_timeout       yes
+
+  - HTTP refusals answer with the kind's status and a JSON body
+    {"error":"quota","reason":"tenant_quota_exceeded","message":...,
+    "retryable":true}.
+  - WebSocket sessions end with a closing event carrying the same "error"
+    and "retryable" fields, then a close frame with the reason's code (see
+    close.go).
+
+In code the kinds are the sentinels ErrAuth, ErrQuota, ErrAudioFormat,
+ErrUpstream and ErrTimeout: errors wrap the one they belong to (with %w or
+an Unwrap method), and classifyError finds it, translating what AWS says
+on the way. A panic recovered in a session (see panic.go) belongs to no
+kind: it is the server's bug, reported as internal_error and 500.
+*/
+
+// The kinds of failure a client can see (see the note above).
+var (
+	ErrAuth        = errors.New("not authorized")
+	ErrQuota       = errors.New("quota exceeded")
+	ErrAudioFormat = errors.New("unsupported audio format")
+	ErrUpstream    = errors.New("speech recognition failed")
+	ErrTimeout     = errors.New("timed out")
+)
+
+// errorKind is how a kind of failure shows to clients.
+type errorKind struct {
+	Name      string // "error" field of refusals and closing events
+	Status    int    // HTTP status
+	Retryable bool   // whether trying again later may succeed
+}
+
+// errorKinds describes the sentinels above.
+var errorKinds = map[error]errorKind{
+	ErrAuth:        {Name: "auth", Status: http.StatusUnauthorized},
+	ErrQuota:       {Name: "quota", Status: http.StatusTooManyRequests, Retryable: true},
+	ErrAudioFormat: {Name: "audio_format", Status: http.StatusUnsupportedMediaType},
+	ErrUpstream:    {Name: "upstream", Status: http.StatusBadGateway, Retryable: true},
+	ErrTimeout:     {Name: "timeout", Status: http.StatusGatewayTimeout, Retryable: true},
+}
+
+// reasonKinds maps the close reasons that report a failure to its kind.
+var reasonKinds = map[string]error{
+	"auth_failed":           ErrAuth,
+	"budget_exceeded":       ErrQuota,
+	"rate_exceeded":         ErrQuota,
+	"quota_exceeded":        ErrQuota,
+	"tenant_quota_exceeded": ErrQuota,
+	"aws_error":             ErrUpstream,
+	"service_degraded":      ErrUpstream,
+	"upstream_timeout":      ErrTimeout,
+	"idle_timeout":          ErrTimeout,
+}
+
+// classifyError returns the kind err belongs to, one of the sentinels above,
+// and false for a panic, which belongs to none. Errors AWS reports are
+// classified by their code; anything else unknown counts as upstream.
+func classifyError(err error) (error, bool) {
+	var pe *panicError
+	if errors.As(err, &pe) {
+		return nil, false
+	}
+	for _, kind := range []error{ErrAuth, ErrQuota, ErrAudioFormat, ErrTimeout, ErrUpstream} {
+		if errors.Is(err, kind) {
+			return kind, true
+		}
+	}
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "AccessDeniedException", "UnrecognizedClientException", "InvalidSignatureException", "ExpiredTokenException":
+			return ErrAuth, true
+		case "LimitExceededException", "ThrottlingException", "ServiceQuotaExceededException":
+			return ErrQuota, true
+		}
+		return ErrUpstream, true
+	}
+	if errors.Is(err, context.DeadlineExceeded) || isTimeout(err) {
+		return ErrTimeout, true
+	}
+	return ErrUpstream, true
+}
+
+// event returns the ClosingEvent announcing r, with the kind of failure it
+// reports, if any.
+func (r closeReason) event() ClosingEvent {
+	ev := ClosingEvent{Type: "closing", Reason: r.Code, Message: r.Message, CloseCode: r.closeCode()}
+	if kind, ok := reasonKinds[r.Code]; ok {
+		ev.Error, ev.Retryable = errorKinds[kind].Name, errorKinds[kind].Retryable
+	}
+	// The server going down or being full is worth another try elsewhere.
+	ev.Retryable = ev.Retryable || ev.CloseCode == CloseUnavailable
+	return ev
+}
+
+// errorBody is the JSON body of a refused request, in the shape of a
+// closing event for clients that parse either.
+type errorBody struct {
+	Error     string `json:"error,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+	Message   string `json:"message"`
+	Retryable bool   `json:"retryable"`
+}
+
+// writeError refuses a request with reason and err, with the status of err's
+// kind (500 for none).
+func writeError(w http.ResponseWriter, reason string, err error) {
+	status, body := http.StatusInternalServerError, errorBody{Reason: reason, Message: err.Error()}
+	if kind, ok := classifyError(err); ok {
+		k := errorKinds[kind]
+		status, body.Error, body.Retryable = k.Status, k.Name, k.Retryable
+	}
+	writeErrorBody(w, status, body)
+}
+
+func writeErrorBody(w http.ResponseWriter, status int, body errorBody) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,25 @@
+package main
+
+import "log/slog"
+
+// Event is an out-of-band message delivered to the WebSocket client next to the
+// transcript pieces (audio levels, warnings, ...). Events are written as JSON
+// objects and always carry a "type" field so clients can dispatch on it, next
+// to the envelope's "v" (see messageVersion).
+type Event interface {
+	EventType() string
+}
+
+// eventBuffer is the capacity of the per-connection events channel.
+const eventBuffer = 32
+
+// emitEvent hands ev to the writer without blocking. Events are advisory: if
+// the client is not draining them fast enough we drop the event instead of
+// stalling the audio pipeline with a select/default send.
+func emitEvent(events chan<- Event, ev Event) {
+	select {
+	case events <- ev:
+	default:
+		slog.Debug("events: dropped", slog.String("type", ev.EventType()))
+	}
+}
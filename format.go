@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"math"
+)
+
+// Raw PCM formats. Transcribe only takes 16-bit PCM, so s24le and f32le are
+// converted by their decoders; s16le is decoded as-is.
+const (
+	FormatS16LE = "s16le" // signed 16-bit little-endian (default)
+	FormatS24LE = "s24le" // signed 24-bit little-endian, packed
+	FormatF32LE = "f32le" // 32-bit IEEE float little-endian, [-1, 1]
+)
+
+func init() {
+	for name, size := range map[string]int{FormatS16LE: 2, FormatS24LE: 3, FormatF32LE: 4} {
+		RegisterDecoder(name, func(_ context.Context, opts DecoderOptions) (Decoder, error) {
+			return newPCMDecoder(name, size, opts.ByteOrder), nil
+		})
+	}
+}
+
+// ByteOrderMode is the byte order of the samples a client sends, declared
+// with ?endian=<mode>. Some embedded devices send big-endian PCM even for
+// formats that are nominally little-endian; with EndianAuto the order is
+// guessed from the audio itself (see detectByteOrder).
+type ByteOrderMode string
+
+const (
+	EndianLittle ByteOrderMode = "le" // default
+	EndianBig    ByteOrderMode = "be"
+	EndianAuto   ByteOrderMode = "auto"
+)
+
+// parseByteOrderMode validates a byte order name; empty means EndianLittle.
+func parseByteOrderMode(s string) (ByteOrderMode, error) {
+	switch m := ByteOrderMode(s); m {
+	case "":
+		return EndianLittle, nil
+	case EndianLittle, EndianBig, EndianAuto:
+		return m, nil
+	default:
+		return "", fmt.Errorf("unsupported byte order %q (want %s, %s or %s)", s, EndianLittle, EndianBig, EndianAuto)
+	}
+}
+
+// pcmDecoder decodes raw integer or float PCM of a fixed sample size. Frames
+// are not required to end on a sample boundary: leftover bytes are carried
+// over to the next frame.
+//
+// With EndianAuto the decoder returns no samples at first and buffers the
+// input (up to byteOrderProbeBytes) until detectByteOrder is confident; the
+// buffered audio is then returned in one go.
+type pcmDecoder struct {
+	name  string
+	size  int
+	order binary.ByteOrder // nil while still detecting
+
+	carry   []byte
+	probe   []byte // input buffered for byte order detection
+	samples []int16
+}
+
+func newPCMDecoder(name string, size int, mode ByteOrderMode) *pcmDecoder {
+	d := &pcmDecoder{name: name, size: size}
+	switch mode {
+	case EndianBig:
+		d.order = binary.BigEndian
+	case EndianAuto:
+	default:
+		d.order = binary.LittleEndian
+	}
+	return d
+}
+
+func (d *pcmDecoder) Info() DecoderInfo {
+	return DecoderInfo{Name: d.name, SampleSize: d.size}
+}
+
+func (d *pcmDecoder) Decode(data []byte) ([]int16, error) {
+	if d.order == nil {
+		d.probe = append(d.probe, data...)
+		whole := d.probe[:len(d.probe)-len(d.probe)%d.size]
+		order, ok := detectByteOrder(whole, d.size, d.decode)
+		switch {
+		case ok:
+			slog.Info("format: byte order detected", slog.String("order", order.String()), slog.String("format", d.name))
+		case len(d.probe) >= byteOrderProbeBytes*d.size/bytesPerSample:
+			order = binary.LittleEndian
+			slog.Info("format: byte order undecided; assuming little-endian", slog.String("format", d.name))
+		default:
+			return nil, nil
+		}
+		d.order = order
+		data, d.probe = d.probe, nil
+	}
+
+	src := append(d.carry, data...)
+	whole := len(src) - len(src)%d.size
+	d.samples = d.samples[:0]
+	for i := 0; i < whole; i += d.size {
+		d.samples = append(d.samples, d.toS16(src[i:]))
+	}
+	d.carry = append(d.carry[:0], src[whole:]...)
+	return d.samples, nil
+}
+
+// Flush returns the audio still buffered for byte order detection, decoded
+// as little-endian.
+func (d *pcmDecoder) Flush() ([]int16, error) {
+	if d.order != nil {
+		return nil, nil
+	}
+	d.order = binary.LittleEndian
+	data := d.probe
+	d.probe = nil
+	return d.Decode(data)
+}
+
+// decode returns the sample stored at the start of b using order, normalized
+// to [-1, 1]. Float samples are returned as-is and may fall outside.
+func (d *pcmDecoder) decode(b []byte, order binary.ByteOrder) float64 {
+	switch d.size {
+	case 3:
+		var v int32
+		if order == binary.BigEndian {
+			v = int32(int8(b[0]))<<16 | int32(b[1])<<8 | int32(b[2])
+		} else {
+			v = int32(int8(b[2]))<<16 | int32(b[1])<<8 | int32(b[0])
+		}
+		return float64(v) / (1 << 23)
+	case 4:
+		return float64(math.Float32frombits(order.Uint32(b)))
+	default:
+		return float64(int16(order.Uint16(b))) / (1 << 15)
+	}
+}
+
+// toS16 converts the sample at the start of b to int16.
+func (d *pcmDecoder) toS16(b []byte) int16 {
+	if d.size == bytesPerSample {
+		return int16(d.order.Uint16(b))
+	}
+	v := d.decode(b, d.order)
+	if math.IsNaN(v) {
+		v = 0
+	}
+	// Scale by 2^15 and saturate: a full-scale float 1.0 maps to 32767.
+	return int16(max(math.MinInt16, min(math.MaxInt16, math.Round(v*(1<<15)))))
+}
+
+const (
+	// byteOrderProbeBytes is how much audio (in the session format) EndianAuto
+	// looks at, at most, before giving up and assuming little-endian.
+	byteOrderProbeBytes = sampleRateHz * bytesPerSample * numChannels // 1s
+
+	// byteOrderMinLevel is the mean absolute amplitude the audio needs before
+	// the guess is trusted; silence looks the same in both orders.
+	byteOrderMinLevel = 0.001
+)
+
+// detectByteOrder guesses the byte order of src, which holds whole samples of
+// size bytes that decode reads. Real audio is smooth from one sample to the
+// next, while reading it with the wrong byte order turns it into something
+// close to white noise (or, for floats, into absurd magnitudes). So the order
+// whose decoding has the smaller mean sample-to-sample jump wins, provided it
+// wins clearly.
+func detectByteOrder(src []byte, size int, decode func([]byte, binary.ByteOrder) float64) (binary.ByteOrder, bool) {
+	roughness := func(order binary.ByteOrder) (jump, level float64) {
+		n := len(src) / size
+		if n < 2 {
+			return 0, 0
+		}
+		prev := 0.0
+		for i := range n {
+			v := decode(src[i*size:], order)
+			if math.IsNaN(v) || math.Abs(v) > 2 {
+				v = 2 // implausible float: penalize as a full-scale jump
+			}
+			if i > 0 {
+				jump += math.Abs(v - prev)
+			}
+			level += math.Abs(v)
+			prev = v
+		}
+		return jump / float64(n-1), level / float64(n)
+	}
+
+	leJump, leLevel := roughness(binary.LittleEndian)
+	beJump, beLevel := roughness(binary.BigEndian)
+	switch {
+	case leLevel >= byteOrderMinLevel && leJump < beJump/2:
+		return binary.LittleEndian, true
+	case beLevel >= byteOrderMinLevel && beJump < leJump/2:
+		return binary.BigEndian, true
+	default:
+		return nil, false
+	}
+}
@@ -0,0 +1,967 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/gorilla/websocket"
+)
+
+/*
+Learning note: GraphQL
+======================
+
+GraphQL lets the client say exactly which fields it wants:
+
+	query { sessions { id started stats { audioMs } } }
+
+	subscription { transcripts(sessionId: "1234") { text partial } }
+
+Queries are answered over plain HTTP (POST /graphql with {"query": ...,
+"variables": ...}); subscriptions need a connection that stays open, so they
+run over a WebSocket with the graphql-transport-ws protocol spoken by the
+usual clients (graphql-ws, Apollo, urql):
+
+	--> connection_init        <-- connection_ack
+	--> subscribe {id, query}  <-- next {id, data} ... <-- complete {id}
+	--> complete {id}          (client stops a subscription)
+
+The API is small enough that it does not need a GraphQL library. The parser
+understands operations, aliases, arguments and variables (no fragments or
+directives). The resolvers return ordinary Go structs and the executor walks
+them with reflection: a selected field maps to the struct field with the
+snake_case JSON name (audioMs -> audio_ms), so the schema below is what the
+JSON API already serves. Live transcripts come from a transcriptHub (see
+hub.go); a subscription completes when its session ends.
+
+Every request, the WebSocket upgrade included, needs the admin token or an
+API key (?api_key= works for browsers), as the JSON API does. The listings
+(sessions, jobs) are the admin's, like GET /sessions; a tenant may look up
+its own sessions and jobs and subscribe to their transcripts, and another
+tenant's resolve as if they did not exist, so IDs cannot be probed.
+*/
+
+// graphqlSubprotocol is the WebSocket subprotocol of GraphQL subscriptions.
+const graphqlSubprotocol = "graphql-transport-ws"
+
+// graphqlSchema describes the API; it is served at GET /graphql/schema.
+const graphqlSchema = `scalar Time
+scalar JSON
+
+type Query {
+  "A running session."
+  session(id: ID!): Session
+  sessions: [Session!]!
+  "A job: an upload or a server-side source such as RTP."
+  job(id: ID!): Job
+  jobs: [Job!]!
+}
+
+type Subscription {
+  "The transcript pieces of a running session, until it ends."
+  transcripts(sessionId: ID!): Transcript!
+}
+
+type Session {
+  id: ID!
+  remote: String!
+  started: Time!
+  labels: JSON
+  stats: Stats!
+}
+
+type Stats {
+  bytesReceived: Int!
+  chunks: Int!
+  audioMs: Int!
+  decodeErrors: Int!
+  missingFrames: Int!
+  droppedChunks: Int!
+  silenceRatio: Float!
+  averageLevel: Float!
+}
+
+type Job {
+  id: ID!
+  filename: String!
+  created: Time!
+  status: String!
+  error: String
+  transcript: [String!]!
+}
+
+type Transcript {
+  sessionId: ID!
+  text: String!
+  partial: Boolean!
+}
+`
+
+// gqlSession is the GraphQL view of a Session.
+type gqlSession struct {
+	ID      string             `json:"id"`
+	Remote  string             `json:"remote"`
+	Started time.Time          `json:"started"`
+	Labels  map[string]string  `json:"labels"`
+	Stats   AudioStatsSnapshot `json:"stats"`
+}
+
+func sessionView(s *Session) gqlSession {
+	return gqlSession{ID: s.ID, Remote: s.Remote, Started: s.Started, Labels: s.Labels(), Stats: s.Stats.Snapshot()}
+}
+
+// GraphQLAPI resolves GraphQL operations against the running sessions, the
+// jobs and the live transcripts.
+type GraphQLAPI struct {
+	cfg      Config
+	sessions *SessionRegistry
+	jobs     *JobStore
+	hub      *transcriptHub
+}
+
+func NewGraphQLAPI(cfg Config, sessions *SessionRegistry, jobs *JobStore, hub *transcriptHub) *GraphQLAPI {
+	return &GraphQLAPI{cfg: cfg, sessions: sessions, jobs: jobs, hub: hub}
+}
+
+// gqlCaller is who a GraphQL request acts for (see callerOf).
+type gqlCaller struct {
+	tenant string
+	admin  bool
+}
+
+// owns reports whether the caller may read what was started for tenant.
+// callerOf gives every caller but the admin a tenant, so what was started
+// without an API key is the admin's only, as with requireSessionAccess.
+func (c gqlCaller) owns(tenant string) bool {
+	return c.admin || tenant == c.tenant
+}
+
+// errGraphQLAdminOnly is returned to callers without the admin token for the
+// listings.
+var errGraphQLAdminOnly = errors.New("listing requires the admin token")
+
+type graphqlRequest struct {
+	Query         string         `json:"query"`
+	OperationName string         `json:"operationName"`
+	Variables     map[string]any `json:"variables"`
+}
+
+type graphqlError struct {
+	Message string `json:"message"`
+}
+
+type graphqlResponse struct {
+	Data   any            `json:"data"`
+	Errors []graphqlError `json:"errors,omitempty"`
+}
+
+// prepare parses req and picks the operation to run.
+func (g *GraphQLAPI) prepare(req graphqlRequest) (gqlOperation, map[string]any, error) {
+	ops, err := parseGraphQL(req.Query)
+	if err != nil {
+		return gqlOperation{}, nil, err
+	}
+	var op *gqlOperation
+	for i := range ops {
+		if req.OperationName == "" && len(ops) == 1 || ops[i].Name == req.OperationName {
+			op = &ops[i]
+		}
+	}
+	if op == nil {
+		return gqlOperation{}, nil, fmt.Errorf("operation %q not found", req.OperationName)
+	}
+	vars := make(map[string]any, len(op.Defaults)+len(req.Variables))
+	for k, v := range op.Defaults {
+		vars[k] = v
+	}
+	for k, v := range req.Variables {
+		vars[k] = v
+	}
+	return *op, vars, nil
+}
+
+// query executes a query operation for caller.
+func (g *GraphQLAPI) query(caller gqlCaller, op gqlOperation, vars map[string]any) (any, error) {
+	var data gqlObject
+	for _, sel := range op.Selections {
+		v, err := g.resolveQuery(caller, sel.Name, sel.args(vars))
+		if err != nil {
+			return nil, err
+		}
+		out, err := gqlProject(reflect.ValueOf(v), sel)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, gqlEntry{sel.key(), out})
+	}
+	return data, nil
+}
+
+func (g *GraphQLAPI) resolveQuery(caller gqlCaller, field string, args map[string]any) (any, error) {
+	switch field {
+	case "__typename":
+		return "Query", nil
+	case "session":
+		s, ok := g.sessions.Get(stringArg(args, "id"))
+		if !ok || !caller.owns(s.Tenant) {
+			return nil, nil
+		}
+		return sessionView(s), nil
+	case "sessions":
+		if !caller.admin {
+			return nil, errGraphQLAdminOnly
+		}
+		list := []gqlSession{}
+		for _, s := range g.sessions.List() {
+			list = append(list, sessionView(s))
+		}
+		return list, nil
+	case "job":
+		j, ok := g.jobs.Get(stringArg(args, "id"))
+		if !ok || !caller.owns(j.Tenant) {
+			return nil, nil
+		}
+		return j.Snapshot(), nil
+	case "jobs":
+		if !caller.admin {
+			return nil, errGraphQLAdminOnly
+		}
+		list := []JobSnapshot{}
+		for _, j := range g.jobs.List() {
+			list = append(list, j.Snapshot())
+		}
+		return list, nil
+	}
+	return nil, fmt.Errorf("cannot query field %q on type Query", field)
+}
+
+// subscribe starts a subscription operation for caller and returns the
+// channel of its results, closed when it ends, and a function to stop it.
+func (g *GraphQLAPI) subscribe(caller gqlCaller, op gqlOperation, vars map[string]any) (<-chan any, func(), error) {
+	if len(op.Selections) != 1 || op.Selections[0].Name != "transcripts" {
+		return nil, nil, errors.New("a subscription must select exactly one field: transcripts")
+	}
+	sel := op.Selections[0]
+	if _, err := gqlProject(reflect.ValueOf(publishedTranscript{}), sel); err != nil {
+		return nil, nil, err
+	}
+	sessionID := stringArg(sel.args(vars), "sessionId")
+	pieces, cancel := g.hub.Subscribe(sessionID)
+	// Checked after subscribing: a session that ends from here on closes pieces.
+	if s, ok := g.sessions.Get(sessionID); !ok || !caller.owns(s.Tenant) {
+		cancel()
+		return nil, nil, fmt.Errorf("session %q is not running", sessionID)
+	}
+	out := make(chan any)
+	stop := make(chan struct{})
+	var once sync.Once
+	go func() {
+		defer close(out)
+		for piece := range pieces {
+			v, _ := gqlProject(reflect.ValueOf(newPublishedTranscript(sessionID, piece)), sel)
+			select {
+			case out <- gqlObject{{sel.key(), v}}:
+			case <-stop:
+				cancel()
+				return
+			}
+		}
+	}()
+	return out, func() { once.Do(func() { close(stop); cancel() }) }, nil
+}
+
+func stringArg(args map[string]any, name string) string {
+	s, _ := args[name].(string)
+	return s
+}
+
+// GraphQLEndpoint serves /graphql: queries over HTTP (POST with a JSON body,
+// or GET with ?query=), subscriptions over a graphql-transport-ws WebSocket,
+// to callers with the admin token or an API key.
+func GraphQLEndpoint(api *GraphQLAPI) http.HandlerFunc {
+	upgrader := websocket.Upgrader{
+		CheckOrigin:  func(r *http.Request) bool { return true },
+		Subprotocols: []string{graphqlSubprotocol},
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		entitlements, admin, err := callerOf(api.cfg.AdminToken, api.cfg.APIKeys, r)
+		if err != nil {
+			rejectAPIKey(w, err)
+			return
+		}
+		caller := gqlCaller{tenant: entitlements.Tenant, admin: admin}
+		if websocket.IsWebSocketUpgrade(r) {
+			conn, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				slog.Error("graphql: upgrade failed", slog.String("error", err.Error()))
+				return
+			}
+			api.serveWS(r.Context(), conn, caller)
+			return
+		}
+
+		var req graphqlRequest
+		switch r.Method {
+		case http.MethodPost:
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		case http.MethodGet:
+			req.Query, req.OperationName = r.URL.Query().Get("query"), r.URL.Query().Get("operationName")
+			if v := r.URL.Query().Get("variables"); v != "" {
+				if err := json.Unmarshal([]byte(v), &req.Variables); err != nil {
+					http.Error(w, "invalid variables: "+err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var resp graphqlResponse
+		op, vars, err := api.prepare(req)
+		if err == nil && op.Kind != "query" {
+			err = errors.New("subscriptions are only served over WebSocket (" + graphqlSubprotocol + ")")
+		}
+		if err == nil {
+			resp.Data, err = api.query(caller, op, vars)
+		}
+		if err != nil {
+			resp.Errors = []graphqlError{{Message: err.Error()}}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			slog.Error("graphql: encode failed", slog.String("error", err.Error()))
+		}
+	}
+}
+
+// GraphQLSchemaEndpoint serves GET /graphql/schema.
+func GraphQLSchemaEndpoint() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = w.Write([]byte(graphqlSchema))
+	}
+}
+
+// gqlWSMessage is a graphql-transport-ws message.
+type gqlWSMessage struct {
+	ID      string          `json:"id,omitempty"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// serveWS speaks graphql-transport-ws on conn for caller until the client
+// leaves.
+func (g *GraphQLAPI) serveWS(ctx context.Context, conn *websocket.Conn, caller gqlCaller) {
+	defer conn.Close()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	keepAlive(ctx, conn, g.cfg.PingInterval, g.cfg.PongTimeout)
+
+	var (
+		wmu  sync.Mutex
+		mu   sync.Mutex
+		subs = make(map[string]func())
+	)
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, stop := range subs {
+			stop()
+		}
+	}()
+	send := func(id, typ string, payload any) error {
+		msg := gqlWSMessage{ID: id, Type: typ}
+		if payload != nil {
+			b, err := json.Marshal(payload)
+			if err != nil {
+				return err
+			}
+			msg.Payload = b
+		}
+		wmu.Lock()
+		defer wmu.Unlock()
+		_ = conn.SetWriteDeadline(time.Now().Add(writeWait))
+		return conn.WriteJSON(msg)
+	}
+	closeWith := func(code int, text string) {
+		_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), time.Now().Add(writeWait))
+	}
+
+	acked := false
+	for {
+		var msg gqlWSMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			var syntaxErr *json.SyntaxError
+			if errors.As(err, &syntaxErr) {
+				closeWith(4400, "invalid message")
+			}
+			return
+		}
+		if g.cfg.PingInterval > 0 {
+			extendReadDeadline(conn, g.cfg.PongTimeout)
+		}
+
+		switch msg.Type {
+		case "connection_init":
+			if acked {
+				closeWith(4429, "too many initialisation requests")
+				return
+			}
+			acked = true
+			if err := send("", "connection_ack", nil); err != nil {
+				return
+			}
+		case "ping":
+			if err := send("", "pong", nil); err != nil {
+				return
+			}
+		case "pong":
+		case "subscribe":
+			if !acked {
+				closeWith(4401, "unauthorized")
+				return
+			}
+			mu.Lock()
+			_, exists := subs[msg.ID]
+			mu.Unlock()
+			if exists || msg.ID == "" {
+				closeWith(4409, "subscriber for "+msg.ID+" already exists")
+				return
+			}
+			var req graphqlRequest
+			if err := json.Unmarshal(msg.Payload, &req); err != nil {
+				closeWith(4400, "invalid subscribe payload")
+				return
+			}
+			if err := g.startWS(caller, msg.ID, req, send, &mu, subs); err != nil {
+				if err := send(msg.ID, "error", []graphqlError{{Message: err.Error()}}); err != nil {
+					return
+				}
+			}
+		case "complete":
+			mu.Lock()
+			if stop, ok := subs[msg.ID]; ok {
+				stop()
+				delete(subs, msg.ID)
+			}
+			mu.Unlock()
+		default:
+			closeWith(4400, "unknown message type "+msg.Type)
+			return
+		}
+	}
+}
+
+// startWS runs the operation of a subscribe message: a query answers once, a
+// subscription streams until it ends or the client completes it.
+func (g *GraphQLAPI) startWS(caller gqlCaller, id string, req graphqlRequest, send func(id, typ string, payload any) error, mu *sync.Mutex, subs map[string]func()) error {
+	op, vars, err := g.prepare(req)
+	if err != nil {
+		return err
+	}
+	if op.Kind == "query" {
+		data, err := g.query(caller, op, vars)
+		if err != nil {
+			return err
+		}
+		if err := send(id, "next", graphqlResponse{Data: data}); err != nil {
+			return nil // the reader notices the broken connection
+		}
+		_ = send(id, "complete", nil)
+		return nil
+	}
+
+	results, stop, err := g.subscribe(caller, op, vars)
+	if err != nil {
+		return err
+	}
+	mu.Lock()
+	subs[id] = stop
+	mu.Unlock()
+	go func() {
+		for data := range results {
+			if err := send(id, "next", graphqlResponse{Data: data}); err != nil {
+				stop()
+			}
+		}
+		mu.Lock()
+		_, active := subs[id]
+		delete(subs, id)
+		mu.Unlock()
+		if active { // ended by the server, not completed by the client
+			_ = send(id, "complete", nil)
+		}
+	}()
+	return nil
+}
+
+// gqlOperation is a parsed query or subscription.
+type gqlOperation struct {
+	Kind       string // query, subscription
+	Name       string
+	Defaults   map[string]any // variable defaults
+	Selections []gqlSelection
+}
+
+// gqlSelection is one selected field.
+type gqlSelection struct {
+	Alias, Name string
+	Args        map[string]any // values may be gqlVariable
+	Selections  []gqlSelection
+}
+
+// gqlVariable is a $variable reference in an argument.
+type gqlVariable string
+
+// key is the name of the field in the result.
+func (s gqlSelection) key() string {
+	if s.Alias != "" {
+		return s.Alias
+	}
+	return s.Name
+}
+
+// args returns the arguments with variables substituted.
+func (s gqlSelection) args(vars map[string]any) map[string]any {
+	out := make(map[string]any, len(s.Args))
+	for k, v := range s.Args {
+		if name, ok := v.(gqlVariable); ok {
+			v = vars[string(name)]
+		}
+		out[k] = v
+	}
+	return out
+}
+
+// gqlObject is a result object; unlike a map it keeps the field order of the
+// query, as GraphQL requires.
+type gqlObject []gqlEntry
+
+type gqlEntry struct {
+	key   string
+	value any
+}
+
+func (o gqlObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, e := range o {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, _ := json.Marshal(e.key)
+		v, err := json.Marshal(e.value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+var jsonMarshalerType = reflect.TypeFor[json.Marshaler]()
+
+// gqlTypeNames are the schema names of the result types, for __typename.
+var gqlTypeNames = map[reflect.Type]string{
+	reflect.TypeFor[gqlSession]():          "Session",
+	reflect.TypeFor[AudioStatsSnapshot]():  "Stats",
+	reflect.TypeFor[JobSnapshot]():         "Job",
+	reflect.TypeFor[publishedTranscript](): "Transcript",
+}
+
+// gqlProject returns the fields of v chosen by sel's selection set. Structs
+// are objects whose fields are found by their JSON names; everything else
+// (including maps and types with their own JSON encoding) is a scalar.
+func gqlProject(v reflect.Value, sel gqlSelection) (any, error) {
+	for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil, nil
+		}
+		v = v.Elem()
+	}
+	if !v.IsValid() {
+		return nil, nil
+	}
+	if v.Kind() == reflect.Slice && v.Type().Elem().Kind() != reflect.Uint8 {
+		list := make([]any, v.Len())
+		for i := range list {
+			item, err := gqlProject(v.Index(i), sel)
+			if err != nil {
+				return nil, err
+			}
+			list[i] = item
+		}
+		return list, nil
+	}
+	t := v.Type()
+	if t.Kind() != reflect.Struct || t.Implements(jsonMarshalerType) {
+		if len(sel.Selections) > 0 {
+			return nil, fmt.Errorf("field %q is a scalar and has no subfields", sel.Name)
+		}
+		return v.Interface(), nil
+	}
+	if len(sel.Selections) == 0 {
+		return nil, fmt.Errorf("field %q is an object and needs a selection of subfields", sel.Name)
+	}
+
+	obj := make(gqlObject, 0, len(sel.Selections))
+	for _, sub := range sel.Selections {
+		if sub.Name == "__typename" {
+			obj = append(obj, gqlEntry{sub.key(), gqlTypeNames[t]})
+			continue
+		}
+		f, ok := gqlField(t, sub.Name)
+		if !ok {
+			return nil, fmt.Errorf("cannot query field %q on %s", sub.Name, sel.Name)
+		}
+		out, err := gqlProject(v.FieldByIndex(f.Index), sub)
+		if err != nil {
+			return nil, err
+		}
+		obj = append(obj, gqlEntry{sub.key(), out})
+	}
+	return obj, nil
+}
+
+// gqlField finds the struct field whose JSON name is the snake_case form of
+// the GraphQL field name.
+func gqlField(t reflect.Type, name string) (reflect.StructField, bool) {
+	var snake strings.Builder
+	for _, r := range name {
+		if unicode.IsUpper(r) {
+			snake.WriteByte('_')
+			r = unicode.ToLower(r)
+		}
+		snake.WriteRune(r)
+	}
+	for _, f := range reflect.VisibleFields(t) {
+		tag, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if f.IsExported() && tag == snake.String() {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// parseGraphQL parses a document of query and subscription operations.
+func parseGraphQL(src string) ([]gqlOperation, error) {
+	p := &gqlParser{src: src}
+	var ops []gqlOperation
+	for {
+		p.skip()
+		if p.eof() {
+			break
+		}
+		op, err := p.operation()
+		if err != nil {
+			return nil, fmt.Errorf("syntax error at offset %d: %w", p.pos, err)
+		}
+		ops = append(ops, op)
+	}
+	if len(ops) == 0 {
+		return nil, errors.New("no operation in query")
+	}
+	return ops, nil
+}
+
+// gqlParser is a recursive-descent parser for the supported GraphQL subset.
+type gqlParser struct {
+	src string
+	pos int
+}
+
+func (p *gqlParser) eof() bool { return p.pos >= len(p.src) }
+
+// skip skips white space, commas and comments, which GraphQL ignores.
+func (p *gqlParser) skip() {
+	for !p.eof() {
+		switch c := p.src[p.pos]; {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			p.pos++
+		case c == '#':
+			for !p.eof() && p.src[p.pos] != '\n' {
+				p.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+// peek returns the next significant byte, or 0 at the end.
+func (p *gqlParser) peek() byte {
+	p.skip()
+	if p.eof() {
+		return 0
+	}
+	return p.src[p.pos]
+}
+
+func (p *gqlParser) expect(c byte) error {
+	if p.peek() != c {
+		return fmt.Errorf("expected %q", c)
+	}
+	p.pos++
+	return nil
+}
+
+func (p *gqlParser) name() (string, error) {
+	p.skip()
+	start := p.pos
+	for !p.eof() {
+		c := p.src[p.pos]
+		if c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || p.pos > start && c >= '0' && c <= '9' {
+			p.pos++
+			continue
+		}
+		break
+	}
+	if p.pos == start {
+		return "", errors.New("expected a name")
+	}
+	return p.src[start:p.pos], nil
+}
+
+func (p *gqlParser) operation() (gqlOperation, error) {
+	op := gqlOperation{Kind: "query"}
+	if p.peek() != '{' {
+		kind, err := p.name()
+		if err != nil {
+			return op, err
+		}
+		switch kind {
+		case "query", "subscription":
+			op.Kind = kind
+		case "mutation":
+			return op, errors.New("mutations are not supported")
+		case "fragment":
+			return op, errors.New("fragments are not supported")
+		default:
+			return op, fmt.Errorf("unknown operation type %q", kind)
+		}
+		if c := p.peek(); c != '{' && c != '(' {
+			if op.Name, err = p.name(); err != nil {
+				return op, err
+			}
+		}
+		if p.peek() == '(' {
+			if op.Defaults, err = p.variableDefinitions(); err != nil {
+				return op, err
+			}
+		}
+	}
+	sels, err := p.selectionSet()
+	op.Selections = sels
+	return op, err
+}
+
+// variableDefinitions parses ($name: Type = default, ...); only the defaults
+// are kept, values are not type-checked.
+func (p *gqlParser) variableDefinitions() (map[string]any, error) {
+	defaults := map[string]any{}
+	p.pos++ // (
+	for p.peek() != ')' {
+		if err := p.expect('$'); err != nil {
+			return nil, err
+		}
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(':'); err != nil {
+			return nil, err
+		}
+		if err := p.typeRef(); err != nil {
+			return nil, err
+		}
+		if p.peek() == '=' {
+			p.pos++
+			v, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			defaults[name] = v
+		}
+	}
+	p.pos++ // )
+	return defaults, nil
+}
+
+// typeRef skips a type such as ID!, [String] or [Int!]!.
+func (p *gqlParser) typeRef() error {
+	if p.peek() == '[' {
+		p.pos++
+		if err := p.typeRef(); err != nil {
+			return err
+		}
+		if err := p.expect(']'); err != nil {
+			return err
+		}
+	} else if _, err := p.name(); err != nil {
+		return err
+	}
+	if p.peek() == '!' {
+		p.pos++
+	}
+	return nil
+}
+
+func (p *gqlParser) selectionSet() ([]gqlSelection, error) {
+	if err := p.expect('{'); err != nil {
+		return nil, err
+	}
+	var sels []gqlSelection
+	for p.peek() != '}' {
+		switch p.peek() {
+		case 0:
+			return nil, errors.New("unterminated selection set")
+		case '.':
+			return nil, errors.New("fragments are not supported")
+		case '@':
+			return nil, errors.New("directives are not supported")
+		}
+		var (
+			sel gqlSelection
+			err error
+		)
+		if sel.Name, err = p.name(); err != nil {
+			return nil, err
+		}
+		if p.peek() == ':' {
+			p.pos++
+			sel.Alias = sel.Name
+			if sel.Name, err = p.name(); err != nil {
+				return nil, err
+			}
+		}
+		if p.peek() == '(' {
+			p.pos++
+			sel.Args = map[string]any{}
+			for p.peek() != ')' {
+				name, err := p.name()
+				if err != nil {
+					return nil, err
+				}
+				if err := p.expect(':'); err != nil {
+					return nil, err
+				}
+				if sel.Args[name], err = p.value(); err != nil {
+					return nil, err
+				}
+			}
+			p.pos++ // )
+		}
+		if p.peek() == '{' {
+			if sel.Selections, err = p.selectionSet(); err != nil {
+				return nil, err
+			}
+		}
+		sels = append(sels, sel)
+	}
+	p.pos++ // }
+	return sels, nil
+}
+
+// value parses an argument value: a variable, string, number, boolean, null,
+// enum name, list or object.
+func (p *gqlParser) value() (any, error) {
+	switch c := p.peek(); {
+	case c == '$':
+		p.pos++
+		name, err := p.name()
+		return gqlVariable(name), err
+	case c == '"':
+		return p.stringValue()
+	case c == '-' || c >= '0' && c <= '9':
+		start := p.pos
+		for p.pos++; !p.eof() && strings.IndexByte("0123456789.eE+-", p.src[p.pos]) >= 0; p.pos++ {
+		}
+		if n, err := strconv.ParseInt(p.src[start:p.pos], 10, 64); err == nil {
+			return n, nil
+		}
+		return strconv.ParseFloat(p.src[start:p.pos], 64)
+	case c == '[':
+		p.pos++
+		list := []any{}
+		for p.peek() != ']' {
+			if p.eof() {
+				return nil, errors.New("unterminated list")
+			}
+			v, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		p.pos++
+		return list, nil
+	case c == '{':
+		p.pos++
+		obj := map[string]any{}
+		for p.peek() != '}' {
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(':'); err != nil {
+				return nil, err
+			}
+			if obj[name], err = p.value(); err != nil {
+				return nil, err
+			}
+		}
+		p.pos++
+		return obj, nil
+	default:
+		name, err := p.name()
+		if err != nil {
+			return nil, errors.New("expected a value")
+		}
+		switch name {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		}
+		return name, nil // enum value
+	}
+}
+
+// stringValue parses a "quoted" string, which uses JSON's escapes.
+func (p *gqlParser) stringValue() (string, error) {
+	start := p.pos
+	for p.pos++; !p.eof(); p.pos++ {
+		switch p.src[p.pos] {
+		case '\\':
+			p.pos++
+		case '"':
+			p.pos++
+			var s string
+			err := json.Unmarshal([]byte(p.src[start:p.pos]), &s)
+			return s, err
+		case '\n':
+			return "", errors.New("unterminated string")
+		}
+	}
+	return "", errors.New("unterminated string")
+}
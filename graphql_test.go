@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newGraphQLServer serves /graphql for one session and one job of tenant
+// acme, to the admin token "admin" and the API keys "k_acme" and "k_globex".
+func newGraphQLServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	cfg := Config{
+		AdminToken: "admin",
+		APIKeys: &APIKeys{keys: map[string]Entitlements{
+			"k_acme":   {Tenant: "acme"},
+			"k_globex": {Tenant: "globex"},
+		}},
+	}
+	sessions := NewSessionRegistry(0)
+	sessions.Add(&Session{ID: "s1", Started: time.Now(), Stats: &AudioStats{}, Tenant: "acme"})
+	jobs := NewJobStore(context.Background(), nil, cfg, sessions, nil)
+	jobs.jobs["j1"] = &Job{ID: "j1", Created: time.Now(), Tenant: "acme", status: JobQueued, changed: make(chan struct{})}
+	server := httptest.NewServer(GraphQLEndpoint(NewGraphQLAPI(cfg, sessions, jobs, newTranscriptHub())))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// graphqlGet runs query with the bearer token key, returning the HTTP status
+// and the response.
+func graphqlGet(t *testing.T, server *httptest.Server, key, query string) (int, graphqlResponse) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, server.URL+"?query="+url.QueryEscape(query), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var resp graphqlResponse
+	if res.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return res.StatusCode, resp
+}
+
+func TestGraphQLEndpointAccess(t *testing.T) {
+	server := newGraphQLServer(t)
+	tests := []struct {
+		name, key, query string
+		status           int
+		data, err        string // data as JSON; err a part of the error
+	}{
+		{name: "no key", query: `{ sessions { id } }`, status: http.StatusUnauthorized},
+		{name: "unknown key", key: "k_nobody", query: `{ sessions { id } }`, status: http.StatusUnauthorized},
+		{name: "admin lists sessions", key: "admin", query: `{ sessions { id } }`, status: http.StatusOK, data: `{"sessions":[{"id":"s1"}]}`},
+		{name: "admin lists jobs", key: "admin", query: `{ jobs { id } }`, status: http.StatusOK, data: `{"jobs":[{"id":"j1"}]}`},
+		{name: "tenant lists sessions", key: "k_acme", query: `{ sessions { id } }`, status: http.StatusOK, err: "admin token"},
+		{name: "tenant lists jobs", key: "k_acme", query: `{ jobs { id } }`, status: http.StatusOK, err: "admin token"},
+		{name: "owner reads session", key: "k_acme", query: `{ session(id: "s1") { id } }`, status: http.StatusOK, data: `{"session":{"id":"s1"}}`},
+		{name: "owner reads job", key: "k_acme", query: `{ job(id: "j1") { id } }`, status: http.StatusOK, data: `{"job":{"id":"j1"}}`},
+		{name: "other tenant reads session", key: "k_globex", query: `{ session(id: "s1") { id } }`, status: http.StatusOK, data: `{"session":null}`},
+		{name: "other tenant reads job", key: "k_globex", query: `{ job(id: "j1") { id } }`, status: http.StatusOK, data: `{"job":null}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, resp := graphqlGet(t, server, tt.key, tt.query)
+			if status != tt.status {
+				t.Fatalf("got status %d, want %d", status, tt.status)
+			}
+			if tt.err != "" {
+				if len(resp.Errors) == 0 || !strings.Contains(resp.Errors[0].Message, tt.err) {
+					t.Fatalf("got errors %v, want one about %q", resp.Errors, tt.err)
+				}
+				return
+			}
+			if len(resp.Errors) > 0 {
+				t.Fatalf("got errors %v", resp.Errors)
+			}
+			if tt.data != "" {
+				data, _ := json.Marshal(resp.Data)
+				if string(data) != tt.data {
+					t.Errorf("got %s, want %s", data, tt.data)
+				}
+			}
+		})
+	}
+}
+
+func TestGraphQLSubscribeForeignSession(t *testing.T) {
+	api := NewGraphQLAPI(Config{}, NewSessionRegistry(0), nil, newTranscriptHub())
+	api.sessions.Add(&Session{ID: "s1", Started: time.Now(), Stats: &AudioStats{}, Tenant: "acme"})
+	ops, err := parseGraphQL(`subscription { transcripts(sessionId: "s1") { text } }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := api.subscribe(gqlCaller{tenant: "globex"}, ops[0], nil); err == nil || !strings.Contains(err.Error(), "not running") {
+		t.Fatalf("got %v, want the session to be not running", err)
+	}
+	_, stop, err := api.subscribe(gqlCaller{tenant: "acme"}, ops[0], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop()
+}
+
+func TestParseGraphQL(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []gqlOperation
+		err   string // a part of the error
+	}{
+		{
+			name:  "anonymous query",
+			input: `{ sessions { id stats { audioMs } } }`,
+			want: []gqlOperation{{Kind: "query", Selections: []gqlSelection{
+				{Name: "sessions", Selections: []gqlSelection{{Name: "id"}, {Name: "stats", Selections: []gqlSelection{{Name: "audioMs"}}}}},
+			}}},
+		},
+		{
+			name:  "aliases, arguments, commas and comments",
+			input: "query Jobs {\n  # the first one\n  first: job(id: \"j1\") { id, status }\n}",
+			want: []gqlOperation{{Kind: "query", Name: "Jobs", Selections: []gqlSelection{
+				{Alias: "first", Name: "job", Args: map[string]any{"id": "j1"}, Selections: []gqlSelection{{Name: "id"}, {Name: "status"}}},
+			}}},
+		},
+		{
+			name:  "subscription with a variable and its default",
+			input: `subscription Live($id: ID! = "s1", $n: [Int!]) { transcripts(sessionId: $id) { text } }`,
+			want: []gqlOperation{{Kind: "subscription", Name: "Live", Defaults: map[string]any{"id": "s1"}, Selections: []gqlSelection{
+				{Name: "transcripts", Args: map[string]any{"sessionId": gqlVariable("id")}, Selections: []gqlSelection{{Name: "text"}}},
+			}}},
+		},
+		{
+			name:  "values",
+			input: `{ f(i: -12, x: 1.5e3, s: "a\"bé", t: true, f: false, n: null, e: ASC, l: [1 "two" []], o: {k: {v: 1}}) }`,
+			want: []gqlOperation{{Kind: "query", Selections: []gqlSelection{{Name: "f", Args: map[string]any{
+				"i": int64(-12), "x": 1500.0, "s": `a"bé`, "t": true, "f": false, "n": nil, "e": "ASC",
+				"l": []any{int64(1), "two", []any{}}, "o": map[string]any{"k": map[string]any{"v": int64(1)}},
+			}}}}},
+		},
+		{
+			name:  "two operations",
+			input: `query A { sessions { id } } query B { jobs { id } }`,
+			want: []gqlOperation{
+				{Kind: "query", Name: "A", Selections: []gqlSelection{{Name: "sessions", Selections: []gqlSelection{{Name: "id"}}}}},
+				{Kind: "query", Name: "B", Selections: []gqlSelection{{Name: "jobs", Selections: []gqlSelection{{Name: "id"}}}}},
+			},
+		},
+		{name: "empty", input: "", err: "no operation in query"},
+		{name: "only a comment", input: "# nothing\n", err: "no operation in query"},
+		{name: "mutation", input: `mutation { kill(id: "s1") }`, err: "mutations are not supported"},
+		{name: "fragment definition", input: `fragment F on Session { id }`, err: "fragments are not supported"},
+		{name: "fragment spread", input: `{ sessions { ...F } }`, err: "fragments are not supported"},
+		{name: "directive", input: `{ sessions @skip(if: true) { id } }`, err: "directives are not supported"},
+		{name: "unknown operation type", input: `select { id }`, err: `unknown operation type "select"`},
+		{name: "unterminated selection set", input: `{ sessions { id }`, err: "unterminated selection set"},
+		{name: "missing selection set", input: `query Q`, err: `expected '{'`},
+		{name: "unterminated arguments", input: `{ job(id: "j1"`, err: "expected a name"},
+		{name: "argument without value", input: `{ job(id: ) { id } }`, err: "expected a value"},
+		{name: "argument without colon", input: `{ job(id "j1") { id } }`, err: `expected ':'`},
+		{name: "unterminated string", input: `{ job(id: "j1) { id } }`, err: "unterminated string"},
+		{name: "string across lines", input: "{ job(id: \"j\n1\") { id } }", err: "unterminated string"},
+		{name: "bad escape", input: `{ job(id: "\q") { id } }`, err: "escape"},
+		{name: "bad number", input: `{ f(n: 1.2.3) }`, err: "invalid syntax"},
+		{name: "unterminated list", input: `{ f(l: [1, 2`, err: "unterminated list"},
+		{name: "unterminated object", input: `{ f(o: {k: 1`, err: "expected a name"},
+		{name: "unterminated variables", input: `query Q($id: ID!`, err: `expected '$'`},
+		{name: "variable without type", input: `query Q($id) { id }`, err: `expected ':'`},
+		{name: "unterminated list type", input: `query Q($ids: [ID!) { id }`, err: `expected ']'`},
+		{name: "alias without field", input: `{ a: { id } }`, err: "expected a name"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseGraphQL(tt.input)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want one about %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+/*
+Learning note: Liveness and readiness
+=====================================
+
+An orchestrator (Kubernetes, an ECS service, a load balancer) asks two
+different questions, and answering them with one endpoint gets the process
+either restarted for no reason or sent traffic it cannot serve:
+
+  - GET /healthz, liveness: is the process working at all? It answers 200
+    as long as the HTTP server does. A failing liveness check gets the
+    process restarted, so it must not depend on anything outside it: an AWS
+    outage is no reason to restart every instance.
+  - GET /readyz, readiness: should this instance get new sessions now? It
+    answers 503 while one of its checks fails, and the instance is taken out
+    of the load balancer until it passes again; running sessions go on.
+
+The readiness checks:
+
+	credentials   the AWS credentials can be retrieved and have not expired
+	transcribe    with -ready-probe, the Transcribe streaming endpoint accepts
+	              a TLS connection (checked at most every readyProbeInterval)
+	capacity      a session slot is free (with -max-sessions)
+	breaker       the circuit breaker is closed (see breaker.go)
+	shutdown      the server is not shutting down
+
+Both answer JSON, e.g. {"status":"not_ready","checks":{"capacity":"10/10
+sessions in use",...}}, so an operator sees why at a glance.
+*/
+
+const (
+	// readyProbeInterval is how long the outcome of a Transcribe probe is
+	// reused, so frequent readiness checks do not each open a connection.
+	readyProbeInterval = 30 * time.Second
+	// readyProbeTimeout bounds one probe.
+	readyProbeTimeout = 3 * time.Second
+)
+
+// healthStatus is the body of /healthz and /readyz.
+type healthStatus struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// HealthzEndpoint serves GET /healthz (see the note above).
+func HealthzEndpoint() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, http.StatusOK, healthStatus{Status: "ok"})
+	}
+}
+
+// transcribeProbe checks that the Transcribe streaming endpoint of a region
+// accepts connections, caching the outcome for readyProbeInterval.
+type transcribeProbe struct {
+	addr string
+
+	mu      sync.Mutex
+	checked time.Time
+	err     error
+}
+
+// newTranscribeProbe returns a probe of the streaming endpoint of region.
+func newTranscribeProbe(region string) *transcribeProbe {
+	return &transcribeProbe{addr: net.JoinHostPort("transcribestreaming."+region+".amazonaws.com", "443")}
+}
+
+// check returns the outcome of the last probe, probing again if it is older
+// than readyProbeInterval.
+func (p *transcribeProbe) check(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if time.Since(p.checked) < readyProbeInterval {
+		return p.err
+	}
+	ctx, cancel := context.WithTimeout(ctx, readyProbeTimeout)
+	defer cancel()
+	var dialer tls.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", p.addr)
+	if err == nil {
+		conn.Close()
+	}
+	p.checked, p.err = time.Now(), err
+	return err
+}
+
+// ReadyzEndpoint serves GET /readyz (see the note above). probe is nil
+// without -ready-probe; serverCtx is canceled when the server shuts down;
+// client's circuit breaker is checked.
+func ReadyzEndpoint(serverCtx context.Context, awsCfg aws.Config, client *TranscribeClient, sessions *SessionRegistry, probe *transcribeProbe) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		checks := map[string]string{}
+		ready := true
+		fail := func(name, format string, args ...any) {
+			checks[name] = fmt.Sprintf(format, args...)
+			ready = false
+		}
+
+		if serverCtx.Err() != nil {
+			fail("shutdown", "the server is shutting down")
+		} else {
+			checks["shutdown"] = "ok"
+		}
+
+		switch creds, err := retrieveCredentials(r.Context(), awsCfg); {
+		case err != nil:
+			fail("credentials", "%v", err)
+		case creds.Expired():
+			fail("credentials", "expired at %s", creds.Expires.Format(time.RFC3339))
+		default:
+			checks["credentials"] = "ok"
+		}
+
+		if probe != nil {
+			if err := probe.check(r.Context()); err != nil {
+				fail("transcribe", "%v", err)
+			} else {
+				checks["transcribe"] = "ok"
+			}
+		}
+
+		if inUse, limit := sessions.Load(); limit > 0 && inUse >= limit {
+			fail("capacity", "%d/%d sessions in use", inUse, limit)
+		} else {
+			checks["capacity"] = "ok"
+		}
+
+		if wait, open := client.breaker.RetryAfter(); open {
+			fail("breaker", "open for another %s", wait.Round(time.Second))
+		} else {
+			checks["breaker"] = "ok"
+		}
+
+		if !ready {
+			writeHealth(w, http.StatusServiceUnavailable, healthStatus{Status: "not_ready", Checks: checks})
+			return
+		}
+		writeHealth(w, http.StatusOK, healthStatus{Status: "ready", Checks: checks})
+	}
+}
+
+// retrieveCredentials returns the credentials of awsCfg, from its cache
+// unless they are about to expire.
+func retrieveCredentials(ctx context.Context, awsCfg aws.Config) (aws.Credentials, error) {
+	if awsCfg.Credentials == nil {
+		return aws.Credentials{}, errors.New("no credentials configured")
+	}
+	return awsCfg.Credentials.Retrieve(ctx)
+}
+
+func writeHealth(w http.ResponseWriter, status int, body healthStatus) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
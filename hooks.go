@@ -0,0 +1,122 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+)
+
+/*
+Learning note: Session hooks
+============================
+
+Sinks (TranscriptSink) and observers (SessionObserver) are how the server's
+own integrations follow sessions, each seeing one side: pieces by session ID,
+or sessions starting and ending. An integration of a deployment (billing, a
+CRM, compliance recording, ...) usually wants all of it for the same session,
+so it implements SessionHooks instead and registers it from an init function
+in a file of its own, the way decoders are registered:
+
+	type crmHooks struct{ NoSessionHooks }
+
+	func (crmHooks) OnFinal(s *Session, p TranscriptPiece) { ... }
+
+	func init() { RegisterSessionHooks(crmHooks{}) }
+
+Embedding NoSessionHooks provides the methods the integration does not care
+about. main turns the registered hooks into one observer and sink
+(hookRunner), so no transport's writer loop has to know about them.
+
+Hooks are called synchronously from the session's goroutines, like sinks: a
+hook that has slow work to do (HTTP calls, ...) must hand it off to a
+goroutine of its own instead of holding up the transcript. One that blocks
+anyway holds up the end of the session for broadcastSinkWait at most (see
+broadcast.go); after that OnEnd may come before its last OnFinal.
+*/
+
+// SessionHooks is called at the points of a session's life. OnPartial and
+// OnFinal get every transcript piece, OnError the error that ended the
+// session early, if any; OnEnd is always called last.
+type SessionHooks interface {
+	OnStart(s *Session)
+	OnPartial(s *Session, piece TranscriptPiece)
+	OnFinal(s *Session, piece TranscriptPiece)
+	OnError(s *Session, err error)
+	OnEnd(s *Session)
+}
+
+// NoSessionHooks implements SessionHooks by doing nothing; embed it to
+// implement only some of the hooks.
+type NoSessionHooks struct{}
+
+func (NoSessionHooks) OnStart(*Session)                    {}
+func (NoSessionHooks) OnPartial(*Session, TranscriptPiece) {}
+func (NoSessionHooks) OnFinal(*Session, TranscriptPiece)   {}
+func (NoSessionHooks) OnError(*Session, error)             {}
+func (NoSessionHooks) OnEnd(*Session)                      {}
+
+var sessionHooks []SessionHooks
+
+// RegisterSessionHooks adds h to the hooks called for every session. It is
+// meant to be called from init functions.
+func RegisterSessionHooks(h SessionHooks) {
+	sessionHooks = append(sessionHooks, h)
+}
+
+// hookRunner calls hooks for the sessions of a SessionRegistry. It is a
+// SessionObserver, a TranscriptSink and a SessionFailureObserver; pieces of
+// unknown sessions (uploads use job IDs) are ignored.
+type hookRunner struct {
+	hooks []SessionHooks
+
+	mu       sync.Mutex
+	sessions map[string]*Session
+}
+
+func newHookRunner(hooks []SessionHooks) *hookRunner {
+	slog.Info("hooks: registered", slog.Int("count", len(hooks)))
+	return &hookRunner{hooks: hooks, sessions: make(map[string]*Session)}
+}
+
+func (r *hookRunner) session(id string) *Session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.sessions[id]
+}
+
+func (r *hookRunner) SessionStarted(s *Session) {
+	r.mu.Lock()
+	r.sessions[s.ID] = s
+	r.mu.Unlock()
+	for _, h := range r.hooks {
+		h.OnStart(s)
+	}
+}
+
+func (r *hookRunner) Publish(sessionID string, piece TranscriptPiece) {
+	s := r.session(sessionID)
+	if s == nil {
+		return
+	}
+	for _, h := range r.hooks {
+		if piece.Partial {
+			h.OnPartial(s, piece)
+		} else {
+			h.OnFinal(s, piece)
+		}
+	}
+}
+
+func (r *hookRunner) SessionFailed(s *Session, err error) {
+	for _, h := range r.hooks {
+		h.OnError(s, err)
+	}
+}
+
+func (r *hookRunner) SessionEnded(s *Session) {
+	r.mu.Lock()
+	delete(r.sessions, s.ID)
+	r.mu.Unlock()
+	for _, h := range r.hooks {
+		h.OnEnd(s)
+	}
+}
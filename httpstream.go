@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// TranscribeEndpoint serves POST /transcribe, a plain HTTP alternative to the
+// WebSocket for clients such as curl or serverless functions:
+//
+//	arecord -f S16_LE -r 16000 -c 1 | curl -sN -T - localhost:8080/transcribe
+//
+// The request body is the audio stream, usually sent with Transfer-Encoding:
+// chunked, in the format given by ?format= and ?endian= (as for /ws). The
+// response streams newline-delimited JSON while the upload is still going:
+// transcript pieces ({"text":...,"partial":...}) and events such as warnings,
+// then the session summary (also after a Transcribe error) and, if the
+// server ended the session early, a closing event. The end of the body plays
+// the role of the "end" control message.
+//
+// The same frame size and rate limits as on the WebSocket apply, so the audio
+// must be streamed at about real time.
+func TranscribeEndpoint(client *TranscribeClient, cfg Config, sessions *SessionRegistry, sink TranscriptSink) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = FormatS16LE
+		}
+		newDecoder, err := lookupDecoder(format)
+		if err != nil {
+			writeError(w, "unsupported_format", err)
+			return
+		}
+		endian, err := parseByteOrderMode(r.URL.Query().Get("endian"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// HTTP/1.1 handlers normally cannot read the body once they started
+		// writing the response; transcripts must flow while audio still arrives.
+		// HTTP/2 is always full duplex.
+		rc := http.NewResponseController(w)
+		if err := rc.EnableFullDuplex(); err != nil && r.ProtoMajor == 1 {
+			slog.Warn("http-stream: full duplex unavailable", slog.String("error", err.Error()))
+		}
+
+		entitlements, err := cfg.APIKeys.Lookup(r)
+		if err != nil {
+			rejectAPIKey(w, err)
+			return
+		}
+		qos, err := qosFor(cfg, entitlements, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if wait, open := client.breaker.RetryAfter(); open {
+			slog.Warn("http-stream: Transcribe degraded; rejecting", slog.String("remote", r.RemoteAddr))
+			rejectServiceDegraded(w, wait)
+			return
+		}
+		admission, err := sessions.Admit(entitlements)
+		if err != nil {
+			rejectQuota(w, err)
+			return
+		}
+		defer admission.release()
+		release, err := sessions.ReserveQoS(qos.Class)
+		if err != nil {
+			slog.Warn("http-stream: session limit reached; rejecting", slog.String("remote", r.RemoteAddr), slog.String("qos", string(qos.Class)))
+			rejectTooManySessions(w)
+			return
+		}
+		defer release()
+
+		ctx := r.Context()
+		audioIn, transcriptOut, errOut, err := startTranscribe(ctx, client, cfg)
+		if err != nil {
+			slog.Error("http-stream: transcribe stream error", slog.String("error", err.Error()))
+			writeError(w, awsCloseReason(err).Code, err)
+			return
+		}
+		decoder, err := newDecoder(ctx, DecoderOptions{ByteOrder: endian, FFmpegPath: cfg.FFmpegPath})
+		if err != nil {
+			slog.Error("http-stream: decoder setup failed", slog.String("format", format), slog.String("error", err.Error()))
+			http.Error(w, "decoder unavailable", http.StatusInternalServerError)
+			return
+		}
+
+		session := &Session{ID: newSessionID(), Remote: r.RemoteAddr, Started: time.Now(), Stats: &AudioStats{}, Tenant: entitlements.Tenant, QoS: qos.Class}
+		sessions.Add(session)
+		defer sessions.Remove(session.ID)
+		if admission.finalsOnly {
+			transcriptOut = dropPartials(ctx, transcriptOut)
+		}
+		transcriptOut = deliverTranscripts(ctx, publishTranscripts(ctx, transcriptOut, session.ID, sink), cfg.TranscriptDelivery)
+		slog.Info("http-stream: session started", slog.Any("session", session), slog.String("remote", r.RemoteAddr), slog.String("format", format))
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("X-Session-Id", session.ID)
+		w.WriteHeader(http.StatusOK)
+
+		rawAudio := make(chan AudioChunk, qos.AudioBuffer)
+		events := make(chan Event, eventBuffer)
+		if admission.finalsOnly {
+			emitEvent(events, finalsOnlyWarning)
+		}
+		closing := make(chan closeReason, 1)
+		endSession := func(reason closeReason) {
+			select {
+			case closing <- reason:
+			default:
+			}
+		}
+
+		staged := endIdleAudio(ctx, rawAudio, cfg.IdleTimeout, nil, endSession)
+		staged = decodeAudio(ctx, staged, decoder, session.Stats, events)
+		staged = trackAudioStats(ctx, staged, session.Stats)
+		staged = checkAudioQuality(ctx, staged, events)
+		staged = capAudioDuration(ctx, staged, budgetFor(cfg, entitlements).withQuota(admission.remaining), endSession)
+		staged = capSessionDuration(ctx, staged, cfg, endSession)
+		staged = endOnKill(ctx, staged, session, endSession)
+		staged = recordSession(ctx, staged, cfg.Recorder, session)
+		go forwardAudio(ctx, staged, audioIn, qos.DropPolicy, qos.QueueLen, &session.Stats.Drops, func(ev SlowDownEvent) { emitEvent(events, ev) })
+
+		// Body reader: cuts the upload into chunks as they arrive.
+		go func() {
+			defer close(rawAudio)
+			validator := newFrameValidator(cfg, decoder.Info().SampleSize)
+			sampleSize := max(decoder.Info().SampleSize, bytesPerSample)
+			var tsMs int64
+			buf := make([]byte, pcmBufferSize)
+			for {
+				n, err := r.Body.Read(buf)
+				if n > 0 {
+					session.Stats.addFrame(n)
+					if reason, ok := validator.check(n, time.Now()); !ok {
+						slog.Warn("http-stream: upload rejected; signaling final", slog.String("reason", reason.Code))
+						endSession(reason)
+						sendChunk(ctx, rawAudio, AudioChunk{Final: true, TsMs: tsMs})
+						return
+					}
+					if ev, ok := validator.backoffDue(); ok {
+						emitEvent(events, ev)
+					}
+					if !sendChunk(ctx, rawAudio, newLiveChunk(buf[:n], tsMs)) {
+						return
+					}
+					tsMs += pcmDuration(n * bytesPerSample / sampleSize).Milliseconds()
+				}
+				if err != nil {
+					if !errors.Is(err, io.EOF) {
+						slog.Warn("http-stream: body read error; signaling final", slog.String("error", err.Error()))
+					}
+					sendChunk(ctx, rawAudio, AudioChunk{Final: true, TsMs: tsMs})
+					return
+				}
+			}
+		}()
+
+		enc := json.NewEncoder(w)
+		write := func(ev Event) error {
+			if err := enc.Encode(ev); err != nil {
+				return err
+			}
+			return rc.Flush()
+		}
+		finish := func() {
+			_ = write(session.Summary())
+			select {
+			case reason := <-closing:
+				_ = write(reason.event())
+			default:
+			}
+		}
+
+		for {
+			select {
+			case piece, ok := <-transcriptOut:
+				if !ok {
+					finish()
+					return
+				}
+				session.AddPiece(piece)
+				if err := write(TranscriptEvent{Text: piece.Text, Partial: piece.Partial}); err != nil {
+					slog.Error("http-stream: write failed", slog.String("error", err.Error()))
+					return
+				}
+			case ev := <-events:
+				if err := write(ev); err != nil {
+					slog.Error("http-stream: write failed", slog.String("type", ev.EventType()), slog.String("error", err.Error()))
+					return
+				}
+			case err, ok := <-errOut:
+				if ok && err != nil {
+					slog.Error("http-stream: transcribe error", slog.String("error", err.Error()))
+					sessions.Fail(session.ID, err)
+					_ = write(session.Summary())
+					return
+				}
+				finish()
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
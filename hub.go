@@ -0,0 +1,67 @@
+package main
+
+import "sync"
+
+// hubSubscriberBuffer is the number of pieces a subscriber may lag behind
+// before pieces are dropped for it.
+const hubSubscriberBuffer = 64
+
+// transcriptHub fans the transcript pieces of running sessions out to
+// in-process subscribers (GraphQL subscriptions, session observers). It is a
+// TranscriptSink for the pieces and a SessionObserver to learn when a session
+// is over, which closes its subscriptions. It is safe for concurrent use.
+type transcriptHub struct {
+	mu   sync.Mutex
+	subs map[string]map[chan TranscriptPiece]struct{} // by session ID
+}
+
+func newTranscriptHub() *transcriptHub {
+	return &transcriptHub{subs: make(map[string]map[chan TranscriptPiece]struct{})}
+}
+
+// Subscribe returns a channel receiving the pieces of the session from now
+// on, closed when the session ends, and a function to unsubscribe early.
+// A subscriber that does not keep up misses pieces rather than slowing the
+// session down.
+func (h *transcriptHub) Subscribe(sessionID string) (<-chan TranscriptPiece, func()) {
+	ch := make(chan TranscriptPiece, hubSubscriberBuffer)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subs[sessionID] == nil {
+		h.subs[sessionID] = make(map[chan TranscriptPiece]struct{})
+	}
+	h.subs[sessionID][ch] = struct{}{}
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if _, ok := h.subs[sessionID][ch]; ok {
+			delete(h.subs[sessionID], ch)
+			if len(h.subs[sessionID]) == 0 {
+				delete(h.subs, sessionID)
+			}
+			close(ch)
+		}
+	}
+}
+
+func (h *transcriptHub) Publish(sessionID string, piece TranscriptPiece) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs[sessionID] {
+		select {
+		case ch <- piece:
+		default:
+		}
+	}
+}
+
+func (h *transcriptHub) SessionStarted(*Session) {}
+
+func (h *transcriptHub) SessionEnded(s *Session) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs[s.ID] {
+		close(ch)
+	}
+	delete(h.subs, s.ID)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+/*
+Learning note: Icecast and SHOUTcast streams
+============================================
+
+Internet radio is served by Icecast and SHOUTcast: an endless HTTP response
+of MP3 or AAC frames, the same bytes to every listener. The dial source
+(dial.go) reads them like any other http:// stream, with three additions:
+
+  - The format comes from the Content-Type (audio/mpeg is MP3, audio/aac and
+    audio/aacp are AAC) unless the request names one.
+  - "Now playing" titles are sent in-band. A client that asks with
+    "Icy-MetaData: 1" gets, every icy-metaint bytes of audio, one length byte
+    and that many times 16 bytes of metadata such as
+    StreamTitle='Artist - Song';. icyReader takes these blocks out of the
+    audio and reports the titles, which become the "title" label of the
+    session.
+  - Old SHOUTcast servers answer "ICY 200 OK" instead of "HTTP/1.0 200 OK",
+    which net/http refuses. The dial source's transport rewrites that status
+    line on plain http connections.
+*/
+
+// formatForContentType returns the audio format of a stream served with the
+// Content-Type ct, FormatS16LE if it is not one we know.
+func formatForContentType(ct string) string {
+	mediaType, _, _ := mime.ParseMediaType(ct)
+	switch mediaType {
+	case "audio/mpeg", "audio/mp3", "audio/mpeg3":
+		return FormatMP3
+	case "audio/aac", "audio/aacp", "audio/x-aac":
+		return FormatAAC
+	default:
+		return FormatS16LE
+	}
+}
+
+// icyReader strips the ICY metadata blocks out of a stream that has them
+// every metaint bytes.
+type icyReader struct {
+	r       io.Reader
+	metaint int
+	left    int // audio bytes until the next metadata block
+	// onTitle, if set, is called with every new StreamTitle.
+	onTitle func(title string)
+	title   string
+}
+
+func newICYReader(r io.Reader, metaint int) *icyReader {
+	return &icyReader{r: r, metaint: metaint, left: metaint}
+}
+
+func (ir *icyReader) Read(p []byte) (int, error) {
+	if ir.left == 0 {
+		if err := ir.readMetadata(); err != nil {
+			return 0, err
+		}
+		ir.left = ir.metaint
+	}
+	n, err := ir.r.Read(p[:min(len(p), ir.left)])
+	ir.left -= n
+	return n, err
+}
+
+func (ir *icyReader) readMetadata() error {
+	var size [1]byte
+	if _, err := io.ReadFull(ir.r, size[:]); err != nil {
+		return err
+	}
+	meta := make([]byte, int(size[0])*16)
+	if _, err := io.ReadFull(ir.r, meta); err != nil {
+		return err
+	}
+	if title, ok := icyField(strings.TrimRight(string(meta), "\x00"), "StreamTitle"); ok && title != ir.title {
+		ir.title = title
+		if ir.onTitle != nil {
+			ir.onTitle(title)
+		}
+	}
+	return nil
+}
+
+// icyField returns the value of key in ICY metadata (key='value';...).
+func icyField(meta, key string) (string, bool) {
+	_, rest, ok := strings.Cut(meta, key+"='")
+	if !ok {
+		return "", false
+	}
+	value, _, ok := strings.Cut(rest, "';")
+	if !ok {
+		value = strings.TrimSuffix(rest, "'")
+	}
+	return value, true
+}
+
+// icyMetaint returns the metadata interval of resp, 0 if it has none.
+func icyMetaint(resp *http.Response) int {
+	n, err := strconv.Atoi(resp.Header.Get("Icy-Metaint"))
+	if err != nil || n <= 0 {
+		return 0
+	}
+	return n
+}
+
+// newICYClient returns an HTTP client connecting with dialer, without a
+// proxy, whose plain http connections accept the "ICY 200 OK" status line of
+// SHOUTcast servers.
+func newICYClient(dialer *net.Dialer) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &icyConn{Conn: conn, br: bufio.NewReader(conn)}, nil
+	}
+	return &http.Client{Transport: transport}
+}
+
+// icyConn rewrites an "ICY" status line to "HTTP/1.0".
+type icyConn struct {
+	net.Conn
+	br      *bufio.Reader
+	r       io.Reader // set after the first read
+	checked bool
+}
+
+func (c *icyConn) Read(p []byte) (int, error) {
+	if !c.checked {
+		c.checked = true
+		c.r = c.br
+		head, err := c.br.Peek(4)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return 0, err
+		}
+		if string(head) == "ICY " {
+			_, _ = c.br.Discard(3)
+			c.r = io.MultiReader(strings.NewReader("HTTP/1.0"), c.br)
+		}
+	}
+	return c.r.Read(p)
+}
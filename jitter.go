@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"sort"
+)
+
+/*
+Learning note: Sequenced framing and the jitter buffer
+======================================================
+
+By default a binary frame is nothing but PCM. Clients that connect with
+?framing=seq prefix every frame with a small header instead:
+
+	offset  size  field
+	0       4     sequence number (uint32, big-endian, +1 per frame)
+	4       8     capture timestamp in ms (int64, big-endian, client clock)
+	12      ...   PCM payload
+
+The capture timestamp, relative to the first frame, becomes the chunk's TsMs,
+so timestamps follow the client's real capture timing instead of being
+synthesized from the frame count.
+
+With sequence numbers the server no longer has to trust arrival order. The
+reorderAudio stage keeps a handful of chunks in a buffer sorted by sequence
+number and only releases them in order. If a chunk is still missing when the
+buffer is full, it is given up on: the gap is logged, skipped and counted in
+the session's missing_frames. Chunks that show up after their slot was
+skipped are dropped. Gaps are counted here rather than as frames arrive, so a
+chunk that is merely late, and put back in its place, is not counted as
+missing.
+*/
+
+const (
+	// seqHeaderLen is the size of the ?framing=seq frame header.
+	seqHeaderLen = 12
+
+	// jitterDepth is how many chunks reorderAudio holds while waiting for a
+	// missing one (~256ms with the demo page's 64ms frames).
+	jitterDepth = 4
+)
+
+var errShortFrame = errors.New("frame shorter than sequence header")
+
+// parseSeqFrame splits a ?framing=seq frame into its header fields and the
+// PCM payload. The payload aliases data.
+func parseSeqFrame(data []byte) (seq uint32, captureMs int64, payload []byte, err error) {
+	if len(data) < seqHeaderLen {
+		return 0, 0, nil, errShortFrame
+	}
+	seq = binary.BigEndian.Uint32(data[0:4])
+	captureMs = int64(binary.BigEndian.Uint64(data[4:12]))
+	return seq, captureMs, data[seqHeaderLen:], nil
+}
+
+// reorderAudio is a jitter buffer stage for sequenced chunks: it forwards
+// chunks in Seq order, waiting for up to jitterDepth chunks for a missing
+// one before skipping it, and counts the skipped ones in stats. A Final
+// chunk flushes everything still buffered.
+func reorderAudio(ctx context.Context, in <-chan AudioChunk, stats *AudioStats) <-chan AudioChunk {
+	out := make(chan AudioChunk, cap(in))
+
+	go func() {
+		defer close(out)
+		var (
+			pending []AudioChunk // sorted by Seq, all >= next
+			next    uint32       // sequence number expected next
+			started bool
+		)
+		emit := func(ch AudioChunk) bool {
+			select {
+			case out <- ch:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		// drain forwards the in-order run at the head of pending.
+		drain := func() bool {
+			for len(pending) > 0 && pending[0].Seq == next {
+				if !emit(pending[0]) {
+					return false
+				}
+				pending = pending[1:]
+				next++
+			}
+			return true
+		}
+
+		for ch := range in {
+			if ch.Final {
+				for _, p := range pending {
+					if p.Seq > next {
+						stats.addMissingFrames(int64(p.Seq - next))
+					}
+					if !emit(p) {
+						return
+					}
+					next = p.Seq + 1
+				}
+				pending = nil
+				if !emit(ch) {
+					return
+				}
+				continue
+			}
+
+			if !started {
+				next, started = ch.Seq, true
+			}
+			if ch.Seq < next {
+				loggerFrom(ctx).Warn("jitter: late chunk dropped", slog.Uint64("seq", uint64(ch.Seq)), slog.Uint64("expected", uint64(next)))
+				ch.Release()
+				continue
+			}
+
+			i := sort.Search(len(pending), func(i int) bool { return pending[i].Seq >= ch.Seq })
+			if i < len(pending) && pending[i].Seq == ch.Seq {
+				loggerFrom(ctx).Debug("jitter: duplicate chunk dropped", slog.Uint64("seq", uint64(ch.Seq)))
+				ch.Release()
+				continue
+			}
+			pending = append(pending, AudioChunk{})
+			copy(pending[i+1:], pending[i:])
+			pending[i] = ch
+
+			if !drain() {
+				return
+			}
+			if len(pending) > jitterDepth {
+				loggerFrom(ctx).Warn("jitter: gap skipped", slog.Uint64("from", uint64(next)), slog.Uint64("to", uint64(pending[0].Seq)))
+				stats.addMissingFrames(int64(pending[0].Seq - next))
+				next = pending[0].Seq
+				if !drain() {
+					return
+				}
+			}
+		}
+	}()
+
+	return out
+}
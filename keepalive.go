@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// writeWait is how long a single write to a client may take before the
+// connection is considered dead.
+const writeWait = 10 * time.Second
+
+// keepAlive detects dead clients. It arms a read deadline of pongTimeout that
+// every pong and every inbound message pushes back (see extendReadDeadline),
+// and pings the client every pingInterval until ctx is done. A client that
+// vanished without closing the TCP connection then makes the reader fail
+// within pongTimeout, which finalizes its Transcribe session like any other
+// read error. A zero pingInterval disables the mechanism.
+func keepAlive(ctx context.Context, conn *websocket.Conn, pingInterval, pongTimeout time.Duration) {
+	if pingInterval <= 0 {
+		return
+	}
+	extendReadDeadline(conn, pongTimeout)
+	conn.SetPongHandler(func(string) error {
+		extendReadDeadline(conn, pongTimeout)
+		return nil
+	})
+
+	go func() {
+		ticker := time.NewTicker(pingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				// WriteControl may be called concurrently with the writer loop.
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)); err != nil {
+					loggerFrom(ctx).Debug("ws-keepalive: ping failed", slog.String("error", err.Error()))
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// extendReadDeadline gives the client another timeout to send something. A
+// zero timeout means no deadline.
+func extendReadDeadline(conn *websocket.Conn, timeout time.Duration) {
+	if timeout <= 0 {
+		return
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"math/bits"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+/*
+Learning note: Amazon Connect audio via Kinesis Video Streams
+=============================================================
+
+With live media streaming enabled, Amazon Connect writes the audio of every
+contact to a Kinesis Video Stream: Matroska (MKV) with two tracks,
+AUDIO_FROM_CUSTOMER and AUDIO_TO_CUSTOMER, each 8kHz 16-bit PCM. A contact
+flow (usually through a Lambda) then hands the stream ARN and the start
+fragment number to whoever should process the call; here that is
+POST /sources/kvs. It takes the admin token (see admin.go): the server reads
+the stream with its own credentials, which can read every stream of the
+account, so the caller must be trusted with all of them.
+
+Reading the stream takes two calls: GetDataEndpoint finds the endpoint that
+serves the stream and GetMedia returns the media from there as one long HTTP
+response. Both are plain JSON-over-HTTP APIs signed with SigV4, so they are
+called directly with the SDK's signer.
+
+The response is a series of MKV fragments. MKV is EBML, a binary XML of sorts
+where every element is an ID, a size and a payload, so readMKVAudio walks it
+as a flat stream of elements: it notes the track numbers, names and sample
+rates from the Tracks section and turns every SimpleBlock of a wanted track
+into an AudioChunk. Each track becomes its own session and job, so the
+customer and the agent are transcribed separately.
+*/
+
+// kvsTracks are the track names written by Amazon Connect.
+var kvsTracks = []string{"AUDIO_FROM_CUSTOMER", "AUDIO_TO_CUSTOMER"}
+
+// KVSRequest is the body of POST /sources/kvs.
+type KVSRequest struct {
+	StreamARN      string   `json:"stream_arn"`
+	StreamName     string   `json:"stream_name"`
+	FragmentNumber string   `json:"fragment_number"` // start here instead of now
+	Tracks         []string `json:"tracks"`          // default: both Connect tracks
+}
+
+// KVSSource reads audio from Kinesis Video Streams.
+type KVSSource struct {
+	aws      aws.Config
+	client   *TranscribeClient
+	cfg      Config
+	jobs     *JobStore
+	sessions *SessionRegistry
+	http     *http.Client
+}
+
+func NewKVSSource(awsCfg aws.Config, client *TranscribeClient, cfg Config, jobs *JobStore, sessions *SessionRegistry) *KVSSource {
+	return &KVSSource{aws: awsCfg, client: client, cfg: cfg, jobs: jobs, sessions: sessions, http: &http.Client{}}
+}
+
+// call sends a signed kinesisvideo API request and returns the response,
+// which the caller must close.
+func (k *KVSSource) call(ctx context.Context, endpoint, path string, body any) (*http.Response, error) {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint+path, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := doAWSRequest(ctx, k.aws, k.http, req, payload, "kinesisvideo", k.aws.Region)
+	if err != nil {
+		return nil, fmt.Errorf("kvs: %s: %w", path, err)
+	}
+	return resp, nil
+}
+
+// getMedia opens the media of the stream described by r.
+func (k *KVSSource) getMedia(ctx context.Context, r KVSRequest) (io.ReadCloser, error) {
+	type streamRef struct {
+		StreamARN  string `json:",omitempty"`
+		StreamName string `json:",omitempty"`
+	}
+	ref := streamRef{StreamARN: r.StreamARN, StreamName: r.StreamName}
+
+	resp, err := k.call(ctx, fmt.Sprintf("https://kinesisvideo.%s.amazonaws.com", k.aws.Region), "/getDataEndpoint", struct {
+		streamRef
+		APIName string
+	}{ref, "GET_MEDIA"})
+	if err != nil {
+		return nil, err
+	}
+	var endpoint struct{ DataEndpoint string }
+	err = json.NewDecoder(resp.Body).Decode(&endpoint)
+	resp.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("kvs: getDataEndpoint: %w", err)
+	}
+
+	type startSelector struct {
+		StartSelectorType   string
+		AfterFragmentNumber string `json:",omitempty"`
+	}
+	selector := startSelector{StartSelectorType: "NOW"}
+	if r.FragmentNumber != "" {
+		selector = startSelector{StartSelectorType: "FRAGMENT_NUMBER", AfterFragmentNumber: r.FragmentNumber}
+	}
+	resp, err = k.call(ctx, endpoint.DataEndpoint, "/getMedia", struct {
+		streamRef
+		StartSelector startSelector
+	}{ref, selector})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// start transcribes the tracks of the stream described by r in the background
+// and returns the job of each track.
+func (k *KVSSource) start(ctx context.Context, r KVSRequest) (map[string]string, error) {
+	if r.StreamARN == "" && r.StreamName == "" {
+		return nil, errors.New("stream_arn or stream_name is required")
+	}
+	if len(r.Tracks) == 0 {
+		r.Tracks = kvsTracks
+	}
+	media, err := k.getMedia(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+
+	stream := r.StreamARN
+	if stream == "" {
+		stream = r.StreamName
+	}
+	ids := make(map[string]string, len(r.Tracks))
+	tracks := make(map[string]chan AudioChunk, len(r.Tracks))
+	for _, name := range r.Tracks {
+		job := k.jobs.add(fmt.Sprintf("kvs %s track=%s", stream, name), "")
+		session := &Session{ID: job.ID, Remote: stream, Started: time.Now(), Stats: &AudioStats{}}
+		session.SetLabels(map[string]string{"stream": stream, "track": name})
+		in := make(chan AudioChunk, 16)
+		tracks[name] = in
+		ids[name] = job.ID
+		go k.jobs.transcribe(ctx, k.client, k.cfg, in, false, session, job, k.sessions, Entitlements{})
+	}
+
+	go func() {
+		defer media.Close()
+		err := readMKVAudio(ctx, media, tracks)
+		for _, in := range tracks {
+			select {
+			case in <- AudioChunk{Final: true}:
+			case <-ctx.Done():
+			}
+			close(in)
+		}
+		if err != nil && ctx.Err() == nil {
+			slog.Warn("kvs: media ended with error", slog.String("stream", stream), slog.String("error", err.Error()))
+			return
+		}
+		slog.Info("kvs: media ended", slog.String("stream", stream))
+	}()
+	return ids, nil
+}
+
+// KVSSourceEndpoint serves POST /sources/kvs: it starts transcribing a
+// Kinesis Video Stream (see KVSRequest) and answers 202 with the job ID of
+// every track, e.g. {"jobs":{"AUDIO_FROM_CUSTOMER":"..."}}.
+func KVSSourceEndpoint(ctx context.Context, source *KVSSource) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req KVSRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		// The transcription outlives this request; ctx is the server's.
+		jobs, err := source.start(ctx, req)
+		if err != nil {
+			slog.Error("kvs: start failed", slog.String("error", err.Error()))
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		_ = json.NewEncoder(w).Encode(map[string]any{"jobs": jobs})
+	}
+}
+
+// EBML element IDs used by readMKVAudio.
+const (
+	mkvEBML         = 0x1A45DFA3
+	mkvSegment      = 0x18538067
+	mkvTracks       = 0x1654AE6B
+	mkvTrackEntry   = 0xAE
+	mkvTrackNumber  = 0xD7
+	mkvName         = 0x536E
+	mkvAudio        = 0xE1
+	mkvSamplingFreq = 0xB5
+	mkvCluster      = 0x1F43B675
+	mkvBlockGroup   = 0xA0
+	mkvSimpleBlock  = 0xA3
+	mkvBlock        = 0xA1
+
+	// mkvMaxElement bounds the payloads readMKVAudio reads into memory.
+	mkvMaxElement = 1 << 20
+)
+
+// mkvMaster lists the elements whose children readMKVAudio looks into.
+var mkvMaster = map[uint64]bool{
+	mkvSegment: true, mkvTracks: true, mkvTrackEntry: true, mkvAudio: true,
+	mkvCluster: true, mkvBlockGroup: true,
+}
+
+// readVint reads an EBML variable-length integer. With keepMarker the length
+// marker bit stays in the value, as it does for element IDs. unknown reports
+// a size with all value bits set, which means "until the parent ends".
+func readVint(r io.ByteReader, keepMarker bool) (v uint64, unknown bool, err error) {
+	first, err := r.ReadByte()
+	if err != nil {
+		return 0, false, err
+	}
+	n := 1
+	for mask := byte(0x80); n <= 8 && first&mask == 0; mask >>= 1 {
+		n++
+	}
+	if n > 8 {
+		return 0, false, errors.New("mkv: invalid vint")
+	}
+	v = uint64(first)
+	if !keepMarker {
+		v &= uint64(0xFF >> n)
+	}
+	allOnes := v == uint64(0xFF>>n)
+	for range n - 1 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, false, err
+		}
+		v = v<<8 | uint64(b)
+		allOnes = allOnes && b == 0xFF
+	}
+	return v, !keepMarker && allOnes, nil
+}
+
+// readMKVAudio reads MKV fragments from r and sends the PCM of the tracks
+// named in out, converted to the session format, until r ends.
+func readMKVAudio(ctx context.Context, r io.Reader, out map[string]chan AudioChunk) error {
+	br := bufio.NewReaderSize(r, 64*1024)
+	type track struct {
+		name string
+		rate float64
+		tsMs int64
+	}
+	var (
+		tracks  = map[uint64]*track{}
+		current *track // TrackEntry being read
+		num     uint64
+	)
+	for {
+		id, _, err := readVint(br, true)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		size, unknown, err := readVint(br, false)
+		if err != nil {
+			return err
+		}
+		if mkvMaster[id] {
+			if id == mkvTrackEntry {
+				current, num = &track{rate: 8000}, 0
+			}
+			continue
+		}
+		if unknown || size > mkvMaxElement {
+			return fmt.Errorf("mkv: element %x too large", id)
+		}
+		switch id {
+		case mkvTrackNumber, mkvName, mkvSamplingFreq, mkvSimpleBlock, mkvBlock:
+		default:
+			if _, err := br.Discard(int(size)); err != nil {
+				return err
+			}
+			continue
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(br, data); err != nil {
+			return err
+		}
+
+		switch id {
+		case mkvTrackNumber:
+			for _, b := range data {
+				num = num<<8 | uint64(b)
+			}
+			if current != nil {
+				tracks[num] = current
+			}
+		case mkvName:
+			if current != nil {
+				current.name = string(data)
+			}
+		case mkvSamplingFreq:
+			if current != nil && len(data) == 4 {
+				current.rate = float64(math.Float32frombits(binary.BigEndian.Uint32(data)))
+			} else if current != nil && len(data) == 8 {
+				current.rate = math.Float64frombits(binary.BigEndian.Uint64(data))
+			}
+		case mkvSimpleBlock, mkvBlock:
+			// Block: track number (vint), timecode (int16), flags, frame data.
+			n, _, err := readVint(bytes.NewReader(data), false)
+			if err != nil {
+				continue
+			}
+			t, ok := tracks[n]
+			hdr := bits.LeadingZeros8(data[0]) + 1 + 3
+			if !ok || out[t.name] == nil || len(data) < hdr {
+				continue
+			}
+			pcm := data[hdr:]
+			samples := make([]int16, len(pcm)/2)
+			for i := range samples {
+				samples[i] = int16(binary.LittleEndian.Uint16(pcm[2*i:]))
+			}
+			var buf []byte
+			switch t.rate {
+			case 8000:
+				buf = appendUpsampled2x(nil, samples)
+			case sampleRateHz:
+				buf = pcm[:2*len(samples)]
+			default:
+				return fmt.Errorf("mkv: track %s: unsupported sample rate %v", t.name, t.rate)
+			}
+			chunk := newLiveChunk(buf, t.tsMs)
+			t.tsMs += pcmDuration(len(buf)).Milliseconds()
+			select {
+			case out[t.name] <- chunk:
+			case <-ctx.Done():
+				chunk.Release()
+				return ctx.Err()
+			}
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+/*
+Learning note: Audio-to-transcript latency
+==========================================
+
+What a user of live captions notices is how long after they said a word it
+shows up. The server sees the two ends of that: when a chunk of audio
+arrived from the client, and when the first piece of transcript covering it
+came back from Transcribe, partial or final. Every chunk that arrives live
+(newLiveChunk) is stamped with its arrival; the sender of a Transcribe
+stream remembers, for the audio it sent, where in the stream each chunk
+ends, and the receiver matches the end of every piece against that:
+
+	chunk arrives     sent to AWS      piece ending in it arrives
+	     |----------------|--------------------------|
+	     |<------------ audio latency -------------->|
+	                      |<-- transcript latency -->|
+
+Each chunk is counted once, by the first piece reaching into it, in the
+gochannels_audio_latency_seconds summary of GET /metrics (see metrics.go),
+with the p50, p95 and p99 of the last latencyWindow chunks; a piece's own
+latency, that of the chunk its end falls in, is in the receiver's debug line
+(see -log-level in logging.go).
+
+Arrival is measured on the server's clock: the client's capture timestamps
+(?framing=seq) come from a clock the server cannot compare with its own.
+Audio read from files (uploads, replays) has no arrival and is not counted.
+*/
+
+// sendClockMarks is how many sends a sendClock remembers: a minute of
+// audio, far more than Transcribe takes to answer.
+const sendClockMarks = 60 * 1000 / chunkMs
+
+// sendClock remembers the audio sent on a Transcribe stream, so pieces can
+// be matched to the chunks they cover (see the note above). It is safe for
+// concurrent use.
+type sendClock struct {
+	mu      sync.Mutex
+	bytes   int        // sent so far
+	marks   []sendMark // oldest first
+	covered int64      // end of the audio a piece reached into so far, in ms
+}
+
+// sendMark is a chunk sent: where its audio lies in the stream, in
+// milliseconds, when it arrived from the client (zero if it did not) and
+// when it went to Transcribe.
+type sendMark struct {
+	startMs, endMs int64
+	received       time.Time
+	sent           time.Time
+}
+
+// sent records that ch went out.
+func (c *sendClock) sent(ch AudioChunk) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	startMs := pcmDuration(c.bytes).Milliseconds()
+	c.bytes += len(ch.PCM)
+	if len(c.marks) == sendClockMarks {
+		c.marks = c.marks[1:]
+	}
+	c.marks = append(c.marks, sendMark{startMs: startMs, endMs: pcmDuration(c.bytes).Milliseconds(), received: ch.Received, sent: time.Now()})
+}
+
+// find returns the index of the mark holding the audio at ms, and false if
+// it was not sent yet or is forgotten.
+func (c *sendClock) find(ms int64) (int, bool) {
+	i, _ := slices.BinarySearchFunc(c.marks, ms, func(m sendMark, ms int64) int {
+		return cmp.Compare(m.endMs, ms)
+	})
+	return i, i < len(c.marks) && c.marks[i].startMs <= ms
+}
+
+// cover records a piece ending at endMs. It calls observe with the audio
+// latency of every chunk the piece is the first to reach into, and returns
+// the latency of the chunk its end falls in, since that arrived (the audio
+// latency) and since it was sent (the transcript latency); ok is false if
+// there is none.
+func (c *sendClock) cover(endMs int64, observe func(time.Duration)) (audio, transcript time.Duration, ok bool) {
+	if endMs <= 0 {
+		return 0, 0, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for _, m := range c.marks {
+		if m.startMs >= endMs {
+			break
+		}
+		if m.startMs >= c.covered && !m.received.IsZero() {
+			observe(now.Sub(m.received))
+		}
+	}
+	c.covered = max(c.covered, endMs)
+	i, ok := c.find(endMs)
+	if !ok {
+		return 0, 0, false
+	}
+	m := c.marks[i]
+	if !m.received.IsZero() {
+		audio = now.Sub(m.received)
+	}
+	return audio, now.Sub(m.sent), true
+}
+
+// latencyWindow is how many recent observations a quantileWindow computes
+// its quantiles from.
+const latencyWindow = 1024
+
+// latencyQuantiles are the quantiles of gochannels_audio_latency_seconds.
+var latencyQuantiles = []float64{0.5, 0.95, 0.99}
+
+// quantileWindow is a Prometheus summary: quantiles of the last
+// latencyWindow observations, and the sum and count of all of them. It is
+// safe for concurrent use.
+type quantileWindow struct {
+	mu     sync.Mutex
+	recent []float64 // ring of the last latencyWindow observations, in seconds
+	next   int       // where the next one goes once recent is full
+	sum    float64
+	count  int64
+}
+
+// observe records d.
+func (q *quantileWindow) observe(d time.Duration) {
+	v := d.Seconds()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.recent) < latencyWindow {
+		q.recent = append(q.recent, v)
+	} else {
+		q.recent[q.next] = v
+		q.next = (q.next + 1) % latencyWindow
+	}
+	q.sum += v
+	q.count++
+}
+
+// writeTo writes the summary as name.
+func (q *quantileWindow) writeTo(w *bufio.Writer, name, help string) {
+	q.mu.Lock()
+	sorted := slices.Sorted(slices.Values(q.recent))
+	sum, count := q.sum, q.count
+	q.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s summary\n", name, help, name)
+	for _, quantile := range latencyQuantiles {
+		v := 0.0
+		if len(sorted) > 0 {
+			v = sorted[min(int(quantile*float64(len(sorted))), len(sorted)-1)]
+		}
+		fmt.Fprintf(w, "%s{quantile=%q} %s\n", name, formatValue(quantile), formatValue(v))
+	}
+	fmt.Fprintf(w, "%s_sum %s\n%s_count %d\n", name, formatValue(sum), name, count)
+}
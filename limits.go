@@ -0,0 +1,399 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// closeReason explains why the server ended a session on its own initiative.
+// Code is a stable machine-readable identifier, Message is for humans.
+type closeReason struct {
+	Code    string
+	Message string
+}
+
+// ClosingEvent is the last message written before the server closes the
+// WebSocket on its own initiative, e.g. because a session limit was reached.
+// Build it with closeReason.event.
+type ClosingEvent struct {
+	Type      string `json:"type"`
+	Reason    string `json:"reason"`
+	Message   string `json:"message"`
+	CloseCode int    `json:"close_code"`      // of the close frame that follows
+	Error     string `json:"error,omitempty"` // the kind of failure, see errors.go
+	Retryable bool   `json:"retryable"`
+}
+
+func (e ClosingEvent) EventType() string { return e.Type }
+
+// sessionRetryAfter is the Retry-After sent with a 503 when the server is
+// running its maximum number of sessions.
+const sessionRetryAfter = 5 * time.Second
+
+// rejectTooManySessions answers a request that would start a session beyond
+// the -max-sessions limit: 503 with a Retry-After header and a JSON body in
+// the shape of a closing event, for clients that parse either.
+func rejectTooManySessions(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(sessionRetryAfter.Seconds())))
+	writeErrorBody(w, http.StatusServiceUnavailable, errorBody{Reason: "too_many_sessions", Message: errTooManySessions.Error(), Retryable: true})
+}
+
+// maxControlBytes is the largest text frame (a control message) a client may
+// send.
+const maxControlBytes = 8 << 10
+
+const (
+	// frameHeaderSlack is room on top of cfg.MaxFrameBytes for the headers of
+	// sequenced, enveloped and multiplexed frames.
+	frameHeaderSlack = 1 << 10
+	// maxReadBytes bounds frames when -max-frame-bytes is 0.
+	maxReadBytes = 1 << 20
+)
+
+// readLimit is the largest message the WebSocket reader of an audio
+// connection accepts at all. gorilla's ReadMessage buffers a whole message
+// before frameValidator sees its size, so without it a client could make the
+// server hold a frame of any size; a message beyond it fails the read (and
+// gorilla closes the connection with 1009) while still on the wire. Frames
+// between cfg.MaxFrameBytes and the limit are read, and then rejected with
+// "frame_too_large" by the validator.
+func readLimit(cfg Config) int64 {
+	n := cfg.MaxFrameBytes
+	if n <= 0 {
+		n = maxReadBytes
+	}
+	return int64(max(n+frameHeaderSlack, maxControlBytes))
+}
+
+// frameTooLarge is the reason a session ends on a frame beyond readLimit.
+func frameTooLarge(cfg Config) closeReason {
+	return closeReason{
+		Code:    "frame_too_large",
+		Message: fmt.Sprintf("frame exceeds the limit of %d bytes", readLimit(cfg)),
+	}
+}
+
+// rateBurst is how much audio a client may send ahead of real time (times
+// the rate factor) before the rate check kicks in, so start-up bursts and
+// network jitter are not punished. A client that goes over it is asked to
+// back off; one that runs up another rateBurst of debt is disconnected.
+const rateBurst = 2 * time.Second
+
+// BackoffEvent asks the client to pause sending audio: it is ahead of the
+// allowed rate and would be disconnected if it kept going. RetryAfterMs is
+// how long until it is within the limit again.
+type BackoffEvent struct {
+	Type         string `json:"type"`
+	RetryAfterMs int64  `json:"retry_after_ms"`
+	Message      string `json:"message"`
+}
+
+func (e BackoffEvent) EventType() string { return e.Type }
+
+// frameValidator checks inbound binary frames against the configured maximum
+// frame size and the maximum byte rate. Clients streaming live audio send at
+// roughly real time; anything much faster is a file dump or abuse and would
+// only burn AWS quota. The rate is enforced with a token bucket measured in
+// audio time: it refills at rateFactor seconds of audio per second and holds
+// at most rateBurst times rateFactor. It is used by a single reader goroutine.
+type frameValidator struct {
+	maxFrame   int
+	rateFactor float64
+	sampleSize int // bytes per sample of the input format
+
+	last    time.Time     // arrival of the previous frame
+	tokens  time.Duration // audio the client may still send; negative when in debt
+	backoff bool          // a backoff was signaled for the current debt
+	pending time.Duration // backoff to report, see backoffDue
+}
+
+// newFrameValidator returns a validator for input with samples of sampleSize
+// bytes. Compressed formats (sampleSize 0) are measured as if they were
+// s16le, which is lenient since they are much smaller.
+func newFrameValidator(cfg Config, sampleSize int) *frameValidator {
+	if sampleSize <= 0 {
+		sampleSize = bytesPerSample
+	}
+	return &frameValidator{maxFrame: cfg.MaxFrameBytes, rateFactor: cfg.MaxRateFactor, sampleSize: sampleSize}
+}
+
+// check validates a frame of n bytes received at now. It returns false along
+// with the reason when the frame must be rejected.
+func (v *frameValidator) check(n int, now time.Time) (closeReason, bool) {
+	if v.maxFrame > 0 && n > v.maxFrame {
+		return closeReason{
+			Code:    "frame_too_large",
+			Message: fmt.Sprintf("audio frame of %d bytes exceeds the limit of %d bytes", n, v.maxFrame),
+		}, false
+	}
+	if v.rateFactor <= 0 {
+		return closeReason{}, true
+	}
+
+	capacity := time.Duration(float64(rateBurst) * v.rateFactor)
+	if v.last.IsZero() {
+		v.tokens = capacity
+	} else {
+		v.tokens = min(v.tokens+time.Duration(float64(now.Sub(v.last))*v.rateFactor), capacity)
+	}
+	v.last = now
+	// Wider input formats carry the same audio in more bytes.
+	v.tokens -= pcmDuration(n * bytesPerSample / v.sampleSize)
+
+	switch {
+	case v.tokens < -capacity:
+		return closeReason{
+			Code:    "rate_exceeded",
+			Message: fmt.Sprintf("audio is arriving faster than %.1fx real time", v.rateFactor),
+		}, false
+	case v.tokens < 0 && !v.backoff:
+		v.backoff = true
+		v.pending = max(time.Duration(float64(-v.tokens)/v.rateFactor), time.Millisecond)
+	case v.tokens >= 0:
+		v.backoff = false
+	}
+	return closeReason{}, true
+}
+
+// backoffDue returns the backoff event to send after the last check, if any.
+func (v *frameValidator) backoffDue() (BackoffEvent, bool) {
+	if v.pending == 0 {
+		return BackoffEvent{}, false
+	}
+	wait := v.pending.Round(time.Millisecond)
+	v.pending = 0
+	return BackoffEvent{
+		Type:         "backoff",
+		RetryAfterMs: wait.Milliseconds(),
+		Message:      fmt.Sprintf("audio is arriving faster than %.1fx real time; pause for %s", v.rateFactor, wait),
+	}, true
+}
+
+// sessionBudget is what a session may use: audio time and its estimated
+// cost at pricePerMinute. Zero limits are unlimited.
+type sessionBudget struct {
+	maxAudio       time.Duration
+	maxCost        float64       // USD
+	pricePerMinute float64       // USD per minute of audio
+	quota          time.Duration // left of the tenant's minute quotas, see quota.go
+}
+
+// budgetFor returns the budget of a session of an API key with entitlements
+// e; entitlements that are zero fall back to cfg.
+func budgetFor(cfg Config, e Entitlements) sessionBudget {
+	b := sessionBudget{maxAudio: cfg.MaxAudioDuration, maxCost: cfg.SessionMaxCost, pricePerMinute: cfg.PricePerMinute}
+	if e.MaxAudioMinutes > 0 {
+		b.maxAudio = time.Duration(e.MaxAudioMinutes * float64(time.Minute))
+	}
+	if e.MaxCostUSD > 0 {
+		b.maxCost = e.MaxCostUSD
+	}
+	return b
+}
+
+// withQuota returns the budget further limited to the audio a tenant has
+// left (see tenantAdmission); zero leaves it as it is.
+func (b sessionBudget) withQuota(remaining time.Duration) sessionBudget {
+	b.quota = remaining
+	return b
+}
+
+// limit returns how much audio the budget allows, and the reason given when
+// a session goes beyond it. Zero means unlimited.
+func (b sessionBudget) limit() (time.Duration, closeReason) {
+	max, reason := b.maxAudio, closeReason{
+		Code:    "max_duration",
+		Message: fmt.Sprintf("session reached the maximum audio duration of %s", b.maxAudio),
+	}
+	if b.maxCost > 0 && b.pricePerMinute > 0 {
+		affordable := time.Duration(b.maxCost / b.pricePerMinute * float64(time.Minute))
+		if max == 0 || affordable < max {
+			max, reason = affordable, closeReason{
+				Code:    "budget_exceeded",
+				Message: fmt.Sprintf("session reached its budget of $%.2f (%s of audio at $%.4f/min)", b.maxCost, affordable.Round(time.Second), b.pricePerMinute),
+			}
+		}
+	}
+	if b.quota > 0 && (max == 0 || b.quota < max) {
+		max, reason = b.quota, closeReason{
+			Code:    "tenant_quota_exceeded",
+			Message: fmt.Sprintf("the tenant used up its quota of audio minutes (%s left when the session started)", b.quota.Round(time.Second)),
+		}
+	}
+	return max, reason
+}
+
+// capAudioDuration is a pipeline stage that forwards audio until the
+// budget's worth of PCM has passed through. At that point it sends a Final
+// chunk, so the Transcribe stream is finalized and the remaining transcript
+// is flushed, and calls onLimit once. Any audio arriving afterwards is
+// released and dropped.
+func capAudioDuration(ctx context.Context, in <-chan AudioChunk, budget sessionBudget, onLimit func(closeReason)) <-chan AudioChunk {
+	max, reason := budget.limit()
+	out := make(chan AudioChunk, cap(in))
+
+	go func() {
+		defer close(out)
+		var (
+			total   int
+			reached bool
+		)
+		for ch := range in {
+			if reached {
+				ch.Release()
+				continue
+			}
+
+			total += len(ch.PCM)
+			if max > 0 && pcmDuration(total) > max {
+				reached = true
+				ch.Release()
+				loggerFrom(ctx).Info("limits: audio budget reached; finalizing", slog.String("reason", reason.Code), slog.Duration("max", max), slog.Int64("ts_ms", ch.TsMs))
+				onLimit(reason)
+				ch = AudioChunk{Final: true, TsMs: ch.TsMs}
+			}
+
+			select {
+			case out <- ch:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out
+}
+
+// endIdleAudio is a pipeline stage that forwards audio and ends the session
+// once no chunk arrived for timeout: it sends a Final chunk, so Transcribe
+// flushes the rest of the transcript and the stream is closed instead of
+// leaking until AWS times it out, and calls onIdle once. Any audio arriving
+// afterwards is released and dropped. Time spent paused (paused may be nil)
+// does not count. A timeout of zero disables the check.
+func endIdleAudio(ctx context.Context, in <-chan AudioChunk, timeout time.Duration, paused *atomic.Bool, onIdle func(closeReason)) <-chan AudioChunk {
+	if timeout <= 0 {
+		return in
+	}
+	out := make(chan AudioChunk, cap(in))
+
+	go func() {
+		defer close(out)
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		var (
+			tsMs  int64
+			ended bool // a Final chunk went out
+		)
+		send := func(ch AudioChunk) bool {
+			select {
+			case out <- ch:
+				return true
+			case <-ctx.Done():
+				ch.Release()
+				return false
+			}
+		}
+		for {
+			var idle <-chan time.Time
+			if !ended {
+				idle = timer.C
+			}
+			select {
+			case ch, ok := <-in:
+				if !ok {
+					return
+				}
+				if ended {
+					ch.Release()
+					continue
+				}
+				tsMs, ended = ch.TsMs, ch.Final
+				timer.Reset(timeout)
+				if !send(ch) {
+					return
+				}
+			case <-idle:
+				if paused != nil && paused.Load() {
+					timer.Reset(timeout)
+					continue
+				}
+				ended = true
+				loggerFrom(ctx).Info("limits: no audio received; finalizing", slog.Duration("timeout", timeout), slog.Int64("ts_ms", tsMs))
+				onIdle(closeReason{
+					Code:    "idle_timeout",
+					Message: fmt.Sprintf("no audio received for %s", timeout),
+				})
+				if !send(AudioChunk{Final: true, TsMs: tsMs}) {
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out
+}
+
+// capSessionDuration is a pipeline stage that ends the session once it has
+// run for cfg.MaxSessionDuration of wall-clock time, the way capAudioDuration
+// does for audio time: a Final chunk, onLimit once, and any later audio
+// dropped. Sessions that roll over (cfg.Rollover) are not capped.
+func capSessionDuration(ctx context.Context, in <-chan AudioChunk, cfg Config, onLimit func(closeReason)) <-chan AudioChunk {
+	max := cfg.MaxSessionDuration
+	if max <= 0 || cfg.Rollover {
+		return in
+	}
+	out := make(chan AudioChunk, cap(in))
+
+	go func() {
+		defer close(out)
+		deadline := time.NewTimer(max)
+		defer deadline.Stop()
+		var (
+			tsMs    int64
+			reached bool
+		)
+		for {
+			var expired <-chan time.Time
+			if !reached {
+				expired = deadline.C
+			}
+			var ch AudioChunk
+			select {
+			case next, ok := <-in:
+				if !ok {
+					return
+				}
+				if reached {
+					next.Release()
+					continue
+				}
+				ch, tsMs, reached = next, next.TsMs, next.Final
+			case <-expired:
+				reached = true
+				loggerFrom(ctx).Info("limits: max session duration reached; finalizing", slog.Duration("max", max), slog.Int64("ts_ms", tsMs))
+				onLimit(closeReason{
+					Code:    "max_session_duration",
+					Message: fmt.Sprintf("session reached the maximum duration of %s", max),
+				})
+				ch = AudioChunk{Final: true, TsMs: tsMs}
+			case <-ctx.Done():
+				return
+			}
+
+			select {
+			case out <- ch:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+)
+
+/*
+Learning note: Session-scoped logging
+=====================================
+
+A server with twenty sessions interleaves the lines of twenty readers,
+twenty writers and forty Transcribe goroutines in one log. Adding the
+session to every call by hand is easy to forget, and impossible in code that
+does not know which session it runs for: a pipeline stage only has its
+channels and a context.
+
+So a session gets a *slog.Logger of its own as soon as its connection is
+accepted, before the upgrade, with its ID (generated there, and told to the
+client later), the client's address and the tenant:
+
+	level=INFO msg="ws-reader: paused" session=9f2c... remote=10.0.0.7:51234 tenant=acme
+
+and the logger travels in the session's context. Code that runs for a
+session logs through loggerFrom(ctx); where the context carries no logger
+(start-up, background jobs, other transports) that is slog.Default(), so
+nothing changes there.
+
+Levels and formats
+------------------
+
+-log-level (or LOG_LEVEL) sets the least severe level logged, info by
+default; debug shows every chunk and piece, which is a lot. -log-format (or
+LOG_FORMAT) is text, logfmt-like lines for people, or json, a document per
+line for log collectors.
+
+The level can be changed while the server runs, without losing its
+sessions, by an admin (see admin.go):
+
+	curl -X PUT -H "Authorization: Bearer $TOKEN" localhost:8080/log-level?level=debug
+	{"level":"DEBUG"}
+
+GET /log-level answers the level in force. A restart goes back to the one
+configured.
+*/
+
+// The values of -log-format.
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// logLevel is the level in force; PUT /log-level changes it.
+var logLevel = new(slog.LevelVar)
+
+// setupLogging makes the default logger log at level and up in format, to
+// standard error.
+func setupLogging(level slog.Level, format string) error {
+	logLevel.Set(level)
+	opts := &slog.HandlerOptions{Level: logLevel}
+	var h slog.Handler
+	switch format {
+	case logFormatText:
+		h = slog.NewTextHandler(os.Stderr, opts)
+	case logFormatJSON:
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("unknown log format %q (want %s or %s)", format, logFormatText, logFormatJSON)
+	}
+	slog.SetDefault(slog.New(h))
+	return nil
+}
+
+// LogLevelEndpoint serves GET and PUT /log-level (see the note above).
+func LogLevelEndpoint() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			var level slog.Level
+			if err := level.UnmarshalText([]byte(r.URL.Query().Get("level"))); err != nil {
+				http.Error(w, "invalid level: want debug, info, warn or error", http.StatusBadRequest)
+				return
+			}
+			if old := logLevel.Level(); old != level {
+				logLevel.Set(level)
+				slog.Warn("log: level changed", slog.String("from", old.String()), slog.String("to", level.String()))
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]string{"level": logLevel.Level().String()})
+	}
+}
+
+// loggerKey is the context key of the logger of a session.
+type loggerKey struct{}
+
+// sessionLogger returns the logger of session id, started by a client at
+// remote with an API key of tenant. Empty ones are left out.
+func sessionLogger(id, remote, tenant string) *slog.Logger {
+	var attrs []any
+	if id != "" {
+		attrs = append(attrs, slog.String("session", id))
+	}
+	attrs = append(attrs, slog.String("remote", remote))
+	if tenant != "" {
+		attrs = append(attrs, slog.String("tenant", tenant))
+	}
+	return slog.With(attrs...)
+}
+
+// withLogger returns a copy of ctx carrying log.
+func withLogger(ctx context.Context, log *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, log)
+}
+
+// loggerFrom returns the logger ctx carries, or slog.Default().
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if log, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return log
+	}
+	return slog.Default()
+}
@@ -5,42 +5,305 @@ import (
 	"log"
 	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/config"
 
 	transcribe "github.com/aws/aws-sdk-go-v2/service/transcribestreaming"
 )
 
+// shutdownGrace is how long the server waits for running sessions to close
+// after a shutdown signal.
+const shutdownGrace = 5 * time.Second
+
 func main() {
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	cfg := loadConfig()
+	if err := setupLogging(cfg.LogLevel, cfg.LogFormat); err != nil {
+		log.Fatalf("log: %v", err)
+	}
 
-	cfg, err := config.LoadDefaultConfig(ctx, config.WithSharedConfigProfile("CaylentDev"), config.WithRegion("us-east-1"))
+	// The server context is canceled with errServerShutdown on SIGINT/SIGTERM;
+	// request contexts derive from it (BaseContext), so running sessions learn
+	// why they end and close with "server_shutdown".
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		s := <-sig
+		slog.Info("http: shutting down", slog.String("signal", s.String()))
+		cancel(errServerShutdown)
+	}()
+
+	awsCfg, err := config.LoadDefaultConfig(ctx, config.WithSharedConfigProfile(cfg.AWSProfile), config.WithRegion(cfg.AWSRegion))
 	if err != nil {
 		slog.Error("aws cfg load failed", slog.String("error", err.Error()))
 		log.Fatalf("aws cfg: %v", err)
 	}
 
-	client := transcribe.NewFromConfig(cfg)
+	// The warm pool counts the silence it sends in the usage (see warm.go).
+	if cfg.Usage, err = NewUsageMeter(ctx, cfg.UsageFile, cfg.UsageFlushInterval); err != nil {
+		log.Fatalf("%v", err)
+	}
+	client := NewTranscribeClient(ctx, sdkTranscribeAPI{client: transcribe.NewFromConfig(awsCfg)}, cfg)
+	if cfg.APIKeysFile != "" {
+		if cfg.APIKeys, err = LoadAPIKeys(cfg.APIKeysFile); err != nil {
+			log.Fatalf("%v", err)
+		}
+	}
+
+	var sinks transcriptSinks
+	if cfg.MQTTBroker != "" {
+		mqtt, err := NewMQTTSink(ctx, cfg.MQTTBroker, cfg.MQTTTopic)
+		if err != nil {
+			log.Fatalf("mqtt: %v", err)
+		}
+		sinks = append(sinks, mqtt)
+	}
+	if cfg.RedisURL != "" {
+		redis, err := NewRedisSink(ctx, cfg.RedisURL, cfg.RedisChannel)
+		if err != nil {
+			log.Fatalf("redis: %v", err)
+		}
+		sinks = append(sinks, redis)
+	}
+	if cfg.NATSURL != "" {
+		nats, err := NewNATSSink(ctx, cfg.NATSURL, cfg.NATSSubject)
+		if err != nil {
+			log.Fatalf("nats: %v", err)
+		}
+		sinks = append(sinks, nats)
+	}
+	hub := newTranscriptHub()
+	sinks = append(sinks, hub)
+	store := NewTranscriptStore()
+	sinks = append(sinks, store)
+	observers := []SessionObserver{hub, store}
+	var dlStores deadLetterStores
+	if cfg.DeadLetterDir != "" {
+		dir, err := newDeadLetterDir(cfg.DeadLetterDir)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		dlStores = append(dlStores, dir)
+	}
+	if cfg.DeadLetterQueueURL != "" {
+		dlStores = append(dlStores, newDeadLetterQueue(awsCfg, cfg.DeadLetterQueueURL))
+	}
+	if len(dlStores) > 0 {
+		cfg.DeadLetters = dlStores
+	}
+	if cfg.SQSQueueURL != "" || cfg.SNSTopicARN != "" {
+		notifier := NewAWSNotifier(ctx, awsCfg, cfg.SQSQueueURL, cfg.SNSTopicARN)
+		sinks = append(sinks, notifier)
+		observers = append(observers, notifier)
+	}
+
+	if len(sessionHooks) > 0 {
+		hooks := newHookRunner(sessionHooks)
+		sinks = append(sinks, hooks)
+		observers = append(observers, hooks)
+	}
+
+	var history *DynamoSessionStore
+	if cfg.DynamoDBTable != "" {
+		if history, err = NewDynamoSessionStore(ctx, awsCfg, cfg.DynamoDBTable, cfg.AdvertiseURL, cfg.DynamoDBTranscriptURL); err != nil {
+			log.Fatalf("dynamodb: %v", err)
+		}
+		observers = append(observers, history)
+	}
+
+	if cfg.AuditLog != "" {
+		audit, err := NewAuditLog(cfg.AuditLog, configuredSinks(cfg))
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		defer audit.Close()
+		observers = append(observers, audit)
+	}
+
+	if cfg.RecordDir != "" {
+		if cfg.Recorder, err = NewRecorder(cfg.RecordDir, cfg.CheckpointInterval); err != nil {
+			log.Fatalf("%v", err)
+		}
+		observers = append(observers, cfg.Recorder)
+	}
+
+	observers = append(observers, cfg.Usage)
+	quotas := NewTenantQuotas(cfg.Usage, cfg)
+
+	// Sinks that publish summaries get them once a session's pieces are out.
+	observers = append(observers, summaryPublisher{sink: sinks})
+	// metrics counts the sessions for GET /metrics (see metrics.go).
+	observers = append(observers, metrics)
+
+	var state *RedisState
+	if cfg.StateRedisURL != "" {
+		state, err = NewRedisState(ctx, cfg.StateRedisURL, cfg.AdvertiseURL, cfg.ClusterMaxSessions)
+		if err != nil {
+			log.Fatalf("redis-state: %v", err)
+		}
+		observers = append(observers, state)
+	}
+
+	sessions := NewSessionRegistry(cfg.MaxSessions, observers...)
+	if state != nil {
+		sessions.ShareLimit(state)
+	}
+	sessions.LimitTenants(quotas)
+	sessions.SetQoS(cfg.QoSRealtimeReserve, cfg.QoSBestEffortLoad)
+	sessions.SetPrice(cfg.PricePerMinute)
+	jobs := NewJobStore(ctx, client, cfg, sessions, sinks)
+	if cfg.Recorder != nil {
+		cfg.Recorder.Recover(jobs)
+	}
 
+	// The per-session routes are the admin's, or the owning tenant's.
+	owners := sessionOwners(sessions, store, cfg.Recorder)
 	mux := http.NewServeMux()
-	mux.HandleFunc("/ws", StreamAudioEndpoint(client))
+	if state != nil {
+		mux.Handle("/ws", state.ResumeProxy(StreamAudioEndpoint(ctx, client, cfg, sessions, sinks)))
+		mux.HandleFunc("GET /cluster/sessions", requireAdmin(cfg.AdminToken, ClusterSessionsEndpoint(state)))
+	} else {
+		mux.HandleFunc("/ws", StreamAudioEndpoint(ctx, client, cfg, sessions, sinks))
+	}
+	var probe *transcribeProbe
+	if cfg.ReadyProbe {
+		probe = newTranscribeProbe(awsCfg.Region)
+	}
+	mux.HandleFunc("GET /healthz", HealthzEndpoint())
+	mux.HandleFunc("GET /readyz", ReadyzEndpoint(ctx, awsCfg, client, sessions, probe))
+	mux.HandleFunc("GET /metrics", MetricsEndpoint(sessions))
+	mux.HandleFunc("POST /transcribe", TranscribeEndpoint(client, cfg, sessions, sinks))
+	mux.HandleFunc("GET /sessions", requireAdmin(cfg.AdminToken, SessionsEndpoint(sessions)))
+	mux.HandleFunc("GET /sessions/{id}", requireAdmin(cfg.AdminToken, SessionEndpoint(sessions, history)))
+	if history != nil {
+		mux.HandleFunc("GET /sessions/history", requireAdmin(cfg.AdminToken, SessionHistoryEndpoint(history)))
+	}
+	mux.HandleFunc("DELETE /sessions/{id}", requireAdmin(cfg.AdminToken, KillSessionEndpoint(sessions)))
+	mux.HandleFunc("GET /log-level", requireAdmin(cfg.AdminToken, LogLevelEndpoint()))
+	mux.HandleFunc("PUT /log-level", requireAdmin(cfg.AdminToken, LogLevelEndpoint()))
+	mux.HandleFunc("GET /usage", requireAdmin(cfg.AdminToken, UsageEndpoint(cfg.Usage, cfg.PricePerMinute)))
+	if cfg.Recorder != nil {
+		mux.HandleFunc("POST /sessions/{id}/replay", requireAdmin(cfg.AdminToken, ReplaySessionEndpoint(cfg.Recorder, jobs)))
+		mux.HandleFunc("GET /sessions/{id}/replays", requireSessionAccess(cfg.AdminToken, cfg.APIKeys, owners, SessionReplaysEndpoint(cfg.Recorder)))
+	}
+	mux.HandleFunc("GET /sessions/{id}/stats", requireSessionAccess(cfg.AdminToken, cfg.APIKeys, owners, SessionStatsEndpoint(sessions)))
+	mux.HandleFunc("GET /sessions/{id}/watch", requireSessionAccess(cfg.AdminToken, cfg.APIKeys, owners, SessionWatchEndpoint(cfg, sessions, hub)))
+	mux.HandleFunc("GET /sessions/{id}/transcripts", requireSessionAccess(cfg.AdminToken, cfg.APIKeys, owners, TranscriptPollEndpoint(store)))
+	mux.HandleFunc("GET /sessions/{id}/transcript.jsonl", requireSessionAccess(cfg.AdminToken, cfg.APIKeys, owners, TranscriptDownloadEndpoint(store)))
+	mux.HandleFunc("GET /sessions/{id}/captions.vtt", requireSessionAccess(cfg.AdminToken, cfg.APIKeys, owners, CaptionsEndpoint(store)))
+	mux.HandleFunc("POST /upload", UploadEndpoint(jobs, cfg))
+	mux.HandleFunc("GET /jobs/{id}", requireJobAccess(cfg.AdminToken, cfg.APIKeys, jobs, JobEndpoint(jobs)))
+	mux.HandleFunc("GET /jobs/{id}/transcript", requireJobAccess(cfg.AdminToken, cfg.APIKeys, jobs, JobTranscriptEndpoint(jobs)))
+	dialer := NewDialSource(client, cfg, jobs, sessions)
+	mux.HandleFunc("POST /sources/dial", DialSourceEndpoint(ctx, dialer))
+	mux.HandleFunc("GET /sources/dial", DialSourcesEndpoint(dialer))
+	mux.HandleFunc("DELETE /sources/dial/{id}", StopDialSourceEndpoint(dialer))
+	// Any stream of the server's AWS account can be read through KVS, so only
+	// the admin may.
+	mux.HandleFunc("POST /sources/kvs", requireAdmin(cfg.AdminToken, KVSSourceEndpoint(ctx, NewKVSSource(awsCfg, client, cfg, jobs, sessions))))
+	mux.HandleFunc("/graphql", GraphQLEndpoint(NewGraphQLAPI(cfg, sessions, jobs, hub)))
+	mux.HandleFunc("GET /graphql/schema", GraphQLSchemaEndpoint())
 	mux.HandleFunc("/", ServeIndexPage())
 	mux.HandleFunc("/audio.mp3", func(w http.ResponseWriter, r *http.Request) {
 		http.ServeFile(w, r, "darling-hold-my-hand.mp3")
 	})
 
-	server := &http.Server{Addr: ":8080", Handler: mux}
+	if cfg.RTPAddr != "" {
+		go func() {
+			if err := ServeRTP(ctx, cfg.RTPAddr, client, cfg, jobs, sessions); err != nil {
+				slog.Error("rtp: listener stopped", slog.String("error", err.Error()))
+			}
+		}()
+	}
+
+	if cfg.RTMPAddr != "" {
+		go func() {
+			if err := ServeRTMP(ctx, cfg.RTMPAddr, client, cfg, jobs, sessions); err != nil {
+				slog.Error("rtmp: listener stopped", slog.String("error", err.Error()))
+			}
+		}()
+	}
+
+	if cfg.SIPRECAddr != "" {
+		go func() {
+			if err := ServeSIPREC(ctx, cfg.SIPRECAddr, client, cfg, jobs, sessions); err != nil {
+				slog.Error("siprec: server stopped", slog.String("error", err.Error()))
+			}
+		}()
+	}
+
+	if cfg.NATSURL != "" && cfg.NATSAudioSubject != "" {
+		go func() {
+			if err := ServeNATSAudio(ctx, cfg.NATSURL, cfg.NATSAudioSubject, client, cfg, jobs, sessions); err != nil {
+				slog.Error("nats: audio consumer stopped", slog.String("error", err.Error()))
+			}
+		}()
+	}
+
+	if cfg.DebugAddr != "" {
+		go func() {
+			if err := ServeDebug(ctx, cfg.DebugAddr, sessions); err != nil {
+				slog.Error("debug: server stopped", slog.String("error", err.Error()))
+			}
+		}()
+	}
 
+	if cfg.DialURL != "" {
+		// The operator's stream may be on a private address (see dial.go).
+		dialer.manage(context.WithValue(ctx, trustedDialKey{}, true), DialRequest{URL: cfg.DialURL, Format: cfg.DialFormat}, Entitlements{})
+	}
+
+	server := newServer(ctx, cfg, mux)
+	if cfg.tlsEnabled() {
+		if err := configureTLS(ctx, cfg, server); err != nil {
+			log.Fatalf("tls: %v", err)
+		}
+	}
+
+	if cfg.WebTransportAddr != "" {
+		if server.TLSConfig == nil {
+			log.Fatalf("wt: -webtransport-addr requires -tls-cert or -autocert-domains")
+		}
+		go func() {
+			if err := ServeWebTransport(ctx, cfg, server.TLSConfig, client, sessions, sinks); err != nil {
+				slog.Error("wt: server stopped", slog.String("error", err.Error()))
+			}
+		}()
+	}
+
+	listeners, err := listen(cfg.Addr)
+	if err != nil {
+		log.Fatalf("http: %v", err)
+	}
 	go func() {
-		slog.Info("http: server start", slog.String("addr", server.Addr))
 		<-ctx.Done()
 		_ = server.Close()
 	}()
 
-	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		slog.Error("http: server error", slog.String("error", err.Error()))
-		panic(err)
+	var wg sync.WaitGroup
+	for _, ln := range listeners {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			slog.Info("http: server start", slog.String("addr", ln.Addr().String()), slog.String("network", ln.Addr().Network()),
+				slog.Bool("tls", servesTLS(server, ln)), slog.Bool("h2c", cfg.H2C))
+			if err := serveListener(server, ln); err != nil && err != http.ErrServerClosed {
+				slog.Error("http: server error", slog.String("addr", ln.Addr().String()), slog.String("error", err.Error()))
+				panic(err)
+			}
+		}()
+	}
+	wg.Wait()
+	// WebSocket connections are hijacked and not tracked by the server; give
+	// their sessions a moment to send their close frames.
+	for deadline := time.Now().Add(shutdownGrace); len(sessions.List()) > 0 && time.Now().Before(deadline); {
+		time.Sleep(50 * time.Millisecond)
 	}
 	slog.Info("http: server stopped")
 }
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"math"
+)
+
+// levelIntervalMs is how much audio is aggregated into a single level event.
+// 100ms gives a smooth VU meter without flooding the socket.
+const levelIntervalMs = 100
+
+// LevelEvent reports the loudness of the audio received during the last
+// metering window. RMS and Peak are normalized to [0, 1] relative to full
+// scale 16-bit PCM.
+type LevelEvent struct {
+	Type string  `json:"type"`
+	RMS  float64 `json:"rms"`
+	Peak float64 `json:"peak"`
+	TsMs int64   `json:"ts_ms"`
+}
+
+func (e LevelEvent) EventType() string { return e.Type }
+
+// meterAudio is a pass-through pipeline stage: every chunk read from in is
+// forwarded unchanged to the returned channel, while RMS/peak levels are
+// accumulated and pushed to events once per levelIntervalMs of audio.
+//
+// The returned channel is closed when in is closed or ctx is canceled, so the
+// stage can be chained with other stages using plain range loops.
+func meterAudio(ctx context.Context, in <-chan AudioChunk, events chan<- Event) <-chan AudioChunk {
+	out := make(chan AudioChunk, cap(in))
+	windowSamples := sampleRateHz * levelIntervalMs / 1000
+
+	go func() {
+		defer close(out)
+		var (
+			sumSquares float64
+			peak       float64
+			samples    int
+		)
+		for ch := range in {
+			for i := range sampleCount(ch.PCM) {
+				s := float64(sampleAt(ch.PCM, i)) / math.MaxInt16
+				sumSquares += s * s
+				peak = math.Max(peak, math.Abs(s))
+				samples++
+
+				if samples >= windowSamples {
+					emitEvent(events, LevelEvent{
+						Type: "level",
+						RMS:  math.Sqrt(sumSquares / float64(samples)),
+						Peak: math.Min(peak, 1),
+						TsMs: ch.TsMs,
+					})
+					sumSquares, peak, samples = 0, 0, 0
+				}
+			}
+
+			select {
+			case out <- ch:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out
+}
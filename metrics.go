@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"maps"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+Learning note: Prometheus metrics
+=================================
+
+GET /metrics answers in the Prometheus text format, which is simple enough
+to write by hand, like the other wire formats of this server:
+
+	# HELP gochannels_sessions_active Sessions running now.
+	# TYPE gochannels_sessions_active gauge
+	gochannels_sessions_active 3
+	# TYPE gochannels_transcript_pieces_total counter
+	gochannels_transcript_pieces_total{kind="final"} 118
+	# TYPE gochannels_transcript_latency_seconds histogram
+	gochannels_transcript_latency_seconds_bucket{le="0.5"} 97
+	...
+	gochannels_transcript_latency_seconds_bucket{le="+Inf"} 131
+	gochannels_transcript_latency_seconds_sum 52.7
+	gochannels_transcript_latency_seconds_count 131
+
+Counters only go up (Prometheus computes rates from them, and notices a
+restart when one goes down); gauges are a value now; a histogram counts
+observations per bucket, each bucket including the ones below it, from
+which Prometheus estimates quantiles with histogram_quantile.
+
+The metrics:
+
+	gochannels_sessions_active              gauge, sessions running now
+	gochannels_sessions_total               counter, sessions started
+	gochannels_audio_bytes_received_total   counter, audio bytes from clients
+	gochannels_transcript_pieces_total      counter, by kind (partial, final)
+	gochannels_aws_errors_total             counter, Transcribe failures by
+	                                        kind (see errors.go)
+	gochannels_audio_queue_chunks           gauge, chunks waiting to be sent
+	                                        to Transcribe (see overload.go)
+	gochannels_transcript_latency_seconds   histogram, from sending the end
+	                                        of the audio a piece covers to
+	                                        Transcribe to receiving the piece
+	gochannels_audio_latency_seconds        summary, from a chunk of audio
+	                                        arriving to the first piece
+	                                        covering it (see latency.go)
+	gochannels_session_channel_length       gauge, by session and channel:
+	                                        items in a channel of a running
+	                                        session's pipeline
+	gochannels_session_channel_capacity     gauge, the same: their capacity
+	gochannels_transcribed_seconds_total    counter, by tenant: audio sent to
+	                                        Transcribe by sessions that ended,
+	                                        and by the warm pool as tenant
+	                                        "warm-pool" (see warm.go)
+	gochannels_estimated_cost_usd_total     counter, by tenant: its estimated
+	                                        cost at -price-per-minute (see
+	                                        usage.go)
+
+They cover the whole process, every transport included, except the channel
+gauges: those are sampled when the metrics are read, from the channels a
+session watches (audio_in, the audio queued for Transcribe, transcript_out,
+the pieces waiting for the client, and more; see debug.go). A channel that
+stays near its capacity is where backpressure builds: audio_in filling up
+comes before dropped chunks (see overload.go), transcript_out before a slow
+client is cut off (see wswriter.go). The tenant counters go up when a
+session ends, by all it sent: a long session shows at once, not as it runs
+(GET /usage adds in running sessions). Other per-session numbers are under
+GET /sessions/{id}/stats. The endpoint needs no token, like
+/healthz: scrapers rarely have one, and nothing in it identifies a client.
+*/
+
+// metrics collects the server's metrics (see the note above). It is always
+// there; main registers it as a SessionObserver.
+var metrics = newServerMetrics()
+
+// latencyBuckets are the upper bounds, in seconds, of the buckets of
+// gochannels_transcript_latency_seconds.
+var latencyBuckets = []float64{0.1, 0.25, 0.5, 1, 2, 5, 10}
+
+// serverMetrics holds the values of the metrics. It is safe for concurrent
+// use.
+type serverMetrics struct {
+	sessionsActive    atomic.Int64
+	sessionsTotal     atomic.Int64
+	audioBytes        atomic.Int64
+	audioQueued       atomic.Int64
+	pieces            labeledCounter
+	awsErrors         labeledCounter
+	transcribed       labeledCounter // seconds, by tenant
+	cost              labeledCounter // USD, by tenant
+	transcriptLatency *histogram
+	audioLatency      quantileWindow
+}
+
+func newServerMetrics() *serverMetrics {
+	return &serverMetrics{transcriptLatency: newHistogram(latencyBuckets)}
+}
+
+func (m *serverMetrics) SessionStarted(*Session) {
+	m.sessionsActive.Add(1)
+	m.sessionsTotal.Add(1)
+}
+
+func (m *serverMetrics) SessionEnded(s *Session) {
+	m.sessionsActive.Add(-1)
+	tenant, audioMs := usageTenant(s), s.Stats.Snapshot().AudioMs
+	m.transcribed.add(tenant, float64(audioMs)/1000)
+	m.cost.add(tenant, estimatedCost(audioMs, s.pricePerMinute))
+}
+
+// warmAudio counts audioMs of silence a pooled stream was kept open with
+// (see warm.go), at pricePerMinute, for warmPoolTenant.
+func (m *serverMetrics) warmAudio(audioMs int64, pricePerMinute float64) {
+	m.transcribed.add(warmPoolTenant, float64(audioMs)/1000)
+	m.cost.add(warmPoolTenant, estimatedCost(audioMs, pricePerMinute))
+}
+
+// piece counts a transcript piece going out.
+func (m *serverMetrics) piece(partial bool) {
+	if partial {
+		m.pieces.inc("partial")
+		return
+	}
+	m.pieces.inc("final")
+}
+
+// awsError counts a Transcribe stream that failed with err.
+func (m *serverMetrics) awsError(err error) {
+	kind, ok := classifyError(err)
+	if !ok {
+		m.awsErrors.inc("panic")
+		return
+	}
+	m.awsErrors.inc(errorKinds[kind].Name)
+}
+
+// writeTo writes every metric to w in the Prometheus text format.
+func (m *serverMetrics) writeTo(w *bufio.Writer) {
+	writeMetric(w, "gochannels_sessions_active", "gauge", "Sessions running now.", float64(m.sessionsActive.Load()))
+	writeMetric(w, "gochannels_sessions_total", "counter", "Sessions started.", float64(m.sessionsTotal.Load()))
+	writeMetric(w, "gochannels_audio_bytes_received_total", "counter", "Audio bytes received from clients.", float64(m.audioBytes.Load()))
+	m.pieces.writeTo(w, "gochannels_transcript_pieces_total", "Transcript pieces produced, by kind.", "kind")
+	m.awsErrors.writeTo(w, "gochannels_aws_errors_total", "Transcribe streams that failed, by kind of error.", "kind")
+	writeMetric(w, "gochannels_audio_queue_chunks", "gauge", "Audio chunks waiting to be sent to Transcribe.", float64(m.audioQueued.Load()))
+	m.transcriptLatency.writeTo(w, "gochannels_transcript_latency_seconds", "Time from sending the audio a transcript piece covers to receiving the piece.")
+	m.audioLatency.writeTo(w, "gochannels_audio_latency_seconds", "Time from a chunk of audio arriving to the first transcript piece covering it.")
+	m.transcribed.writeTo(w, "gochannels_transcribed_seconds_total", "Seconds of audio sent to Transcribe by ended sessions and the warm pool, by tenant.", "tenant")
+	m.cost.writeTo(w, "gochannels_estimated_cost_usd_total", "Estimated Transcribe cost in USD of ended sessions and the warm pool, by tenant.", "tenant")
+}
+
+// MetricsEndpoint serves GET /metrics (see the note above).
+func MetricsEndpoint(sessions *SessionRegistry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		bw := bufio.NewWriter(w)
+		metrics.writeTo(bw)
+		writeSessionChannels(bw, sessions)
+		_ = bw.Flush()
+	}
+}
+
+// writeSessionChannels samples the watched channels of the running sessions
+// and writes them as gauges.
+func writeSessionChannels(w *bufio.Writer, sessions *SessionRegistry) {
+	type sample struct {
+		session, channel string
+		depth            ChannelDepth
+	}
+	var samples []sample
+	for _, s := range sessions.List() {
+		depths := s.ChannelDepths()
+		for _, name := range slices.Sorted(maps.Keys(depths)) {
+			samples = append(samples, sample{s.ID, name, depths[name]})
+		}
+	}
+	for _, g := range []struct {
+		name, help string
+		value      func(ChannelDepth) int
+	}{
+		{"gochannels_session_channel_length", "Items in a channel of a running session, when sampled.", func(d ChannelDepth) int { return d.Len }},
+		{"gochannels_session_channel_capacity", "Capacity of a channel of a running session.", func(d ChannelDepth) int { return d.Cap }},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+		for _, s := range samples {
+			fmt.Fprintf(w, "%s{session=%q,channel=%q} %d\n", g.name, s.session, s.channel, g.value(s.depth))
+		}
+	}
+}
+
+// writeMetric writes a metric without labels.
+func writeMetric(w *bufio.Writer, name, typ, help string, value float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %s\n", name, help, name, typ, name, formatValue(value))
+}
+
+// formatValue formats v as the text format wants it.
+func formatValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// labeledCounter is a counter per value of one label.
+type labeledCounter struct {
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func (c *labeledCounter) inc(label string) {
+	c.add(label, 1)
+}
+
+// add adds v, which must not be negative, to the counter of label.
+func (c *labeledCounter) add(label string, v float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.values == nil {
+		c.values = make(map[string]float64)
+	}
+	c.values[label] += v
+}
+
+// writeTo writes the counter as name, one sample per label value, sorted.
+func (c *labeledCounter) writeTo(w *bufio.Writer, name, help, label string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	// The label values are names of the server's own, or tenants from the
+	// API keys file, printable text, which %q quotes as the format wants.
+	for _, value := range slices.Sorted(maps.Keys(c.values)) {
+		fmt.Fprintf(w, "%s{%s=%q} %s\n", name, label, value, formatValue(c.values[value]))
+	}
+}
+
+// histogram counts observations in buckets (see the note above).
+type histogram struct {
+	mu     sync.Mutex
+	bounds []float64 // upper bounds, ascending
+	counts []int64   // per bucket, the last one for +Inf
+	sum    float64
+	count  int64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]int64, len(bounds)+1)}
+}
+
+// observe records d, in seconds.
+func (h *histogram) observe(d time.Duration) {
+	v := d.Seconds()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	i, _ := slices.BinarySearch(h.bounds, v)
+	h.counts[i]++
+	h.sum += v
+	h.count++
+}
+
+// writeTo writes the histogram as name, with cumulative buckets.
+func (h *histogram) writeTo(w *bufio.Writer, name, help string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	var cumulative int64
+	for i, n := range h.counts {
+		cumulative += n
+		le := math.Inf(1)
+		if i < len(h.bounds) {
+			le = h.bounds[i]
+		}
+		fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", name, formatValue(le), cumulative)
+	}
+	fmt.Fprintf(w, "%s_sum %s\n%s_count %d\n", name, formatValue(h.sum), name, h.count)
+}
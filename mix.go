@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math"
+	"sync"
+	"time"
+)
+
+/*
+Learning note: Mixing several producers into one session
+=========================================================
+
+A mix room lets several WebSocket connections (e.g. two meeting participants
+on separate devices) share a single Transcribe session. Each member keeps its
+own reader and analysis stages, but instead of a private session its audio
+goes into the room:
+
+	member audio --> pending buffer --+
+	member audio --> pending buffer --+--> mixer tick (every chunkMs) --> session audioIn
+	member audio --> pending buffer --+
+
+	session transcriptOut --> fan-out --> every member's transcript channel
+
+Members send audio at their own pace, so the mixer runs on a ticker: every
+chunkMs it takes one chunk worth of PCM from every member (padding with
+silence when a member is behind), sums the samples as int32 and clips the
+result back into the int16 range. The room ends once every member has sent
+Final or disconnected.
+*/
+
+const (
+	// maxMixMembers bounds how many connections may share one room.
+	maxMixMembers = 8
+
+	// maxMixPending bounds how much audio is buffered per member before the
+	// oldest is dropped, so a member sending too fast cannot add latency.
+	maxMixPending = time.Second
+)
+
+var errRoomFull = errors.New("mix room is full")
+
+// mixPCM sums the 16-bit samples of srcs into dst, saturating at the int16
+// range instead of wrapping around. dst must be zeroed by the caller and
+// sources shorter than dst are treated as padded with silence.
+func mixPCM(dst []byte, srcs ...[]byte) {
+	for i := range sampleCount(dst) {
+		var sum int32
+		for _, src := range srcs {
+			if i < sampleCount(src) {
+				sum += int32(sampleAt(src, i))
+			}
+		}
+		sum = max(math.MinInt16, min(math.MaxInt16, sum))
+		dst[i*bytesPerSample] = byte(sum)
+		dst[i*bytesPerSample+1] = byte(sum >> 8)
+	}
+}
+
+// mixRooms tracks the Transcribe sessions shared by several connections,
+// keyed by room name. A room's session outlives the connection that started
+// it, so it runs in serverCtx: it ends when the server shuts down, not when
+// its first member leaves. It is started like any other session's, with
+// startTranscribe, and waits in admissions when AWS is at its limit.
+type mixRooms struct {
+	serverCtx  context.Context
+	client     *TranscribeClient
+	cfg        Config
+	sessions   *SessionRegistry // for the session limit
+	admissions *admissionQueue
+
+	mu    sync.Mutex
+	rooms map[string]*mixRoom
+}
+
+func newMixRooms(serverCtx context.Context, client *TranscribeClient, cfg Config, sessions *SessionRegistry, admissions *admissionQueue) *mixRooms {
+	return &mixRooms{serverCtx: serverCtx, client: client, cfg: cfg, sessions: sessions, admissions: admissions, rooms: make(map[string]*mixRoom)}
+}
+
+// mixRoom is one shared session and the members feeding it.
+type mixRoom struct {
+	name    string
+	release func() // the room's session slot
+
+	// ready is closed once the session has started, or failed to with err;
+	// audioIn and cancel are set before, and read only after.
+	ready   chan struct{}
+	err     error
+	audioIn chan<- AudioChunk
+	cancel  context.CancelFunc
+
+	mu      sync.Mutex
+	members map[*mixMember]struct{} // receiving transcripts
+	sources map[*mixMember]struct{} // still producing audio
+}
+
+// mixMember is the room side of one connection.
+type mixMember struct {
+	pending     []byte // PCM waiting to be mixed, guarded by mixRoom.mu
+	transcripts chan TranscriptPiece
+	errs        chan error
+	done        chan struct{} // closed by leave
+}
+
+// join adds a connection to the room called name, starting the room's
+// Transcribe session if it is the first member. The returned channels mirror
+// runTranscribeStream: send the member's audio on audioIn (a Final chunk means
+// the member stops producing), receive the room's transcripts on
+// transcriptOut and the session's terminal error on errOut. leave must be
+// called once the connection is gone. ctx is the connection's; if the room
+// has to wait for Transcribe capacity, the first member waits in it and is
+// told its position with queued.
+//
+// The room is registered under m.mu, but its session is started outside it:
+// starting one is a round trip to AWS, and joins of other rooms must not
+// wait for it. Joins of the same room wait on the room's ready instead.
+func (m *mixRooms) join(ctx context.Context, name string, queued func(position int)) (chan<- AudioChunk, <-chan TranscriptPiece, <-chan error, func(), error) {
+	for {
+		m.mu.Lock()
+		room, ok := m.rooms[name]
+		if !ok {
+			return m.open(ctx, name, queued)
+		}
+		m.mu.Unlock()
+		<-room.ready
+		if room.err != nil {
+			return nil, nil, nil, nil, room.err
+		}
+
+		// The room may have finished while we waited; then join a new one.
+		m.mu.Lock()
+		if m.rooms[name] != room {
+			m.mu.Unlock()
+			continue
+		}
+		room.mu.Lock()
+		m.mu.Unlock()
+		in, transcripts, errs, leave, err := room.add()
+		room.mu.Unlock()
+		return in, transcripts, errs, leave, err
+	}
+}
+
+// open registers the room called name with its first member and starts its
+// session. m.mu must be held; open unlocks it. The member is in the room
+// before anyone sees it, so mixLoop never finds a new room without
+// producers and finalizes it.
+func (m *mixRooms) open(ctx context.Context, name string, queued func(position int)) (chan<- AudioChunk, <-chan TranscriptPiece, <-chan error, func(), error) {
+	release, err := m.sessions.Reserve()
+	if err != nil {
+		m.mu.Unlock()
+		return nil, nil, nil, nil, err
+	}
+	room := &mixRoom{
+		name:    name,
+		release: release,
+		ready:   make(chan struct{}),
+		members: make(map[*mixMember]struct{}),
+		sources: make(map[*mixMember]struct{}),
+	}
+	room.mu.Lock()
+	in, transcripts, errs, leave, _ := room.add()
+	room.mu.Unlock()
+	m.rooms[name] = room
+	m.mu.Unlock()
+
+	roomCtx, cancel := context.WithCancel(m.serverCtx)
+	var (
+		audioIn       chan<- AudioChunk
+		transcriptOut <-chan TranscriptPiece
+		errOut        <-chan error
+	)
+	start := func() error {
+		audioIn, transcriptOut, errOut, err = startTranscribe(roomCtx, m.client, m.cfg)
+		return err
+	}
+	if err = start(); isConcurrencyLimit(err) {
+		err = m.admissions.wait(ctx, err, queued, start)
+	}
+	if err != nil {
+		cancel()
+		release()
+		leave()
+		m.mu.Lock()
+		delete(m.rooms, name)
+		m.mu.Unlock()
+		room.err = err
+		close(room.ready)
+		return nil, nil, nil, nil, err
+	}
+	room.audioIn, room.cancel = audioIn, cancel
+	close(room.ready)
+	go m.mixLoop(roomCtx, room)
+	go m.fanOut(room, transcriptOut, errOut)
+	slog.Info("mix: room started", slog.String("room", name))
+	return in, transcripts, errs, leave, nil
+}
+
+// add makes a new member of r. r.mu must be held.
+func (r *mixRoom) add() (chan<- AudioChunk, <-chan TranscriptPiece, <-chan error, func(), error) {
+	if len(r.members) >= maxMixMembers {
+		return nil, nil, nil, nil, errRoomFull
+	}
+
+	member := &mixMember{
+		transcripts: make(chan TranscriptPiece, 32),
+		errs:        make(chan error, 1),
+		done:        make(chan struct{}),
+	}
+	r.members[member] = struct{}{}
+	r.sources[member] = struct{}{}
+
+	in := make(chan AudioChunk, 16)
+	go r.collect(member, in)
+
+	var once sync.Once
+	leave := func() {
+		once.Do(func() {
+			close(member.done)
+			r.mu.Lock()
+			delete(r.members, member)
+			delete(r.sources, member)
+			r.mu.Unlock()
+		})
+	}
+
+	slog.Info("mix: member joined", slog.String("room", r.name), slog.Int("members", len(r.members)))
+	return in, member.transcripts, member.errs, leave, nil
+}
+
+// collect appends the member's audio to its pending buffer until it sends
+// Final or leaves.
+func (r *mixRoom) collect(member *mixMember, in <-chan AudioChunk) {
+	maxPending := int(maxMixPending.Milliseconds()) * sampleRateHz / 1000 * bytesPerSample * numChannels
+	for {
+		select {
+		case ch := <-in:
+			r.mu.Lock()
+			if ch.Final {
+				delete(r.sources, member)
+				r.mu.Unlock()
+				slog.Info("mix: member finished producing", slog.String("room", r.name))
+				return
+			}
+			member.pending = append(member.pending, ch.PCM...)
+			if excess := len(member.pending) - maxPending; excess > 0 {
+				member.pending = member.pending[excess-excess%bytesPerSample:]
+			}
+			r.mu.Unlock()
+			ch.Release()
+		case <-member.done:
+			return
+		}
+	}
+}
+
+// mixLoop emits one mixed chunk per chunkMs into the room's session. Once no
+// member produces audio anymore the room is unregistered and the session is
+// finalized.
+func (m *mixRooms) mixLoop(ctx context.Context, room *mixRoom) {
+	ticker := time.NewTicker(chunkMs * time.Millisecond)
+	defer ticker.Stop()
+
+	chunkBytes := sampleRateHz * chunkMs / 1000 * bytesPerSample * numChannels
+	var tsMs int64
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		m.mu.Lock()
+		room.mu.Lock()
+		if len(room.sources) == 0 {
+			if m.rooms[room.name] == room {
+				delete(m.rooms, room.name)
+			}
+			room.mu.Unlock()
+			m.mu.Unlock()
+			slog.Info("mix: no producers left; finalizing room", slog.String("room", room.name))
+			select {
+			case room.audioIn <- AudioChunk{Final: true, TsMs: tsMs}:
+			case <-ctx.Done():
+			}
+			return
+		}
+		m.mu.Unlock()
+
+		var srcs [][]byte
+		for member := range room.sources {
+			if len(member.pending) == 0 {
+				continue
+			}
+			n := min(chunkBytes, len(member.pending))
+			srcs = append(srcs, member.pending[:n])
+			member.pending = member.pending[n:]
+		}
+		if len(srcs) == 0 {
+			room.mu.Unlock()
+			continue
+		}
+		mixed := make([]byte, chunkBytes)
+		mixPCM(mixed, srcs...)
+		room.mu.Unlock()
+
+		select {
+		case room.audioIn <- AudioChunk{PCM: mixed, TsMs: tsMs}:
+			tsMs += chunkMs
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// fanOut copies every transcript piece of the room's session to all current
+// members, then delivers the terminal error (if any) and closes the members'
+// channels.
+func (m *mixRooms) fanOut(room *mixRoom, transcriptOut <-chan TranscriptPiece, errOut <-chan error) {
+	snapshot := func() []*mixMember {
+		room.mu.Lock()
+		defer room.mu.Unlock()
+		members := make([]*mixMember, 0, len(room.members))
+		for member := range room.members {
+			members = append(members, member)
+		}
+		return members
+	}
+
+	for piece := range transcriptOut {
+		for _, member := range snapshot() {
+			select {
+			case member.transcripts <- piece:
+			case <-member.done:
+			}
+		}
+	}
+	err := <-errOut
+
+	// The session is over: make sure nobody joins it anymore and stop mixing.
+	m.mu.Lock()
+	if m.rooms[room.name] == room {
+		delete(m.rooms, room.name)
+	}
+	m.mu.Unlock()
+	room.cancel()
+	room.release()
+
+	room.mu.Lock()
+	for member := range room.members {
+		if err != nil {
+			member.errs <- err
+		}
+		close(member.transcripts)
+		close(member.errs)
+	}
+	room.members = map[*mixMember]struct{}{}
+	room.mu.Unlock()
+	slog.Info("mix: room finished", slog.String("room", room.name), slog.Bool("error", err != nil))
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/*
+Learning note: MQTT publishing
+==============================
+
+MQTT is the publish/subscribe protocol of IoT devices and home-automation
+hubs: clients keep one TCP connection to a broker (Mosquitto, EMQX, AWS IoT,
+...) and publish messages to slash-separated topics, which any number of
+subscribers follow with wildcards such as transcripts/#.
+
+The sink only needs a small part of MQTT 3.1.1, so it speaks the protocol
+itself instead of pulling in a client library:
+
+	CONNECT -->            client ID, keep-alive, optional user/password
+	        <-- CONNACK    return code 0 = accepted
+	PUBLISH -->            topic + payload, QoS 0 (at most once, no reply)
+	PINGREQ --> ...        every keep-alive/2; the broker answers PINGRESP
+
+Every packet starts with a type byte and a "remaining length" encoded in 7-bit
+groups, strings are prefixed with their 16-bit length.
+
+Publish only queues the message; one goroutine owns the connection, writes the
+queue out and reconnects with backoff when the broker goes away (see
+runConnected). Partials that do not fit in the queue meanwhile are dropped:
+transcripts are live data and the sink must never hold up a session. A final
+waits for room for up to sinkFinalWait before it is dropped too.
+*/
+
+const (
+	// mqttKeepAlive is the keep-alive interval announced in CONNECT.
+	mqttKeepAlive = 30 * time.Second
+
+	// mqttQueue is the number of messages waiting for the connection.
+	mqttQueue = 256
+
+	mqttConnect    = 0x10
+	mqttConnAck    = 0x20
+	mqttPublish    = 0x30
+	mqttPingReq    = 0xC0
+	mqttDisconnect = 0xE0
+)
+
+// mqttMessage is a queued PUBLISH.
+type mqttMessage struct {
+	topic   string
+	payload []byte
+}
+
+// MQTTSink publishes transcript pieces to an MQTT broker, one topic per
+// session. The topic is cfg.MQTTTopic with "{session}" replaced by the
+// session ID.
+type MQTTSink struct {
+	broker   *url.URL
+	topic    string
+	clientID string
+	queue    chan mqttMessage
+	dropped  atomic.Int64
+}
+
+// NewMQTTSink returns a sink publishing to the broker at brokerURL
+// (tcp://, mqtt://, ssl:// or mqtts://, with optional user:password@) and
+// starts its connection, which lives until ctx is done.
+func NewMQTTSink(ctx context.Context, brokerURL, topic string) (*MQTTSink, error) {
+	u, err := url.Parse(brokerURL)
+	if err != nil {
+		return nil, fmt.Errorf("mqtt: broker: %w", err)
+	}
+	switch u.Scheme {
+	case "tcp", "mqtt", "ssl", "mqtts":
+	default:
+		return nil, fmt.Errorf("mqtt: broker: unsupported scheme %q", u.Scheme)
+	}
+	if u.Port() == "" {
+		port := "1883"
+		if u.Scheme == "ssl" || u.Scheme == "mqtts" {
+			port = "8883"
+		}
+		u.Host = net.JoinHostPort(u.Hostname(), port)
+	}
+	s := &MQTTSink{
+		broker:   u,
+		topic:    topic,
+		clientID: "gochannels-" + newSessionID()[:8],
+		queue:    make(chan mqttMessage, mqttQueue),
+	}
+	go runConnected(ctx, "mqtt", u.Host, s.session)
+	return s, nil
+}
+
+// Publish queues piece for the session's topic.
+func (s *MQTTSink) Publish(sessionID string, piece TranscriptPiece) {
+	if payload, err := json.Marshal(newPublishedTranscript(sessionID, piece)); err == nil {
+		s.enqueue(sessionID, payload, !piece.Partial)
+	}
+}
+
+// PublishSummary queues the summary for the session's topic.
+func (s *MQTTSink) PublishSummary(summary SummaryEvent) {
+	if payload, err := json.Marshal(summary); err == nil {
+		s.enqueue(summary.SessionID, payload, false)
+	}
+}
+
+// enqueue queues payload for the session's topic, dropping it if the queue
+// is full, with wait only after sinkFinalWait.
+func (s *MQTTSink) enqueue(sessionID string, payload []byte, wait bool) {
+	if !enqueueSinkMessage(s.queue, mqttMessage{topic: strings.ReplaceAll(s.topic, "{session}", sessionID), payload: payload}, wait) {
+		dropped := s.dropped.Add(1)
+		if wait {
+			slog.Error("mqtt: queue full; dropping a final", slog.String("session", sessionID), slog.Int64("dropped", dropped))
+		} else if dropped%100 == 1 {
+			slog.Warn("mqtt: queue full; dropping messages", slog.Int64("dropped", dropped))
+		}
+	}
+}
+
+// session connects once and writes queued messages until the connection
+// fails or ctx is done.
+func (s *MQTTSink) session(ctx context.Context) error {
+	conn, err := dialBroker(ctx, s.broker.Host, s.broker.Scheme == "ssl" || s.broker.Scheme == "mqtts")
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	_ = conn.SetDeadline(time.Now().Add(writeWait))
+	if _, err := conn.Write(s.connectPacket()); err != nil {
+		return err
+	}
+	typ, body, err := readMQTTPacket(r)
+	if err != nil {
+		return err
+	}
+	if typ != mqttConnAck || len(body) != 2 {
+		return fmt.Errorf("unexpected packet %#x instead of CONNACK", typ)
+	}
+	if body[1] != 0 {
+		return fmt.Errorf("connection refused, return code %d", body[1])
+	}
+	_ = conn.SetDeadline(time.Time{})
+	slog.Info("mqtt: connected", slog.String("broker", s.broker.Host), slog.String("client_id", s.clientID))
+
+	// Reader: the broker only sends PINGRESP, so silence for longer than the
+	// keep-alive means the connection is dead.
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			_ = conn.SetReadDeadline(time.Now().Add(mqttKeepAlive * 3 / 2))
+			if _, _, err := readMQTTPacket(r); err != nil {
+				readErr <- err
+				return
+			}
+		}
+	}()
+
+	ping := time.NewTicker(mqttKeepAlive / 2)
+	defer ping.Stop()
+	write := func(packet []byte) error {
+		_ = conn.SetWriteDeadline(time.Now().Add(writeWait))
+		_, err := conn.Write(packet)
+		return err
+	}
+	for {
+		select {
+		case msg := <-s.queue:
+			if err := write(mqttPublishPacket(msg)); err != nil {
+				return err
+			}
+		case <-ping.C:
+			if err := write([]byte{mqttPingReq, 0}); err != nil {
+				return err
+			}
+		case err := <-readErr:
+			return err
+		case <-ctx.Done():
+			_ = write([]byte{mqttDisconnect, 0})
+			return ctx.Err()
+		}
+	}
+}
+
+// connectPacket builds the CONNECT packet: clean session, credentials from
+// the broker URL.
+func (s *MQTTSink) connectPacket() []byte {
+	flags := byte(0x02) // clean session
+	body := appendMQTTString(nil, "MQTT")
+	body = append(body, 4, 0) // protocol level 3.1.1, flags patched below
+	body = binary.BigEndian.AppendUint16(body, uint16(mqttKeepAlive/time.Second))
+	body = appendMQTTString(body, s.clientID)
+	if user := s.broker.User; user != nil {
+		flags |= 0x80
+		body = appendMQTTString(body, user.Username())
+		if pass, ok := user.Password(); ok {
+			flags |= 0x40
+			body = appendMQTTString(body, pass)
+		}
+	}
+	body[7] = flags
+	return appendMQTTPacket(nil, mqttConnect, body)
+}
+
+// mqttPublishPacket builds a QoS 0 PUBLISH packet.
+func mqttPublishPacket(msg mqttMessage) []byte {
+	body := appendMQTTString(make([]byte, 0, 2+len(msg.topic)+len(msg.payload)), msg.topic)
+	return appendMQTTPacket(nil, mqttPublish, append(body, msg.payload...))
+}
+
+// appendMQTTPacket appends the fixed header (type and remaining length) and
+// body.
+func appendMQTTPacket(dst []byte, typ byte, body []byte) []byte {
+	dst = append(dst, typ)
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		dst = append(dst, b)
+		if n == 0 {
+			break
+		}
+	}
+	return append(dst, body...)
+}
+
+// appendMQTTString appends s prefixed with its length.
+func appendMQTTString(dst []byte, s string) []byte {
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(s)))
+	return append(dst, s...)
+}
+
+// readMQTTPacket reads one packet and returns its type (with the flags
+// masked out) and body.
+func readMQTTPacket(r *bufio.Reader) (byte, []byte, error) {
+	typ, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	var n, shift int
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		n |= int(b&0x7F) << shift
+		if b&0x80 == 0 {
+			break
+		}
+		if shift += 7; shift > 21 {
+			return 0, nil, errors.New("malformed remaining length")
+		}
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return typ & 0xF0, body, nil
+}
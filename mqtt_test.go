@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net/url"
+	"testing"
+)
+
+func TestReadMQTTPacket(t *testing.T) {
+	long := bytes.Repeat([]byte{'x'}, 200)
+	tests := []struct {
+		name  string
+		input []byte
+		typ   byte
+		body  []byte
+		err   string
+	}{
+		{name: "CONNACK", input: []byte{mqttConnAck, 2, 0, 0}, typ: mqttConnAck, body: []byte{0, 0}},
+		{name: "PINGRESP", input: []byte{0xD0, 0}, typ: 0xD0, body: []byte{}},
+		{name: "flags masked out", input: []byte{mqttPublish | 0x0B, 3, 0, 1, 't'}, typ: mqttPublish, body: []byte{0, 1, 't'}},
+		{name: "two byte length", input: append([]byte{mqttPublish, 0xC8, 0x01}, long...), typ: mqttPublish, body: long},
+		{name: "empty", err: "EOF"},
+		{name: "no length", input: []byte{mqttConnAck}, err: "EOF"},
+		{name: "length cut off", input: []byte{mqttPublish, 0x80}, err: "EOF"},
+		{name: "length of five bytes", input: []byte{mqttPublish, 0xFF, 0xFF, 0xFF, 0xFF, 0x01}, err: "malformed remaining length"},
+		{name: "no body", input: []byte{mqttConnAck, 2}, err: "EOF"},
+		{name: "truncated body", input: []byte{mqttConnAck, 2, 0}, err: "unexpected EOF"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			typ, body, err := readMQTTPacket(bufio.NewReader(bytes.NewReader(tt.input)))
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if typ != tt.typ || !bytes.Equal(body, tt.body) {
+				t.Fatalf("got packet %#x %q, want %#x %q", typ, body, tt.typ, tt.body)
+			}
+		})
+	}
+}
+
+func TestAppendMQTTPacketLength(t *testing.T) {
+	tests := []struct {
+		size, header int // of the body, and of the fixed header encoding it
+	}{
+		{0, 2}, {127, 2}, {128, 3}, {16383, 3}, {16384, 4}, {2097151, 4}, {2097152, 5},
+	}
+	for _, tt := range tests {
+		body := bytes.Repeat([]byte{0xAA}, tt.size)
+		packet := appendMQTTPacket(nil, mqttPublish, body)
+		if got := len(packet) - tt.size; got != tt.header {
+			t.Errorf("body of %d bytes: got a header of %d bytes, want %d", tt.size, got, tt.header)
+		}
+		typ, got, err := readMQTTPacket(bufio.NewReader(bytes.NewReader(packet)))
+		if err != nil || typ != mqttPublish || !bytes.Equal(got, body) {
+			t.Errorf("body of %d bytes: read back %#x, %d bytes, %v", tt.size, typ, len(got), err)
+		}
+	}
+}
+
+func TestMQTTPackets(t *testing.T) {
+	withUser := func(s string) *MQTTSink {
+		u, _ := url.Parse(s)
+		return &MQTTSink{broker: u, clientID: "gochannels-1"}
+	}
+	tests := []struct {
+		name   string
+		packet []byte
+		want   []byte
+	}{
+		{
+			name:   "publish",
+			packet: mqttPublishPacket(mqttMessage{topic: "t/1", payload: []byte("{}")}),
+			want:   []byte{mqttPublish, 7, 0, 3, 't', '/', '1', '{', '}'},
+		},
+		{
+			name:   "connect",
+			packet: withUser("tcp://broker:1883").connectPacket(),
+			want: []byte{mqttConnect, 24, 0, 4, 'M', 'Q', 'T', 'T', 4, 0x02, 0, 30,
+				0, 12, 'g', 'o', 'c', 'h', 'a', 'n', 'n', 'e', 'l', 's', '-', '1'},
+		},
+		{
+			name:   "connect with user and password",
+			packet: withUser("tcp://u:p@broker:1883").connectPacket(),
+			want: []byte{mqttConnect, 30, 0, 4, 'M', 'Q', 'T', 'T', 4, 0xC2, 0, 30,
+				0, 12, 'g', 'o', 'c', 'h', 'a', 'n', 'n', 'e', 'l', 's', '-', '1',
+				0, 1, 'u', 0, 1, 'p'},
+		},
+		{
+			name:   "connect with user only",
+			packet: withUser("tcp://u@broker:1883").connectPacket(),
+			want: []byte{mqttConnect, 27, 0, 4, 'M', 'Q', 'T', 'T', 4, 0x82, 0, 30,
+				0, 12, 'g', 'o', 'c', 'h', 'a', 'n', 'n', 'e', 'l', 's', '-', '1',
+				0, 1, 'u'},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !bytes.Equal(tt.packet, tt.want) {
+				t.Fatalf("got % x, want % x", tt.packet, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewMQTTSinkURL(t *testing.T) {
+	tests := []struct {
+		input, err string
+	}{
+		{input: "http://broker", err: `mqtt: broker: unsupported scheme "http"`},
+		{input: "broker:1883", err: `mqtt: broker: unsupported scheme "broker"`},
+		{input: "tcp://bro ker", err: `mqtt: broker: parse "tcp://bro ker": invalid character " " in host name`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			if _, err := NewMQTTSink(context.Background(), tt.input, "t"); err == nil || err.Error() != tt.err {
+				t.Fatalf("got error %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+/*
+Learning note: Multiplexing streams over one WebSocket
+======================================================
+
+A meeting bot that hears every participant separately would otherwise need a
+connection per participant. With ?framing=mux one connection carries up to
+maxMuxStreams independent audio streams; every binary frame names its stream
+in front of the ?framing=seq header:
+
+	offset  size  field
+	0       2     stream ID (uint16, big-endian, chosen by the client)
+	2       4     sequence number (uint32, big-endian, +1 per frame of this stream)
+	6       8     capture timestamp in ms (int64, big-endian)
+	14      ...   audio payload
+
+The first frame of a stream opens it: the server starts a Transcribe session
+for it, registers it as a session of its own and announces it with
+{"type":"stream","stream":N,"session_id":"..."}. Every stream has its own
+pipeline (jitter buffer, decoder, stats, limits), so one stream falling behind
+or breaking a limit does not affect the others. Transcripts carry the stream
+they belong to ({"type":"transcript","stream":N,...}), and a finished stream
+sends its own summary.
+
+Control messages may name a stream: {"type":"end","stream":N} ends stream N
+(a later frame with the same ID opens a new one), {"type":"config","stream":N,
+"labels":{...}} labels it. Without "stream", end and config apply to all
+streams; pause, resume and ping always do. When every stream has finished after
+an end of all streams, the server closes the connection normally. A normal
+close by the client ends all streams the same way; their last transcripts then
+only go to the sink.
+*/
+
+// maxMuxStreams is the number of streams a multiplexed connection may have
+// open at once.
+const maxMuxStreams = 16
+
+// muxHeaderLen is the size of the ?framing=mux frame header.
+const muxHeaderLen = 2 + seqHeaderLen
+
+// parseMuxFrame decodes the header of a ?framing=mux frame.
+func parseMuxFrame(data []byte) (stream uint16, seq uint32, captureMs int64, payload []byte, err error) {
+	if len(data) < muxHeaderLen {
+		return 0, 0, 0, nil, errShortFrame
+	}
+	seq, captureMs, payload, err = parseSeqFrame(data[2:])
+	return binary.BigEndian.Uint16(data[0:2]), seq, captureMs, payload, err
+}
+
+// StreamEvent announces a new stream of a multiplexed connection and the ID
+// of its session.
+type StreamEvent struct {
+	Type      string `json:"type"`
+	Stream    uint16 `json:"stream"`
+	SessionID string `json:"session_id"`
+}
+
+func (e StreamEvent) EventType() string { return e.Type }
+
+// muxStream is the reader's state of one stream.
+type muxStream struct {
+	id        uint16
+	session   *Session
+	raw       chan AudioChunk
+	validator *frameValidator
+
+	captureBase int64
+	hasBase     bool
+	tsMs        int64
+}
+
+// multiplexer serves a ?framing=mux connection (see the note above).
+type multiplexer struct {
+	client     *TranscribeClient
+	cfg        Config
+	sessions   *SessionRegistry
+	sink       TranscriptSink
+	newDecoder DecoderFactory
+	decOpts    DecoderOptions
+	remote     string
+
+	entitlements Entitlements // of the connection's API key
+	qos          qosTier      // of every stream
+	speakers     bool         // label speakers in every stream (?speakers=1)
+
+	out          chan Event    // transcripts and summaries, never dropped
+	events       chan Event    // side events, dropped when the writer lags
+	clientClosed chan struct{} // closed on a normal close by the client
+	paused       atomic.Bool   // "pause" applies to all streams
+	wg           sync.WaitGroup
+}
+
+// send hands ev to the writer.
+func (m *multiplexer) send(ctx context.Context, ev Event) {
+	select {
+	case m.out <- ev:
+	case <-ctx.Done():
+	}
+}
+
+// open starts the session and pipeline of a new stream.
+func (m *multiplexer) open(ctx context.Context, id uint16) (*muxStream, error) {
+	admission, err := m.sessions.Admit(m.entitlements)
+	if err != nil {
+		return nil, err
+	}
+	reserved, err := m.sessions.ReserveQoS(m.qos.Class)
+	if err != nil {
+		admission.release()
+		return nil, err
+	}
+	release := func() {
+		reserved()
+		admission.release()
+	}
+	// The stream's goroutines log with its session ID (see logging.go) and
+	// are labelled with it (see dump.go).
+	sessionID := newSessionID()
+	defer labelGoroutines(ctx, sessionID)()
+	log := loggerFrom(ctx).With(slog.String("session", sessionID), slog.Int("stream", int(id)))
+	streamCtx, cancel := context.WithCancel(withLogger(ctx, log))
+	audioIn, transcriptOut, errOut, err := startTranscribeWith(streamCtx, m.client, m.cfg, TranscribeOptions{Speakers: m.speakers})
+	if err != nil {
+		cancel()
+		release()
+		return nil, fmt.Errorf("start transcription: %w", err)
+	}
+	decoder, err := m.newDecoder(streamCtx, m.decOpts)
+	if err != nil {
+		cancel()
+		release()
+		return nil, fmt.Errorf("decoder: %w", err)
+	}
+
+	s := &muxStream{
+		id:        id,
+		session:   &Session{ID: sessionID, Remote: m.remote, Started: time.Now(), Stats: &AudioStats{}, Tenant: m.entitlements.Tenant, QoS: m.qos.Class},
+		raw:       make(chan AudioChunk, m.qos.AudioBuffer),
+		validator: newFrameValidator(m.cfg, decoder.Info().SampleSize),
+	}
+	s.session.SetLabels(map[string]string{"stream": strconv.Itoa(int(id))})
+	s.session.WatchChannel("raw_audio", s.raw)
+	s.session.WatchChannel("audio_in", audioIn)
+	s.session.WatchChannel("transcript_out", transcriptOut)
+	m.sessions.Add(s.session)
+
+	// Limits end the stream, not the connection; the client gets a warning.
+	endStream := func(reason closeReason) {
+		emitEvent(m.events, WarningEvent{Type: "warning", Code: reason.Code, Message: fmt.Sprintf("stream %d: %s", id, reason.Message)})
+	}
+	if admission.finalsOnly {
+		emitEvent(m.events, WarningEvent{Type: "warning", Code: finalsOnlyWarning.Code, Message: fmt.Sprintf("stream %d: %s", id, finalsOnlyWarning.Message)})
+	}
+	staged := endIdleAudio(streamCtx, s.raw, m.cfg.IdleTimeout, &m.paused, endStream)
+	staged = reorderAudio(streamCtx, staged, s.session.Stats)
+	staged = decodeAudio(streamCtx, staged, decoder, s.session.Stats, m.events)
+	staged = trackAudioStats(streamCtx, staged, s.session.Stats)
+	staged = checkAudioQuality(streamCtx, staged, m.events)
+	staged = capAudioDuration(streamCtx, staged, budgetFor(m.cfg, m.entitlements).withQuota(admission.remaining), endStream)
+	staged = capSessionDuration(streamCtx, staged, m.cfg, endStream)
+	staged = endOnKill(streamCtx, staged, s.session, endStream)
+	staged = recordSession(streamCtx, staged, m.cfg.Recorder, s.session)
+	staged = padPauses(streamCtx, staged, &m.paused)
+	go forwardAudio(streamCtx, staged, audioIn, m.qos.DropPolicy, m.qos.QueueLen, &s.session.Stats.Drops, func(ev SlowDownEvent) {
+		ev.Stream = &s.id
+		emitEvent(m.events, ev)
+	})
+
+	// send hands an event of the stream to the connection's writer.
+	send := func(ctx context.Context, ev Event) {
+		s.session.NoteEvent(ev)
+		m.send(ctx, ev)
+	}
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		defer release()
+		defer cancel()
+		defer m.sessions.Remove(s.session.ID)
+		if admission.finalsOnly {
+			transcriptOut = dropPartials(streamCtx, transcriptOut)
+		}
+		for piece := range deliverTranscripts(streamCtx, publishTranscripts(streamCtx, transcriptOut, s.session.ID, m.sink), m.cfg.TranscriptDelivery) {
+			s.session.AddPiece(piece)
+			send(streamCtx, TranscriptEvent{Text: piece.Text, Partial: piece.Partial, Stream: &s.id})
+		}
+		if err := <-errOut; err != nil {
+			log.Error("ws-mux: transcribe error", slog.String("error", err.Error()))
+			m.sessions.Fail(s.session.ID, err)
+			send(streamCtx, s.session.Summary())
+			emitEvent(m.events, WarningEvent{Type: "warning", Code: "transcribe_error", Message: fmt.Sprintf("stream %d: %v", id, err)})
+			return
+		}
+		send(streamCtx, s.session.Summary())
+		log.Info("ws-mux: stream finished", slog.Any("labels", s.session.Labels()))
+	}()
+
+	send(ctx, StreamEvent{Type: "stream", Stream: id, SessionID: s.session.ID})
+	log.Info("ws-mux: stream opened")
+	return s, nil
+}
+
+// serve runs the connection until all streams are done or the client leaves.
+func (m *multiplexer) serve(ctx context.Context, conn *websocket.Conn, codec messageCodec) {
+	m.out = make(chan Event, eventBuffer)
+	m.events = make(chan Event, eventBuffer)
+	m.clientClosed = make(chan struct{})
+	// All streams share the connection's frame numbers (see sequence.go).
+	frames := newFrameLog()
+	readerDone := make(chan struct{})
+	go func() {
+		defer close(readerDone)
+		m.read(ctx, conn)
+	}()
+	// No stream opens once the reader is gone, so the writer can stop after
+	// the last stream finished.
+	go func() {
+		<-readerDone
+		m.wg.Wait()
+		close(m.out)
+	}()
+
+	// As for a single session, a writer owns the connection's writes (see
+	// wswriter.go), so a client that stops reading holds up every stream only
+	// as far as -slow-client allows.
+	writer := newWSWriter(conn, codec, frames, m.cfg.SlowClient, loggerFrom(ctx), nil)
+	defer writer.Stop()
+	for {
+		select {
+		case ev, ok := <-m.out:
+			if !ok {
+				loggerFrom(ctx).Info("ws-mux: all streams finished; closing")
+				writer.Stop()
+				_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(writeWait))
+				return
+			}
+			if err := writer.Send(ev); err != nil {
+				m.writeFailed(ctx, writer, err)
+				return
+			}
+		case ev := <-m.events:
+			writer.Offer(ev)
+		case <-writer.Done():
+			m.writeFailed(ctx, writer, writer.Err())
+			return
+		case <-m.clientClosed:
+			m.flush(ctx)
+			return
+		case <-ctx.Done():
+			if isServerShutdown(ctx) {
+				writer.Close(closeReason{Code: "server_shutdown", Message: "the server is shutting down"})
+			}
+			return
+		}
+	}
+}
+
+// writeFailed handles writer failing with err: after a normal close by the
+// client the streams still finish for the sinks; a client too slow for the
+// -slow-client policy is disconnected; otherwise the connection is dead.
+func (m *multiplexer) writeFailed(ctx context.Context, writer *wsWriter, err error) {
+	select {
+	case <-m.clientClosed:
+		m.flush(ctx)
+		return
+	default:
+	}
+	if errors.Is(err, errSlowClient) {
+		loggerFrom(ctx).Warn("ws-mux: client too slow; disconnecting")
+		writer.Abort(closeReason{Code: "slow_client", Message: "the client did not read its transcripts in time"})
+		return
+	}
+	loggerFrom(ctx).Error("ws-mux: write failed", slog.String("error", err.Error()))
+}
+
+// flush lets the streams of a connection the client closed finish, for at most
+// closeFlushTimeout, so their final transcripts reach the sink.
+func (m *multiplexer) flush(ctx context.Context) {
+	loggerFrom(ctx).Info("ws-mux: client closed; waiting for final transcripts")
+	timeout := time.NewTimer(closeFlushTimeout)
+	defer timeout.Stop()
+	for {
+		select {
+		case _, ok := <-m.out:
+			if !ok {
+				loggerFrom(ctx).Info("ws-mux: final transcripts delivered")
+				return
+			}
+		case <-timeout.C:
+			loggerFrom(ctx).Warn("ws-mux: gave up waiting for final transcripts")
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// read reads frames and control messages until the client ends all streams
+// or leaves; every stream still open then gets its Final chunk.
+func (m *multiplexer) read(ctx context.Context, conn *websocket.Conn) {
+	streams := make(map[uint16]*muxStream)
+	end := func(s *muxStream) {
+		delete(streams, s.id)
+		select {
+		case s.raw <- AudioChunk{Final: true, TsMs: s.tsMs}:
+		case <-ctx.Done():
+		}
+		close(s.raw)
+	}
+	defer func() {
+		for _, s := range streams {
+			end(s)
+		}
+	}()
+
+	var (
+		started, gotAudio bool
+	)
+	router := controlRouter{
+		ControlStart: func(msg ControlMessage) error {
+			if started || gotAudio {
+				return fmt.Errorf("%w: start must be the first message", errInvalidControl)
+			}
+			started = true
+			return nil
+		},
+		ControlConfig: func(msg ControlMessage) error {
+			if msg.changesOptions() {
+				return fmt.Errorf("%w: options cannot change with framing=mux", errInvalidControl)
+			}
+			if msg.Stream == nil {
+				for _, s := range streams {
+					s.session.SetLabels(msg.Labels)
+				}
+				return nil
+			}
+			s, ok := streams[*msg.Stream]
+			if !ok {
+				return fmt.Errorf("%w: stream %d is not open", errInvalidControl, *msg.Stream)
+			}
+			s.session.SetLabels(msg.Labels)
+			return nil
+		},
+		ControlPause:  func(ControlMessage) error { m.paused.Store(true); return nil },
+		ControlResume: func(ControlMessage) error { m.paused.Store(false); return nil },
+		ControlPing: func(msg ControlMessage) error {
+			emitEvent(m.events, PongEvent{Type: "pong", ID: msg.ID})
+			return nil
+		},
+		ControlEnd: func(msg ControlMessage) error {
+			if msg.Stream == nil {
+				loggerFrom(ctx).Info("ws-mux: received end of all streams")
+				return errStreamEnded // the deferred cleanup ends them
+			}
+			s, ok := streams[*msg.Stream]
+			if !ok {
+				return fmt.Errorf("%w: stream %d is not open", errInvalidControl, *msg.Stream)
+			}
+			loggerFrom(ctx).Info("ws-mux: received end", slog.Int("stream", int(s.id)))
+			end(s)
+			return nil
+		},
+	}
+
+	for {
+		mt, data, err := conn.ReadMessage()
+		if isClientClose(err) {
+			loggerFrom(ctx).Info("ws-mux: client closed; ending all streams")
+			close(m.clientClosed)
+			return
+		}
+		if err != nil {
+			loggerFrom(ctx).Warn("ws-mux: read error; ending all streams", slog.String("error", err.Error()))
+			return
+		}
+		// Frames beyond readLimit fail the read above; gorilla closes the
+		// connection with 1009 (see readLimit).
+		if m.cfg.PingInterval > 0 {
+			extendReadDeadline(conn, m.cfg.PongTimeout)
+		}
+		switch mt {
+		case websocket.BinaryMessage:
+			gotAudio = true
+			if m.paused.Load() {
+				continue
+			}
+			id, seq, captureMs, payload, err := parseMuxFrame(data)
+			if err != nil {
+				loggerFrom(ctx).Warn("ws-mux: malformed frame ignored", slog.String("error", err.Error()))
+				continue
+			}
+			s, ok := streams[id]
+			if !ok {
+				if len(streams) >= maxMuxStreams {
+					emitEvent(m.events, WarningEvent{Type: "warning", Code: "too_many_streams", Message: fmt.Sprintf("stream %d rejected: at most %d streams per connection", id, maxMuxStreams)})
+					continue
+				}
+				if s, err = m.open(ctx, id); err != nil {
+					loggerFrom(ctx).Error("ws-mux: stream setup failed", slog.Int("stream", int(id)), slog.String("error", err.Error()))
+					code := "stream_unavailable"
+					var qe *quotaError
+					switch {
+					case errors.Is(err, errTooManySessions):
+						code = "too_many_sessions"
+					case errors.As(err, &qe):
+						code = "tenant_quota_exceeded"
+					}
+					emitEvent(m.events, WarningEvent{Type: "warning", Code: code, Message: fmt.Sprintf("stream %d: %v", id, err)})
+					continue
+				}
+				streams[id] = s
+			}
+			s.session.Stats.addFrame(len(data))
+			if reason, ok := s.validator.check(len(data), time.Now()); !ok {
+				loggerFrom(ctx).Warn("ws-mux: frame rejected; ending stream", slog.Int("stream", int(id)), slog.String("reason", reason.Code))
+				emitEvent(m.events, WarningEvent{Type: "warning", Code: reason.Code, Message: fmt.Sprintf("stream %d: %s", id, reason.Message)})
+				end(s)
+				continue
+			}
+			if ev, ok := s.validator.backoffDue(); ok {
+				ev.Message = fmt.Sprintf("stream %d: %s", id, ev.Message)
+				emitEvent(m.events, ev)
+			}
+			if !s.hasBase {
+				s.captureBase, s.hasBase = captureMs, true
+			}
+			s.tsMs = captureMs - s.captureBase
+			chunk := newLiveChunk(payload, s.tsMs)
+			chunk.Seq, chunk.CaptureMs = seq, captureMs
+			select {
+			case s.raw <- chunk:
+			case <-ctx.Done():
+				chunk.Release()
+				return
+			}
+
+		case websocket.TextMessage:
+			err := router.dispatch(data)
+			switch {
+			case err == nil:
+			case errors.Is(err, errStreamEnded):
+				return
+			case errors.Is(err, errUnsupportedVersion):
+				loggerFrom(ctx).Warn("ws-mux: unsupported protocol version; ending all streams", slog.String("error", err.Error()))
+				emitEvent(m.events, WarningEvent{Type: "warning", Code: "unsupported_version", Message: err.Error()})
+				return
+			default:
+				emitEvent(m.events, WarningEvent{Type: "warning", Code: "invalid_control", Message: err.Error()})
+			}
+		}
+	}
+}
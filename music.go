@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math"
+)
+
+/*
+Learning note: Telling speech from music
+========================================
+
+Speech and music differ a lot in how they evolve over time, which two cheap
+features capture well enough for a first cut:
+
+  - Low-energy ratio: the share of short frames quieter than half the
+    window's mean level. Speech is full of short pauses between syllables and
+    words, so the ratio is high; music tends to be continuous.
+  - Zero-crossing rate variability: speech alternates voiced sounds (few
+    zero crossings) and fricatives like "s" (many), so the ZCR jumps around;
+    in music it is much steadier.
+
+classifyAudio computes both over 1s windows of 20ms frames. A window counts
+as speech when either feature looks speech-like, otherwise as music; near
+silent windows keep the current class. The segment only changes after two
+consecutive windows agree, so single odd windows do not cause flapping.
+*/
+
+const (
+	musicFrameMs  = 20
+	musicWindowMs = 1000
+
+	// musicSilenceRMS is the window RMS (normalized) under which no decision is made.
+	musicSilenceRMS = 0.005
+	// speechLowEnergyRatio and speechZCRVariation are the thresholds above
+	// which a window is considered speech.
+	speechLowEnergyRatio = 0.25
+	speechZCRVariation   = 0.7
+	// musicSwitchWindows is how many consecutive windows must agree on a new
+	// class before the segment changes.
+	musicSwitchWindows = 2
+)
+
+// AudioClass is the kind of content detected in a segment of audio.
+type AudioClass string
+
+const (
+	ClassSpeech AudioClass = "speech"
+	ClassMusic  AudioClass = "music"
+)
+
+// SegmentEvent tells the client that the audio switched between speech and
+// music at TsMs. Suppressed reports whether the new segment is withheld
+// from Transcribe.
+type SegmentEvent struct {
+	Type       string     `json:"type"`
+	Class      AudioClass `json:"class"`
+	Suppressed bool       `json:"suppressed"`
+	TsMs       int64      `json:"ts_ms"`
+}
+
+func (e SegmentEvent) EventType() string { return e.Type }
+
+// classifyWindow decides whether a window of per-frame RMS and ZCR values is
+// speech or music. ok is false for near silent windows.
+func classifyWindow(rms, zcr []float64) (class AudioClass, ok bool) {
+	meanRMS, meanZCR := mean(rms), mean(zcr)
+	if meanRMS < musicSilenceRMS {
+		return "", false
+	}
+
+	low := 0
+	for _, v := range rms {
+		if v < meanRMS/2 {
+			low++
+		}
+	}
+	lowEnergyRatio := float64(low) / float64(len(rms))
+
+	var variance float64
+	for _, v := range zcr {
+		variance += (v - meanZCR) * (v - meanZCR)
+	}
+	zcrVariation := 0.0
+	if meanZCR > 0 {
+		zcrVariation = math.Sqrt(variance/float64(len(zcr))) / meanZCR
+	}
+
+	if lowEnergyRatio >= speechLowEnergyRatio || zcrVariation >= speechZCRVariation {
+		return ClassSpeech, true
+	}
+	return ClassMusic, true
+}
+
+func mean(vs []float64) float64 {
+	if len(vs) == 0 {
+		return 0
+	}
+	var sum float64
+	for _, v := range vs {
+		sum += v
+	}
+	return sum / float64(len(vs))
+}
+
+// classifyAudio is a pipeline stage that labels the audio as speech or music
+// (see the note above) and pushes a SegmentEvent to events whenever the label
+// changes. With suppress, chunks classified as music are replaced by silence
+// before they reach Transcribe; silence rather than dropping keeps the stream
+// timing intact and AWS from timing out. Classification lags the audio by up
+// to one window, so a segment boundary is only honored from that point on.
+func classifyAudio(ctx context.Context, in <-chan AudioChunk, suppress bool, events chan<- Event) <-chan AudioChunk {
+	out := make(chan AudioChunk, cap(in))
+	frameSamples := sampleRateHz * musicFrameMs / 1000
+	windowFrames := musicWindowMs / musicFrameMs
+
+	go func() {
+		defer close(out)
+		var (
+			current   = ClassSpeech // assume speech until shown otherwise
+			candidate AudioClass
+			agreeing  int
+
+			sumSquares float64
+			crossings  int
+			samples    int
+			prev       int16
+			rms, zcr   []float64
+		)
+		for ch := range in {
+			for i := range sampleCount(ch.PCM) {
+				s := sampleAt(ch.PCM, i)
+				v := float64(s) / math.MaxInt16
+				sumSquares += v * v
+				if (s >= 0) != (prev >= 0) {
+					crossings++
+				}
+				prev = s
+				samples++
+				if samples < frameSamples {
+					continue
+				}
+
+				rms = append(rms, math.Sqrt(sumSquares/float64(samples)))
+				zcr = append(zcr, float64(crossings)/float64(samples))
+				sumSquares, crossings, samples = 0, 0, 0
+				if len(rms) < windowFrames {
+					continue
+				}
+
+				class, ok := classifyWindow(rms, zcr)
+				rms, zcr = rms[:0], zcr[:0]
+				switch {
+				case !ok || class == current:
+					candidate, agreeing = "", 0
+				case class == candidate:
+					agreeing++
+				default:
+					candidate, agreeing = class, 1
+				}
+				if agreeing >= musicSwitchWindows {
+					current, candidate, agreeing = class, "", 0
+					tsMs := ch.TsMs + int64(i*1000/sampleRateHz)
+					loggerFrom(ctx).Info("music: segment changed", slog.String("class", string(current)), slog.Int64("ts_ms", tsMs))
+					emitEvent(events, SegmentEvent{Type: "segment", Class: current, Suppressed: suppress && current == ClassMusic, TsMs: tsMs})
+				}
+			}
+
+			if suppress && current == ClassMusic {
+				clear(ch.PCM)
+			}
+
+			select {
+			case out <- ch:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+Learning note: NATS
+===================
+
+NATS is a lightweight message bus: clients publish to dot-separated subjects
+and subscribe with wildcards (* for one token, > for the rest). The server
+takes part in two ways:
+
+	session 1234 --PUB transcripts.1234--> NATS --> any subscriber of transcripts.>
+	producer --PUB audio.call-42 (PCM)-->  NATS --> ServeNATSAudio --> Transcribe
+
+The protocol is plain text lines, much like Redis':
+
+	<-- INFO {...}                       server greeting
+	--> CONNECT {...}  PING              options and credentials; PONG confirms
+	--> PUB <subject> <n>\r\n<payload>
+	--> SUB <subject> <sid>
+	<-- MSG <subject> <sid> [reply] <n>\r\n<payload>
+	<-- PING / --> PONG                  server keepalive, answered or dropped
+
+JetStream, the persistence layer of NATS, needs no extra protocol here: a
+stream whose subjects include the transcript subject stores every piece, and
+a push consumer with a deliver subject (and ack policy none) replays a stream
+into a subject ServeNATSAudio subscribes to.
+
+Audio messages carry raw s16le 16kHz mono PCM. Every subject is one stream,
+transcribed as a job like RTP streams (see rtp.go); an empty message or
+natsIdleTimeout without messages ends it.
+*/
+
+const (
+	// natsQueue is the number of messages waiting for the connection.
+	natsQueue = 256
+
+	// natsIdleTimeout ends an audio stream that stopped receiving messages.
+	natsIdleTimeout = 10 * time.Second
+
+	// natsMaxPayload bounds the messages the client reads.
+	natsMaxPayload = 8 << 20
+)
+
+// natsConn is a NATS client connection. Writes are safe for concurrent use;
+// reads must happen on one goroutine.
+type natsConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	wmu  sync.Mutex
+}
+
+// dialNATS connects and authenticates to the server at u (nats:// or tls://,
+// with user:password@ or a token as user name).
+func dialNATS(ctx context.Context, u *url.URL) (*natsConn, error) {
+	conn, err := (&net.Dialer{Timeout: 10 * time.Second}).DialContext(ctx, "tcp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+	c := &natsConn{conn: conn, r: bufio.NewReader(conn)}
+	_ = conn.SetDeadline(time.Now().Add(writeWait))
+	line, err := c.readLine()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected greeting %q", line)
+	}
+	if u.Scheme == "tls" {
+		// NATS starts in plain text and upgrades after INFO.
+		tc := tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+		if err := tc.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		c.conn, c.r = tc, bufio.NewReader(tc)
+	}
+
+	opts := map[string]any{"verbose": false, "pedantic": false, "name": "gochannels", "lang": "go", "protocol": 1}
+	if user := u.User; user != nil {
+		if pass, ok := user.Password(); ok {
+			opts["user"], opts["pass"] = user.Username(), pass
+		} else {
+			opts["auth_token"] = user.Username()
+		}
+	}
+	connect, _ := json.Marshal(opts)
+	if err := c.write(fmt.Appendf(nil, "CONNECT %s\r\nPING\r\n", connect)); err != nil {
+		c.conn.Close()
+		return nil, err
+	}
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			c.conn.Close()
+			return nil, err
+		}
+		if line == "PONG" {
+			break
+		}
+		if strings.HasPrefix(line, "-ERR") {
+			c.conn.Close()
+			return nil, errors.New(strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		}
+	}
+	_ = c.conn.SetDeadline(time.Time{})
+	return c, nil
+}
+
+func (c *natsConn) Close() error { return c.conn.Close() }
+
+func (c *natsConn) write(b []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	_ = c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	_, err := c.conn.Write(b)
+	return err
+}
+
+func (c *natsConn) readLine() (string, error) {
+	line, err := c.r.ReadString('\n')
+	return strings.TrimRight(line, "\r\n"), err
+}
+
+// next reads until the next MSG and returns its subject and payload,
+// answering server pings on the way. An -ERR from the server is returned as
+// an error.
+func (c *natsConn) next() (string, []byte, error) {
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return "", nil, err
+		}
+		switch {
+		case line == "PING":
+			if err := c.write([]byte("PONG\r\n")); err != nil {
+				return "", nil, err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return "", nil, errors.New(strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		case strings.HasPrefix(line, "MSG "):
+			// MSG <subject> <sid> [reply-to] <#bytes>
+			f := strings.Fields(line)
+			if len(f) < 4 {
+				return "", nil, fmt.Errorf("malformed %q", line)
+			}
+			n, err := strconv.Atoi(f[len(f)-1])
+			if err != nil || n < 0 || n > natsMaxPayload {
+				return "", nil, fmt.Errorf("malformed %q", line)
+			}
+			payload := make([]byte, n+2) // payload and CRLF
+			if _, err := io.ReadFull(c.r, payload); err != nil {
+				return "", nil, err
+			}
+			return f[1], payload[:n], nil
+		}
+		// INFO updates, +OK and PONG need no action.
+	}
+}
+
+// parseNATSURL validates a server URL and fills in the default port.
+func parseNATSURL(serverURL string) (*url.URL, error) {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return nil, fmt.Errorf("nats: server: %w", err)
+	}
+	if u.Scheme != "nats" && u.Scheme != "tls" {
+		return nil, fmt.Errorf("nats: server: unsupported scheme %q", u.Scheme)
+	}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), "4222")
+	}
+	return u, nil
+}
+
+// NATSSink publishes transcript pieces to a NATS subject per session: the
+// subject is cfg.NATSSubject with "{session}" replaced by the session ID.
+type NATSSink struct {
+	server  *url.URL
+	subject string
+	queue   chan []byte // encoded PUB commands
+	dropped atomic.Int64
+}
+
+// NewNATSSink returns a sink publishing to the NATS server at serverURL and
+// starts its connection, which lives until ctx is done.
+func NewNATSSink(ctx context.Context, serverURL, subject string) (*NATSSink, error) {
+	u, err := parseNATSURL(serverURL)
+	if err != nil {
+		return nil, err
+	}
+	s := &NATSSink{server: u, subject: subject, queue: make(chan []byte, natsQueue)}
+	go runConnected(ctx, "nats", u.Host, s.session)
+	return s, nil
+}
+
+// Publish queues piece for the session's subject.
+func (s *NATSSink) Publish(sessionID string, piece TranscriptPiece) {
+	if payload, err := json.Marshal(newPublishedTranscript(sessionID, piece)); err == nil {
+		s.enqueue(sessionID, payload, !piece.Partial)
+	}
+}
+
+// PublishSummary queues the summary for the session's subject.
+func (s *NATSSink) PublishSummary(summary SummaryEvent) {
+	if payload, err := json.Marshal(summary); err == nil {
+		s.enqueue(summary.SessionID, payload, false)
+	}
+}
+
+// enqueue queues payload for the session's subject, dropping it if the
+// queue is full, with wait only after sinkFinalWait.
+func (s *NATSSink) enqueue(sessionID string, payload []byte, wait bool) {
+	subject := strings.ReplaceAll(s.subject, "{session}", sessionID)
+	pub := append(fmt.Appendf(nil, "PUB %s %d\r\n", subject, len(payload)), append(payload, "\r\n"...)...)
+	if !enqueueSinkMessage(s.queue, pub, wait) {
+		dropped := s.dropped.Add(1)
+		if wait {
+			slog.Error("nats: queue full; dropping a final", slog.String("session", sessionID), slog.Int64("dropped", dropped))
+		} else if dropped%100 == 1 {
+			slog.Warn("nats: queue full; dropping messages", slog.Int64("dropped", dropped))
+		}
+	}
+}
+
+// session connects once and publishes queued messages until the connection
+// fails or ctx is done.
+func (s *NATSSink) session(ctx context.Context) error {
+	c, err := dialNATS(ctx, s.server)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	slog.Info("nats: connected", slog.String("addr", s.server.Host))
+
+	// Reader: answers pings and notices a broken connection.
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			if _, _, err := c.next(); err != nil {
+				readErr <- err
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case pub := <-s.queue:
+			if err := c.write(pub); err != nil {
+				return err
+			}
+		case err := <-readErr:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// natsStream is the state ServeNATSAudio keeps per subject.
+type natsStream struct {
+	in       chan AudioChunk
+	session  *Session
+	tsMs     int64
+	lastSeen time.Time
+}
+
+// ServeNATSAudio subscribes to subject on the NATS server at serverURL until
+// ctx is done and transcribes the audio published to every matching subject
+// as a job (see the note above).
+func ServeNATSAudio(ctx context.Context, serverURL, subject string, client *TranscribeClient, cfg Config, jobs *JobStore, sessions *SessionRegistry) error {
+	u, err := parseNATSURL(serverURL)
+	if err != nil {
+		return err
+	}
+
+	var (
+		mu      sync.Mutex
+		streams = make(map[string]*natsStream)
+	)
+	// end removes a stream and lets its pipeline finish. Called with mu held.
+	end := func(key string, s *natsStream) {
+		delete(streams, key)
+		go func() {
+			select {
+			case s.in <- AudioChunk{Final: true, TsMs: s.tsMs}:
+			case <-ctx.Done():
+			}
+			close(s.in)
+		}()
+	}
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for key, s := range streams {
+			end(key, s)
+		}
+	}()
+
+	// Sweeper: end streams that went quiet.
+	go func() {
+		ticker := time.NewTicker(natsIdleTimeout / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				mu.Lock()
+				for key, s := range streams {
+					if now.Sub(s.lastSeen) > natsIdleTimeout {
+						slog.Info("nats: audio stream idle; ending", slog.String("subject", key))
+						end(key, s)
+					}
+				}
+				mu.Unlock()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	// handle feeds one message into its stream. As with RTP, a stream that
+	// falls behind loses audio instead of stalling the subscription.
+	handle := func(key string, payload []byte) {
+		mu.Lock()
+		defer mu.Unlock()
+		s, ok := streams[key]
+		if len(payload) == 0 {
+			if ok {
+				slog.Info("nats: audio stream ended", slog.String("subject", key))
+				end(key, s)
+			}
+			return
+		}
+		if !ok {
+			job := jobs.add("nats "+key, "")
+			s = &natsStream{
+				in:      make(chan AudioChunk, rtpStreamBuffer),
+				session: &Session{ID: job.ID, Remote: u.Host, Started: time.Now(), Stats: &AudioStats{}},
+			}
+			s.session.SetLabels(map[string]string{"subject": key})
+			streams[key] = s
+			go jobs.transcribe(ctx, client, cfg, s.in, false, s.session, job, sessions, Entitlements{})
+			slog.Info("nats: audio stream started", slog.String("subject", key), slog.Any("session", s.session))
+		}
+		s.lastSeen = time.Now()
+		s.session.Stats.addFrame(len(payload))
+		chunk := newLiveChunk(payload[:len(payload)&^1], s.tsMs)
+		s.tsMs += pcmDuration(len(chunk.PCM)).Milliseconds()
+		select {
+		case s.in <- chunk:
+		default:
+			s.session.Stats.Drops.Chunks.Add(1)
+			s.session.Stats.Drops.Bytes.Add(int64(len(chunk.PCM)))
+			chunk.Release()
+		}
+	}
+
+	runConnected(ctx, "nats-audio", u.Host, func(ctx context.Context) error {
+		c, err := dialNATS(ctx, u)
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-ctx.Done():
+				_ = c.Close() // unblocks next
+			case <-done:
+			}
+		}()
+		if err := c.write(fmt.Appendf(nil, "SUB %s 1\r\n", subject)); err != nil {
+			return err
+		}
+		slog.Info("nats: subscribed to audio", slog.String("addr", u.Host), slog.String("subject", subject))
+		for {
+			key, payload, err := c.next()
+			if err != nil {
+				return err
+			}
+			handle(key, payload)
+		}
+	})
+	return nil
+}
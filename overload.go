@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+)
+
+// overloadQueueLen is how many chunks forwardAudio holds locally while the
+// Transcribe sender is not keeping up, before the drop policy applies, unless
+// the session's QoS class says otherwise (see qos.go).
+const overloadQueueLen = 16
+
+// DropPolicy decides what happens to audio when the Transcribe sender falls
+// behind and the forwarding queue is full.
+type DropPolicy string
+
+const (
+	// DropPolicyBlock stops reading new audio until there is room again. No
+	// audio is lost, but latency grows and backpressure reaches the client.
+	DropPolicyBlock DropPolicy = "block"
+	// DropPolicyOldest discards the oldest queued chunk to make room, favoring
+	// recency over completeness.
+	DropPolicyOldest DropPolicy = "drop-oldest"
+	// DropPolicyNewest discards the incoming chunk, keeping what is queued.
+	DropPolicyNewest DropPolicy = "drop-newest"
+)
+
+// parseDropPolicy validates a policy name given on the command line.
+func parseDropPolicy(s string) (DropPolicy, error) {
+	switch p := DropPolicy(s); p {
+	case DropPolicyBlock, DropPolicyOldest, DropPolicyNewest:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown drop policy %q (want %s, %s or %s)", s, DropPolicyBlock, DropPolicyOldest, DropPolicyNewest)
+	}
+}
+
+// SlowDownEvent asks the client to send audio more slowly: the queue towards
+// Transcribe holds half of what it may before the drop policy applies (see
+// forwardAudio).
+type SlowDownEvent struct {
+	Type         string  `json:"type"`
+	BacklogMs    int64   `json:"backlog_ms"` // of audio queued
+	QueuedChunks int     `json:"queued_chunks"`
+	Stream       *uint16 `json:"stream,omitempty"` // ?framing=mux only
+}
+
+func (e SlowDownEvent) EventType() string { return e.Type }
+
+// dropCounters counts the audio discarded by the overload policy of a
+// session. Fields are atomic so they can be read while the session runs.
+type dropCounters struct {
+	Chunks atomic.Int64
+	Bytes  atomic.Int64
+}
+
+// forwardAudio pumps chunks from in to audioIn until in is closed or ctx is
+// canceled. While audioIn is full, up to queueLen chunks are held in a local
+// queue; once that is full as well, policy decides whether to wait or
+// which chunk to discard. Discarded chunks are released and counted in drops.
+// Final chunks are never dropped.
+//
+// Before it comes to that, slowDown (if not nil) is called once the queue is
+// half full, so a well-behaved client can lower its rate; it is called again
+// only after the queue has drained.
+//
+// The loop uses the nil-channel idiom: a select case on a nil channel never
+// fires, so setting recv or send to nil switches that case off.
+func forwardAudio(ctx context.Context, in <-chan AudioChunk, audioIn chan<- AudioChunk, policy DropPolicy, queueLen int, drops *dropCounters, slowDown func(SlowDownEvent)) {
+	var (
+		queue     []AudioChunk
+		signaled  bool // slowDown was called since the queue was last empty
+		watermark = max(queueLen/2, 1)
+	)
+	backlog := func() SlowDownEvent {
+		var bytes int
+		for _, ch := range queue {
+			bytes += len(ch.PCM)
+		}
+		return SlowDownEvent{Type: "slow_down", BacklogMs: pcmDuration(bytes).Milliseconds(), QueuedChunks: len(queue)}
+	}
+	drop := func(ch AudioChunk) {
+		drops.Chunks.Add(1)
+		drops.Bytes.Add(int64(len(ch.PCM)))
+		loggerFrom(ctx).Debug("forward: chunk dropped", slog.String("policy", string(policy)), slog.Int64("ts_ms", ch.TsMs))
+		ch.Release()
+	}
+	defer func() {
+		if n := drops.Chunks.Load(); n > 0 {
+			loggerFrom(ctx).Warn("forward: audio dropped due to overload", slog.String("policy", string(policy)), slog.Int64("chunks", n), slog.Int64("bytes", drops.Bytes.Load()))
+		}
+	}()
+
+	// queued is how much of queue the audio queue metric counts.
+	var queued int
+	defer func() { metrics.audioQueued.Add(-int64(queued)) }()
+
+	for in != nil || len(queue) > 0 {
+		metrics.audioQueued.Add(int64(len(queue) - queued))
+		queued = len(queue)
+		recv := in
+		if policy == DropPolicyBlock && len(queue) >= queueLen {
+			recv = nil
+		}
+		var (
+			send chan<- AudioChunk
+			head AudioChunk
+		)
+		if len(queue) > 0 {
+			send, head = audioIn, queue[0]
+		}
+
+		select {
+		case ch, ok := <-recv:
+			if !ok {
+				in = nil
+				continue
+			}
+			if len(queue) >= queueLen && !ch.Final {
+				switch policy {
+				case DropPolicyNewest:
+					drop(ch)
+					continue
+				case DropPolicyOldest:
+					drop(queue[0])
+					queue = queue[1:]
+				}
+			}
+			queue = append(queue, ch)
+			if slowDown != nil && !signaled && len(queue) >= watermark {
+				signaled = true
+				ev := backlog()
+				loggerFrom(ctx).Info("forward: Transcribe falling behind; asking the client to slow down", slog.Int64("backlog_ms", ev.BacklogMs))
+				slowDown(ev)
+			}
+		case send <- head:
+			queue = queue[1:]
+			if len(queue) == 0 {
+				signaled = false
+			}
+		case <-ctx.Done():
+			for _, ch := range queue {
+				ch.Release()
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+)
+
+/*
+Learning note: Panics in goroutines
+===================================
+
+A panic that is not recovered ends the whole process, not just the goroutine
+it happened in: one malformed frame tripping an index out of range in a
+session's reader would take every other session on the server down with it.
+net/http recovers panics in handlers, but not in the goroutines a handler
+starts, and a session is mostly such goroutines.
+
+So the long-lived goroutines of a session (the Transcribe sender, receiver
+and closer, the WebSocket reader) start with
+
+	defer recoverPanic("sender", func(err error) { ... })
+
+recover() only stops a panic when it is called by a deferred function
+directly, which is why recoverPanic itself is what is deferred. It logs the
+panic with its stack and hands report a *panicError, which the goroutine
+turns into the way it normally fails: an error on errOut, or the session
+ending with reason "internal_error" (4500). The session is finalized and
+its client told, like after any other failure; the server keeps running.
+*/
+
+// panicError is a panic recovered in a session goroutine.
+type panicError struct {
+	component string
+	value     any
+}
+
+func (e *panicError) Error() string {
+	return fmt.Sprintf("%s: panic: %v", e.component, e.value)
+}
+
+// recoverPanic recovers a panic of the calling goroutine, logs it and passes
+// it to report as a *panicError. It must be deferred directly.
+func recoverPanic(component string, report func(err error)) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	slog.Error(component+": panic recovered", slog.Any("panic", v), slog.String("stack", string(debug.Stack())))
+	report(&panicError{component: component, value: v})
+}
@@ -0,0 +1,54 @@
+package main
+
+import "log/slog"
+
+// partialFilterMemory is how many finished results a partialFilter
+// remembers, to recognize partials that arrive after their final.
+const partialFilterMemory = 64
+
+// partialFilter drops the partials that tell the client nothing new. AWS
+// repeats a result's partial whenever it revises any part of it, often with
+// the same text, and with stabilization it may even send a partial of a
+// result it already finalized. So a partial passes only if its text differs
+// from the last one sent for its result, and only while the result is open.
+// Finals always pass. The zero value is ready to use, logging to
+// slog.Default(); it belongs to one stream.
+type partialFilter struct {
+	log      *slog.Logger        // of the session, see logging.go; nil for slog.Default()
+	open     map[string]string   // result ID -> text last sent
+	finished map[string]struct{} // results whose final was sent
+	order    []string            // finished, oldest first
+}
+
+// keep reports whether p should be passed on, and records it if so.
+func (f *partialFilter) keep(p TranscriptPiece) bool {
+	if p.ResultID == "" {
+		return true
+	}
+	if f.open == nil {
+		f.open, f.finished = make(map[string]string), make(map[string]struct{})
+	}
+	if !p.Partial {
+		delete(f.open, p.ResultID)
+		f.finished[p.ResultID] = struct{}{}
+		f.order = append(f.order, p.ResultID)
+		if len(f.order) > partialFilterMemory {
+			delete(f.finished, f.order[0])
+			f.order = f.order[1:]
+		}
+		return true
+	}
+	if _, done := f.finished[p.ResultID]; done {
+		log := f.log
+		if log == nil {
+			log = slog.Default()
+		}
+		log.Debug("receiver: partial after its final dropped", slog.String("result", p.ResultID))
+		return false
+	}
+	if last, ok := f.open[p.ResultID]; ok && last == p.Text {
+		return false
+	}
+	f.open[p.ResultID] = p.Text
+	return true
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+/*
+Learning note: Pausing without ending the session
+=================================================
+
+A muted microphone or a confidential part of a call should not reach AWS,
+but the session should survive it: the client keeps its session ID, the
+transcript continues where it left off, and no new Transcribe stream has to
+be negotiated. After "pause" the reader discards the client's audio, and
+Transcribe would end a stream that got nothing for 15 seconds. So while a
+session is paused, padPauses sends silence in its place, at real time:
+
+	client audio --X (discarded)
+	             padPauses --> 100ms of silence every 100ms --> Transcribe
+
+Silence transcribes to nothing, keeps the stream's clock running (timestamps
+after "resume" still match the session's time), and costs the same as audio.
+The idle timeout (endIdleAudio) does not count paused time either.
+
+The paused flag is an atomic.Bool: the reader goroutine sets it, the stages
+read it, and nothing else about the pause needs to be shared.
+*/
+
+// silenceChunk is chunkMs of silence in the session format. It is only ever
+// read, so all sessions share it.
+var silenceChunk = make([]byte, sampleRateHz*chunkMs/1000*bytesPerSample*numChannels)
+
+// padPauses is a pipeline stage that forwards audio and, while paused is
+// set, sends silenceChunk every chunkMs so Transcribe keeps the stream open.
+// It stops padding once a Final chunk went through.
+func padPauses(ctx context.Context, in <-chan AudioChunk, paused *atomic.Bool) <-chan AudioChunk {
+	out := make(chan AudioChunk, cap(in))
+
+	go func() {
+		defer close(out)
+		ticker := time.NewTicker(chunkMs * time.Millisecond)
+		defer ticker.Stop()
+		var (
+			tsMs    int64 // end of the audio sent so far
+			ended   bool
+			padding bool
+		)
+		for {
+			var ch AudioChunk
+			select {
+			case next, ok := <-in:
+				if !ok {
+					return
+				}
+				ch, ended = next, next.Final
+				tsMs = max(tsMs, next.TsMs+pcmDuration(len(next.PCM)).Milliseconds())
+			case <-ticker.C:
+				if ended || !paused.Load() {
+					if padding {
+						padding = false
+						loggerFrom(ctx).Debug("pause: audio resumed; padding stopped", slog.Int64("ts_ms", tsMs))
+					}
+					continue
+				}
+				if !padding {
+					padding = true
+					loggerFrom(ctx).Debug("pause: padding with silence", slog.Int64("ts_ms", tsMs))
+				}
+				ch = AudioChunk{PCM: silenceChunk, TsMs: tsMs}
+				tsMs += chunkMs
+			case <-ctx.Done():
+				return
+			}
+
+			select {
+			case out <- ch:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out
+}
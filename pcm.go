@@ -0,0 +1,36 @@
+package main
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// sampleCount returns how many complete 16-bit samples pcm holds.
+func sampleCount(pcm []byte) int {
+	return len(pcm) / bytesPerSample
+}
+
+// sampleAt decodes the i-th little-endian 16-bit sample of pcm.
+func sampleAt(pcm []byte, i int) int16 {
+	return int16(binary.LittleEndian.Uint16(pcm[i*bytesPerSample:]))
+}
+
+// pcmDuration returns how long n bytes of audio in the session format last.
+func pcmDuration(n int) time.Duration {
+	return time.Duration(n) * time.Second / (sampleRateHz * bytesPerSample * numChannels)
+}
+
+// appendUpsampled2x appends samples to dst as s16le at twice their rate,
+// inserting between every two samples the value halfway between them. It
+// turns 8kHz telephony audio into the session's 16kHz.
+func appendUpsampled2x(dst []byte, samples []int16) []byte {
+	for i, s := range samples {
+		next := s
+		if i+1 < len(samples) {
+			next = samples[i+1]
+		}
+		dst = binary.LittleEndian.AppendUint16(dst, uint16(s))
+		dst = binary.LittleEndian.AppendUint16(dst, uint16((int32(s)+int32(next))/2))
+	}
+	return dst
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	// pcmBufferSize is the initial capacity of pooled PCM buffers. It fits the
+	// 1024-sample frames sent by the demo page without growing.
+	pcmBufferSize = 4096
+
+	// maxPooledPCMBuffer keeps an occasional oversized frame from pinning a
+	// large buffer in the pool forever.
+	maxPooledPCMBuffer = 64 * 1024
+)
+
+// pcmPool recycles the byte slices that back AudioChunk.PCM. Every WebSocket
+// frame needs its own copy of the payload (see ws-reader), and with many
+// concurrent sessions allocating a fresh slice per frame creates a lot of GC
+// churn. Pointers to slices are stored so Put does not allocate.
+var pcmPool = sync.Pool{
+	New: func() any {
+		b := make([]byte, 0, pcmBufferSize)
+		return &b
+	},
+}
+
+// newPooledChunk copies data into a buffer taken from pcmPool and returns an
+// AudioChunk owning it. The chunk must be released exactly once, by whoever
+// consumes it last, via Release.
+func newPooledChunk(data []byte, tsMs int64) AudioChunk {
+	buf := getPCMBuffer()
+	*buf = append(*buf, data...)
+	return AudioChunk{PCM: *buf, TsMs: tsMs, pooled: buf}
+}
+
+// newLiveChunk is newPooledChunk for audio arriving from a client as it is
+// captured: the chunk is stamped with its arrival (see latency.go).
+func newLiveChunk(data []byte, tsMs int64) AudioChunk {
+	ch := newPooledChunk(data, tsMs)
+	ch.Received = time.Now()
+	return ch
+}
+
+// getPCMBuffer takes an empty buffer from pcmPool. Stages that produce new
+// PCM fill it and attach it to their output chunk with withPooledPCM.
+func getPCMBuffer() *[]byte {
+	buf := pcmPool.Get().(*[]byte)
+	*buf = (*buf)[:0]
+	return buf
+}
+
+// withPooledPCM returns a copy of c whose PCM is the pooled buffer buf. The
+// buffer previously owned by c is released.
+func (c AudioChunk) withPooledPCM(buf *[]byte) AudioChunk {
+	c.Release()
+	c.PCM, c.pooled = *buf, buf
+	return c
+}
+
+// Release hands the chunk's PCM buffer back to pcmPool. It is a no-op for
+// chunks that were not created with newPooledChunk. After Release the PCM
+// slice must not be touched anymore.
+func (c AudioChunk) Release() {
+	if c.pooled == nil || cap(*c.pooled) > maxPooledPCMBuffer {
+		return
+	}
+	pcmPool.Put(c.pooled)
+}
+
+// sendChunk hands ch to out, unless ctx is done first: then ch is released,
+// since nobody downstream will, and sendChunk reports false. Readers use it
+// instead of a bare send so a session whose pipeline has stopped reading
+// cannot keep them blocked forever.
+func sendChunk(ctx context.Context, out chan<- AudioChunk, ch AudioChunk) bool {
+	select {
+	case out <- ch:
+		return true
+	case <-ctx.Done():
+		ch.Release()
+		return false
+	}
+}
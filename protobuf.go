@@ -0,0 +1,233 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+
+	"github.com/gorilla/websocket"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+/*
+Learning note: Protobuf without generated code
+==============================================
+
+JSON is convenient in the browser but verbose: a level event is ~60 bytes and
+is sent ten times a second. Clients that care about bandwidth can ask for the
+"gochannels.protobuf.v1" WebSocket subprotocol instead; then every binary
+frame in both directions is a protobuf message described in stream.proto.
+
+The messages are small and flat, so rather than running protoc and checking
+in generated code we write and read the wire format directly with protowire:
+each field is a tag (field number + wire type) followed by its value. As in
+proto3, fields holding their zero value are simply left out.
+*/
+
+// protobufSubprotocol is the WebSocket subprotocol that selects protobuf
+// encoding (see stream.proto).
+const protobufSubprotocol = "gochannels.protobuf.v1"
+
+// Field numbers of ServerMessage.event, see stream.proto.
+const (
+	pbTranscript protowire.Number = iota + 1
+	pbLevel
+	pbWarning
+	pbDTMF
+	pbSegment
+	pbSession
+	pbSummary
+	pbClosing
+	pbPong
+	pbSlowDown
+	pbQueued
+	pbBackoff
+	pbOptions
+)
+
+// pbSeq is the field number of ServerMessage.seq.
+const pbSeq protowire.Number = 15
+
+// errNoProtobufMessage is returned for events without a ServerMessage
+// member; the writer skips them.
+var errNoProtobufMessage = errors.New("no protobuf message")
+
+// protobufCodec writes every event as a binary ServerMessage frame.
+type protobufCodec struct{}
+
+func (protobufCodec) encode(ev Event, seq uint64) (int, []byte, error) {
+	var (
+		num  protowire.Number
+		body []byte
+	)
+	switch e := ev.(type) {
+	case TranscriptEvent:
+		num = pbTranscript
+		body = pbString(body, 1, e.Text)
+		body = pbBool(body, 2, e.Partial)
+		body = pbBool(body, 3, e.Replayed)
+		body = pbInt64(body, 4, int64(e.ReplayOf))
+	case LevelEvent:
+		num = pbLevel
+		body = pbDouble(body, 1, e.RMS)
+		body = pbDouble(body, 2, e.Peak)
+		body = pbInt64(body, 3, e.TsMs)
+	case WarningEvent:
+		num = pbWarning
+		body = pbString(body, 1, e.Code)
+		body = pbString(body, 2, e.Message)
+		body = pbDouble(body, 3, e.Value)
+		body = pbInt64(body, 4, e.TsMs)
+	case DTMFEvent:
+		num = pbDTMF
+		body = pbString(body, 1, e.Digit)
+		body = pbInt64(body, 2, e.TsMs)
+	case SegmentEvent:
+		num = pbSegment
+		body = pbString(body, 1, string(e.Class))
+		body = pbBool(body, 2, e.Suppressed)
+		body = pbInt64(body, 3, e.TsMs)
+	case SessionEvent:
+		num = pbSession
+		body = pbString(body, 1, e.ID)
+		body = pbString(body, 2, e.Token)
+		body = pbBool(body, 3, e.Resumed)
+		body = pbBool(body, 4, e.Ack)
+	case SummaryEvent:
+		num = pbSummary
+		body = pbString(body, 1, e.SessionID)
+		keys := make([]string, 0, len(e.Labels))
+		for k := range e.Labels {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+		for _, k := range keys {
+			var entry []byte
+			entry = pbString(entry, 1, k)
+			entry = pbString(entry, 2, e.Labels[k])
+			body = pbMessage(body, 2, entry)
+		}
+		var stats []byte
+		stats = pbInt64(stats, 1, e.Stats.BytesReceived)
+		stats = pbInt64(stats, 2, e.Stats.Chunks)
+		stats = pbInt64(stats, 3, e.Stats.AudioMs)
+		stats = pbDouble(stats, 4, e.Stats.SilenceRatio)
+		stats = pbDouble(stats, 5, e.Stats.AverageLevel)
+		stats = pbInt64(stats, 6, e.Stats.DecodeErrors)
+		stats = pbInt64(stats, 7, e.Stats.MissingFrames)
+		stats = pbInt64(stats, 8, e.Stats.DroppedChunks)
+		body = pbMessage(body, 3, stats)
+		body = pbInt64(body, 4, e.DurationMs)
+		var counts []byte
+		counts = pbInt64(counts, 1, e.Transcript.Partials)
+		counts = pbInt64(counts, 2, e.Transcript.Finals)
+		counts = pbInt64(counts, 3, e.Transcript.Words)
+		counts = pbDouble(counts, 4, e.Transcript.AverageConfidence)
+		body = pbMessage(body, 5, counts)
+		body = pbString(body, 6, e.Error)
+		body = pbDouble(body, 7, e.CostUSD)
+	case ClosingEvent:
+		num = pbClosing
+		body = pbString(body, 1, e.Reason)
+		body = pbString(body, 2, e.Message)
+		body = pbInt64(body, 3, int64(e.CloseCode))
+	case PongEvent:
+		num = pbPong
+		body = pbString(body, 1, e.ID)
+	case SlowDownEvent:
+		num = pbSlowDown
+		body = pbInt64(body, 1, e.BacklogMs)
+		body = pbInt64(body, 2, int64(e.QueuedChunks))
+	case QueuedEvent:
+		num = pbQueued
+		body = pbInt64(body, 1, int64(e.Position))
+		body = pbString(body, 2, e.Message)
+	case BackoffEvent:
+		num = pbBackoff
+		body = pbInt64(body, 1, e.RetryAfterMs)
+		body = pbString(body, 2, e.Message)
+	case OptionsEvent:
+		num = pbOptions
+		body = pbString(body, 1, e.Language)
+		body = pbString(body, 2, e.Vocabulary)
+		body = pbInt64(body, 3, e.TsMs)
+	default:
+		return 0, nil, fmt.Errorf("encode %s event: %w", ev.EventType(), errNoProtobufMessage)
+	}
+	// A oneof member is always written, even when empty, so the client can
+	// tell which event it got.
+	msg := protowire.AppendBytes(protowire.AppendTag(nil, num, protowire.BytesType), body)
+	return websocket.BinaryMessage, pbInt64(msg, pbSeq, int64(seq)), nil
+}
+
+func pbString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func pbBool(b []byte, num protowire.Number, v bool) []byte {
+	if !v {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, 1)
+}
+
+func pbInt64(b []byte, num protowire.Number, v int64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(v))
+}
+
+func pbDouble(b []byte, num protowire.Number, v float64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, math.Float64bits(v))
+}
+
+func pbMessage(b []byte, num protowire.Number, msg []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, msg)
+}
+
+var errBadAudioFrame = errors.New("malformed AudioFrame")
+
+// parseAudioFrame decodes an AudioFrame message. The payload aliases data.
+// Unknown fields are skipped, as protobuf requires.
+func parseAudioFrame(data []byte) (seq uint32, captureMs int64, payload []byte, err error) {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return 0, 0, nil, fmt.Errorf("%w: %v", errBadAudioFrame, protowire.ParseError(n))
+		}
+		data = data[n:]
+
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(data)
+			seq = uint32(v)
+		case num == 2 && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(data)
+			captureMs = int64(v)
+		case num == 3 && typ == protowire.BytesType:
+			payload, n = protowire.ConsumeBytes(data)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, data)
+		}
+		if n < 0 {
+			return 0, 0, nil, fmt.Errorf("%w: %v", errBadAudioFrame, protowire.ParseError(n))
+		}
+		data = data[n:]
+	}
+	return seq, captureMs, payload, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+)
+
+/*
+Learning note: QoS classes
+==========================
+
+Not every session minds the same thing when the server is busy. A live
+caption needs its words now and would rather lose a moment of audio than
+fall behind; a batch of recorded calls can wait for a slot and take its time,
+as long as nothing is lost. Every session runs in one of three classes:
+
+	class        buffers      when AWS falls behind   admitted while
+	realtime     4 chunks     drop the oldest audio   any slot is free
+	standard     16 chunks    -drop-policy            a slot outside the reserve is free
+	best-effort  64 chunks    wait (never drop)       the server is below -qos-best-effort-load
+
+Buffers are the audio between the connection's reader and the pipeline
+stages, and the queue of forwardAudio: small buffers keep latency low, large
+ones ride out bursts. -qos-realtime-reserve keeps that many of -max-sessions
+for realtime sessions, so a full server still takes a live caption; and
+best-effort sessions are refused (uploads and replays wait) once that share
+of -max-sessions is in use, which leaves the rest of the slots to
+interactive sessions during overload. Without -max-sessions every session is
+admitted, whatever its class.
+
+The class is that of the API key ("qos" in the key file), or -qos for
+requests without one. A request can ask for another with ?qos=, but never
+for a class above its key's: realtime is what the reserve is kept for.
+*/
+
+// QoSClass is the priority class of a session (see the note above).
+type QoSClass string
+
+const (
+	QoSRealtime   QoSClass = "realtime"
+	QoSStandard   QoSClass = "standard"
+	QoSBestEffort QoSClass = "best-effort"
+)
+
+// qosRank orders the classes by priority.
+var qosRank = map[QoSClass]int{QoSBestEffort: 0, QoSStandard: 1, QoSRealtime: 2}
+
+// parseQoSClass validates a class name given on the command line, in the API
+// key file or in a request.
+func parseQoSClass(s string) (QoSClass, error) {
+	if _, ok := qosRank[QoSClass(s)]; !ok {
+		return "", fmt.Errorf("unknown QoS class %q (want %s, %s or %s)", s, QoSRealtime, QoSStandard, QoSBestEffort)
+	}
+	return QoSClass(s), nil
+}
+
+// qosTier is what a class means for the pipeline of a session.
+type qosTier struct {
+	Class       QoSClass
+	AudioBuffer int        // chunks between the reader and the pipeline stages
+	QueueLen    int        // chunks forwardAudio holds before DropPolicy applies
+	DropPolicy  DropPolicy // once the queue is full
+}
+
+// qosTierOf returns the tier of class; standard sessions follow
+// cfg.DropPolicy.
+func qosTierOf(cfg Config, class QoSClass) qosTier {
+	switch class {
+	case QoSRealtime:
+		return qosTier{Class: class, AudioBuffer: 4, QueueLen: 4, DropPolicy: DropPolicyOldest}
+	case QoSBestEffort:
+		return qosTier{Class: class, AudioBuffer: 64, QueueLen: 64, DropPolicy: DropPolicyBlock}
+	}
+	return qosTier{Class: QoSStandard, AudioBuffer: 16, QueueLen: overloadQueueLen, DropPolicy: cfg.DropPolicy}
+}
+
+// qosFor returns the tier of a request with the entitlements e: that of
+// ?qos= if given, of the API key otherwise, and of cfg.QoS for requests
+// without a class on either. A request cannot ask for a class above its
+// key's.
+func qosFor(cfg Config, e Entitlements, r *http.Request) (qosTier, error) {
+	ceiling := cfg.QoS
+	if e.QoS != "" {
+		ceiling = e.QoS
+	}
+	class := ceiling
+	if v := r.URL.Query().Get("qos"); v != "" {
+		requested, err := parseQoSClass(v)
+		if err != nil {
+			return qosTier{}, err
+		}
+		if qosRank[requested] > qosRank[ceiling] {
+			return qosTier{}, fmt.Errorf("QoS class %s is above the %s this client may use", requested, ceiling)
+		}
+		class = requested
+	}
+	return qosTierOf(cfg, class), nil
+}
+
+// SetQoS keeps realtimeReserve of the registry's slots for realtime
+// sessions, and admits best-effort sessions only while fewer than
+// bestEffortLoad (0..1) of the slots are in use.
+func (r *SessionRegistry) SetQoS(realtimeReserve int, bestEffortLoad float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.realtimeReserve, r.bestEffortLoad = realtimeReserve, bestEffortLoad
+}
+
+// capacity returns how many slots may be in use for a session of class to
+// be admitted. The caller holds r.mu.
+func (r *SessionRegistry) capacity(class QoSClass) int {
+	n := r.limit
+	if class != QoSRealtime {
+		n -= r.realtimeReserve
+	}
+	if class == QoSBestEffort && r.bestEffortLoad > 0 {
+		n = min(n, int(math.Ceil(float64(r.limit)*r.bestEffortLoad)))
+	}
+	return n
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+)
+
+const (
+	// qualityWindowMs is how much audio is analyzed before deciding whether the
+	// input is clipping or carries a DC offset.
+	qualityWindowMs = 1000
+
+	// qualityWarnEveryMs throttles repeated warnings of the same kind while the
+	// condition persists, measured in audio time.
+	qualityWarnEveryMs = 10000
+
+	// clipLevel is the absolute sample value considered clipped (~99% of full scale).
+	clipLevel = 32440
+
+	// clipRatio is the fraction of clipped samples in a window that triggers a warning.
+	clipRatio = 0.01
+
+	// dcOffsetLevel is the absolute window mean, relative to full scale, that
+	// triggers a DC offset warning.
+	dcOffsetLevel = 0.05
+)
+
+// WarningEvent tells the client about a condition on its input that is likely
+// to hurt transcription accuracy, e.g. clipping or DC offset.
+type WarningEvent struct {
+	Type    string  `json:"type"`
+	Code    string  `json:"code"`
+	Message string  `json:"message"`
+	Value   float64 `json:"value"`
+	TsMs    int64   `json:"ts_ms"`
+}
+
+func (e WarningEvent) EventType() string { return e.Type }
+
+// checkAudioQuality is a pass-through pipeline stage that looks for clipping
+// (too many samples at full scale) and DC offset (a non-zero signal mean).
+// Both silently wreck recognition accuracy, so whenever one is detected a
+// WarningEvent is pushed to events and a warning is logged.
+func checkAudioQuality(ctx context.Context, in <-chan AudioChunk, events chan<- Event) <-chan AudioChunk {
+	out := make(chan AudioChunk, cap(in))
+	windowSamples := sampleRateHz * qualityWindowMs / 1000
+	warnEverySamples := sampleRateHz * qualityWarnEveryMs / 1000
+
+	go func() {
+		defer close(out)
+		var (
+			sum      float64
+			clipped  int
+			samples  int
+			position int // samples analyzed since the session started
+
+			// position of the last warning per code; -1 means never warned
+			lastWarned = map[string]int{"clipping": -1, "dc_offset": -1}
+		)
+
+		warn := func(code, message string, value float64, tsMs int64) {
+			if last := lastWarned[code]; last >= 0 && position-last < warnEverySamples {
+				return
+			}
+			lastWarned[code] = position
+			loggerFrom(ctx).Warn("quality: "+message, slog.String("code", code), slog.Float64("value", value), slog.Int64("ts_ms", tsMs))
+			emitEvent(events, WarningEvent{Type: "warning", Code: code, Message: message, Value: value, TsMs: tsMs})
+		}
+
+		for ch := range in {
+			for i := range sampleCount(ch.PCM) {
+				s := sampleAt(ch.PCM, i)
+				sum += float64(s)
+				if s >= clipLevel || s <= -clipLevel {
+					clipped++
+				}
+				samples++
+				position++
+
+				if samples < windowSamples {
+					continue
+				}
+				if ratio := float64(clipped) / float64(samples); ratio >= clipRatio {
+					warn("clipping", fmt.Sprintf("input is clipping (%.1f%% of samples at full scale)", ratio*100), ratio, ch.TsMs)
+				}
+				if mean := sum / float64(samples) / math.MaxInt16; math.Abs(mean) >= dcOffsetLevel {
+					warn("dc_offset", fmt.Sprintf("input has a DC offset of %.1f%% full scale", mean*100), mean, ch.TsMs)
+				}
+				sum, clipped, samples = 0, 0, 0
+			}
+
+			select {
+			case out <- ch:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+Learning note: Tenant quotas
+============================
+
+Budgets (see capAudioDuration) bound one session; quotas bound a tenant. On
+top of the usage the UsageMeter accounts (see usage.go), TenantQuotas holds
+every tenant to:
+
+  - daily_minutes / monthly_minutes: audio per UTC day / calendar month
+  - max_sessions: sessions running at the same time
+
+Each comes from the tenant's API key entitlements, or else from the flag of
+the same name (-tenant-daily-minutes, ...), so the flags are the quota of
+every tenant, anonymous included, unless its key says otherwise.
+
+A session is admitted before it starts (SessionRegistry.Admit). What happens
+to one over its quota depends on the key's "over_quota" (or -over-quota):
+
+  - "reject" (default): the request is refused with 429, a Retry-After of
+    the next day or month, and the reason tenant_quota_exceeded. A session
+    admitted under the quota is given the minutes left as an extra budget,
+    and ends with tenant_quota_exceeded (4429) when it uses them up.
+  - "finals_only": the session runs, degraded: partial transcripts are
+    dropped (dropPartials), which saves the tenant's clients most of the
+    traffic, and the client gets a "finals_only" warning. Minutes still
+    count, and the session is not ended.
+
+The concurrency cap always rejects. Sessions admitted together each see the
+minutes left when they start, so a tenant starting many at once can go over
+its quota by what they use together; the next session is refused.
+*/
+
+// Over-quota policies of Entitlements.OverQuota.
+const (
+	overQuotaReject     = "reject"
+	overQuotaFinalsOnly = "finals_only"
+)
+
+// quotaError is why a tenant's session was refused.
+type quotaError struct {
+	message    string
+	retryAfter time.Duration
+}
+
+func (e *quotaError) Error() string { return e.message }
+
+func (e *quotaError) Unwrap() error { return ErrQuota }
+
+// tenantAdmission is what a session of a tenant may do; see
+// SessionRegistry.Admit.
+type tenantAdmission struct {
+	// release gives back the tenant's session slot; it must be called once
+	// the session is over. Calling it more than once is harmless.
+	release func()
+	// finalsOnly degrades the session to final transcripts.
+	finalsOnly bool
+	// remaining is the audio the tenant has left, 0 = no minute quota.
+	remaining time.Duration
+}
+
+// TenantQuotas enforces the quotas of tenants (see the note above). It is
+// safe for concurrent use.
+type TenantQuotas struct {
+	meter    *UsageMeter
+	defaults Entitlements // the flags
+
+	mu      sync.Mutex
+	running map[string]int // sessions per tenant
+}
+
+// NewTenantQuotas returns quotas checked against the usage of meter, with
+// the quotas of cfg for entitlements that set none.
+func NewTenantQuotas(meter *UsageMeter, cfg Config) *TenantQuotas {
+	return &TenantQuotas{
+		meter: meter,
+		defaults: Entitlements{
+			DailyMinutes:   cfg.TenantDailyMinutes,
+			MonthlyMinutes: cfg.TenantMonthlyMinutes,
+			MaxSessions:    cfg.TenantMaxSessions,
+			OverQuota:      cfg.OverQuota,
+		},
+		running: make(map[string]int),
+	}
+}
+
+// Admit checks the quotas of the tenant of e and takes one of its session
+// slots, or fails with a *quotaError.
+func (q *TenantQuotas) Admit(e Entitlements) (tenantAdmission, error) {
+	if e.DailyMinutes == 0 {
+		e.DailyMinutes = q.defaults.DailyMinutes
+	}
+	if e.MonthlyMinutes == 0 {
+		e.MonthlyMinutes = q.defaults.MonthlyMinutes
+	}
+	if e.MaxSessions == 0 {
+		e.MaxSessions = q.defaults.MaxSessions
+	}
+	if e.OverQuota == "" {
+		e.OverQuota = q.defaults.OverQuota
+	}
+	tenant := e.Tenant
+	if tenant == "" {
+		tenant = anonymousTenant
+	}
+
+	var admission tenantAdmission
+	now := time.Now().UTC()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	for _, quota := range []struct {
+		name    string
+		minutes float64
+		from    time.Time
+		next    time.Time
+	}{
+		{"daily", e.DailyMinutes, today, today.AddDate(0, 0, 1)},
+		{"monthly", e.MonthlyMinutes, month, month.AddDate(0, 1, 0)},
+	} {
+		if quota.minutes <= 0 {
+			continue
+		}
+		var used float64
+		if u := q.meter.Usage(tenant, quota.from, now)[tenant]; u != nil {
+			used = u.AudioSeconds
+		}
+		left := time.Duration((quota.minutes*60 - used) * float64(time.Second))
+		if left <= 0 {
+			if e.OverQuota == overQuotaFinalsOnly {
+				admission.finalsOnly = true
+				break
+			}
+			slog.Warn("quota: tenant over quota; rejecting", slog.String("tenant", tenant), slog.String("quota", quota.name))
+			return tenantAdmission{}, &quotaError{
+				message:    fmt.Sprintf("tenant %s used its %s quota of %g minutes", tenant, quota.name, quota.minutes),
+				retryAfter: quota.next.Sub(now),
+			}
+		}
+		if admission.remaining == 0 || left < admission.remaining {
+			admission.remaining = left
+		}
+	}
+	if admission.finalsOnly {
+		admission.remaining = 0
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if e.MaxSessions > 0 && q.running[tenant] >= e.MaxSessions {
+		return tenantAdmission{}, &quotaError{
+			message:    fmt.Sprintf("tenant %s is running its maximum of %d sessions", tenant, e.MaxSessions),
+			retryAfter: sessionRetryAfter,
+		}
+	}
+	q.running[tenant]++
+	var once sync.Once
+	admission.release = func() {
+		once.Do(func() {
+			q.mu.Lock()
+			defer q.mu.Unlock()
+			if q.running[tenant]--; q.running[tenant] == 0 {
+				delete(q.running, tenant)
+			}
+		})
+	}
+	return admission, nil
+}
+
+// rejectQuota answers a request whose tenant is over a quota.
+func rejectQuota(w http.ResponseWriter, err error) {
+	retryAfter := sessionRetryAfter
+	var qe *quotaError
+	if errors.As(err, &qe) {
+		retryAfter = qe.retryAfter
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+	writeError(w, "tenant_quota_exceeded", err)
+}
+
+// finalsOnlyWarning tells the client of a degraded session why it gets no
+// partial transcripts.
+var finalsOnlyWarning = WarningEvent{Type: "warning", Code: "finals_only", Message: "the tenant is over its quota; only final transcripts are sent"}
+
+// dropPartials passes on the final pieces from in and drops the partials.
+// Once ctx is done it only drains in.
+func dropPartials(ctx context.Context, in <-chan TranscriptPiece) <-chan TranscriptPiece {
+	out := make(chan TranscriptPiece, cap(in))
+	go func() {
+		defer close(out)
+		for piece := range in {
+			if piece.Partial {
+				continue
+			}
+			select {
+			case out <- piece:
+			case <-ctx.Done():
+			}
+		}
+	}()
+	return out
+}
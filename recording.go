@@ -0,0 +1,546 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"time"
+)
+
+/*
+Learning note: Recording and replaying sessions
+===============================================
+
+Was a bad transcript the audio's fault, or the model's? Would another
+language variant, or a custom vocabulary, have done better? With -record-dir
+the server keeps what it needs to find out. For every session it writes, to
+that directory:
+
+  - <id>.wav: the audio as sent to Transcribe (16 kHz mono s16le, after
+    decoding; see recordSession)
+  - <id>.json: the final transcript and the summary, once the session ended
+  - <id>.checkpoint.json: the transcript so far, while it runs (see
+    checkpoint.go)
+
+POST /sessions/{id}/replay (admin) runs the recording through a new
+Transcribe stream, with the options in its body if any:
+
+	{"language": "en-GB", "vocabulary": "product-names"}
+
+It answers 202 with a job ID, like an upload: the replay is a job (see
+upload.go), paced to real time again, so it takes as long as the session
+did, and waits for a session slot. Its transcript is followed with GET
+/jobs/{id}/transcript and, once done, kept as <id>.replay-<job>.json.
+GET /sessions/{id}/replays returns the original transcript next to every
+replay's, with the options each was run with, to compare them.
+
+The recordings are plain files and never deleted by the server; what keeps
+them, for how long, and where else they go (S3 with a lifecycle rule, ...)
+is for the deployment to decide. Session IDs are checked to be UUIDs before
+they name a file, so a request cannot reach outside the directory.
+*/
+
+// wavHeaderBytes is the size of the header createWAV writes.
+const wavHeaderBytes = 44
+
+// sessionIDPattern matches the IDs of newSessionID.
+var sessionIDPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+// errNotRecorded is returned for sessions that have no recording.
+var errNotRecorded = errors.New("session was not recorded")
+
+// Recorder keeps the audio and transcripts of sessions in a directory (see
+// the note above). It is a SessionObserver, writing a session's transcript
+// when it ends.
+type Recorder struct {
+	dir             string
+	checkpointEvery time.Duration // 0 = no checkpoints, see checkpoint.go
+}
+
+// NewRecorder returns a recorder writing to dir, which is created if needed,
+// and checkpointing sessions every checkpointEvery (0 = never).
+func NewRecorder(dir string, checkpointEvery time.Duration) (*Recorder, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("record: %w", err)
+	}
+	slog.Info("record: recording sessions", slog.String("dir", dir), slog.Duration("checkpoint_every", checkpointEvery))
+	return &Recorder{dir: dir, checkpointEvery: checkpointEvery}, nil
+}
+
+// path returns the file of session id with suffix, or false if id is not a
+// session ID.
+func (rec *Recorder) path(id, suffix string) (string, bool) {
+	if !sessionIDPattern.MatchString(id) {
+		return "", false
+	}
+	return filepath.Join(rec.dir, id+suffix), true
+}
+
+// recordedTranscript is the content of <id>.json and <id>.replay-<job>.json.
+type recordedTranscript struct {
+	SessionID  string             `json:"session_id"`
+	JobID      string             `json:"job_id,omitempty"`  // replays
+	Options    *TranscribeOptions `json:"options,omitempty"` // replays
+	Tenant     string             `json:"tenant,omitempty"`
+	Started    time.Time          `json:"started"`
+	Transcript []string           `json:"transcript"`
+	Summary    *SummaryEvent      `json:"summary,omitempty"`
+	Recovered  bool               `json:"recovered,omitempty"` // after a crash, see checkpoint.go
+}
+
+func (rec *Recorder) SessionStarted(*Session) {}
+
+func (rec *Recorder) SessionEnded(s *Session) {
+	wav, _ := rec.path(s.ID, ".wav")
+	if _, err := os.Stat(wav); err != nil {
+		return // not recorded, e.g. an RTP source
+	}
+	summary := s.Summary()
+	rec.write(s.ID+".json", recordedTranscript{SessionID: s.ID, Tenant: s.Tenant, Started: s.Started, Transcript: s.Finals(), Summary: &summary})
+	rec.removeCheckpoint(s.ID)
+}
+
+// write writes v as JSON to the file name in the directory.
+func (rec *Recorder) write(name string, v any) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err == nil {
+		err = os.WriteFile(filepath.Join(rec.dir, name), data, 0o644)
+	}
+	if err != nil {
+		slog.Error("record: write failed", slog.String("file", name), slog.String("error", err.Error()))
+	}
+}
+
+// readRecorded reads the JSON file at path into v.
+func readRecorded(path string, v any) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// recordSession is a pass-through pipeline stage that writes the decoded
+// audio of session to <id>.wav in the directory of recorder, checkpointing
+// the session on the way (see checkpoint.go). With a nil recorder (no
+// -record-dir) it returns in as it is.
+func recordSession(ctx context.Context, in <-chan AudioChunk, recorder *Recorder, session *Session) <-chan AudioChunk {
+	if recorder == nil {
+		return in
+	}
+	path, _ := recorder.path(session.ID, ".wav")
+	wav, err := createWAV(path)
+	if err != nil {
+		slog.Error("record: not recording session", slog.Any("session", session), slog.String("error", err.Error()))
+		return in
+	}
+	out := make(chan AudioChunk, cap(in))
+
+	go func() {
+		defer close(out)
+		defer func() {
+			if err := wav.Close(); err != nil {
+				slog.Error("record: close failed", slog.Any("session", session), slog.String("error", err.Error()))
+			}
+		}()
+		var checkpoints <-chan time.Time
+		if recorder.checkpointEvery > 0 {
+			ticker := time.NewTicker(recorder.checkpointEvery)
+			defer ticker.Stop()
+			checkpoints = ticker.C
+		}
+		for {
+			var ch AudioChunk
+			select {
+			case next, ok := <-in:
+				if !ok {
+					return
+				}
+				ch = next
+			case <-checkpoints:
+				recorder.checkpoint(session, wav)
+				continue
+			case <-ctx.Done():
+				return
+			}
+			if len(ch.PCM) > 0 {
+				if err := wav.Write(ch.PCM); err != nil {
+					slog.Error("record: write failed; recording stops", slog.Any("session", session), slog.String("error", err.Error()))
+				}
+			}
+
+			select {
+			case out <- ch:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out
+}
+
+// wavWriter writes s16le audio in the session format to a WAV file. The
+// sizes in the header are filled in by Close.
+type wavWriter struct {
+	f     *os.File
+	w     *bufio.Writer
+	bytes int64
+	err   error // the first write error; later writes are dropped
+}
+
+// createWAV creates the WAV file at path.
+func createWAV(path string) (*wavWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	w := &wavWriter{f: f, w: bufio.NewWriter(f)}
+	if _, err := w.w.Write(wavHeader(0)); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// Write appends pcm to the file. After a failure it keeps returning nil, so
+// the error is reported once.
+func (w *wavWriter) Write(pcm []byte) error {
+	if w.err != nil {
+		return nil
+	}
+	n, err := w.w.Write(pcm)
+	w.bytes += int64(n)
+	w.err = err
+	return err
+}
+
+// Sync writes what is buffered to disk.
+func (w *wavWriter) Sync() error {
+	if w.err != nil {
+		return w.err
+	}
+	if err := w.w.Flush(); err != nil {
+		return err
+	}
+	return w.f.Sync()
+}
+
+// Close writes the sizes into the header and closes the file.
+func (w *wavWriter) Close() error {
+	err := w.w.Flush()
+	if err == nil {
+		_, err = w.f.WriteAt(wavHeader(uint32(min(w.bytes, 1<<32-1-wavHeaderBytes))), 0)
+	}
+	if cerr := w.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// wavHeader returns the header of a PCM WAV file in the session format with
+// dataBytes of audio.
+func wavHeader(dataBytes uint32) []byte {
+	h := make([]byte, 0, wavHeaderBytes)
+	h = append(h, "RIFF"...)
+	h = binary.LittleEndian.AppendUint32(h, wavHeaderBytes-8+dataBytes)
+	h = append(h, "WAVEfmt "...)
+	h = binary.LittleEndian.AppendUint32(h, 16)
+	h = binary.LittleEndian.AppendUint16(h, 1) // PCM
+	h = binary.LittleEndian.AppendUint16(h, numChannels)
+	h = binary.LittleEndian.AppendUint32(h, sampleRateHz)
+	h = binary.LittleEndian.AppendUint32(h, sampleRateHz*numChannels*bytesPerSample)
+	h = binary.LittleEndian.AppendUint16(h, numChannels*bytesPerSample)
+	h = binary.LittleEndian.AppendUint16(h, bytesPerSample*8)
+	h = append(h, "data"...)
+	return binary.LittleEndian.AppendUint32(h, dataBytes)
+}
+
+// readWAV reads the WAV file at path, which must be in the session format,
+// as chunkMs chunks ending with a Final chunk, like decodeFile, leaving out
+// the first skipMs of audio. A data size of 0 (a recording that was never
+// closed) reads up to the end of the file.
+func readWAV(ctx context.Context, path string, skipMs int64) (<-chan AudioChunk, <-chan error) {
+	out := make(chan AudioChunk, 16)
+	errc := make(chan error, 1)
+
+	go func() {
+		defer close(out)
+		var tsMs int64
+		send := func(ch AudioChunk) bool {
+			select {
+			case out <- ch:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		finish := func(err error) {
+			errc <- err
+			send(AudioChunk{Final: true, TsMs: tsMs})
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			finish(err)
+			return
+		}
+		defer f.Close()
+		data, err := wavData(bufio.NewReader(f))
+		if err != nil {
+			finish(fmt.Errorf("%s: %w", filepath.Base(path), err))
+			return
+		}
+		if skipMs > 0 {
+			skip := skipMs * sampleRateHz / 1000 * bytesPerSample * numChannels
+			if _, err := io.CopyN(io.Discard, data, skip); err != nil && !errors.Is(err, io.EOF) {
+				finish(err)
+				return
+			}
+			tsMs = skipMs
+		}
+
+		buf := make([]byte, sampleRateHz*bytesPerSample*numChannels*chunkMs/1000)
+		for {
+			n, err := io.ReadFull(data, buf)
+			if n > 0 && !send(newPooledChunk(buf[:n], tsMs)) {
+				errc <- ctx.Err()
+				return
+			}
+			tsMs += chunkMs
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				break
+			}
+			if err != nil {
+				finish(err)
+				return
+			}
+		}
+		finish(nil)
+	}()
+
+	return out, errc
+}
+
+// wavData checks the header of the WAV file on r and returns its audio.
+func wavData(r io.Reader) (io.Reader, error) {
+	var riff [12]byte
+	if _, err := io.ReadFull(r, riff[:]); err != nil || string(riff[0:4]) != "RIFF" || string(riff[8:12]) != "WAVE" {
+		return nil, errors.New("not a WAV file")
+	}
+	var gotFmt bool
+	for {
+		var hdr [8]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return nil, errors.New("WAV file without data")
+		}
+		id, size := string(hdr[0:4]), binary.LittleEndian.Uint32(hdr[4:8])
+		switch id {
+		case "fmt ":
+			if size < 16 {
+				return nil, errors.New("short WAV fmt chunk")
+			}
+			var f [16]byte
+			if _, err := io.ReadFull(r, f[:]); err != nil {
+				return nil, err
+			}
+			le := binary.LittleEndian
+			if le.Uint16(f[0:2]) != 1 || le.Uint16(f[2:4]) != numChannels || le.Uint32(f[4:8]) != sampleRateHz || le.Uint16(f[14:16]) != bytesPerSample*8 {
+				return nil, fmt.Errorf("WAV file is not %d Hz mono s16le", sampleRateHz)
+			}
+			gotFmt = true
+			size -= 16
+		case "data":
+			if !gotFmt {
+				return nil, errors.New("WAV data before fmt chunk")
+			}
+			if size == 0 || size == 1<<32-1 {
+				return r, nil
+			}
+			return io.LimitReader(r, int64(size)), nil
+		}
+		// RIFF chunks are padded to an even size.
+		if _, err := io.CopyN(io.Discard, r, int64(size+size%2)); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Replay runs the recording of session id through a new Transcribe stream
+// with opts, as a job of jobs.
+func (rec *Recorder) Replay(jobs *JobStore, id string, opts TranscribeOptions) (*Job, error) {
+	wav, ok := rec.path(id, ".wav")
+	if !ok {
+		return nil, errNotRecorded
+	}
+	if _, err := os.Stat(wav); err != nil {
+		return nil, errNotRecorded
+	}
+	tenant, _ := rec.Tenant(id)
+	job := jobs.add("replay of "+id, tenant)
+	go func() {
+		jobs.finish(job, rec.replay(jobs, job, id, wav, opts))
+	}()
+	return job, nil
+}
+
+// replay transcribes the recording at wav into job and keeps the result.
+func (rec *Recorder) replay(jobs *JobStore, job *Job, id, wav string, opts TranscribeOptions) error {
+	result := recordedTranscript{SessionID: id, JobID: job.ID, Options: &opts, Started: time.Now()}
+	finals, err := transcribeRecording(jobs, job, id, wav, 0, opts)
+	if err != nil {
+		return err
+	}
+	result.Transcript = finals
+	rec.write(id+".replay-"+job.ID+".json", result)
+	return nil
+}
+
+// transcribeRecording runs the recording of session id at wav, from skipMs
+// on, through a new Transcribe stream with opts, as job of jobs, and returns
+// its finals.
+func transcribeRecording(jobs *JobStore, job *Job, id, wav string, skipMs int64, opts TranscribeOptions) ([]string, error) {
+	ctx, cancel := context.WithCancel(jobs.ctx)
+	defer cancel()
+
+	release, err := jobs.sessions.ReserveWait(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	audioIn, transcriptOut, errOut, err := runTranscribeStreamWith(ctx, jobs.client, opts)
+	if err != nil {
+		return nil, fmt.Errorf("start transcription: %w", err)
+	}
+	job.setRunning()
+	slog.Info("record: transcribing recording", slog.String("job", job.ID), slog.String("session", id), slog.Int64("from_ms", skipMs))
+
+	audio, readErr := readWAV(ctx, wav, skipMs)
+	var drops dropCounters
+	go forwardAudio(ctx, paceAudio(ctx, audio), audioIn, DropPolicyBlock, overloadQueueLen, &drops, nil)
+
+	finals := []string{}
+	for piece := range publishTranscripts(ctx, transcriptOut, job.ID, jobs.sink) {
+		if !piece.Partial {
+			job.addFinal(piece.Text)
+			finals = append(finals, piece.Text)
+		}
+	}
+	if err := <-errOut; err != nil {
+		return nil, err
+	}
+	if err := <-readErr; err != nil {
+		return nil, err
+	}
+	return finals, nil
+}
+
+// Tenant returns the tenant of recorded session id; ok is false if it was
+// not recorded. A nil *Recorder recorded nothing.
+func (rec *Recorder) Tenant(id string) (tenant string, ok bool) {
+	if rec == nil {
+		return "", false
+	}
+	path, ok := rec.path(id, ".json")
+	if !ok {
+		return "", false
+	}
+	var recorded recordedTranscript
+	if err := readRecorded(path, &recorded); err != nil {
+		return "", false
+	}
+	return recorded.Tenant, true
+}
+
+// sessionReplays is the response of GET /sessions/{id}/replays.
+type sessionReplays struct {
+	recordedTranscript
+	Replays []recordedTranscript `json:"replays"`
+}
+
+// Replays returns the transcript of session id and those of its replays,
+// oldest first.
+func (rec *Recorder) Replays(id string) (sessionReplays, error) {
+	path, ok := rec.path(id, ".json")
+	if !ok {
+		return sessionReplays{}, errNotRecorded
+	}
+	var result sessionReplays
+	if err := readRecorded(path, &result.recordedTranscript); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			err = errNotRecorded
+		}
+		return sessionReplays{}, err
+	}
+	files, err := filepath.Glob(filepath.Join(rec.dir, id+".replay-*.json"))
+	if err != nil {
+		return sessionReplays{}, err
+	}
+	result.Replays = []recordedTranscript{}
+	for _, file := range files {
+		var replay recordedTranscript
+		if err := readRecorded(file, &replay); err != nil {
+			slog.Warn("record: unreadable replay", slog.String("file", file), slog.String("error", err.Error()))
+			continue
+		}
+		result.Replays = append(result.Replays, replay)
+	}
+	slices.SortFunc(result.Replays, func(a, b recordedTranscript) int { return a.Started.Compare(b.Started) })
+	return result, nil
+}
+
+// ReplaySessionEndpoint serves POST /sessions/{id}/replay: it replays the
+// recording of the session with the TranscribeOptions in the body, if any,
+// and answers 202 with the job ID.
+func ReplaySessionEndpoint(rec *Recorder, jobs *JobStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var opts TranscribeOptions
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&opts); err != nil && !errors.Is(err, io.EOF) {
+			http.Error(w, "replay: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		job, err := rec.Replay(jobs, r.PathValue("id"), opts)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		slog.Info("record: replay queued", slog.String("job", job.ID), slog.String("session", r.PathValue("id")))
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", "/jobs/"+job.ID)
+		w.WriteHeader(http.StatusAccepted)
+		_ = json.NewEncoder(w).Encode(map[string]string{"job_id": job.ID})
+	}
+}
+
+// SessionReplaysEndpoint serves GET /sessions/{id}/replays: the recorded
+// transcript of the session and the transcripts of its replays.
+func SessionReplaysEndpoint(rec *Recorder) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		replays, err := rec.Replays(r.PathValue("id"))
+		switch {
+		case errors.Is(err, errNotRecorded):
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case err != nil:
+			slog.Error("record: replays failed", slog.String("error", err.Error()))
+			http.Error(w, "replays unavailable", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(replays); err != nil {
+			slog.Error("http: replays encode failed", slog.String("error", err.Error()))
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/*
+Learning note: Redis pub/sub fan-out
+====================================
+
+A session lives on the server instance its client connected to. To follow it
+from anywhere else (another instance behind the load balancer, a dashboard
+service, a CRM plugin) every transcript piece is also published to a Redis
+channel named after the session:
+
+	instance A: session 1234 --PUBLISH transcripts:1234--> Redis --> SUBSCRIBE transcripts:1234
+	                                                             --> PSUBSCRIBE transcripts:*
+
+Redis pub/sub is fire-and-forget: a message reaches whoever is subscribed at
+that moment and is gone afterwards, which is what a live transcript needs.
+
+The client speaks RESP, Redis' text protocol, directly: a command is an array
+of bulk strings (*3 $7 PUBLISH $<n> <channel> $<n> <payload>) and every reply
+is one line starting with +, -, : or $. Only replies for PUBLISH (an integer,
+the number of receivers) and AUTH/SELECT (+OK) come back, so reading them is
+simple; like the MQTT sink, one goroutine owns the connection and Publish only
+queues.
+*/
+
+// redisQueue is the number of messages waiting for the connection.
+const redisQueue = 256
+
+// redisMessage is a queued PUBLISH.
+type redisMessage struct {
+	channel string
+	payload []byte
+}
+
+// RedisSink publishes transcript pieces to a Redis channel per session: the
+// channel is cfg.RedisChannel with "{session}" replaced by the session ID.
+type RedisSink struct {
+	server  *url.URL
+	channel string
+	queue   chan redisMessage
+	dropped atomic.Int64
+}
+
+// NewRedisSink returns a sink publishing to the Redis server at serverURL
+// (redis://[user:password@]host:port/db, or rediss:// for TLS) and starts its
+// connection, which lives until ctx is done.
+func NewRedisSink(ctx context.Context, serverURL, channel string) (*RedisSink, error) {
+	u, err := parseRedisURL(serverURL)
+	if err != nil {
+		return nil, err
+	}
+	s := &RedisSink{server: u, channel: channel, queue: make(chan redisMessage, redisQueue)}
+	go runConnected(ctx, "redis", u.Host, s.session)
+	return s, nil
+}
+
+// parseRedisURL parses redis://[user:password@]host:port/db (rediss:// for
+// TLS), filling in the default port.
+func parseRedisURL(serverURL string) (*url.URL, error) {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return nil, fmt.Errorf("redis: server: %w", err)
+	}
+	if u.Scheme != "redis" && u.Scheme != "rediss" {
+		return nil, fmt.Errorf("redis: server: unsupported scheme %q", u.Scheme)
+	}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		if _, err := strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("redis: server: invalid database %q", db)
+		}
+	}
+	return u, nil
+}
+
+// dialRedis connects to server and sends AUTH and SELECT as given in its URL.
+func dialRedis(ctx context.Context, server *url.URL) (net.Conn, *bufio.Reader, error) {
+	conn, err := dialBroker(ctx, server.Host, server.Scheme == "rediss")
+	if err != nil {
+		return nil, nil, err
+	}
+	r := bufio.NewReader(conn)
+
+	// Handshake: AUTH and SELECT as given in the URL, each answered by +OK.
+	var setup [][]string
+	if user := server.User; user != nil {
+		if pass, ok := user.Password(); ok && user.Username() != "" {
+			setup = append(setup, []string{"AUTH", user.Username(), pass})
+		} else if ok {
+			setup = append(setup, []string{"AUTH", pass})
+		}
+	}
+	if db := strings.TrimPrefix(server.Path, "/"); db != "" {
+		setup = append(setup, []string{"SELECT", db})
+	}
+	_ = conn.SetDeadline(time.Now().Add(writeWait))
+	for _, cmd := range setup {
+		if _, err := conn.Write(appendRESPCommand(nil, cmd...)); err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+		if _, err := readRESPReply(r); err != nil {
+			conn.Close()
+			return nil, nil, fmt.Errorf("%s: %w", cmd[0], err)
+		}
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, r, nil
+}
+
+// Publish queues piece for the session's channel.
+func (s *RedisSink) Publish(sessionID string, piece TranscriptPiece) {
+	if payload, err := json.Marshal(newPublishedTranscript(sessionID, piece)); err == nil {
+		s.enqueue(sessionID, payload, !piece.Partial)
+	}
+}
+
+// PublishSummary queues the summary for the session's channel.
+func (s *RedisSink) PublishSummary(summary SummaryEvent) {
+	if payload, err := json.Marshal(summary); err == nil {
+		s.enqueue(summary.SessionID, payload, false)
+	}
+}
+
+// enqueue queues payload for the session's channel, dropping it if the
+// queue is full, with wait only after sinkFinalWait.
+func (s *RedisSink) enqueue(sessionID string, payload []byte, wait bool) {
+	if !enqueueSinkMessage(s.queue, redisMessage{channel: strings.ReplaceAll(s.channel, "{session}", sessionID), payload: payload}, wait) {
+		dropped := s.dropped.Add(1)
+		if wait {
+			slog.Error("redis: queue full; dropping a final", slog.String("session", sessionID), slog.Int64("dropped", dropped))
+		} else if dropped%100 == 1 {
+			slog.Warn("redis: queue full; dropping messages", slog.Int64("dropped", dropped))
+		}
+	}
+}
+
+// session connects once and publishes queued messages until the connection
+// fails or ctx is done.
+func (s *RedisSink) session(ctx context.Context) error {
+	conn, r, err := dialRedis(ctx, s.server)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	slog.Info("redis: connected", slog.String("addr", s.server.Host))
+
+	// Reader: consumes the PUBLISH replies; errors are logged, a broken
+	// connection ends the session.
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			_, err := readRESPReply(r)
+			var replyErr redisError
+			if errors.As(err, &replyErr) {
+				slog.Warn("redis: publish failed", slog.String("error", err.Error()))
+				continue
+			}
+			if err != nil {
+				readErr <- err
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case msg := <-s.queue:
+			_ = conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if _, err := conn.Write(appendRESPCommand(nil, "PUBLISH", msg.channel, string(msg.payload))); err != nil {
+				return err
+			}
+		case err := <-readErr:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// redisError is an error reply (-ERR ...) from the server.
+type redisError string
+
+func (e redisError) Error() string { return string(e) }
+
+// appendRESPCommand appends args encoded as a RESP array of bulk strings.
+func appendRESPCommand(dst []byte, args ...string) []byte {
+	dst = fmt.Appendf(dst, "*%d\r\n", len(args))
+	for _, a := range args {
+		dst = fmt.Appendf(dst, "$%d\r\n%s\r\n", len(a), a)
+	}
+	return dst
+}
+
+// readRESPValue reads any reply: a string for status and bulk replies, an
+// int64 for integers, a []any for arrays and nil for null replies. Error
+// replies are returned as a redisError.
+func readRESPValue(r *bufio.Reader) (any, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2) // with the trailing \r\n
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		values := make([]any, n)
+		for i := range values {
+			if values[i], err = readRESPValue(r); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	default:
+		return nil, fmt.Errorf("redis: unexpected reply %q", line)
+	}
+}
+
+// readRESPReply reads a simple reply (status, error or integer) and returns
+// its text. Error replies are returned as a redisError.
+func readRESPReply(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return "", errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+', ':':
+		return line[1:], nil
+	case '-':
+		return "", redisError(line[1:])
+	default:
+		return "", fmt.Errorf("redis: unexpected reply %q", line)
+	}
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+Learning note: Sharing session state through Redis
+==================================================
+
+Behind a load balancer every instance only knows its own sessions. With
+-state-redis-url the instances keep what the others need to know in Redis:
+
+	gochannels:instance:<url>   "1", expires unless the instance is alive
+	gochannels:sessions         set of session IDs
+	gochannels:session:<id>     {"instance":<url>,"session":<SessionInfo>}
+	gochannels:resume:<token>   <url> of the instance holding the session
+	gochannels:slots            hash: <url> -> sessions running there
+
+Instances are named by the URL the others reach them at (-advertise-url).
+Every key expires after stateTTL and is refreshed every stateTTL/3 while its
+owner runs, so a crashed instance's entries disappear on their own.
+
+  - GET /cluster/sessions lists the sessions of all instances, with their
+    stats as of the last refresh.
+  - A WebSocket connection lives on one instance, so a resume cannot move the
+    session. When ?resume=<token> arrives at an instance that does not hold
+    the session, ResumeProxy passes the whole connection through to the one
+    that does (httputil.ReverseProxy handles the WebSocket upgrade).
+  - With -cluster-max-sessions, a session is only started while the
+    instances together run fewer; the slots hash is the shared counter. It is
+    incremented first and checked after, so two instances racing for the last
+    slot may both back off, but never both get it.
+
+All writes are queued and done by one goroutine, so observers never wait for
+Redis; reads (the list, a resume lookup, a slot) wait for their reply.
+*/
+
+const (
+	// stateTTL is how long the state of an instance outlives it.
+	stateTTL = 30 * time.Second
+	// stateQueue is the number of writes waiting for Redis.
+	stateQueue = 256
+	// stateForwarded marks a request ResumeProxy already passed on.
+	stateForwarded = "X-Gochannels-Forwarded"
+)
+
+// redisClient sends commands over one connection and waits for the
+// replies. It reconnects on the next command after the connection broke. It
+// is safe for concurrent use.
+type redisClient struct {
+	server *url.URL
+
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// do sends a command and returns its reply (see readRESPValue).
+func (c *redisClient) do(ctx context.Context, args ...string) (any, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		conn, r, err := dialRedis(ctx, c.server)
+		if err != nil {
+			return nil, err
+		}
+		c.conn, c.r = conn, r
+	}
+	_ = c.conn.SetDeadline(time.Now().Add(writeWait))
+	_, err := c.conn.Write(appendRESPCommand(nil, args...))
+	var reply any
+	if err == nil {
+		reply, err = readRESPValue(c.r)
+	}
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) {
+		c.conn.Close()
+		c.conn, c.r = nil, nil
+	}
+	return reply, err
+}
+
+// clusterSession is a session as stored in Redis.
+type clusterSession struct {
+	Instance string      `json:"instance"`
+	Session  SessionInfo `json:"session"`
+}
+
+// RedisState shares sessions, resume tokens and the session count of this
+// instance with the others through Redis (see the note above). It is a
+// SessionObserver and a SharedLimit.
+type RedisState struct {
+	client   *redisClient
+	instance string // the advertised URL
+	limit    int    // across instances, 0 = unlimited
+	queue    chan []string
+	dropped  atomic.Int64
+
+	mu       sync.Mutex
+	sessions map[string]*Session // running here
+	slots    int                 // reserved here
+}
+
+// NewRedisState connects to the Redis server at serverURL as the instance
+// reachable at instanceURL and keeps its state there until ctx is done.
+// limit is the number of sessions all instances may run together.
+func NewRedisState(ctx context.Context, serverURL, instanceURL string, limit int) (*RedisState, error) {
+	u, err := parseRedisURL(serverURL)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := url.Parse(instanceURL); err != nil || instanceURL == "" {
+		return nil, errors.New("redis-state: -advertise-url must be the URL other instances reach this one at")
+	}
+	s := &RedisState{
+		client:   &redisClient{server: u},
+		instance: instanceURL,
+		limit:    limit,
+		queue:    make(chan []string, stateQueue),
+		sessions: make(map[string]*Session),
+	}
+	// Whatever a previous run of this instance left is stale.
+	if _, err := s.client.do(ctx, "HDEL", "gochannels:slots", s.instance); err != nil {
+		return nil, err
+	}
+	go s.run(ctx)
+	slog.Info("redis-state: started", slog.String("instance", instanceURL))
+	return s, nil
+}
+
+// enqueue queues a write, dropping it if the queue is full; the next
+// refresh repairs what was lost.
+func (s *RedisState) enqueue(args ...string) {
+	select {
+	case s.queue <- args:
+	default:
+		if s.dropped.Add(1)%100 == 1 {
+			slog.Warn("redis-state: queue full; dropping writes", slog.Int64("dropped", s.dropped.Load()))
+		}
+	}
+}
+
+// run does the queued writes and refreshes the instance's keys.
+func (s *RedisState) run(ctx context.Context) {
+	ticker := time.NewTicker(stateTTL / 3)
+	defer ticker.Stop()
+	s.refresh()
+	for {
+		select {
+		case args := <-s.queue:
+			if _, err := s.client.do(ctx, args...); err != nil {
+				slog.Warn("redis-state: write failed", slog.String("command", args[0]), slog.String("error", err.Error()))
+			}
+		case <-ticker.C:
+			s.refresh()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// refresh queues the writes that keep the instance's keys from expiring.
+func (s *RedisState) refresh() {
+	ttl := strconv.Itoa(int(stateTTL.Seconds()))
+	s.mu.Lock()
+	slots := s.slots
+	sessions := make([]*Session, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		sessions = append(sessions, session)
+	}
+	s.mu.Unlock()
+
+	s.enqueue("SET", "gochannels:instance:"+s.instance, "1", "EX", ttl)
+	s.enqueue("HSET", "gochannels:slots", s.instance, strconv.Itoa(slots))
+	for _, session := range sessions {
+		s.store(session, ttl)
+	}
+}
+
+// store queues the writes that publish session.
+func (s *RedisState) store(session *Session, ttl string) {
+	data, err := json.Marshal(clusterSession{Instance: s.instance, Session: session.Info()})
+	if err != nil {
+		return
+	}
+	s.enqueue("SET", "gochannels:session:"+session.ID, string(data), "EX", ttl)
+	s.enqueue("SADD", "gochannels:sessions", session.ID)
+	if session.ResumeToken != "" {
+		s.enqueue("SET", "gochannels:resume:"+session.ResumeToken, s.instance, "EX", ttl)
+	}
+}
+
+func (s *RedisState) SessionStarted(session *Session) {
+	s.mu.Lock()
+	s.sessions[session.ID] = session
+	s.mu.Unlock()
+	s.store(session, strconv.Itoa(int(stateTTL.Seconds())))
+}
+
+func (s *RedisState) SessionEnded(session *Session) {
+	s.mu.Lock()
+	delete(s.sessions, session.ID)
+	s.mu.Unlock()
+	s.enqueue("DEL", "gochannels:session:"+session.ID)
+	s.enqueue("SREM", "gochannels:sessions", session.ID)
+	if session.ResumeToken != "" {
+		s.enqueue("DEL", "gochannels:resume:"+session.ResumeToken)
+	}
+}
+
+// Acquire takes a slot of the cluster-wide session limit. If Redis cannot
+// be reached, the session is let through: the local limit still applies.
+func (s *RedisState) Acquire() error {
+	s.mu.Lock()
+	s.slots++
+	s.mu.Unlock()
+	if s.limit <= 0 {
+		s.enqueue("HINCRBY", "gochannels:slots", s.instance, "1")
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), writeWait)
+	defer cancel()
+	if _, err := s.client.do(ctx, "HINCRBY", "gochannels:slots", s.instance, "1"); err != nil {
+		slog.Warn("redis-state: slot count unavailable; admitting", slog.String("error", err.Error()))
+		return nil
+	}
+	total, err := s.runningSessions(ctx)
+	if err != nil {
+		slog.Warn("redis-state: slot count unavailable; admitting", slog.String("error", err.Error()))
+		return nil
+	}
+	if total > s.limit {
+		s.Release()
+		return errTooManySessions
+	}
+	return nil
+}
+
+// Release gives back a slot taken with Acquire.
+func (s *RedisState) Release() {
+	s.mu.Lock()
+	s.slots--
+	s.mu.Unlock()
+	s.enqueue("HINCRBY", "gochannels:slots", s.instance, "-1")
+}
+
+// runningSessions returns the number of slots taken on all live instances.
+func (s *RedisState) runningSessions(ctx context.Context) (int, error) {
+	reply, err := s.client.do(ctx, "HGETALL", "gochannels:slots")
+	if err != nil {
+		return 0, err
+	}
+	fields, _ := reply.([]any)
+	total := 0
+	for i := 0; i+1 < len(fields); i += 2 {
+		instance, _ := fields[i].(string)
+		count, _ := fields[i+1].(string)
+		n, _ := strconv.Atoi(count)
+		if instance != s.instance {
+			// A crashed instance's slots count until its heartbeat expires.
+			alive, err := s.client.do(ctx, "EXISTS", "gochannels:instance:"+instance)
+			if err != nil {
+				return 0, err
+			}
+			if alive != int64(1) {
+				continue
+			}
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// List returns the sessions of all instances.
+func (s *RedisState) List(ctx context.Context) ([]clusterSession, error) {
+	reply, err := s.client.do(ctx, "SMEMBERS", "gochannels:sessions")
+	if err != nil {
+		return nil, err
+	}
+	ids, _ := reply.([]any)
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	args := []string{"MGET"}
+	for _, id := range ids {
+		args = append(args, "gochannels:session:"+id.(string))
+	}
+	if reply, err = s.client.do(ctx, args...); err != nil {
+		return nil, err
+	}
+	values, _ := reply.([]any)
+	var list []clusterSession
+	for i, v := range values {
+		data, ok := v.(string)
+		if !ok {
+			// Expired: its instance went away without removing it.
+			s.enqueue("SREM", "gochannels:sessions", ids[i].(string))
+			continue
+		}
+		var cs clusterSession
+		if err := json.Unmarshal([]byte(data), &cs); err != nil {
+			continue
+		}
+		list = append(list, cs)
+	}
+	return list, nil
+}
+
+// ResumeProxy passes ?resume= reconnects for sessions held by another
+// instance through to it; everything else goes to next.
+func (s *RedisState) ResumeProxy(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.URL.Query().Get("resume")
+		if token == "" || r.Header.Get(stateForwarded) != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		reply, err := s.client.do(r.Context(), "GET", "gochannels:resume:"+token)
+		owner, _ := reply.(string)
+		if err != nil || owner == "" || owner == s.instance {
+			next.ServeHTTP(w, r)
+			return
+		}
+		target, err := url.Parse(owner)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		slog.Info("redis-state: passing resume to its instance", slog.String("instance", owner), slog.String("remote", r.RemoteAddr))
+		proxy := httputil.NewSingleHostReverseProxy(target)
+		r.Header.Set(stateForwarded, s.instance)
+		proxy.ServeHTTP(w, r)
+	})
+}
+
+// ClusterSessionsEndpoint serves GET /cluster/sessions: the sessions of all
+// instances sharing the Redis state.
+func ClusterSessionsEndpoint(state *RedisState) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		list, err := state.List(r.Context())
+		if err != nil {
+			slog.Error("redis-state: list failed", slog.String("error", err.Error()))
+			http.Error(w, "cluster state unavailable", http.StatusBadGateway)
+			return
+		}
+		if list == nil {
+			list = []clusterSession{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(list); err != nil {
+			slog.Error("http: cluster sessions encode failed", slog.String("error", err.Error()))
+		}
+	}
+}
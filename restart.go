@@ -0,0 +1,263 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"log/slog"
+	"math"
+	"sync"
+	"time"
+)
+
+/*
+Learning note: Changing options mid-session
+===========================================
+
+The language and the custom vocabulary of a Transcribe stream are fixed when
+it starts. A client that learns halfway through a call that the speaker
+switched to Spanish, or that the topic calls for another vocabulary, sends a
+config message:
+
+	{"type":"config","language":"es-US","vocabulary":"medical-es"}
+
+and the server moves the session to a new Transcribe stream started with
+those options (they replace the previous ones as a whole: a message with only
+a language drops the vocabulary). The WebSocket stays open and the session
+keeps its ID, its stats and its transcript.
+
+Cutting a stream mid-word would lose the word: the old stream never hears
+its end, the new one never hears its beginning. So the switch waits for a
+silence boundary, restartSilence of audio quieter than restartSilenceLevel,
+and happens anyway after restartMaxWait of audio for speakers who never
+pause:
+
+	audio --> [stream 1: en-US] ...... silence |
+	                                           | --> [stream 2: es-US] ......
+
+As in a rollover (see rollover.go), the new stream first gets the last
+restartOverlap of audio again, kept in an audioRing, so it starts with the
+context of what was said instead of in the middle of it, and a forced switch
+does not cut the word at the seam in half. The old stream receives its final
+chunk at the boundary and flushes what it still has in the background, the
+new one takes over the live audio after the replay, and the timestamps of
+its pieces are moved to session time; those ending inside the replayed audio
+were transcribed by the old stream already and are dropped. The client gets an
+"options" event once the new stream runs, or an "options_failed" warning if
+it could not be started, in which case the session stays on the old one.
+
+Only plain WebSocket sessions can change options: a mix room shares one
+stream among its members, and a multiplexed connection has one per stream.
+*/
+
+const (
+	// restartSilence is how much silence a restart waits for.
+	restartSilence = 300 * time.Millisecond
+	// restartMaxWait is how much audio a restart waits through for silence
+	// before it happens anyway.
+	restartMaxWait = 5 * time.Second
+	// restartSilenceLevel is the RMS, relative to full scale, below which a
+	// chunk counts as silence.
+	restartSilenceLevel = 0.01
+	// restartOverlap is how much audio is replayed into the new stream.
+	restartOverlap = 2 * time.Second
+)
+
+// errOptionsSuperseded is reported for an option change that was replaced by
+// a later one before it took effect.
+var errOptionsSuperseded = errors.New("superseded by a later change")
+
+// optionChange asks a restartable stream to move to a new Transcribe stream
+// with opts; done is called with the outcome and, on success, the session
+// time the new stream starts at.
+type optionChange struct {
+	opts TranscribeOptions
+	done func(tsMs int64, err error)
+}
+
+// OptionsEvent tells the client that its session runs with new options.
+type OptionsEvent struct {
+	Type       string `json:"type"`
+	Language   string `json:"language,omitempty"`
+	Vocabulary string `json:"vocabulary,omitempty"`
+	TsMs       int64  `json:"ts_ms"`
+}
+
+func (e OptionsEvent) EventType() string { return e.Type }
+
+// transcribeStarter starts a Transcribe stream with opts, as
+// runTranscribeStreamWith does.
+type transcribeStarter func(ctx context.Context, opts TranscribeOptions) (chan<- AudioChunk, <-chan TranscriptPiece, <-chan error, error)
+
+// chunkRMS returns the RMS of the samples of pcm, relative to full scale.
+func chunkRMS(pcm []byte) float64 {
+	n := sampleCount(pcm)
+	if n == 0 {
+		return 0
+	}
+	var sumSquares float64
+	for i := range n {
+		s := float64(sampleAt(pcm, i)) / math.MaxInt16
+		sumSquares += s * s
+	}
+	return math.Sqrt(sumSquares / float64(n))
+}
+
+// runRestartableTranscribeStream starts a stream with start and moves the
+// session to a new one, at a silence boundary, for every change received on
+// changes (see the note above). The channels behave as those of
+// runTranscribeStream.
+func runRestartableTranscribeStream(ctx context.Context, start transcribeStarter, changes <-chan optionChange) (chan<- AudioChunk, <-chan TranscriptPiece, <-chan error, error) {
+	firstIn, firstOut, firstErr, err := start(ctx, TranscribeOptions{})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	audioIn := make(chan AudioChunk, 16)
+	transcriptOut := make(chan TranscriptPiece, 32)
+	errOut := make(chan error, 1)
+
+	// pump forwards the pieces of one stream, moved by offsetMs into session
+	// time, and then reports how the stream ended on done. Pieces ending
+	// before skipMs were transcribed by the previous stream.
+	var wg sync.WaitGroup
+	pump := func(out <-chan TranscriptPiece, errc <-chan error, offsetMs, skipMs int64, done chan<- error) {
+		defer wg.Done()
+		for p := range out {
+			if skipMs > 0 && p.EndMs <= skipMs {
+				continue
+			}
+			p.StartMs += offsetMs
+			p.EndMs += offsetMs
+			select {
+			case transcriptOut <- p:
+			case <-ctx.Done():
+			}
+		}
+		done <- <-errc
+	}
+
+	go func() {
+		var (
+			curIn   = firstIn
+			curDone = make(chan error, 1)
+			ring    = newAudioRing(restartOverlap)
+			pending *optionChange
+			waited  time.Duration // audio since the pending change arrived
+			silence time.Duration // of quiet audio just before this chunk
+			sent    int           // bytes of session audio sent, replays excluded
+			failure error
+		)
+		wg.Add(1)
+		go pump(firstOut, firstErr, 0, 0, curDone)
+
+		// send hands ch to the current stream; false means the session is over.
+		send := func(ch AudioChunk) bool {
+			select {
+			case curIn <- ch:
+				return true
+			case err := <-curDone:
+				failure = cmp.Or(err, errTranscribeStreamEnded)
+			case <-ctx.Done():
+			}
+			return false
+		}
+
+		// restart moves the session to a stream with the options of pending;
+		// false means the session is over.
+		restart := func(tsMs int64) bool {
+			change := *pending
+			pending = nil
+			nextIn, nextOut, nextErr, err := start(ctx, change.opts)
+			if err != nil {
+				loggerFrom(ctx).Warn("restart: new stream failed; staying on the current one", slog.String("error", err.Error()))
+				change.done(tsMs, err)
+				return true
+			}
+			replay := ring.Chunks()
+			var replayed int
+			for _, c := range replay {
+				replayed += len(c.PCM)
+			}
+			nextDone := make(chan error, 1)
+			wg.Add(1)
+			go pump(nextOut, nextErr, pcmDuration(sent-replayed).Milliseconds(), pcmDuration(replayed).Milliseconds(), nextDone)
+
+			// The previous stream has all audio up to here; it flushes its
+			// last pieces in the background.
+			select {
+			case curIn <- AudioChunk{Final: true, TsMs: tsMs}:
+			case <-curDone:
+			case <-ctx.Done():
+			}
+			curIn, curDone = nextIn, nextDone
+			for _, c := range replay {
+				if !send(c) {
+					change.done(tsMs, errStreamEnded)
+					return false
+				}
+			}
+			loggerFrom(ctx).Info("restart: session moved to a new Transcribe stream", slog.Int64("ts_ms", tsMs), slog.Duration("overlap", pcmDuration(replayed)), slog.String("language", change.opts.Language), slog.String("vocabulary", change.opts.Vocabulary))
+			change.done(tsMs, nil)
+			return true
+		}
+
+	loop:
+		for {
+			select {
+			case ch, ok := <-audioIn:
+				if !ok {
+					close(curIn)
+					break loop
+				}
+				if ch.Final {
+					send(ch)
+					break loop
+				}
+				if pending != nil {
+					d := pcmDuration(len(ch.PCM))
+					waited += d
+					if chunkRMS(ch.PCM) < restartSilenceLevel {
+						silence += d
+					} else {
+						silence = 0
+					}
+					if (silence >= restartSilence || waited >= restartMaxWait) && !restart(ch.TsMs) {
+						break loop
+					}
+				}
+				ring.Write(ch.PCM, ch.TsMs)
+				sent += len(ch.PCM)
+				if !send(ch) {
+					break loop
+				}
+			case change := <-changes:
+				if pending != nil {
+					pending.done(0, errOptionsSuperseded)
+				}
+				pending, waited, silence = &change, 0, 0
+			case err := <-curDone:
+				failure = cmp.Or(err, errTranscribeStreamEnded)
+				break loop
+			}
+		}
+		if pending != nil {
+			pending.done(0, errStreamEnded)
+		}
+
+		wg.Wait()
+		if failure == nil {
+			select {
+			case failure = <-curDone:
+			default:
+			}
+		}
+		if failure != nil {
+			errOut <- failure
+		}
+		close(transcriptOut)
+		close(errOut)
+	}()
+
+	return audioIn, transcriptOut, errOut, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+/*
+Learning note: Resumable sessions
+=================================
+
+Mobile networks drop, laptops sleep, browsers reload. Without help every drop
+ends the Transcribe session, and with it the words spoken around the seam.
+So the first {"type":"session",...} frame carries a token as well, and a
+session whose connection breaks (anything but "end" or a normal close) is kept
+running for cfg.ResumeGrace. A client that reconnects within that window with
+
+	GET /ws?resume=<token>
+
+is attached to the same session: it gets {"type":"session",...,"resumed":true},
+then the transcript pieces produced while it was away (at most resumeBuffer of
+them, oldest dropped first; "replay" resends all finals), and then carries on
+streaming audio as before. The session keeps its format and framing, so the
+query parameters of the reconnect are ignored. A reconnect while the old
+connection is still open takes the session over, which is what a reloaded page
+needs when the old socket is not known to be dead yet. If nobody comes back in
+time, the session is finalized like after "end": its last transcripts go to the
+sinks only.
+
+The token is a secret, unlike the session ID that the HTTP API exposes. It is
+never logged.
+
+The session's handler goroutine does not go away in between; the reconnect's
+handler only upgrades the connection and hands it over through a
+resumeRegistry, so there is no state to move around. Transcribe ends a stream
+that gets no audio for 15 seconds, which bounds any useful grace period.
+*/
+
+// resumeBuffer is the number of transcript pieces kept for a client that is
+// away.
+const resumeBuffer = 256
+
+// resumeAttachment is a reconnected client handed over to its session.
+type resumeAttachment struct {
+	conn  *websocket.Conn
+	codec messageCodec
+}
+
+// resumeEntry is the handover point of one running session.
+type resumeEntry struct {
+	attach chan resumeAttachment
+	done   chan struct{} // closed when the session no longer accepts reconnects
+}
+
+// resumeRegistry maps resume tokens to running sessions. It is safe for
+// concurrent use.
+type resumeRegistry struct {
+	mu      sync.Mutex
+	entries map[string]resumeEntry
+}
+
+func newResumeRegistry() *resumeRegistry {
+	return &resumeRegistry{entries: make(map[string]resumeEntry)}
+}
+
+// register issues a token for a new session. Reconnects with the token arrive
+// on attach until release is called.
+func (r *resumeRegistry) register() (token string, attach <-chan resumeAttachment, release func()) {
+	var b [16]byte
+	_, _ = rand.Read(b[:]) // never fails, see crypto/rand.Read
+	token = hex.EncodeToString(b[:])
+	e := resumeEntry{attach: make(chan resumeAttachment), done: make(chan struct{})}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries[token] = e
+	return token, e.attach, func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		delete(r.entries, token)
+		close(e.done)
+	}
+}
+
+// has reports whether token belongs to a running session.
+func (r *resumeRegistry) has(token string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.entries[token]
+	return ok
+}
+
+// resume hands att to the session of token. It reports false if there is no
+// such session (any more); the caller then still owns the connection.
+func (r *resumeRegistry) resume(token string, att resumeAttachment) bool {
+	r.mu.Lock()
+	e, ok := r.entries[token]
+	r.mu.Unlock()
+	if !ok {
+		return false
+	}
+	select {
+	case e.attach <- att:
+		return true
+	case <-e.done:
+		return false
+	}
+}
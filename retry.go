@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math/rand/v2"
+	"time"
+
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+/*
+Learning note: Retrying the start of a stream
+=============================================
+
+AWS refuses a StartStreamTranscription now and then for reasons that are
+gone a moment later: a throttled burst of sessions, a 503 from a front end
+being replaced. Failing the client's connection for those would turn a
+blip on AWS's side into an error on the user's screen, so the start is
+retried, up to -start-attempts times in all:
+
+	attempt 1 --x  wait ~base     attempt 2 --x  wait ~2*base   attempt 3 --> stream
+
+The waits double from startRetryBase up to startRetryMax, and each is drawn
+at random between half and all of that ("jitter"): sessions refused together
+by a throttled account would otherwise come back together and be refused
+together again.
+
+Only errors worth another try are retried: throttling and quota errors, and
+5xx responses. A wrong language code, bad credentials or a canceled context
+fail at once; retrying them only delays the inevitable. Audio is not lost
+meanwhile: the client's frames wait in the session's buffers, as they do
+for any slow start.
+*/
+
+const (
+	// startRetryBase is the wait before the second attempt.
+	startRetryBase = 200 * time.Millisecond
+	// startRetryMax caps the wait between two attempts.
+	startRetryMax = 5 * time.Second
+)
+
+// isRetryable reports whether a failed start is worth another attempt (see
+// the note above).
+func isRetryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "ThrottlingException", "LimitExceededException", "ServiceQuotaExceededException",
+			"InternalFailureException", "ServiceUnavailableException":
+			return true
+		}
+	}
+	var respErr *smithyhttp.ResponseError
+	return errors.As(err, &respErr) && respErr.HTTPStatusCode() >= 500
+}
+
+// retryDelay returns the jittered wait after the given failed attempt (1 for
+// the first).
+func retryDelay(attempt int) time.Duration {
+	d := startRetryBase << (attempt - 1)
+	if d <= 0 || d > startRetryMax {
+		d = startRetryMax
+	}
+	return d/2 + rand.N(d/2+1)
+}
+
+// withRetry calls start until it succeeds, fails with an error that is not
+// retryable, or has been tried attempts times, and returns its last result.
+func withRetry[T any](ctx context.Context, attempts int, start func() (T, error)) (T, error) {
+	for attempt := 1; ; attempt++ {
+		v, err := start()
+		if err == nil || attempt >= attempts || !isRetryable(err) {
+			return v, err
+		}
+		wait := retryDelay(attempt)
+		slog.Warn("transcribe: start failed; retrying", slog.Int("attempt", attempt), slog.Duration("wait", wait), slog.String("error", err.Error()))
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return v, err
+		}
+	}
+}
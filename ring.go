@@ -0,0 +1,85 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// audioRing is a fixed-size ring buffer holding the most recent PCM of a
+// session. Writes overwrite the oldest audio once the buffer is full, so the
+// memory used per session is bounded regardless of how long it runs. A
+// session moving to a new Transcribe stream, when it rolls over (see
+// rollover.go) or changes options (see restart.go), replays it into the new
+// stream. It is safe for concurrent use.
+type audioRing struct {
+	mu    sync.Mutex
+	buf   []byte
+	next  int   // position of the next write
+	full  bool  // whether buf has wrapped at least once
+	endTs int64 // TsMs of the most recently written chunk
+}
+
+// newAudioRing returns a ring large enough to hold d of audio in the session
+// format (sampleRateHz, bytesPerSample, numChannels).
+func newAudioRing(d time.Duration) *audioRing {
+	size := int(d.Milliseconds()) * sampleRateHz / 1000 * bytesPerSample * numChannels
+	return &audioRing{buf: make([]byte, size)}
+}
+
+// Write appends pcm to the ring, dropping the oldest audio if needed. The data
+// is copied, so callers may reuse or release pcm afterwards.
+func (r *audioRing) Write(pcm []byte, tsMs int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(pcm) >= len(r.buf) {
+		// Only the tail of an oversized write fits anyway.
+		copy(r.buf, pcm[len(pcm)-len(r.buf):])
+		r.next, r.full = 0, true
+	} else {
+		n := copy(r.buf[r.next:], pcm)
+		if n < len(pcm) {
+			copy(r.buf, pcm[n:])
+			r.full = true
+		}
+		r.next = (r.next + len(pcm)) % len(r.buf)
+		if r.next == 0 {
+			r.full = true
+		}
+	}
+	r.endTs = tsMs
+}
+
+// Bytes returns a copy of the buffered audio, oldest first.
+func (r *audioRing) Bytes() []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.full {
+		return append([]byte(nil), r.buf[:r.next]...)
+	}
+	out := make([]byte, 0, len(r.buf))
+	out = append(out, r.buf[r.next:]...)
+	return append(out, r.buf[:r.next]...)
+}
+
+// Chunks returns the buffered audio re-split into chunkMs sized AudioChunks,
+// ready to be sent again. Timestamps are reconstructed backwards from the most
+// recent write.
+func (r *audioRing) Chunks() []AudioChunk {
+	pcm := r.Bytes()
+	r.mu.Lock()
+	endTs := r.endTs
+	r.mu.Unlock()
+
+	chunkBytes := sampleRateHz * chunkMs / 1000 * bytesPerSample * numChannels
+	startTs := endTs - int64(len(pcm)/(bytesPerSample*numChannels)*1000/sampleRateHz)
+
+	var chunks []AudioChunk
+	for off := 0; off < len(pcm); off += chunkBytes {
+		end := min(off+chunkBytes, len(pcm))
+		tsMs := startTs + int64(off/(bytesPerSample*numChannels)*1000/sampleRateHz)
+		chunks = append(chunks, AudioChunk{PCM: pcm[off:end], TsMs: tsMs})
+	}
+	return chunks
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+/*
+Learning note: Rolling over to a new Transcribe stream
+======================================================
+
+A Transcribe stream cannot last forever: AWS ends it after 4 hours, and long
+streams are a risk of their own (one broken HTTP/2 connection loses the whole
+meeting). With -max-session-duration a session is either ended after that
+much wall-clock time (see capSessionDuration), or, with -rollover, moved to a
+fresh Transcribe stream every -max-session-duration while the client notices
+nothing:
+
+	audio --> [stream 1] ...........final
+	             \__ last rolloverOverlap of audio __/
+	                      replayed into [stream 2] ......
+
+The words at the seam would be cut in half if stream 2 only got the audio
+after the switch, so it first gets the last rolloverOverlap of audio again
+(kept in an audioRing). Stream 1 receives its final chunk and flushes what
+it still has while stream 2 takes over the live audio. Both write into the
+one transcript channel the caller sees:
+
+  - Stream 2's timestamps start at the beginning of the replayed audio; they are
+    moved to session time by adding the offset of that point.
+  - Pieces of stream 2 that end inside the replayed audio were already
+    transcribed by stream 1 and are dropped. A sentence spanning the seam can
+    still appear partly in both streams' pieces.
+
+runRollingTranscribeStream has the signature of runTranscribeStream, so the
+pipeline in front of it and the writer behind it do not change.
+*/
+
+// rolloverOverlap is how much audio is replayed into the next Transcribe
+// stream when a session rolls over.
+const rolloverOverlap = 5 * time.Second
+
+// errTranscribeStreamEnded is reported when a Transcribe stream of a rolling
+// session ends without error before the session does.
+var errTranscribeStreamEnded = errors.New("transcribe stream ended unexpectedly")
+
+// startTranscribe starts the Transcribe side of a session: a rolling stream
+// when cfg.Rollover is set along with cfg.MaxSessionDuration, a single
+// stream otherwise, taken from the warm pool if one is ready (see warm.go).
+func startTranscribe(ctx context.Context, client *TranscribeClient, cfg Config) (chan<- AudioChunk, <-chan TranscriptPiece, <-chan error, error) {
+	return startTranscribeWith(ctx, client, cfg, TranscribeOptions{})
+}
+
+// startTranscribeWith is startTranscribe with opts. Warm streams were started
+// with the default options, so only sessions without options take one.
+func startTranscribeWith(ctx context.Context, client *TranscribeClient, cfg Config, opts TranscribeOptions) (chan<- AudioChunk, <-chan TranscriptPiece, <-chan error, error) {
+	if cfg.Rollover && cfg.MaxSessionDuration > 0 {
+		return runRollingTranscribeStream(ctx, client, cfg.MaxSessionDuration, opts)
+	}
+	if client.pool != nil && opts == (TranscribeOptions{}) {
+		if audioIn, transcriptOut, errOut, ok := client.pool.take(ctx); ok {
+			return audioIn, transcriptOut, errOut, nil
+		}
+	}
+	return runTranscribeStreamWith(ctx, client, opts)
+}
+
+// runRollingTranscribeStream is runTranscribeStream for sessions of any
+// length: it moves the session to a new Transcribe stream every period (see
+// the note above). Every stream is started with opts. The channels behave as
+// those of runTranscribeStream.
+func runRollingTranscribeStream(ctx context.Context, client *TranscribeClient, period time.Duration, opts TranscribeOptions) (chan<- AudioChunk, <-chan TranscriptPiece, <-chan error, error) {
+	firstIn, firstOut, firstErr, err := runTranscribeStreamWith(ctx, client, opts)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	audioIn := make(chan AudioChunk, 16)
+	transcriptOut := make(chan TranscriptPiece, 32)
+	errOut := make(chan error, 1)
+
+	// pump forwards the pieces of one stream, moved by offsetMs into session
+	// time, and then reports how the stream ended on done. Pieces ending
+	// before skipMs were transcribed by the previous stream.
+	var wg sync.WaitGroup
+	pump := func(out <-chan TranscriptPiece, errc <-chan error, offsetMs, skipMs int64, done chan<- error) {
+		defer wg.Done()
+		for p := range out {
+			if p.EndMs <= skipMs {
+				continue
+			}
+			p.StartMs += offsetMs
+			p.EndMs += offsetMs
+			select {
+			case transcriptOut <- p:
+			case <-ctx.Done():
+			}
+		}
+		done <- <-errc
+	}
+
+	go func() {
+		var (
+			curIn   = firstIn
+			curDone = make(chan error, 1)
+			ring    = newAudioRing(rolloverOverlap)
+			sent    int   // bytes of session audio sent, replays excluded
+			tsMs    int64 // of the latest chunk
+			failure error
+		)
+		wg.Add(1)
+		go pump(firstOut, firstErr, 0, 0, curDone)
+
+		ticker := time.NewTicker(period)
+		defer ticker.Stop()
+
+		// send hands ch to the current stream; false means the session is over.
+		send := func(ch AudioChunk) bool {
+			select {
+			case curIn <- ch:
+				return true
+			case err := <-curDone:
+				failure = cmp.Or(err, errTranscribeStreamEnded)
+			case <-ctx.Done():
+			}
+			return false
+		}
+
+	loop:
+		for {
+			select {
+			case ch, ok := <-audioIn:
+				if !ok {
+					close(curIn)
+					break loop
+				}
+				tsMs = ch.TsMs
+				if ch.Final {
+					send(ch)
+					break loop
+				}
+				ring.Write(ch.PCM, ch.TsMs)
+				sent += len(ch.PCM)
+				if !send(ch) {
+					break loop
+				}
+			case err := <-curDone:
+				failure = cmp.Or(err, errTranscribeStreamEnded)
+				break loop
+			case <-ticker.C:
+				nextIn, nextOut, nextErr, err := runTranscribeStreamWith(ctx, client, opts)
+				if err != nil {
+					loggerFrom(ctx).Warn("rollover: new stream failed; staying on the current one", slog.String("error", err.Error()))
+					continue
+				}
+				replay := ring.Chunks()
+				var replayed int
+				for _, c := range replay {
+					replayed += len(c.PCM)
+				}
+				nextDone := make(chan error, 1)
+				wg.Add(1)
+				go pump(nextOut, nextErr, pcmDuration(sent-replayed).Milliseconds(), pcmDuration(replayed).Milliseconds(), nextDone)
+
+				// The previous stream has all audio up to here; it flushes its
+				// last pieces in the background.
+				select {
+				case curIn <- AudioChunk{Final: true, TsMs: tsMs}:
+				case <-curDone:
+				case <-ctx.Done():
+				}
+				curIn, curDone = nextIn, nextDone
+				for _, c := range replay {
+					if !send(c) {
+						break loop
+					}
+				}
+				loggerFrom(ctx).Info("rollover: session moved to a new Transcribe stream", slog.Int64("ts_ms", tsMs), slog.Duration("overlap", pcmDuration(replayed)))
+			}
+		}
+
+		wg.Wait()
+		if failure == nil {
+			select {
+			case failure = <-curDone:
+			default:
+			}
+		}
+		if failure != nil {
+			errOut <- failure
+		}
+		close(transcriptOut)
+		close(errOut)
+	}()
+
+	return audioIn, transcriptOut, errOut, nil
+}
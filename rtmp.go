@@ -0,0 +1,675 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"time"
+)
+
+/*
+Learning note: RTMP ingest
+==========================
+
+OBS, vMix and most hardware encoders publish live streams over RTMP. Pointing
+one at rtmp://<host><-rtmp-addr>/live with any stream key makes the server
+transcribe its audio track; the video is ignored. Every published stream is a
+job like the RTP ones: its transcript is at GET /jobs/{id}, and its captions
+at GET /sessions/{id}/captions.vtt while it runs.
+
+RTMP is a TCP protocol in three layers, of which we implement only what a
+publishing client needs:
+
+  - the handshake: three fixed-size messages each way (C0-C2, S0-S2). We use
+    the simple variant without the Flash digest, which encoders accept.
+  - chunking: messages are cut into chunks of at most the chunk size, and
+    chunks of different "chunk streams" may be interleaved. Each chunk header
+    only repeats what changed since the previous chunk of its chunk stream,
+    so the reader keeps per-chunk-stream state (rtmpChunkStream).
+  - messages: protocol control (chunk size, acknowledgements), AMF0-encoded
+    commands (connect, createStream, publish, ...), and audio and video data.
+
+	encoder --connect--> _result --createStream--> _result --publish--> onStatus
+	        --audio, audio, ...--> rtmpAudio --> decodeAudio(aac) --> Transcribe
+
+Encoders send AAC as raw frames plus one AudioSpecificConfig describing them.
+The AAC decoder (aac.go) reads ADTS, so every frame gets an ADTS header built
+from that config. Other audio codecs are rejected.
+
+-rtmp-key, if set, is the only stream key accepted; it is a shared secret and
+never logged.
+*/
+
+const (
+	// rtmpReadTimeout drops connections that stopped sending.
+	rtmpReadTimeout = 30 * time.Second
+
+	// rtmpMaxMessage bounds the size of one message; audio frames are a few
+	// hundred bytes, video keyframes can be a few hundred kilobytes.
+	rtmpMaxMessage = 4 << 20
+
+	rtmpHandshakeSize = 1536
+	rtmpChunkSize     = 4096 // what we send with
+	rtmpWindowSize    = 2500000
+
+	// Message types.
+	rtmpSetChunkSize     = 1
+	rtmpAbort            = 2
+	rtmpAck              = 3
+	rtmpUserControl      = 4
+	rtmpWindowAckSize    = 5
+	rtmpSetPeerBandwidth = 6
+	rtmpAudio            = 8
+	rtmpVideo            = 9
+	rtmpDataAMF0         = 18
+	rtmpCommandAMF0      = 20
+
+	// FLV sound format of AAC, and its packet types.
+	flvSoundAAC     = 10
+	aacSequenceHead = 0
+	aacRaw          = 1
+)
+
+var (
+	errRTMPUnsupported = errors.New("unsupported RTMP stream")
+	errShortAMF0       = errors.New("truncated AMF0 value")
+)
+
+// ServeRTMP accepts RTMP publishers on the TCP address addr until ctx
+// is done, transcribing the audio of every published stream as a job (see the
+// note above).
+func ServeRTMP(ctx context.Context, addr string, client *TranscribeClient, cfg Config, jobs *JobStore, sessions *SessionRegistry) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("rtmp: listen: %w", err)
+	}
+	go func() {
+		<-ctx.Done()
+		_ = ln.Close()
+	}()
+	slog.Info("rtmp: listening", slog.String("addr", ln.Addr().String()))
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("rtmp: accept: %w", err)
+		}
+		c := &rtmpConn{
+			conn: conn, r: bufio.NewReader(conn),
+			cfg: cfg, client: client, jobs: jobs, sessions: sessions,
+			inChunkSize: 128, outChunkSize: 128, // until changed, per the spec
+			chunkStreams: make(map[uint32]*rtmpChunkStream),
+		}
+		go func() {
+			stop := context.AfterFunc(ctx, func() { conn.Close() })
+			defer stop()
+			defer conn.Close()
+			if err := c.serve(ctx); err != nil && ctx.Err() == nil {
+				slog.Warn("rtmp: connection failed", slog.String("remote", conn.RemoteAddr().String()), slog.String("error", err.Error()))
+			}
+		}()
+	}
+}
+
+// rtmpChunkStream is what the reader remembers about one chunk stream.
+type rtmpChunkStream struct {
+	timestamp uint32
+	delta     uint32
+	length    uint32
+	typ       uint8
+	streamID  uint32
+	extended  bool   // the last header had an extended timestamp
+	payload   []byte // the message being assembled
+}
+
+// rtmpConn is one RTMP client connection.
+type rtmpConn struct {
+	conn     net.Conn
+	r        *bufio.Reader
+	cfg      Config
+	client   *TranscribeClient
+	jobs     *JobStore
+	sessions *SessionRegistry
+
+	inChunkSize, outChunkSize uint32
+	chunkStreams              map[uint32]*rtmpChunkStream
+	received, acked           uint32 // bytes read, and as of the last acknowledgement
+	peerWindow                uint32 // the client's acknowledgement window
+
+	app string
+	// Publishing state; raw is nil until a publish command arrives.
+	raw       chan AudioChunk
+	session   *Session
+	aacConfig []byte
+	baseTs    uint32
+	hasBase   bool
+}
+
+func (c *rtmpConn) serve(ctx context.Context) error {
+	defer c.endStream(ctx)
+	if err := c.handshake(); err != nil {
+		return fmt.Errorf("handshake: %w", err)
+	}
+	for {
+		typ, streamID, ts, payload, err := c.readMessage()
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		if err := c.handle(ctx, typ, streamID, ts, payload); err != nil {
+			return err
+		}
+	}
+}
+
+// handshake runs the simple handshake: C0+C1 in, S0+S1+S2 out, C2 in.
+func (c *rtmpConn) handshake() error {
+	_ = c.conn.SetReadDeadline(time.Now().Add(rtmpReadTimeout))
+	c0c1 := make([]byte, 1+rtmpHandshakeSize)
+	if _, err := io.ReadFull(c.r, c0c1); err != nil {
+		return err
+	}
+	if c0c1[0] != 3 {
+		return fmt.Errorf("%w: version %d", errRTMPUnsupported, c0c1[0])
+	}
+	s := make([]byte, 1+2*rtmpHandshakeSize)
+	s[0] = 3
+	// S1: time and zero, then random bytes. Zero version bytes tell the client
+	// that we do not do the digest handshake.
+	_, _ = rand.Read(s[9 : 1+rtmpHandshakeSize])
+	copy(s[1+rtmpHandshakeSize:], c0c1[1:]) // S2 echoes C1
+	if _, err := c.conn.Write(s); err != nil {
+		return err
+	}
+	_, err := io.ReadFull(c.r, make([]byte, rtmpHandshakeSize))
+	return err
+}
+
+// readMessage reads chunks until a message is complete.
+func (c *rtmpConn) readMessage() (typ uint8, streamID, ts uint32, payload []byte, err error) {
+	for {
+		_ = c.conn.SetReadDeadline(time.Now().Add(rtmpReadTimeout))
+		b0, err := c.readByte()
+		if err != nil {
+			return 0, 0, 0, nil, err
+		}
+		format := b0 >> 6
+		csid := uint32(b0 & 0x3F)
+		switch csid {
+		case 0:
+			b, err := c.read(1)
+			if err != nil {
+				return 0, 0, 0, nil, err
+			}
+			csid = 64 + uint32(b[0])
+		case 1:
+			b, err := c.read(2)
+			if err != nil {
+				return 0, 0, 0, nil, err
+			}
+			csid = 64 + uint32(b[0]) + uint32(b[1])<<8
+		}
+		cs, ok := c.chunkStreams[csid]
+		if !ok {
+			if format != 0 {
+				return 0, 0, 0, nil, fmt.Errorf("chunk stream %d starts with a type %d header", csid, format)
+			}
+			cs = &rtmpChunkStream{}
+			c.chunkStreams[csid] = cs
+		}
+
+		var header []byte
+		switch format {
+		case 0:
+			header, err = c.read(11)
+		case 1:
+			header, err = c.read(7)
+		case 2:
+			header, err = c.read(3)
+		}
+		if err != nil {
+			return 0, 0, 0, nil, err
+		}
+		var stamp uint32
+		if format < 3 {
+			stamp = uint32(header[0])<<16 | uint32(header[1])<<8 | uint32(header[2])
+			cs.extended = stamp == 0xFFFFFF
+		}
+		if format <= 1 {
+			cs.length = uint32(header[3])<<16 | uint32(header[4])<<8 | uint32(header[5])
+			cs.typ = header[6]
+			if cs.length > rtmpMaxMessage {
+				return 0, 0, 0, nil, fmt.Errorf("message of %d bytes is too large", cs.length)
+			}
+		}
+		if format == 0 {
+			cs.streamID = binary.LittleEndian.Uint32(header[7:11])
+		}
+		// An extended timestamp follows the header, and is repeated in type 3
+		// chunks of a message that has one.
+		if cs.extended {
+			b, err := c.read(4)
+			if err != nil {
+				return 0, 0, 0, nil, err
+			}
+			if format < 3 {
+				stamp = binary.BigEndian.Uint32(b)
+			}
+		}
+		// A type 3 chunk that starts a message repeats the previous delta.
+		if len(cs.payload) == 0 {
+			switch format {
+			case 0:
+				cs.timestamp = stamp
+			case 1, 2:
+				cs.delta = stamp
+				cs.timestamp += stamp
+			case 3:
+				cs.timestamp += cs.delta
+			}
+		}
+
+		n := min(c.inChunkSize, cs.length-uint32(len(cs.payload)))
+		data, err := c.read(int(n))
+		if err != nil {
+			return 0, 0, 0, nil, err
+		}
+		cs.payload = append(cs.payload, data...)
+		if err := c.acknowledge(); err != nil {
+			return 0, 0, 0, nil, err
+		}
+		if uint32(len(cs.payload)) < cs.length {
+			continue
+		}
+		payload = cs.payload
+		cs.payload = nil
+		return cs.typ, cs.streamID, cs.timestamp, payload, nil
+	}
+}
+
+func (c *rtmpConn) readByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.received++
+	}
+	return b, err
+}
+
+// read returns the next n bytes.
+func (c *rtmpConn) read(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(c.r, b); err != nil {
+		return nil, err
+	}
+	c.received += uint32(n)
+	return b, nil
+}
+
+// acknowledge sends an acknowledgement whenever the client's window has been
+// received.
+func (c *rtmpConn) acknowledge() error {
+	if c.peerWindow == 0 || c.received-c.acked < c.peerWindow {
+		return nil
+	}
+	c.acked = c.received
+	return c.writeMessage(2, rtmpAck, 0, binary.BigEndian.AppendUint32(nil, c.received))
+}
+
+// writeMessage sends a message in chunks of the outgoing chunk size.
+func (c *rtmpConn) writeMessage(csid uint8, typ uint8, streamID uint32, payload []byte) error {
+	header := []byte{csid, 0, 0, 0, byte(len(payload) >> 16), byte(len(payload) >> 8), byte(len(payload)), typ}
+	header = binary.LittleEndian.AppendUint32(header, streamID)
+	out := header
+	for i := 0; ; {
+		n := min(len(payload)-i, int(c.outChunkSize))
+		out = append(out, payload[i:i+n]...)
+		if i += n; i >= len(payload) {
+			break
+		}
+		out = append(out, 0xC0|csid) // type 3 continuation
+	}
+	_ = c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	_, err := c.conn.Write(out)
+	return err
+}
+
+func (c *rtmpConn) handle(ctx context.Context, typ uint8, streamID, ts uint32, payload []byte) error {
+	switch typ {
+	case rtmpSetChunkSize:
+		if len(payload) < 4 {
+			return errors.New("short set chunk size")
+		}
+		size := binary.BigEndian.Uint32(payload) & 0x7FFFFFFF
+		if size == 0 {
+			return errors.New("chunk size 0")
+		}
+		c.inChunkSize = size
+	case rtmpWindowAckSize:
+		if len(payload) >= 4 {
+			c.peerWindow = binary.BigEndian.Uint32(payload)
+		}
+	case rtmpAbort, rtmpAck, rtmpUserControl, rtmpSetPeerBandwidth, rtmpVideo, rtmpDataAMF0:
+	case rtmpCommandAMF0:
+		values, err := decodeAMF0(payload)
+		if err != nil {
+			return fmt.Errorf("command: %w", err)
+		}
+		return c.command(ctx, streamID, values)
+	case rtmpAudio:
+		return c.audio(ctx, ts, payload)
+	default:
+		slog.Debug("rtmp: message ignored", slog.Int("type", int(typ)))
+	}
+	return nil
+}
+
+// command answers the commands of a publishing client.
+func (c *rtmpConn) command(ctx context.Context, streamID uint32, values []any) error {
+	if len(values) < 2 {
+		return errors.New("command without name")
+	}
+	name, _ := values[0].(string)
+	txID, _ := values[1].(float64)
+	str := func(i int) string {
+		if i < len(values) {
+			s, _ := values[i].(string)
+			return s
+		}
+		return ""
+	}
+
+	switch name {
+	case "connect":
+		if len(values) > 2 {
+			if obj, ok := values[2].(map[string]any); ok {
+				c.app, _ = obj["app"].(string)
+			}
+		}
+		for _, m := range []struct {
+			typ   uint8
+			value []byte
+		}{
+			{rtmpWindowAckSize, binary.BigEndian.AppendUint32(nil, rtmpWindowSize)},
+			{rtmpSetPeerBandwidth, append(binary.BigEndian.AppendUint32(nil, rtmpWindowSize), 2)},
+			{rtmpSetChunkSize, binary.BigEndian.AppendUint32(nil, rtmpChunkSize)},
+		} {
+			if err := c.writeMessage(2, m.typ, 0, m.value); err != nil {
+				return err
+			}
+		}
+		c.outChunkSize = rtmpChunkSize
+		return c.writeMessage(3, rtmpCommandAMF0, 0, encodeAMF0("_result", txID,
+			map[string]any{"fmsVer": "FMS/3,0,1,123", "capabilities": 31.0},
+			map[string]any{"level": "status", "code": "NetConnection.Connect.Success", "description": "Connection succeeded.", "objectEncoding": 0.0}))
+	case "createStream":
+		return c.writeMessage(3, rtmpCommandAMF0, 0, encodeAMF0("_result", txID, nil, 1.0))
+	case "publish":
+		key := str(3)
+		if c.cfg.RTMPKey != "" && key != c.cfg.RTMPKey {
+			slog.Warn("rtmp: publish rejected: wrong stream key", slog.String("remote", c.conn.RemoteAddr().String()))
+			_ = c.onStatus(streamID, "error", "NetStream.Publish.BadName", "invalid stream key")
+			return errors.New("wrong stream key")
+		}
+		if c.raw != nil {
+			return errors.New("publish on a connection that is already publishing")
+		}
+		if err := c.startStream(ctx); err != nil {
+			_ = c.onStatus(streamID, "error", "NetStream.Publish.Failed", err.Error())
+			return err
+		}
+		return c.onStatus(streamID, "status", "NetStream.Publish.Start", "publishing")
+	case "FCUnpublish", "deleteStream", "closeStream":
+		c.endStream(ctx)
+	case "releaseStream", "FCPublish", "getStreamLength", "_checkbw":
+	default:
+		slog.Debug("rtmp: command ignored", slog.String("name", name))
+	}
+	return nil
+}
+
+func (c *rtmpConn) onStatus(streamID uint32, level, code, description string) error {
+	return c.writeMessage(5, rtmpCommandAMF0, streamID, encodeAMF0("onStatus", 0.0, nil,
+		map[string]any{"level": level, "code": code, "description": description}))
+}
+
+// startStream starts the job transcribing the published audio.
+func (c *rtmpConn) startStream(ctx context.Context) error {
+	decoder, err := NewDecoder(ctx, FormatAAC, DecoderOptions{FFmpegPath: c.cfg.FFmpegPath})
+	if err != nil {
+		return err
+	}
+	remote := c.conn.RemoteAddr().String()
+	job := c.jobs.add(fmt.Sprintf("rtmp %s from %s", c.app, remote), "")
+	c.session = &Session{ID: job.ID, Remote: remote, Started: time.Now(), Stats: &AudioStats{}}
+	c.session.SetLabels(map[string]string{"source": "rtmp", "app": c.app})
+	c.raw = make(chan AudioChunk, 16)
+	go c.jobs.transcribe(ctx, c.client, c.cfg, decodeAudio(ctx, c.raw, decoder, c.session.Stats, nil), false, c.session, job, c.sessions, Entitlements{})
+	slog.Info("rtmp: stream started", slog.String("app", c.app), slog.String("remote", remote), slog.String("session", job.ID))
+	return nil
+}
+
+// endStream ends the audio of the published stream, if any.
+func (c *rtmpConn) endStream(ctx context.Context) {
+	if c.raw == nil {
+		return
+	}
+	select {
+	case c.raw <- AudioChunk{Final: true}:
+	case <-ctx.Done():
+	}
+	close(c.raw)
+	c.raw = nil
+	slog.Info("rtmp: stream ended", slog.Any("session", c.session))
+}
+
+// audio handles an FLV audio tag.
+func (c *rtmpConn) audio(ctx context.Context, ts uint32, payload []byte) error {
+	if c.raw == nil || len(payload) < 2 {
+		return nil
+	}
+	c.session.Stats.addFrame(len(payload))
+	if payload[0]>>4 != flvSoundAAC {
+		return fmt.Errorf("%w: sound format %d, want AAC", errRTMPUnsupported, payload[0]>>4)
+	}
+	switch payload[1] {
+	case aacSequenceHead:
+		c.aacConfig = append([]byte(nil), payload[2:]...)
+		return nil
+	case aacRaw:
+	default:
+		return nil
+	}
+	frame, err := adtsFrame(c.aacConfig, payload[2:])
+	if err != nil {
+		c.session.Stats.addDecodeError()
+		return nil
+	}
+	if !c.hasBase {
+		c.baseTs, c.hasBase = ts, true
+	}
+	select {
+	case c.raw <- newLiveChunk(frame, int64(ts-c.baseTs)):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// adtsFrame prefixes a raw AAC frame with the ADTS header described by the
+// AudioSpecificConfig config.
+func adtsFrame(config, raw []byte) ([]byte, error) {
+	if len(config) < 2 {
+		return nil, errors.New("no AudioSpecificConfig")
+	}
+	profile := config[0] >> 3
+	rateIdx := (config[0]&0x07)<<1 | config[1]>>7
+	channels := (config[1] >> 3) & 0x0F
+	if profile == 0 || profile > 4 || int(rateIdx) >= len(adtsSampleRates) {
+		return nil, fmt.Errorf("AAC object type %d at rate index %d cannot be put in ADTS", profile, rateIdx)
+	}
+	n := 7 + len(raw)
+	if n >= 1<<13 {
+		return nil, errors.New("AAC frame too large for ADTS")
+	}
+	frame := make([]byte, 0, n)
+	frame = append(frame,
+		0xFF, 0xF1, // syncword, MPEG-4, no CRC
+		(profile-1)<<6|rateIdx<<2|channels>>2,
+		channels<<6|byte(n>>11),
+		byte(n>>3),
+		byte(n<<5)|0x1F,
+		0xFC,
+	)
+	return append(frame, raw...), nil
+}
+
+// AMF0 value markers.
+const (
+	amf0Number      = 0x00
+	amf0Boolean     = 0x01
+	amf0String      = 0x02
+	amf0Object      = 0x03
+	amf0Null        = 0x05
+	amf0Undefined   = 0x06
+	amf0ECMAArray   = 0x08
+	amf0ObjectEnd   = 0x09
+	amf0StrictArray = 0x0A
+	amf0LongString  = 0x0C
+)
+
+// decodeAMF0 decodes the AMF0 values of a command: numbers become float64,
+// objects and ECMA arrays map[string]any, null and undefined nil.
+func decodeAMF0(b []byte) ([]any, error) {
+	var values []any
+	for len(b) > 0 {
+		v, rest, err := decodeAMF0Value(b)
+		if err != nil {
+			return values, err
+		}
+		values, b = append(values, v), rest
+	}
+	return values, nil
+}
+
+func decodeAMF0Value(b []byte) (any, []byte, error) {
+	if len(b) == 0 {
+		return nil, nil, errShortAMF0
+	}
+	marker, b := b[0], b[1:]
+	switch marker {
+	case amf0Number:
+		if len(b) < 8 {
+			return nil, nil, errShortAMF0
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), b[8:], nil
+	case amf0Boolean:
+		if len(b) < 1 {
+			return nil, nil, errShortAMF0
+		}
+		return b[0] != 0, b[1:], nil
+	case amf0String, amf0LongString:
+		size := 2
+		if marker == amf0LongString {
+			size = 4
+		}
+		if len(b) < size {
+			return nil, nil, errShortAMF0
+		}
+		n := int(binary.BigEndian.Uint16(b))
+		if size == 4 {
+			n = int(binary.BigEndian.Uint32(b))
+		}
+		if len(b) < size+n {
+			return nil, nil, errShortAMF0
+		}
+		return string(b[size : size+n]), b[size+n:], nil
+	case amf0Null, amf0Undefined:
+		return nil, b, nil
+	case amf0Object, amf0ECMAArray:
+		if marker == amf0ECMAArray {
+			if len(b) < 4 {
+				return nil, nil, errShortAMF0
+			}
+			b = b[4:] // the count is only a hint
+		}
+		obj := make(map[string]any)
+		for {
+			if len(b) < 3 {
+				return nil, nil, errShortAMF0
+			}
+			n := int(binary.BigEndian.Uint16(b))
+			if n == 0 && b[2] == amf0ObjectEnd {
+				return obj, b[3:], nil
+			}
+			if len(b) < 2+n {
+				return nil, nil, errShortAMF0
+			}
+			key := string(b[2 : 2+n])
+			v, rest, err := decodeAMF0Value(b[2+n:])
+			if err != nil {
+				return nil, nil, err
+			}
+			obj[key], b = v, rest
+		}
+	case amf0StrictArray:
+		if len(b) < 4 {
+			return nil, nil, errShortAMF0
+		}
+		n := binary.BigEndian.Uint32(b)
+		b = b[4:]
+		var arr []any
+		for range n {
+			v, rest, err := decodeAMF0Value(b)
+			if err != nil {
+				return nil, nil, err
+			}
+			arr, b = append(arr, v), rest
+		}
+		return arr, b, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported AMF0 marker %#x", marker)
+	}
+}
+
+// encodeAMF0 encodes values of the types decodeAMF0 returns (without arrays).
+func encodeAMF0(values ...any) []byte {
+	var b []byte
+	for _, v := range values {
+		b = appendAMF0(b, v)
+	}
+	return b
+}
+
+func appendAMF0(b []byte, v any) []byte {
+	switch v := v.(type) {
+	case float64:
+		return binary.BigEndian.AppendUint64(append(b, amf0Number), math.Float64bits(v))
+	case bool:
+		if v {
+			return append(b, amf0Boolean, 1)
+		}
+		return append(b, amf0Boolean, 0)
+	case string:
+		return append(binary.BigEndian.AppendUint16(append(b, amf0String), uint16(len(v))), v...)
+	case map[string]any:
+		b = append(b, amf0Object)
+		for k, val := range v {
+			b = append(binary.BigEndian.AppendUint16(b, uint16(len(k))), k...)
+			b = appendAMF0(b, val)
+		}
+		return append(b, 0, 0, amf0ObjectEnd)
+	default:
+		return append(b, amf0Null)
+	}
+}
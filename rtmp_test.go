@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"math"
+	"net"
+	"reflect"
+	"testing"
+)
+
+// rtmpHeader0 is the basic and type 0 message header of a chunk of chunk
+// stream csid (2 to 63).
+func rtmpHeader0(csid byte, ts uint32, length int, typ byte, streamID uint32) []byte {
+	b := []byte{csid, byte(ts >> 16), byte(ts >> 8), byte(ts), byte(length >> 16), byte(length >> 8), byte(length), typ}
+	return binary.LittleEndian.AppendUint32(b, streamID)
+}
+
+// newTestRTMPConn returns an rtmpConn past the handshake that reads input
+// and then the end of the connection.
+func newTestRTMPConn(t *testing.T, input []byte) *rtmpConn {
+	t.Helper()
+	server, client := net.Pipe()
+	go func() {
+		_, _ = client.Write(input)
+		client.Close()
+	}()
+	t.Cleanup(func() { server.Close() })
+	return &rtmpConn{
+		conn: server, r: bufio.NewReader(server),
+		inChunkSize: 128, outChunkSize: 128,
+		chunkStreams: make(map[uint32]*rtmpChunkStream),
+	}
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestRTMPReadMessage(t *testing.T) {
+	type message struct {
+		typ      uint8
+		streamID uint32
+		ts       uint32
+		payload  []byte
+	}
+	long := bytes.Repeat([]byte{0xAB}, 200)
+
+	tests := []struct {
+		name  string
+		input []byte
+		want  []message
+		err   string // of the read after the messages
+	}{
+		{
+			name:  "one chunk",
+			input: concat(rtmpHeader0(3, 1000, 5, rtmpCommandAMF0, 1), []byte("hello")),
+			want:  []message{{rtmpCommandAMF0, 1, 1000, []byte("hello")}},
+			err:   "EOF",
+		},
+		{
+			name:  "message in two chunks",
+			input: concat(rtmpHeader0(4, 0, len(long), rtmpAudio, 1), long[:128], []byte{0xC4}, long[128:]),
+			want:  []message{{rtmpAudio, 1, 0, long}},
+			err:   "EOF",
+		},
+		{
+			name: "type 1, 2 and 3 headers add deltas",
+			input: concat(
+				rtmpHeader0(4, 100, 3, rtmpAudio, 1), []byte("abc"),
+				[]byte{0x44, 0, 0, 20, 0, 0, 2, rtmpAudio}, []byte("de"),
+				[]byte{0x84, 0, 0, 30}, []byte("fg"),
+				[]byte{0xC4}, []byte("hi"),
+			),
+			want: []message{
+				{rtmpAudio, 1, 100, []byte("abc")},
+				{rtmpAudio, 1, 120, []byte("de")},
+				{rtmpAudio, 1, 150, []byte("fg")},
+				{rtmpAudio, 1, 180, []byte("hi")},
+			},
+			err: "EOF",
+		},
+		{
+			name: "extended timestamp, repeated in type 3 chunks",
+			input: concat(
+				rtmpHeader0(5, 0xFFFFFF, len(long), rtmpAudio, 1), []byte{1, 0, 0, 0}, long[:128],
+				[]byte{0xC5, 1, 0, 0, 0}, long[128:],
+			),
+			want: []message{{rtmpAudio, 1, 1 << 24, long}},
+			err:  "EOF",
+		},
+		{
+			name:  "two byte chunk stream ID",
+			input: concat([]byte{0x00, 10}, rtmpHeader0(0, 7, 1, rtmpVideo, 1)[1:], []byte("v")),
+			want:  []message{{rtmpVideo, 1, 7, []byte("v")}},
+			err:   "EOF",
+		},
+		{
+			name: "interleaved chunk streams",
+			input: concat(
+				rtmpHeader0(4, 0, len(long), rtmpAudio, 1), long[:128],
+				rtmpHeader0(3, 5, 2, rtmpCommandAMF0, 0), []byte("ok"),
+				[]byte{0xC4}, long[128:],
+			),
+			want: []message{
+				{rtmpCommandAMF0, 0, 5, []byte("ok")},
+				{rtmpAudio, 1, 0, long},
+			},
+			err: "EOF",
+		},
+		{
+			name: "empty",
+			err:  "EOF",
+		},
+		{
+			name:  "truncated chunk stream ID",
+			input: []byte{0x01, 10},
+			err:   "unexpected EOF",
+		},
+		{
+			name:  "truncated header",
+			input: rtmpHeader0(3, 0, 5, rtmpAudio, 1)[:6],
+			err:   "unexpected EOF",
+		},
+		{
+			name:  "truncated extended timestamp",
+			input: concat(rtmpHeader0(3, 0xFFFFFF, 1, rtmpAudio, 1), []byte{1, 0}),
+			err:   "unexpected EOF",
+		},
+		{
+			name:  "truncated payload",
+			input: concat(rtmpHeader0(3, 0, 10, rtmpAudio, 1), []byte("abc")),
+			err:   "unexpected EOF",
+		},
+		{
+			name:  "message cut off between chunks",
+			input: concat(rtmpHeader0(4, 0, len(long), rtmpAudio, 1), long[:128]),
+			err:   "EOF",
+		},
+		{
+			name:  "chunk stream starting with a type 1 header",
+			input: []byte{0x43, 0, 0, 0, 0, 0, 1, rtmpAudio, 'x'},
+			err:   "chunk stream 3 starts with a type 1 header",
+		},
+		{
+			name:  "message too large",
+			input: rtmpHeader0(3, 0, rtmpMaxMessage+1, rtmpVideo, 1),
+			err:   "message of 4194305 bytes is too large",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestRTMPConn(t, tt.input)
+			for _, want := range tt.want {
+				typ, streamID, ts, payload, err := c.readMessage()
+				if err != nil {
+					t.Fatalf("got error %v, want %+v", err, want)
+				}
+				if got := (message{typ, streamID, ts, payload}); !reflect.DeepEqual(got, want) {
+					t.Fatalf("got %+v, want %+v", got, want)
+				}
+			}
+			if _, _, _, _, err := c.readMessage(); err == nil || err.Error() != tt.err {
+				t.Fatalf("got error %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestDecodeAMF0(t *testing.T) {
+	number := func(f float64) []byte {
+		return binary.BigEndian.AppendUint64([]byte{amf0Number}, math.Float64bits(f))
+	}
+	str := func(s string) []byte {
+		return append(binary.BigEndian.AppendUint16([]byte{amf0String}, uint16(len(s))), s...)
+	}
+	key := func(s string) []byte {
+		return append(binary.BigEndian.AppendUint16(nil, uint16(len(s))), s...)
+	}
+	objectEnd := []byte{0, 0, amf0ObjectEnd}
+
+	tests := []struct {
+		name  string
+		input []byte
+		want  []any
+		err   string
+	}{
+		{name: "empty"},
+		{name: "number", input: number(1.5), want: []any{1.5}},
+		{name: "booleans", input: []byte{amf0Boolean, 1, amf0Boolean, 0}, want: []any{true, false}},
+		{name: "string", input: str("live"), want: []any{"live"}},
+		{name: "long string", input: []byte{amf0LongString, 0, 0, 0, 2, 'o', 'k'}, want: []any{"ok"}},
+		{name: "null and undefined", input: []byte{amf0Null, amf0Undefined}, want: []any{nil, nil}},
+		{
+			name:  "connect command",
+			input: concat(str("connect"), number(1), []byte{amf0Object}, key("app"), str("live"), key("audioCodecs"), number(3191), objectEnd),
+			want:  []any{"connect", 1.0, map[string]any{"app": "live", "audioCodecs": 3191.0}},
+		},
+		{
+			name:  "nested object",
+			input: concat([]byte{amf0Object}, key("a"), []byte{amf0Object}, key("b"), []byte{amf0Null}, objectEnd, objectEnd),
+			want:  []any{map[string]any{"a": map[string]any{"b": nil}}},
+		},
+		{
+			name:  "ECMA array",
+			input: concat([]byte{amf0ECMAArray, 0, 0, 0, 1}, key("duration"), number(0), objectEnd),
+			want:  []any{map[string]any{"duration": 0.0}},
+		},
+		{
+			name:  "strict array",
+			input: concat([]byte{amf0StrictArray, 0, 0, 0, 2}, number(1), str("x")),
+			want:  []any{[]any{1.0, "x"}},
+		},
+		{name: "truncated number", input: number(1)[:5], err: "truncated AMF0 value"},
+		{name: "truncated boolean", input: []byte{amf0Boolean}, err: "truncated AMF0 value"},
+		{name: "truncated string length", input: []byte{amf0String, 0}, err: "truncated AMF0 value"},
+		{name: "string shorter than its length", input: []byte{amf0String, 0, 5, 'a', 'b'}, err: "truncated AMF0 value"},
+		{name: "truncated long string", input: []byte{amf0LongString, 0, 0, 0, 9, 'a'}, err: "truncated AMF0 value"},
+		{name: "object without end", input: concat([]byte{amf0Object}, key("app"), str("live")), err: "truncated AMF0 value"},
+		{name: "object key cut off", input: []byte{amf0Object, 0, 9, 'a'}, err: "truncated AMF0 value"},
+		{name: "object value missing", input: concat([]byte{amf0Object}, key("app")), err: "truncated AMF0 value"},
+		{name: "truncated ECMA array count", input: []byte{amf0ECMAArray, 0, 0}, err: "truncated AMF0 value"},
+		{name: "strict array shorter than its count", input: concat([]byte{amf0StrictArray, 0, 0, 0, 3}, number(1)), err: "truncated AMF0 value"},
+		{name: "unsupported marker", input: concat(str("ok"), []byte{0x11}), err: "unsupported AMF0 marker 0x11"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeAMF0(tt.input)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncodeAMF0RoundTrip(t *testing.T) {
+	values := []any{"_result", 2.0, nil, map[string]any{"level": "status", "code": "NetStream.Publish.Start", "ok": true}}
+	got, err := decodeAMF0(encodeAMF0(values...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, values) {
+		t.Fatalf("got %#v, want %#v", got, values)
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+Learning note: RTP ingest
+=========================
+
+Telephony gear and media servers send audio as RTP over UDP: every datagram
+is one packet with a 12-byte header (payload type, sequence number, media
+timestamp, SSRC) and a few milliseconds of audio. There is no connection, so
+the listener treats every SSRC (synchronization source) as one stream:
+
+	UDP socket --> ServeRTP --(SSRC 1)--> rtpStream --> reorderAudio --> ... --> Transcribe
+	                        --(SSRC 2)--> rtpStream --> ...
+
+A stream starts with its first packet and ends after rtpIdleTimeout without
+packets. Its transcript is published as a job (see upload.go), so it can be
+read from GET /jobs/{id} and followed on GET /jobs/{id}/transcript; its audio
+stats are under GET /sessions/{id}/stats with the same ID.
+
+Supported payloads: PCMU (type 0) and PCMA (type 8), 8kHz G.711, which are
+upsampled to the session rate, and L16 mono at 16kHz on the dynamic payload
+type cfg.RTPL16PayloadType. Because UDP has no backpressure, packets are
+dropped (and counted) rather than blocking the socket when a stream falls
+behind.
+*/
+
+const (
+	// rtpIdleTimeout ends a stream that stopped sending packets.
+	rtpIdleTimeout = 10 * time.Second
+
+	// rtpStreamBuffer is the number of packets a stream may queue.
+	rtpStreamBuffer = 64
+
+	rtpPayloadPCMU = 0
+	rtpPayloadPCMA = 8
+)
+
+var errNotRTP = errors.New("not an RTP packet")
+
+// rtpPacket is the part of an RTP packet the listener uses.
+type rtpPacket struct {
+	PayloadType uint8
+	Seq         uint16
+	Timestamp   uint32
+	SSRC        uint32
+	Payload     []byte // aliases the datagram
+}
+
+// parseRTP decodes the RTP header of b (RFC 3550, section 5.1).
+func parseRTP(b []byte) (rtpPacket, error) {
+	if len(b) < 12 || b[0]>>6 != 2 {
+		return rtpPacket{}, errNotRTP
+	}
+	p := rtpPacket{
+		PayloadType: b[1] & 0x7F,
+		Seq:         binary.BigEndian.Uint16(b[2:4]),
+		Timestamp:   binary.BigEndian.Uint32(b[4:8]),
+		SSRC:        binary.BigEndian.Uint32(b[8:12]),
+	}
+	n := 12 + 4*int(b[0]&0x0F) // CSRC list
+	if b[0]&0x10 != 0 {        // header extension
+		if len(b) < n+4 {
+			return rtpPacket{}, errNotRTP
+		}
+		n += 4 + 4*int(binary.BigEndian.Uint16(b[n+2:n+4]))
+	}
+	if len(b) < n {
+		return rtpPacket{}, errNotRTP
+	}
+	end := len(b)
+	if b[0]&0x20 != 0 { // padding, the last byte is its length
+		end -= int(b[end-1])
+	}
+	if end < n {
+		return rtpPacket{}, errNotRTP
+	}
+	p.Payload = b[n:end]
+	return p, nil
+}
+
+// ulawToLinear decodes a G.711 mu-law sample.
+func ulawToLinear(u byte) int16 {
+	u = ^u
+	t := (int16(u&0x0F)<<3 + 0x84) << ((u & 0x70) >> 4)
+	if u&0x80 != 0 {
+		return 0x84 - t
+	}
+	return t - 0x84
+}
+
+// alawToLinear decodes a G.711 A-law sample.
+func alawToLinear(a byte) int16 {
+	a ^= 0x55
+	t := int16(a&0x0F) << 4
+	switch seg := (a & 0x70) >> 4; seg {
+	case 0:
+		t += 8
+	case 1:
+		t += 0x108
+	default:
+		t = (t + 0x108) << (seg - 1)
+	}
+	if a&0x80 != 0 {
+		return t
+	}
+	return -t
+}
+
+// rtpDecoder converts RTP payloads to s16le at the session rate.
+type rtpDecoder struct {
+	l16Type uint8
+}
+
+// clockRate returns the RTP clock rate of payload type pt, or 0 if pt is not
+// supported.
+func (d rtpDecoder) clockRate(pt uint8) int {
+	switch pt {
+	case rtpPayloadPCMU, rtpPayloadPCMA:
+		return 8000
+	case d.l16Type:
+		return sampleRateHz
+	default:
+		return 0
+	}
+}
+
+// decode appends the payload as s16le to dst, upsampling 8kHz G.711 to the
+// session rate.
+func (d rtpDecoder) decode(dst []byte, pt uint8, payload []byte) []byte {
+	if pt == d.l16Type {
+		for i := 0; i+1 < len(payload); i += 2 {
+			dst = binary.LittleEndian.AppendUint16(dst, binary.BigEndian.Uint16(payload[i:]))
+		}
+		return dst
+	}
+	decode := ulawToLinear
+	if pt == rtpPayloadPCMA {
+		decode = alawToLinear
+	}
+	samples := make([]int16, len(payload))
+	for i, b := range payload {
+		samples[i] = decode(b)
+	}
+	return appendUpsampled2x(dst, samples)
+}
+
+// seqExtender turns 16-bit RTP sequence numbers into the 32-bit sequence
+// reorderAudio works with, counting wrap-arounds.
+type seqExtender struct {
+	cycles  uint32
+	last    uint16
+	started bool
+}
+
+func (e *seqExtender) extend(seq uint16) uint32 {
+	switch {
+	case !e.started:
+		e.started = true
+	case seq < e.last && e.last-seq > 0x8000:
+		e.cycles += 1 << 16 // wrapped forward
+	case seq > e.last && seq-e.last > 0x8000:
+		// Late packet from before a wrap; before the first wrap it predates the
+		// stream and maps to 0, which reorderAudio drops as late.
+		if e.cycles == 0 {
+			return 0
+		}
+		return e.cycles - 1<<16 + uint32(seq)
+	}
+	e.last = seq
+	return e.cycles + uint32(seq)
+}
+
+// rtpStream is the state the listener keeps per SSRC.
+type rtpStream struct {
+	in       chan AudioChunk
+	session  *Session
+	seq      seqExtender
+	base     uint32 // RTP timestamp of the first packet
+	lastSeen time.Time
+}
+
+// ServeRTP listens for RTP on the UDP address addr until ctx is done, running
+// one Transcribe session per SSRC (see the note above).
+func ServeRTP(ctx context.Context, addr string, client *TranscribeClient, cfg Config, jobs *JobStore, sessions *SessionRegistry) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return fmt.Errorf("rtp: listen: %w", err)
+	}
+	slog.Info("rtp: listening", slog.String("addr", conn.LocalAddr().String()))
+	r := &rtpReceiver{client: client, cfg: cfg, jobs: jobs, sessions: sessions}
+	return r.serve(ctx, ctx, conn)
+}
+
+// rtpReceiver turns the RTP streams arriving on a socket into Transcribe
+// sessions.
+type rtpReceiver struct {
+	client   *TranscribeClient
+	cfg      Config
+	jobs     *JobStore
+	sessions *SessionRegistry
+
+	// describe, if set, names the job of a new stream and returns labels for
+	// its session.
+	describe func(ssrc uint32, from net.Addr) (string, map[string]string)
+}
+
+// serve reads packets from conn until ctx is done, then closes conn and ends
+// the remaining streams, which finish transcribing within sessionCtx.
+func (r *rtpReceiver) serve(ctx, sessionCtx context.Context, conn net.PacketConn) error {
+	go func() {
+		<-ctx.Done()
+		_ = conn.Close()
+	}()
+
+	var (
+		mu      sync.Mutex
+		streams = make(map[uint32]*rtpStream)
+		dec     = rtpDecoder{l16Type: uint8(r.cfg.RTPL16PayloadType)}
+	)
+
+	// end removes a stream and lets its pipeline finish. Called with mu held.
+	end := func(ssrc uint32, s *rtpStream) {
+		delete(streams, ssrc)
+		go func() {
+			select {
+			case s.in <- AudioChunk{Final: true}:
+			case <-sessionCtx.Done():
+			}
+			close(s.in)
+		}()
+	}
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for ssrc, s := range streams {
+			end(ssrc, s)
+		}
+	}()
+
+	// Sweeper: end streams that went quiet.
+	go func() {
+		ticker := time.NewTicker(rtpIdleTimeout / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				mu.Lock()
+				for ssrc, s := range streams {
+					if now.Sub(s.lastSeen) > rtpIdleTimeout {
+						slog.Info("rtp: stream idle; ending", slog.String("ssrc", fmt.Sprintf("%08x", ssrc)))
+						end(ssrc, s)
+					}
+				}
+				mu.Unlock()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, 1500)
+	var pcm []byte
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("rtp: read: %w", err)
+		}
+		p, err := parseRTP(buf[:n])
+		if err != nil {
+			slog.Debug("rtp: packet ignored", slog.String("from", from.String()), slog.String("error", err.Error()))
+			continue
+		}
+		rate := dec.clockRate(p.PayloadType)
+		if rate == 0 {
+			slog.Debug("rtp: unsupported payload type", slog.Int("type", int(p.PayloadType)))
+			continue
+		}
+
+		mu.Lock()
+		s, ok := streams[p.SSRC]
+		if !ok {
+			name, labels := fmt.Sprintf("rtp ssrc=%08x from %s", p.SSRC, from), map[string]string(nil)
+			if r.describe != nil {
+				name, labels = r.describe(p.SSRC, from)
+			}
+			// The session shares the job's ID, so stats and transcript are found
+			// under the same ID.
+			job := r.jobs.add(name, "")
+			s = &rtpStream{
+				in:      make(chan AudioChunk, rtpStreamBuffer),
+				session: &Session{ID: job.ID, Remote: from.String(), Started: time.Now(), Stats: &AudioStats{}},
+				base:    p.Timestamp,
+			}
+			if len(labels) > 0 {
+				s.session.SetLabels(labels)
+			}
+			streams[p.SSRC] = s
+			go r.jobs.transcribe(sessionCtx, r.client, r.cfg, s.in, true, s.session, job, r.sessions, Entitlements{})
+			slog.Info("rtp: stream started", slog.String("ssrc", fmt.Sprintf("%08x", p.SSRC)), slog.String("from", from.String()), slog.Any("session", s.session))
+		}
+		s.lastSeen = time.Now()
+		s.session.Stats.addFrame(n)
+
+		pcm = dec.decode(pcm[:0], p.PayloadType, p.Payload)
+		chunk := newLiveChunk(pcm, int64(p.Timestamp-s.base)*1000/int64(rate))
+		chunk.Seq = s.seq.extend(p.Seq)
+		select {
+		case s.in <- chunk:
+		default:
+			s.session.Stats.Drops.Chunks.Add(1)
+			s.session.Stats.Drops.Bytes.Add(int64(len(chunk.PCM)))
+			chunk.Release()
+		}
+		mu.Unlock()
+	}
+}
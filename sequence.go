@@ -0,0 +1,157 @@
+package main
+
+import (
+	"slices"
+	"sync"
+)
+
+/*
+Learning note: Frame sequence numbers
+=====================================
+
+A client that reconnects, or that suspects it lost a frame, cannot tell
+from the transcript alone what it missed. So every frame the server writes
+on a session's WebSocket carries a sequence number, 1 for the first and one
+more for every frame after it, across reconnects of a resumable session:
+
+	{"v":1,"seq":41,"type":"transcript","text":"hello","partial":true}
+	{"v":1,"seq":42,"type":"level","rms":0.12,...}
+	{"v":1,"seq":44,"type":"transcript","text":"hello world","partial":false}
+
+(In protobuf it is ServerMessage.seq.) A jump, like 42 to 44 above, means
+frames were lost. Side events, such as levels, can be dropped for a slow
+client without a gap: a number is taken only by a frame that is written.
+
+The last frameRetention transcript frames are kept, and
+
+	{"type":"replay","after":42}
+
+resends the ones after 42 with "replayed":true and "replay_of" holding their
+original number; they get new numbers of their own like any other frame.
+When the gap reaches further back than that, the server falls back to
+resending all finals, as for a plain {"type":"replay"}. Observers (see
+watch.go) see sequence numbers of their own connection.
+
+Acknowledgements
+----------------
+
+Replay depends on the client noticing what it lost. Integrations that must
+not lose a word connect with ?ack=1 instead, get "ack":true in the session
+frame, and confirm what they received:
+
+	{"type":"ack","seq":44}    every frame up to 44 arrived
+
+The server keeps every final it sent until the client acknowledges its
+number or a later one, however many finals that are. When the client resumes (see
+resume.go), the unacknowledged finals are sent again, as replays, before
+the pieces produced while it was away; and while it is away no final is
+dropped from those. Finals still unacknowledged when the session ends
+without the client, because it closed the connection or did not come back,
+are stored as a dead letter (see deadletter.go). Acknowledging often keeps
+the server's memory small; acknowledging every final is not necessary.
+*/
+
+// frameRetention is how many transcript frames a frameLog keeps for replay.
+const frameRetention = resumeBuffer
+
+// sequencedTranscript is a transcript frame as it was sent.
+type sequencedTranscript struct {
+	Seq   uint64
+	Event TranscriptEvent
+}
+
+// frameLog numbers the frames of a session and keeps its recent transcript
+// frames (see the note above). It is safe for concurrent use; a nil frameLog
+// numbers nothing.
+type frameLog struct {
+	mu      sync.Mutex
+	last    uint64                // number of the last frame sent
+	kept    []sequencedTranscript // oldest first
+	evicted uint64                // number of the newest transcript frame no longer kept
+
+	acking  bool                  // the client acknowledges, see trackAcks
+	unacked []sequencedTranscript // finals sent and not acknowledged, oldest first
+}
+
+func newFrameLog() *frameLog {
+	return &frameLog{}
+}
+
+// next returns the number the next frame gets, or 0 for a nil log.
+func (l *frameLog) next() uint64 {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.last + 1
+}
+
+// sent records that ev went out as frame seq, taken from next. Only one
+// goroutine writes a connection, so nobody took seq in between.
+func (l *frameLog) sent(seq uint64, ev Event) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.last = seq
+	if t, ok := ev.(TranscriptEvent); ok && !t.Replayed {
+		if len(l.kept) == frameRetention {
+			l.evicted = l.kept[0].Seq
+			l.kept = l.kept[1:]
+		}
+		l.kept = append(l.kept, sequencedTranscript{Seq: seq, Event: t})
+		if l.acking && !t.Partial {
+			l.unacked = append(l.unacked, sequencedTranscript{Seq: seq, Event: t})
+		}
+	}
+}
+
+// trackAcks makes the log keep the finals it numbers until they are
+// acknowledged (see the note above).
+func (l *frameLog) trackAcks() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.acking = true
+}
+
+// ack records that the client received every frame up to seq. It reports
+// false if seq was never sent.
+func (l *frameLog) ack(seq uint64) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if seq > l.last {
+		return false
+	}
+	i := 0
+	for i < len(l.unacked) && l.unacked[i].Seq <= seq {
+		i++
+	}
+	l.unacked = l.unacked[i:]
+	return true
+}
+
+// unackedFinals returns the finals sent and not acknowledged, oldest first.
+func (l *frameLog) unackedFinals() []sequencedTranscript {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return slices.Clone(l.unacked)
+}
+
+// since returns the kept transcript frames numbered after seq. It reports
+// false if some of them are no longer kept.
+func (l *frameLog) since(seq uint64) ([]sequencedTranscript, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if seq < l.evicted {
+		return nil, false
+	}
+	var frames []sequencedTranscript
+	for _, f := range l.kept {
+		if f.Seq > seq {
+			frames = append(frames, f)
+		}
+	}
+	return frames, true
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+/*
+Learning note: HTTP/2 and h2c
+=============================
+
+HTTP/1.1 carries one request at a time per connection, so a browser that
+streams audio to POST /transcribe, follows jobs and loads the page at the same
+time opens a connection for each. HTTP/2 multiplexes them all over one
+connection and is full duplex, which the streaming endpoints need anyway (see
+TranscribeEndpoint).
+
+Browsers only speak HTTP/2 over TLS. Behind a reverse proxy that terminates
+TLS, the hop to this server is plain text; with -h2c the server accepts
+HTTP/2 there as well ("h2c" with prior knowledge; the HTTP/1.1 Upgrade route
+is not supported). Only enable it behind a proxy you control: the public side
+should always be TLS.
+
+WebSocket upgrades stay on HTTP/1.1: clients open /ws with an HTTP/1.1
+request whatever else runs on the connection, so nothing changes for them.
+
+Listeners
+---------
+
+-addr takes a comma-separated list of addresses, all served by the same
+server: host:port for TCP, or unix:/path/to.sock for a Unix domain socket.
+A sidecar (a proxy, a log shipper, a recorder on the same host) can then talk
+to the server over a socket file that file permissions protect, while the
+public port stays as it is, e.g. -addr :8080,unix:/run/gochannels.sock.
+TLS, when configured, only applies to the TCP listeners; a Unix socket never
+leaves the host.
+*/
+
+// readHeaderTimeout bounds how long a client may take to send request headers.
+const readHeaderTimeout = 10 * time.Second
+
+// newServer returns the HTTP server for handler. Request contexts derive from
+// ctx, so handlers see the server shutting down (see isServerShutdown).
+func newServer(ctx context.Context, cfg Config, handler http.Handler) *http.Server {
+	var protocols http.Protocols
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(true) // over TLS
+	protocols.SetUnencryptedHTTP2(cfg.H2C)
+	return &http.Server{
+		Handler:           handler,
+		Protocols:         &protocols,
+		ReadHeaderTimeout: readHeaderTimeout,
+		BaseContext:       func(net.Listener) context.Context { return ctx },
+	}
+}
+
+// listen opens a listener for each of the comma-separated addresses in addrs
+// (see the note above). A socket file left behind by a previous run is
+// replaced.
+func listen(addrs string) ([]net.Listener, error) {
+	var listeners []net.Listener
+	fail := func(err error) ([]net.Listener, error) {
+		for _, ln := range listeners {
+			ln.Close()
+		}
+		return nil, err
+	}
+	for addr := range strings.SplitSeq(addrs, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		network := "tcp"
+		if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+			network, addr = "unix", path
+			if fi, err := os.Stat(path); err == nil && fi.Mode().Type() == fs.ModeSocket {
+				_ = os.Remove(path)
+			}
+		}
+		ln, err := net.Listen(network, addr)
+		if err != nil {
+			return fail(err)
+		}
+		listeners = append(listeners, ln)
+	}
+	if len(listeners) == 0 {
+		return nil, errors.New("no listen address")
+	}
+	return listeners, nil
+}
+
+// servesTLS reports whether ln is served with TLS.
+func servesTLS(server *http.Server, ln net.Listener) bool {
+	return server.TLSConfig != nil && ln.Addr().Network() == "tcp"
+}
+
+// serveListener serves server on ln until the server is closed.
+func serveListener(server *http.Server, ln net.Listener) error {
+	if servesTLS(server, ln) {
+		// The certificates are in server.TLSConfig.
+		return server.ServeTLS(ln, "", "")
+	}
+	return server.Serve(ln)
+}
@@ -0,0 +1,538 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Session is the server-side state of one WebSocket transcription session.
+type Session struct {
+	ID          string
+	Remote      string
+	Started     time.Time
+	Stats       *AudioStats
+	ResumeToken string // empty unless the session can be resumed, see resume.go
+	Tenant      string // of the API key the session was started with, see apikeys.go
+	QoS         QoSClass
+	Options     map[string]string // query parameters of the connection, for the audit log (see audit.go)
+
+	pricePerMinute float64 // USD, that its cost is estimated at; set by SessionRegistry.Add
+
+	mu         sync.Mutex
+	labels     map[string]string // set by the client with a config message
+	stream     TranscribeOptions // of the current Transcribe stream, see restart.go
+	finals     []string          // final transcript pieces so far, in order
+	finalEndMs int64             // end of the last final in the audio
+	counts     TranscriptCounts  // AverageConfidence is computed by Summary
+	confidence float64           // sum of the confidence of the counted words
+	confWords  int64             // words with a confidence
+	err        error             // that ended the session, see SessionRegistry.Fail
+	killed     chan struct{}     // closed by Kill; created on first use
+	killReason closeReason
+	channels   []watchedChannel // see WatchChannel
+	events     []notedEvent     // the last recentEvents written to the client, a ring; see NoteEvent
+	nextEvent  int              // where the next one goes once events is full
+	lastErr    *notedError      // see NoteError
+}
+
+// LogValue logs a session as its ID and labels, so the labels a client sets
+// (user, call, ...) can be used to find its log lines.
+func (s *Session) LogValue() slog.Value {
+	labels := s.Labels()
+	if len(labels) == 0 {
+		return slog.GroupValue(slog.String("id", s.ID))
+	}
+	attrs := make([]slog.Attr, 0, len(labels))
+	for _, k := range slices.Sorted(maps.Keys(labels)) {
+		attrs = append(attrs, slog.String(k, labels[k]))
+	}
+	return slog.GroupValue(slog.String("id", s.ID), slog.Any("labels", slog.GroupValue(attrs...)))
+}
+
+// SessionInfo describes a running session, as served by GET /sessions and
+// GET /sessions/{id}.
+type SessionInfo struct {
+	ID           string             `json:"id"`
+	Remote       string             `json:"remote"`
+	Tenant       string             `json:"tenant,omitempty"`
+	QoS          QoSClass           `json:"qos,omitempty"`
+	Language     string             `json:"language"`
+	Vocabulary   string             `json:"vocabulary,omitempty"`
+	Started      time.Time          `json:"started"`
+	LastActivity time.Time          `json:"last_activity,omitzero"`
+	Labels       map[string]string  `json:"labels,omitempty"`
+	Stats        AudioStatsSnapshot `json:"stats"`
+}
+
+// Info returns the current state of the session.
+func (s *Session) Info() SessionInfo {
+	opts := s.StreamOptions()
+	return SessionInfo{
+		ID:           s.ID,
+		Remote:       s.Remote,
+		Tenant:       s.Tenant,
+		QoS:          s.QoS,
+		Language:     cmp.Or(opts.Language, string(transcribeLanguage)),
+		Vocabulary:   opts.Vocabulary,
+		Started:      s.Started,
+		LastActivity: s.Stats.LastActivity(),
+		Labels:       s.Labels(),
+		Stats:        s.Stats.Snapshot(),
+	}
+}
+
+// AddPiece counts a transcript piece for the session's summary and appends
+// finals to the session's transcript.
+func (s *Session) AddPiece(piece TranscriptPiece) {
+	metrics.piece(piece.Partial)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if piece.Partial {
+		s.counts.Partials++
+		return
+	}
+	s.finals = append(s.finals, piece.Text)
+	s.finalEndMs = max(s.finalEndMs, piece.EndMs)
+	words := int64(len(strings.Fields(piece.Text)))
+	s.counts.Finals++
+	s.counts.Words += words
+	if piece.Confidence > 0 {
+		s.confidence += piece.Confidence * float64(words)
+		s.confWords += words
+	}
+}
+
+// Checkpoint returns the final pieces so far and where the last of them ends
+// in the audio, in milliseconds (see checkpoint.go).
+func (s *Session) Checkpoint() ([]string, int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.finals), s.finalEndMs
+}
+
+// Summary returns the summary of the session so far, as sent when it ends.
+func (s *Session) Summary() SummaryEvent {
+	s.mu.Lock()
+	counts, err := s.counts, s.err
+	if s.confWords > 0 {
+		counts.AverageConfidence = s.confidence / float64(s.confWords)
+	}
+	s.mu.Unlock()
+	stats := s.Stats.Snapshot()
+	summary := SummaryEvent{
+		Type:       "summary",
+		SessionID:  s.ID,
+		Labels:     s.Labels(),
+		DurationMs: time.Since(s.Started).Milliseconds(),
+		Stats:      stats,
+		Transcript: counts,
+		CostUSD:    estimatedCost(stats.AudioMs, s.pricePerMinute),
+	}
+	if err != nil {
+		summary.Error = err.Error()
+	}
+	return summary
+}
+
+// Finals returns the final transcript pieces received so far.
+func (s *Session) Finals() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.finals)
+}
+
+// Kill asks the session to end early with reason: its audio is finalized,
+// the rest of the transcript is flushed and the client is told the reason
+// (see endOnKill). It reports false if the session was already killed.
+func (s *Session) Kill(reason closeReason) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.killed == nil {
+		s.killed = make(chan struct{})
+	}
+	select {
+	case <-s.killed:
+		return false
+	default:
+	}
+	s.killReason = reason
+	close(s.killed)
+	return true
+}
+
+// Killed returns a channel that is closed once the session is killed, and
+// the reason given to Kill.
+func (s *Session) Killed() (<-chan struct{}, func() closeReason) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.killed == nil {
+		s.killed = make(chan struct{})
+	}
+	return s.killed, func() closeReason {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.killReason
+	}
+}
+
+// SetLabels merges labels into the session's labels.
+func (s *Session) SetLabels(labels map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.labels == nil {
+		s.labels = make(map[string]string, len(labels))
+	}
+	maps.Copy(s.labels, labels)
+}
+
+// Labels returns a copy of the session's labels.
+func (s *Session) Labels() map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return maps.Clone(s.labels)
+}
+
+// SetStreamOptions records the options of the Transcribe stream the session
+// runs on now, once a config message moved it to a new one.
+func (s *Session) SetStreamOptions(opts TranscribeOptions) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stream = opts
+}
+
+// StreamOptions returns the options of the session's current Transcribe
+// stream; the zero value for the defaults.
+func (s *Session) StreamOptions() TranscribeOptions {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stream
+}
+
+// WatchChannel makes the fill level of ch, a channel of the session's
+// pipeline, show under name in GET /debug/runtime (see debug.go).
+func (s *Session) WatchChannel(name string, ch any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.channels = append(s.channels, watchedChannel{name: name, ch: reflect.ValueOf(ch)})
+}
+
+// ChannelDepths returns how full the watched channels are now, by name.
+func (s *Session) ChannelDepths() map[string]ChannelDepth {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.channels) == 0 {
+		return nil
+	}
+	depths := make(map[string]ChannelDepth, len(s.channels))
+	for _, c := range s.channels {
+		depths[c.name] = c.depth()
+	}
+	return depths
+}
+
+// NoteEvent remembers ev, written to the session's client, for GET
+// /debug/sessions/{id} (see dump.go).
+func (s *Session) NoteEvent(ev Event) {
+	noted := notedEvent{Time: time.Now(), Type: ev.EventType(), Event: ev}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.events) < recentEvents {
+		s.events = append(s.events, noted)
+		return
+	}
+	s.events[s.nextEvent] = noted
+	s.nextEvent = (s.nextEvent + 1) % recentEvents
+}
+
+// NoteError remembers err as the latest error the session saw, for GET
+// /debug/sessions/{id} (see dump.go).
+func (s *Session) NoteError(err error) {
+	noted := &notedError{Time: time.Now(), Message: err.Error()}
+	if kind, ok := classifyError(err); ok {
+		noted.Kind = errorKinds[kind].Name
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastErr = noted
+}
+
+// Noted returns what NoteError and NoteEvent remembered: the latest error,
+// nil if there was none, and the recent events, oldest first.
+func (s *Session) Noted() (*notedError, []notedEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	events := make([]notedEvent, 0, len(s.events))
+	events = append(events, s.events[s.nextEvent:]...)
+	events = append(events, s.events[:s.nextEvent]...)
+	return s.lastErr, events
+}
+
+// SessionEvent is the first message of every connection; it tells the client
+// the ID under which its session can be found in the HTTP API.
+type SessionEvent struct {
+	Type    string `json:"type"`
+	ID      string `json:"id"`
+	Token   string `json:"token,omitempty"`   // resume token, see resume.go
+	Resumed bool   `json:"resumed,omitempty"` // sent again after a resume
+	Ack     bool   `json:"ack,omitempty"`     // the client acknowledges frames, see sequence.go
+}
+
+func (e SessionEvent) EventType() string { return e.Type }
+
+// SessionObserver is told when sessions are added to and removed from a
+// SessionRegistry, e.g. to publish lifecycle events. The calls are made
+// synchronously from the session's goroutine and must not block.
+type SessionObserver interface {
+	SessionStarted(s *Session)
+	SessionEnded(s *Session)
+}
+
+// SessionFailureObserver is a SessionObserver that is also told about the
+// error that ended a session early (see SessionRegistry.Fail).
+type SessionFailureObserver interface {
+	SessionFailed(s *Session, err error)
+}
+
+// errTooManySessions is returned when the limit on concurrent Transcribe
+// sessions is reached.
+var errTooManySessions = errors.New("too many concurrent sessions")
+
+// SessionRegistry keeps track of the running sessions so they can be looked
+// up by ID from the HTTP API. It also enforces the limit on concurrent
+// Transcribe sessions: every source reserves a slot before it starts a
+// Transcribe stream, so a full server turns clients away up front instead of
+// AWS failing the stream with a LimitExceededException. It is safe for
+// concurrent use.
+type SessionRegistry struct {
+	mu        sync.RWMutex
+	sessions  map[string]*Session
+	observers []SessionObserver
+
+	limit     int           // 0 = unlimited
+	reserved  int           // slots in use
+	slotFreed chan struct{} // closed and replaced whenever a slot is released
+	shared    SharedLimit   // limit across server instances, nil if none
+	price     float64       // USD per minute of audio, see SetPrice
+	quotas    *TenantQuotas // nil if tenants have no quotas
+
+	// QoS admission, see qos.go.
+	realtimeReserve int
+	bestEffortLoad  float64
+}
+
+// SharedLimit is a limit on concurrent sessions shared with other server
+// instances, e.g. through Redis (see redisstate.go). Acquire fails with
+// errTooManySessions when the limit is reached.
+type SharedLimit interface {
+	Acquire() error
+	Release()
+}
+
+// NewSessionRegistry returns a registry that allows limit concurrent
+// Transcribe sessions (0 = unlimited) and tells observers about sessions.
+func NewSessionRegistry(limit int, observers ...SessionObserver) *SessionRegistry {
+	return &SessionRegistry{sessions: make(map[string]*Session), observers: observers, limit: limit, slotFreed: make(chan struct{})}
+}
+
+// ShareLimit makes the registry reserve its slots from l as well.
+func (r *SessionRegistry) ShareLimit(l SharedLimit) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.shared = l
+}
+
+// SetPrice makes the registry estimate the cost of the sessions added from
+// now on at pricePerMinute, in USD per minute of audio (see usage.go).
+func (r *SessionRegistry) SetPrice(pricePerMinute float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.price = pricePerMinute
+}
+
+// LimitTenants makes the registry admit sessions by the quotas of their
+// tenant (see quota.go).
+func (r *SessionRegistry) LimitTenants(q *TenantQuotas) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.quotas = q
+}
+
+// Admit checks the quotas of the tenant of e before a session of it starts,
+// failing with a *quotaError if it is over one. Without quotas every session
+// is admitted. The admission's release must be called once the session is
+// over.
+func (r *SessionRegistry) Admit(e Entitlements) (tenantAdmission, error) {
+	r.mu.RLock()
+	q := r.quotas
+	r.mu.RUnlock()
+	if q == nil {
+		return tenantAdmission{release: func() {}}, nil
+	}
+	return q.Admit(e)
+}
+
+// Load returns how many slots are in use and the limit (0 = unlimited).
+func (r *SessionRegistry) Load() (inUse, limit int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.reserved, r.limit
+}
+
+// Reserve claims a slot for a Transcribe session of the standard QoS class,
+// or fails with errTooManySessions if none is free. release gives the slot
+// back once the Transcribe stream is over; calling it more than once is
+// harmless.
+func (r *SessionRegistry) Reserve() (release func(), err error) {
+	return r.ReserveQoS(QoSStandard)
+}
+
+// ReserveQoS is Reserve for a session of class (see qos.go).
+func (r *SessionRegistry) ReserveQoS(class QoSClass) (release func(), err error) {
+	r.mu.Lock()
+	if r.limit > 0 && r.reserved >= r.capacity(class) {
+		r.mu.Unlock()
+		return nil, errTooManySessions
+	}
+	r.reserved++
+	shared := r.shared
+	r.mu.Unlock()
+
+	free := func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.reserved--
+		close(r.slotFreed)
+		r.slotFreed = make(chan struct{})
+	}
+	if shared != nil {
+		if err := shared.Acquire(); err != nil {
+			free()
+			return nil, err
+		}
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			if shared != nil {
+				shared.Release()
+			}
+			free()
+		})
+	}, nil
+}
+
+// sharedLimitPoll is how often ReserveWait retries while a shared limit is
+// reached; slots freed on other instances are not announced.
+const sharedLimitPoll = 5 * time.Second
+
+// ReserveWait is Reserve for work that can wait, such as uploads: it waits
+// for a free best-effort slot until ctx is done.
+func (r *SessionRegistry) ReserveWait(ctx context.Context) (release func(), err error) {
+	for {
+		r.mu.RLock()
+		freed, shared := r.slotFreed, r.shared
+		r.mu.RUnlock()
+		release, err := r.ReserveQoS(QoSBestEffort)
+		if err == nil {
+			return release, nil
+		}
+		var poll <-chan time.Time
+		if shared != nil {
+			poll = time.After(sharedLimitPoll)
+		}
+		select {
+		case <-freed:
+		case <-poll:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Freed returns a channel that is closed when the next slot is released.
+func (r *SessionRegistry) Freed() <-chan struct{} {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.slotFreed
+}
+
+// Add registers s under s.ID, its cost estimated at the price of SetPrice.
+func (r *SessionRegistry) Add(s *Session) {
+	r.mu.Lock()
+	s.pricePerMinute = r.price
+	r.sessions[s.ID] = s
+	r.mu.Unlock()
+	for _, o := range r.observers {
+		o.SessionStarted(s)
+	}
+}
+
+// Remove forgets the session with the given ID.
+func (r *SessionRegistry) Remove(id string) {
+	r.mu.Lock()
+	s, ok := r.sessions[id]
+	delete(r.sessions, id)
+	r.mu.Unlock()
+	if !ok {
+		return
+	}
+	for _, o := range r.observers {
+		o.SessionEnded(s)
+	}
+}
+
+// Fail reports err as the reason the session with the given ID is ending,
+// before it is removed.
+func (r *SessionRegistry) Fail(id string, err error) {
+	s, ok := r.Get(id)
+	if !ok {
+		return
+	}
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.mu.Unlock()
+	s.NoteError(err)
+	for _, o := range r.observers {
+		if f, ok := o.(SessionFailureObserver); ok {
+			f.SessionFailed(s, err)
+		}
+	}
+}
+
+// Get returns the session with the given ID, if it is running.
+func (r *SessionRegistry) Get(id string) (*Session, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	s, ok := r.sessions[id]
+	return s, ok
+}
+
+// List returns the running sessions, oldest first.
+func (r *SessionRegistry) List() []*Session {
+	r.mu.RLock()
+	list := slices.Collect(maps.Values(r.sessions))
+	r.mu.RUnlock()
+	slices.SortFunc(list, func(a, b *Session) int { return a.Started.Compare(b.Started) })
+	return list
+}
+
+// newSessionID returns a random (version 4) UUID.
+func newSessionID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:]) // never fails, see crypto/rand.Read
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"log/slog"
+	"net"
+	"time"
+)
+
+// sinkMaxBackoff caps the delay between reconnection attempts of a sink.
+const sinkMaxBackoff = 30 * time.Second
+
+// sinkFinalWait is how long a sink with a queue of its own waits for room
+// for a final before dropping it, while its broker is away or slow.
+// Partials are dropped at once.
+const sinkFinalWait = 5 * time.Second
+
+// TranscriptSink receives the transcript pieces of every session, for
+// publishing them outside the server (MQTT, Redis, NATS, ...). Publish is
+// called from a goroutine per session and sink, in the order of the pieces;
+// a sink that cannot keep up misses partials, and finals after
+// sinkFinalWait, rather than stalling the client (see broadcast.go).
+// Publish may block that long, but not longer.
+type TranscriptSink interface {
+	Publish(sessionID string, piece TranscriptPiece)
+}
+
+// SummarySink is implemented by sinks that also publish the summary of
+// every session when it ends.
+type SummarySink interface {
+	PublishSummary(summary SummaryEvent)
+}
+
+// transcriptSinks publishes to every sink in the list; an empty list
+// publishes nowhere.
+type transcriptSinks []TranscriptSink
+
+func (s transcriptSinks) Publish(sessionID string, piece TranscriptPiece) {
+	for _, sink := range s {
+		sink.Publish(sessionID, piece)
+	}
+}
+
+// PublishSummary publishes the summary to the sinks that are SummarySinks.
+func (s transcriptSinks) PublishSummary(summary SummaryEvent) {
+	for _, sink := range s {
+		if ss, ok := sink.(SummarySink); ok {
+			ss.PublishSummary(summary)
+		}
+	}
+}
+
+// summaryPublisher is a SessionObserver handing the summary of every session
+// that ends to a SummarySink. The session's pieces have all been published
+// by then (see broadcast.go).
+type summaryPublisher struct {
+	sink SummarySink
+}
+
+func (p summaryPublisher) SessionStarted(*Session) {}
+
+func (p summaryPublisher) SessionEnded(s *Session) {
+	p.sink.PublishSummary(s.Summary())
+}
+
+// publishTranscripts passes the pieces from in through to the returned
+// channel and hands each one to every sink, each on a tap of its own (see
+// broadcast.go). Once ctx is done the remaining pieces are still drained
+// (and published) but no longer passed on, so the Transcribe receiver never
+// blocks.
+func publishTranscripts(ctx context.Context, in <-chan TranscriptPiece, sessionID string, sink TranscriptSink) <-chan TranscriptPiece {
+	b := newTranscriptBroadcaster(sessionID)
+	b.AttachSink(sink)
+	out := b.Subscribe("client", cap(in))
+	go b.run(ctx, in)
+	return out
+}
+
+// enqueueSinkMessage queues m on queue, the queue of a sink's connection.
+// When the queue is full, m is dropped at once, or with wait (finals) only
+// after sinkFinalWait. It reports whether m was queued.
+func enqueueSinkMessage[T any](queue chan<- T, m T, wait bool) bool {
+	select {
+	case queue <- m:
+		return true
+	default:
+	}
+	if !wait {
+		return false
+	}
+	timer := time.NewTimer(sinkFinalWait)
+	defer timer.Stop()
+	select {
+	case queue <- m:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// publishedTranscript is the JSON payload network sinks publish for every
+// transcript piece. Type tells it from the summary ("summary") published on
+// the same topic when the session ends.
+type publishedTranscript struct {
+	Type      string `json:"type"`
+	SessionID string `json:"session_id"`
+	Text      string `json:"text"`
+	Partial   bool   `json:"partial"`
+}
+
+func newPublishedTranscript(sessionID string, piece TranscriptPiece) publishedTranscript {
+	return publishedTranscript{Type: "transcript", SessionID: sessionID, Text: piece.Text, Partial: piece.Partial}
+}
+
+// runConnected calls connect, which holds one connection to addr until it
+// fails, again and again with exponential backoff until ctx is done. It is
+// the connection loop of the sinks that talk to a broker.
+func runConnected(ctx context.Context, name, addr string, connect func(context.Context) error) {
+	backoff := time.Second
+	for {
+		start := time.Now()
+		err := connect(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(start) > sinkMaxBackoff {
+			backoff = time.Second // the connection was up for a while
+		}
+		slog.Warn(name+": disconnected; retrying", slog.String("addr", addr), slog.String("error", err.Error()), slog.Duration("backoff", backoff))
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		backoff = min(2*backoff, sinkMaxBackoff)
+	}
+}
+
+// dialBroker opens a TCP connection to addr, over TLS if useTLS is set.
+func dialBroker(ctx context.Context, addr string, useTLS bool) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	if !useTLS {
+		return dialer.DialContext(ctx, "tcp", addr)
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	return (&tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: host}}).DialContext(ctx, "tcp", addr)
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+Learning note: SIPREC
+=====================
+
+SIPREC (RFC 7866) is how PBXs and session border controllers fork the media
+of a call to a recorder. The SBC (the recording client) sends the recorder an
+INVITE whose body has two parts:
+
+  - SDP offering one RTP stream per call leg, each tagged with a=label, and
+  - rs-metadata XML naming the participants and which labeled stream each of
+    them sends.
+
+The recorder answers with SDP pointing every stream at a port of its own and
+the media starts flowing; a BYE ends the recording.
+
+ServeSIPREC implements just enough of SIP over UDP for this: INVITE (and its
+retransmissions), ACK, BYE, CANCEL and OPTIONS. Every leg gets its own UDP
+port and goes through the RTP receiver (see rtp.go), so each participant is
+transcribed in a session of its own. Transcribe never has to tell speakers
+apart: the leg is the speaker, recorded in the session labels call_id, leg
+and participant.
+*/
+
+// sipMessage is a parsed SIP request or response.
+type sipMessage struct {
+	Method     string // empty for responses
+	RequestURI string
+	Header     textproto.MIMEHeader
+	Body       []byte
+}
+
+// sipCompactHeaders maps compact header names to their long form.
+var sipCompactHeaders = map[string]string{
+	"V": "Via", "F": "From", "T": "To", "I": "Call-Id", "M": "Contact",
+	"L": "Content-Length", "C": "Content-Type", "K": "Supported",
+}
+
+// parseSIP parses a SIP message from a datagram.
+func parseSIP(b []byte) (*sipMessage, error) {
+	r := textproto.NewReader(bufio.NewReader(bytes.NewReader(b)))
+	line, err := r.ReadLine()
+	if err != nil {
+		return nil, fmt.Errorf("sip: %w", err)
+	}
+	parts := strings.SplitN(line, " ", 3)
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("sip: malformed start line %q", line)
+	}
+	msg := &sipMessage{}
+	if parts[2] == "SIP/2.0" {
+		msg.Method, msg.RequestURI = parts[0], parts[1]
+	} else if parts[0] != "SIP/2.0" {
+		return nil, fmt.Errorf("sip: malformed start line %q", line)
+	}
+
+	hdr, err := r.ReadMIMEHeader()
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("sip: %w", err)
+	}
+	msg.Header = make(textproto.MIMEHeader, len(hdr))
+	for k, vs := range hdr {
+		if long, ok := sipCompactHeaders[k]; ok {
+			k = long
+		}
+		msg.Header[k] = append(msg.Header[k], vs...)
+	}
+	msg.Body, _ = io.ReadAll(r.R)
+	if n, err := strconv.Atoi(msg.Header.Get("Content-Length")); err == nil && n < len(msg.Body) {
+		msg.Body = msg.Body[:n]
+	}
+	return msg, nil
+}
+
+// sipResponse builds a response to req. extra holds additional header lines.
+func sipResponse(req *sipMessage, code int, reason, toTag string, extra []string, body []byte) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "SIP/2.0 %d %s\r\n", code, reason)
+	for _, via := range req.Header.Values("Via") {
+		fmt.Fprintf(&b, "Via: %s\r\n", via)
+	}
+	fmt.Fprintf(&b, "From: %s\r\n", req.Header.Get("From"))
+	to := req.Header.Get("To")
+	if toTag != "" && !strings.Contains(to, ";tag=") {
+		to += ";tag=" + toTag
+	}
+	fmt.Fprintf(&b, "To: %s\r\n", to)
+	fmt.Fprintf(&b, "Call-ID: %s\r\n", req.Header.Get("Call-Id"))
+	fmt.Fprintf(&b, "CSeq: %s\r\n", req.Header.Get("Cseq"))
+	for _, h := range extra {
+		b.WriteString(h + "\r\n")
+	}
+	fmt.Fprintf(&b, "Content-Length: %d\r\n\r\n", len(body))
+	b.Write(body)
+	return b.Bytes()
+}
+
+// sdpMedia is an m= section of an SDP offer.
+type sdpMedia struct {
+	Kind    string   // "audio", ...
+	Formats []string // payload types
+	Label   string   // a=label
+	RTPMap  map[string]string
+}
+
+// parseSDPMedia returns the media sections of an SDP body.
+func parseSDPMedia(body []byte) []sdpMedia {
+	var media []sdpMedia
+	for _, line := range strings.Split(string(body), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "m="):
+			fields := strings.Fields(line[2:])
+			if len(fields) < 3 {
+				continue
+			}
+			media = append(media, sdpMedia{Kind: fields[0], Formats: fields[3:], RTPMap: map[string]string{}})
+		case len(media) == 0:
+		case strings.HasPrefix(line, "a=label:"):
+			media[len(media)-1].Label = line[len("a=label:"):]
+		case strings.HasPrefix(line, "a=rtpmap:"):
+			if pt, codec, ok := strings.Cut(line[len("a=rtpmap:"):], " "); ok {
+				media[len(media)-1].RTPMap[pt] = codec
+			}
+		}
+	}
+	return media
+}
+
+// recordingMetadata is the part of the rs-metadata XML (RFC 7865) we use.
+type recordingMetadata struct {
+	Participants []struct {
+		ID     string `xml:"participant_id,attr"`
+		NameID struct {
+			AOR  string `xml:"aor,attr"`
+			Name string `xml:"name"`
+		} `xml:"nameID"`
+	} `xml:"participant"`
+	Streams []struct {
+		ID    string `xml:"stream_id,attr"`
+		Label string `xml:"label"`
+	} `xml:"stream"`
+	Associations []struct {
+		ParticipantID string   `xml:"participant_id,attr"`
+		Send          []string `xml:"send"`
+	} `xml:"participantstreamassoc"`
+}
+
+// speakers maps stream labels to the participant sending on them.
+func (m recordingMetadata) speakers() map[string]string {
+	names := map[string]string{}
+	for _, p := range m.Participants {
+		name := p.NameID.Name
+		if name == "" {
+			name = p.NameID.AOR
+		}
+		names[p.ID] = name
+	}
+	labels := map[string]string{}
+	for _, s := range m.Streams {
+		labels[s.ID] = s.Label
+	}
+	speakers := map[string]string{}
+	for _, a := range m.Associations {
+		for _, streamID := range a.Send {
+			if label, ok := labels[strings.TrimSpace(streamID)]; ok {
+				speakers[label] = names[a.ParticipantID]
+			}
+		}
+	}
+	return speakers
+}
+
+// splitSIPRECBody returns the SDP and metadata parts of an INVITE body.
+func splitSIPRECBody(contentType string, body []byte) (sdp []byte, meta recordingMetadata, err error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, meta, fmt.Errorf("sip: content type: %w", err)
+	}
+	if mediaType == "application/sdp" {
+		return body, meta, nil
+	}
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		return nil, meta, fmt.Errorf("sip: unsupported body %s", mediaType)
+	}
+	mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, meta, fmt.Errorf("sip: body: %w", err)
+		}
+		data, err := io.ReadAll(part)
+		if err != nil {
+			return nil, meta, fmt.Errorf("sip: body: %w", err)
+		}
+		switch t, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type")); t {
+		case "application/sdp":
+			sdp = data
+		case "application/rs-metadata+xml":
+			if err := xml.Unmarshal(data, &meta); err != nil {
+				slog.Warn("siprec: metadata ignored", slog.String("error", err.Error()))
+			}
+		}
+	}
+	if sdp == nil {
+		return nil, meta, errors.New("sip: no SDP in body")
+	}
+	return sdp, meta, nil
+}
+
+// sipCall is a recording in progress.
+type sipCall struct {
+	toTag  string
+	answer []byte // the 200 OK, resent on INVITE retransmissions
+	cancel context.CancelFunc
+}
+
+// ServeSIPREC runs a SIPREC recording server on the UDP address addr until
+// ctx is done (see the note above).
+func ServeSIPREC(ctx context.Context, addr string, client *TranscribeClient, cfg Config, jobs *JobStore, sessions *SessionRegistry) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return fmt.Errorf("siprec: listen: %w", err)
+	}
+	go func() {
+		<-ctx.Done()
+		_ = conn.Close()
+	}()
+	slog.Info("siprec: listening", slog.String("addr", conn.LocalAddr().String()))
+
+	var (
+		mu    sync.Mutex
+		calls = make(map[string]*sipCall)
+	)
+	reply := func(to net.Addr, msg []byte) {
+		if _, err := conn.WriteTo(msg, to); err != nil {
+			slog.Warn("siprec: write failed", slog.String("to", to.String()), slog.String("error", err.Error()))
+		}
+	}
+	hangUp := func(callID string) {
+		mu.Lock()
+		defer mu.Unlock()
+		if call, ok := calls[callID]; ok {
+			call.cancel()
+			delete(calls, callID)
+			slog.Info("siprec: call ended", slog.String("call_id", callID))
+		}
+	}
+
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("siprec: read: %w", err)
+		}
+		req, err := parseSIP(buf[:n])
+		if err != nil || req.Method == "" {
+			continue // garbage or a response to something we never sent
+		}
+		callID := req.Header.Get("Call-Id")
+
+		switch req.Method {
+		case "INVITE":
+			mu.Lock()
+			call, ok := calls[callID]
+			mu.Unlock()
+			if ok {
+				reply(from, call.answer)
+				continue
+			}
+			call, err := startSIPRECCall(ctx, req, from, conn.LocalAddr().(*net.UDPAddr).Port, client, cfg, jobs, sessions)
+			if err != nil {
+				slog.Warn("siprec: invite rejected", slog.String("call_id", callID), slog.String("error", err.Error()))
+				reply(from, sipResponse(req, 488, "Not Acceptable Here", newSIPTag(), nil, nil))
+				continue
+			}
+			mu.Lock()
+			calls[callID] = call
+			mu.Unlock()
+			reply(from, call.answer)
+		case "BYE", "CANCEL":
+			hangUp(callID)
+			reply(from, sipResponse(req, 200, "OK", "", nil, nil))
+		case "OPTIONS":
+			reply(from, sipResponse(req, 200, "OK", newSIPTag(), []string{"Allow: INVITE, ACK, BYE, CANCEL, OPTIONS"}, nil))
+		case "ACK":
+		default:
+			reply(from, sipResponse(req, 405, "Method Not Allowed", newSIPTag(), []string{"Allow: INVITE, ACK, BYE, CANCEL, OPTIONS"}, nil))
+		}
+	}
+}
+
+// startSIPRECCall opens an RTP port per offered audio stream and returns the
+// call with its 200 OK answer. The ports are closed when the call's context
+// is canceled; the sessions then finish within ctx.
+func startSIPRECCall(ctx context.Context, req *sipMessage, from net.Addr, sipPort int, client *TranscribeClient, cfg Config, jobs *JobStore, sessions *SessionRegistry) (*sipCall, error) {
+	sdp, meta, err := splitSIPRECBody(req.Header.Get("Content-Type"), req.Body)
+	if err != nil {
+		return nil, err
+	}
+	media := parseSDPMedia(sdp)
+	speakers := meta.speakers()
+	callID := req.Header.Get("Call-Id")
+
+	// The address the client reaches us on is the one our route to it uses.
+	local, err := net.Dial("udp", from.String())
+	if err != nil {
+		return nil, err
+	}
+	localIP := local.LocalAddr().(*net.UDPAddr).IP
+	local.Close()
+
+	callCtx, cancel := context.WithCancel(ctx)
+	var answer strings.Builder
+	fmt.Fprintf(&answer, "v=0\r\no=gochannels %d 1 IN IP4 %s\r\ns=SIPREC\r\nc=IN IP4 %s\r\nt=0 0\r\n", newSIPSessionID(), localIP, localIP)
+	accepted := 0
+	for i, m := range media {
+		var formats []string
+		for _, pt := range m.Formats {
+			switch {
+			case pt == strconv.Itoa(rtpPayloadPCMU), pt == strconv.Itoa(rtpPayloadPCMA):
+				formats = append(formats, pt)
+			case pt == strconv.Itoa(cfg.RTPL16PayloadType) && strings.EqualFold(m.RTPMap[pt], "L16/16000"):
+				formats = append(formats, pt)
+			}
+		}
+		if m.Kind != "audio" || len(formats) == 0 {
+			fmt.Fprintf(&answer, "m=%s 0 RTP/AVP %s\r\n", m.Kind, strings.Join(m.Formats, " "))
+			continue
+		}
+
+		conn, err := net.ListenPacket("udp", net.JoinHostPort(localIP.String(), "0"))
+		if err != nil {
+			cancel()
+			return nil, fmt.Errorf("siprec: media port: %w", err)
+		}
+		leg := m.Label
+		if leg == "" {
+			leg = strconv.Itoa(i)
+		}
+		labels := map[string]string{"call_id": callID, "leg": leg}
+		if speaker := speakers[m.Label]; speaker != "" {
+			labels["participant"] = speaker
+		}
+		r := &rtpReceiver{client: client, cfg: cfg, jobs: jobs, sessions: sessions,
+			describe: func(ssrc uint32, _ net.Addr) (string, map[string]string) {
+				name := fmt.Sprintf("siprec call=%s leg=%s", callID, leg)
+				if speaker := labels["participant"]; speaker != "" {
+					name += " participant=" + speaker
+				}
+				return name, labels
+			}}
+		go func() {
+			if err := r.serve(callCtx, ctx, conn); err != nil {
+				slog.Warn("siprec: media stopped", slog.String("call_id", callID), slog.String("error", err.Error()))
+			}
+		}()
+		accepted++
+
+		fmt.Fprintf(&answer, "m=audio %d RTP/AVP %s\r\na=recvonly\r\n", conn.LocalAddr().(*net.UDPAddr).Port, strings.Join(formats, " "))
+		if m.Label != "" {
+			fmt.Fprintf(&answer, "a=label:%s\r\n", m.Label)
+		}
+	}
+	if accepted == 0 {
+		cancel()
+		return nil, errors.New("siprec: no supported audio stream offered")
+	}
+	slog.Info("siprec: call started", slog.String("call_id", callID), slog.Int("legs", accepted))
+
+	tag := newSIPTag()
+	contact := fmt.Sprintf("Contact: <sip:recorder@%s>", net.JoinHostPort(localIP.String(), strconv.Itoa(sipPort)))
+	ok := sipResponse(req, 200, "OK", tag, []string{contact, "Content-Type: application/sdp"}, []byte(answer.String()))
+	return &sipCall{toTag: tag, answer: ok, cancel: cancel}, nil
+}
+
+func newSIPTag() string {
+	var b [6]byte
+	_, _ = rand.Read(b[:])
+	return fmt.Sprintf("%x", b)
+}
+
+func newSIPSessionID() uint32 {
+	var b [4]byte
+	_, _ = rand.Read(b[:])
+	return binary.BigEndian.Uint32(b[:])
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"net/textproto"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// crlf turns the lines of s into the CRLF-terminated lines of SIP.
+func crlf(s string) string {
+	return strings.ReplaceAll(s, "\n", "\r\n")
+}
+
+func TestParseSIP(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  *sipMessage
+		err   string
+	}{
+		{
+			name: "request",
+			input: crlf("INVITE sip:recorder@10.0.0.1 SIP/2.0\n" +
+				"Via: SIP/2.0/UDP 10.0.0.2;branch=z9hG4bK1\n" +
+				"Via: SIP/2.0/UDP 10.0.0.3;branch=z9hG4bK2\n" +
+				"Call-ID: abc@10.0.0.2\n" +
+				"Content-Length: 5\n" +
+				"\n" +
+				"v=0\n"),
+			want: &sipMessage{
+				Method: "INVITE", RequestURI: "sip:recorder@10.0.0.1",
+				Header: textproto.MIMEHeader{
+					"Via":            {"SIP/2.0/UDP 10.0.0.2;branch=z9hG4bK1", "SIP/2.0/UDP 10.0.0.3;branch=z9hG4bK2"},
+					"Call-Id":        {"abc@10.0.0.2"},
+					"Content-Length": {"5"},
+				},
+				Body: []byte("v=0\r\n"),
+			},
+		},
+		{
+			name:  "response",
+			input: crlf("SIP/2.0 200 OK\nCSeq: 1 OPTIONS\n\n"),
+			want:  &sipMessage{Header: textproto.MIMEHeader{"Cseq": {"1 OPTIONS"}}, Body: []byte{}},
+		},
+		{
+			name:  "compact headers",
+			input: crlf("BYE sip:r@h SIP/2.0\nv: SIP/2.0/UDP h\ni: abc\nl: 0\n\n"),
+			want: &sipMessage{
+				Method: "BYE", RequestURI: "sip:r@h",
+				Header: textproto.MIMEHeader{"Via": {"SIP/2.0/UDP h"}, "Call-Id": {"abc"}, "Content-Length": {"0"}},
+				Body:   []byte{},
+			},
+		},
+		{
+			name:  "body beyond Content-Length",
+			input: crlf("ACK sip:r@h SIP/2.0\nContent-Length: 2\n\nokjunk"),
+			want:  &sipMessage{Method: "ACK", RequestURI: "sip:r@h", Header: textproto.MIMEHeader{"Content-Length": {"2"}}, Body: []byte("ok")},
+		},
+		{
+			name:  "headers without the blank line",
+			input: crlf("OPTIONS sip:r@h SIP/2.0\nCall-ID: abc\n"),
+			want:  &sipMessage{Method: "OPTIONS", RequestURI: "sip:r@h", Header: textproto.MIMEHeader{"Call-Id": {"abc"}}, Body: []byte{}},
+		},
+		{name: "empty", input: "", err: "sip: EOF"},
+		{name: "start line without version", input: crlf("INVITE sip:r@h\n\n"), err: `sip: malformed start line "INVITE sip:r@h"`},
+		{name: "not SIP", input: crlf("GET / HTTP/1.1\n\n"), err: `sip: malformed start line "GET / HTTP/1.1"`},
+		{name: "malformed header", input: crlf("BYE sip:r@h SIP/2.0\nno colon here\n\n"), err: `sip: malformed MIME header: missing colon: "no colon here"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSIP([]byte(tt.input))
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSDPMedia(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []sdpMedia
+	}{
+		{name: "empty"},
+		{
+			name: "two labeled legs",
+			input: crlf("v=0\no=- 1 1 IN IP4 10.0.0.2\na=label:ignored\n" +
+				"m=audio 10000 RTP/AVP 0 8\na=rtpmap:0 PCMU/8000\na=rtpmap:8 PCMA/8000\na=label:1\n" +
+				"m=audio 10002 RTP/AVP 0\na=label:2\n"),
+			want: []sdpMedia{
+				{Kind: "audio", Formats: []string{"0", "8"}, Label: "1", RTPMap: map[string]string{"0": "PCMU/8000", "8": "PCMA/8000"}},
+				{Kind: "audio", Formats: []string{"0"}, Label: "2", RTPMap: map[string]string{}},
+			},
+		},
+		{
+			name:  "short media line",
+			input: "m=audio 10000\na=label:1\nm=video 10004 RTP/AVP 96\n",
+			want:  []sdpMedia{{Kind: "video", Formats: []string{"96"}, RTPMap: map[string]string{}}},
+		},
+		{
+			name:  "rtpmap without codec",
+			input: "m=audio 10000 RTP/AVP 0\na=rtpmap:0\n",
+			want:  []sdpMedia{{Kind: "audio", Formats: []string{"0"}, RTPMap: map[string]string{}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseSDPMedia([]byte(tt.input)); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitSIPRECBody(t *testing.T) {
+	const sdp = "v=0\r\nm=audio 10000 RTP/AVP 0\r\na=label:1\r\n"
+	const metadata = `<?xml version="1.0"?>
+<recording xmlns="urn:ietf:params:xml:ns:recording:1">
+  <participant participant_id="p1"><nameID aor="sip:alice@example.com"><name>Alice</name></nameID></participant>
+  <participant participant_id="p2"><nameID aor="sip:bob@example.com"/></participant>
+  <stream stream_id="s1"><label>1</label></stream>
+  <stream stream_id="s2"><label>2</label></stream>
+  <participantstreamassoc participant_id="p1"><send>s1</send></participantstreamassoc>
+  <participantstreamassoc participant_id="p2"><send> s2 </send></participantstreamassoc>
+</recording>`
+	multipartBody := func(parts ...string) string {
+		var b strings.Builder
+		for _, p := range parts {
+			b.WriteString("--b1\r\n" + p)
+		}
+		b.WriteString("--b1--\r\n")
+		return b.String()
+	}
+	sdpPart := "Content-Type: application/sdp\r\n\r\n" + sdp + "\r\n"
+	metaPart := "Content-Type: application/rs-metadata+xml\r\n\r\n" + metadata + "\r\n"
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		sdp         string
+		speakers    map[string]string
+		err         string
+	}{
+		{name: "plain SDP", contentType: "application/sdp", body: sdp, sdp: sdp, speakers: map[string]string{}},
+		{
+			name:        "SDP and metadata",
+			contentType: `multipart/mixed;boundary=b1`,
+			body:        multipartBody(sdpPart, metaPart),
+			sdp:         sdp,
+			speakers:    map[string]string{"1": "Alice", "2": "sip:bob@example.com"},
+		},
+		{
+			name:        "malformed metadata is ignored",
+			contentType: `multipart/mixed; boundary="b1"`,
+			body:        multipartBody(sdpPart, "Content-Type: application/rs-metadata+xml\r\n\r\n<recording><participant\r\n"),
+			sdp:         sdp,
+			speakers:    map[string]string{},
+		},
+		{name: "no SDP part", contentType: "multipart/mixed;boundary=b1", body: multipartBody(metaPart), err: "sip: no SDP in body"},
+		{name: "unsupported body", contentType: "text/plain", body: "hi", err: "sip: unsupported body text/plain"},
+		{name: "malformed content type", contentType: "multipart/mixed; boundary", err: "sip: content type: mime: invalid media parameter"},
+		{name: "truncated multipart", contentType: "multipart/mixed;boundary=b1", body: "--b1\r\nContent-Type: application/sdp\r\n\r\nv=0", err: "sip: body: unexpected EOF"},
+		{name: "missing boundary", contentType: "multipart/mixed;boundary=b2", body: multipartBody(sdpPart), err: "sip: no SDP in body"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sdp, meta, err := splitSIPRECBody(tt.contentType, []byte(tt.body))
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(sdp) != tt.sdp {
+				t.Errorf("got SDP %q, want %q", sdp, tt.sdp)
+			}
+			if got := meta.speakers(); !reflect.DeepEqual(got, tt.speakers) {
+				t.Errorf("got speakers %v, want %v", got, tt.speakers)
+			}
+		})
+	}
+}
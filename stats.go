@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// statsWindowMs is the granularity at which silence and level are measured.
+	statsWindowMs = 100
+
+	// silenceRMS is the normalized RMS (about -40dBFS) below which a window
+	// counts as silence.
+	silenceRMS = 0.01
+)
+
+// AudioStats accumulates per-session audio statistics. The reader and the
+// pipeline stages update it while the HTTP API reads it, so all access goes
+// through its methods.
+type AudioStats struct {
+	// Drops is updated by forwardAudio directly.
+	Drops dropCounters
+
+	mu            sync.Mutex
+	bytesReceived int64
+	chunks        int64
+	decodeErrors  int64
+	missingFrames int64
+	audioBytes    int64
+	windows       int64
+	silentWindows int64
+	levelSum      float64
+	lastFrame     time.Time
+}
+
+// AudioStatsSnapshot is a point-in-time copy of AudioStats, as served by
+// GET /sessions/{id}/stats and sent in the session summary.
+type AudioStatsSnapshot struct {
+	BytesReceived int64   `json:"bytes_received"`
+	Chunks        int64   `json:"chunks"`
+	AudioMs       int64   `json:"audio_ms"`
+	SilenceRatio  float64 `json:"silence_ratio"`
+	AverageLevel  float64 `json:"average_level"`
+	DecodeErrors  int64   `json:"decode_errors"`
+	MissingFrames int64   `json:"missing_frames"`
+	DroppedChunks int64   `json:"dropped_chunks"`
+}
+
+// addFrame records an inbound frame of n bytes, as received from the client.
+func (s *AudioStats) addFrame(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bytesReceived += int64(n)
+	s.chunks++
+	s.lastFrame = time.Now()
+	metrics.audioBytes.Add(int64(n))
+}
+
+// LastActivity returns when the last frame was received, zero if none was.
+func (s *AudioStats) LastActivity() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastFrame
+}
+
+// addDecodeError records a frame or stream that could not be decoded.
+func (s *AudioStats) addDecodeError() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.decodeErrors++
+}
+
+// addMissingFrames records n sequence numbers the jitter buffer gave up on
+// (see jitter.go).
+func (s *AudioStats) addMissingFrames(n int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.missingFrames += n
+}
+
+// addWindow records a statsWindowMs window of decoded audio with the given RMS.
+func (s *AudioStats) addWindow(rms float64, bytes int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.audioBytes += int64(bytes)
+	s.windows++
+	s.levelSum += rms
+	if rms < silenceRMS {
+		s.silentWindows++
+	}
+}
+
+// Snapshot returns a consistent copy of the statistics.
+func (s *AudioStats) Snapshot() AudioStatsSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snap := AudioStatsSnapshot{
+		BytesReceived: s.bytesReceived,
+		Chunks:        s.chunks,
+		AudioMs:       pcmDuration(int(s.audioBytes)).Milliseconds(),
+		DecodeErrors:  s.decodeErrors,
+		MissingFrames: s.missingFrames,
+		DroppedChunks: s.Drops.Chunks.Load(),
+	}
+	if s.windows > 0 {
+		snap.SilenceRatio = float64(s.silentWindows) / float64(s.windows)
+		snap.AverageLevel = s.levelSum / float64(s.windows)
+	}
+	return snap
+}
+
+// TranscriptCounts counts the transcript pieces of a session.
+// AverageConfidence is over the words of the finals, weighted by word.
+type TranscriptCounts struct {
+	Partials          int64   `json:"partials"`
+	Finals            int64   `json:"finals"`
+	Words             int64   `json:"words"`
+	AverageConfidence float64 `json:"average_confidence,omitempty"`
+}
+
+// SummaryEvent is sent when a session ends, to the client and to the sinks
+// that implement SummarySink, and carries its final statistics. Error is
+// set if the session ended because of one. CostUSD is the estimated cost of
+// the audio sent to Transcribe (see usage.go).
+type SummaryEvent struct {
+	Type       string             `json:"type"`
+	SessionID  string             `json:"session_id"`
+	Labels     map[string]string  `json:"labels,omitempty"`
+	DurationMs int64              `json:"duration_ms"`
+	Stats      AudioStatsSnapshot `json:"stats"`
+	Transcript TranscriptCounts   `json:"transcript"`
+	CostUSD    float64            `json:"cost_usd"`
+	Error      string             `json:"error,omitempty"`
+}
+
+func (e SummaryEvent) EventType() string { return e.Type }
+
+// trackAudioStats is a pass-through pipeline stage that measures the decoded
+// audio in statsWindowMs windows and records level and silence into stats.
+func trackAudioStats(ctx context.Context, in <-chan AudioChunk, stats *AudioStats) <-chan AudioChunk {
+	out := make(chan AudioChunk, cap(in))
+	windowSamples := sampleRateHz * statsWindowMs / 1000
+
+	go func() {
+		defer close(out)
+		var (
+			sumSquares float64
+			samples    int
+		)
+		for ch := range in {
+			for i := range sampleCount(ch.PCM) {
+				v := float64(sampleAt(ch.PCM, i)) / math.MaxInt16
+				sumSquares += v * v
+				samples++
+				if samples >= windowSamples {
+					stats.addWindow(math.Sqrt(sumSquares/float64(samples)), samples*bytesPerSample)
+					sumSquares, samples = 0, 0
+				}
+			}
+
+			select {
+			case out <- ch:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+/*
+Learning note: TLS and Let's Encrypt
+====================================
+
+Browsers only give microphone access to secure pages, and a page served over
+https may only open wss:// WebSockets. Without a reverse proxy in front, the
+server has to terminate TLS itself, with one of two kinds of certificate:
+
+  - -tls-cert and -tls-key name PEM files, e.g. from a company CA or certbot.
+  - -autocert-domains lists host names for which certificates are obtained
+    from Let's Encrypt (ACME) on first use and renewed before they expire.
+
+ACME has to prove that we control the domains. With the HTTP-01 challenge the
+CA fetches http://<domain>/.well-known/acme-challenge/<token> on port 80, so
+autocert mode runs a second, plain HTTP server on -autocert-http-addr that
+answers the challenges and redirects everything else to https. Certificates
+are kept in -autocert-cache, so a restart does not ask for new ones; Let's
+Encrypt rate-limits those.
+
+Both modes keep HTTP/2 (ALPN "h2") next to HTTP/1.1 for the WebSockets.
+*/
+
+// tlsEnabled reports whether the server terminates TLS itself.
+func (c Config) tlsEnabled() bool {
+	return c.TLSCertFile != "" || c.AutocertDomains != ""
+}
+
+// configureTLS sets up server.TLSConfig for the mode selected in cfg. In
+// autocert mode it also starts the HTTP-01 challenge server, which runs until
+// ctx is done.
+func configureTLS(ctx context.Context, cfg Config, server *http.Server) error {
+	if cfg.TLSCertFile != "" && cfg.AutocertDomains != "" {
+		return errors.New("tls: -tls-cert and -autocert-domains are mutually exclusive")
+	}
+	if cfg.TLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			return err
+		}
+		server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"h2", "http/1.1"}}
+		return nil
+	}
+
+	var domains []string
+	for d := range strings.SplitSeq(cfg.AutocertDomains, ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			domains = append(domains, d)
+		}
+	}
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Cache:      autocert.DirCache(cfg.AutocertCacheDir),
+		Email:      cfg.AutocertEmail,
+	}
+	server.TLSConfig = m.TLSConfig()
+
+	challenge := &http.Server{Addr: cfg.AutocertHTTPAddr, Handler: m.HTTPHandler(nil), ReadHeaderTimeout: readHeaderTimeout}
+	go func() {
+		<-ctx.Done()
+		_ = challenge.Close()
+	}()
+	go func() {
+		slog.Info("tls: ACME challenge server start", slog.String("addr", challenge.Addr), slog.Any("domains", domains))
+		if err := challenge.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			slog.Error("tls: ACME challenge server error", slog.String("error", err.Error()))
+		}
+	}()
+	return nil
+}
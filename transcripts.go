@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+Learning note: Long polling
+===========================
+
+Some networks only let plain request/response HTTP through: proxies that
+buffer responses break streaming, and some block WebSocket upgrades outright.
+Long polling works everywhere. The client asks for what is new and the server
+holds the request until there is something, or until a timeout, then the
+client asks again right away:
+
+	GET /sessions/{id}/transcripts?after=0        -> {"pieces":[...],"cursor":7,"done":false}
+	GET /sessions/{id}/transcripts?after=7        -> (waits) {"pieces":[...],"cursor":9,...}
+
+Every piece of a session gets a sequence number. The cursor is the last one
+returned and goes into the next request's ?after=, so nothing is missed or
+repeated between polls and the client only keeps one number. ?wait= sets how
+long to hold the request (default pollDefaultWait, at most pollMaxWait); a
+timeout answers with no pieces and the same cursor.
+
+A partial is superseded by the next partial or final of the same segment, so
+the store only keeps the partials since the last final: a slow poller skips
+partials it no longer needs instead of replaying all of them. Once the
+session has ended, "done" is true and the store keeps the transcript for
+transcriptRetention.
+
+GET /sessions/{id}/transcript.jsonl downloads the transcript of an ended
+session: one final piece per line, with its start and end in milliseconds of
+session audio and the speaker Transcribe's speaker partitioning assigned. Both
+views carry the labels the client set with its config message.
+*/
+
+const (
+	// transcriptRetention is how long the transcript of an ended session
+	// stays available.
+	transcriptRetention = time.Hour
+
+	pollDefaultWait = 25 * time.Second
+	pollMaxWait     = time.Minute
+)
+
+// StoredPiece is a transcript piece with its position in the session.
+type StoredPiece struct {
+	Seq int64 `json:"seq"`
+	TranscriptPiece
+}
+
+// sessionTranscript is the stored transcript of one session.
+type sessionTranscript struct {
+	session *Session
+	pieces  []StoredPiece
+	seq     int64
+	done    bool
+	changed chan struct{} // closed and replaced on every update
+}
+
+func (t *sessionTranscript) notify() {
+	close(t.changed)
+	t.changed = make(chan struct{})
+}
+
+// TranscriptStore keeps the transcript pieces of running and recently ended
+// sessions for the HTTP API. It is a TranscriptSink for the pieces and a
+// SessionObserver for the sessions' lifetimes; pieces published under IDs of
+// unknown sessions (uploads use job IDs) are ignored. It is safe for
+// concurrent use.
+type TranscriptStore struct {
+	mu       sync.Mutex
+	sessions map[string]*sessionTranscript
+}
+
+func NewTranscriptStore() *TranscriptStore {
+	return &TranscriptStore{sessions: make(map[string]*sessionTranscript)}
+}
+
+func (s *TranscriptStore) SessionStarted(session *Session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[session.ID] = &sessionTranscript{session: session, changed: make(chan struct{})}
+}
+
+func (s *TranscriptStore) SessionEnded(session *Session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.sessions[session.ID]
+	if !ok {
+		return
+	}
+	t.done = true
+	t.notify()
+	time.AfterFunc(transcriptRetention, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.sessions, session.ID)
+	})
+}
+
+func (s *TranscriptStore) Publish(sessionID string, piece TranscriptPiece) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.sessions[sessionID]
+	if !ok || t.done {
+		return
+	}
+	// Drop the partials the new piece supersedes.
+	if n := len(t.pieces); n > 0 && t.pieces[n-1].Partial {
+		t.pieces = slices.DeleteFunc(t.pieces, func(p StoredPiece) bool { return p.Partial })
+	}
+	t.seq++
+	t.pieces = append(t.pieces, StoredPiece{Seq: t.seq, TranscriptPiece: piece})
+	t.notify()
+}
+
+// After returns the stored pieces of the session with a sequence number
+// above after, whether the session has ended, and a channel that is closed
+// on the next change. ok is false for unknown sessions.
+func (s *TranscriptStore) After(sessionID string, after int64) (pieces []StoredPiece, done bool, changed <-chan struct{}, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.sessions[sessionID]
+	if !ok {
+		return nil, false, nil, false
+	}
+	i, _ := slices.BinarySearchFunc(t.pieces, after+1, func(p StoredPiece, seq int64) int { return int(p.Seq - seq) })
+	return slices.Clone(t.pieces[i:]), t.done, t.changed, true
+}
+
+// Tenant returns the tenant of the session; ok is false for unknown sessions.
+func (s *TranscriptStore) Tenant(sessionID string) (tenant string, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.sessions[sessionID]
+	if !ok {
+		return "", false
+	}
+	return t.session.Tenant, true
+}
+
+// Labels returns the labels of the session, nil for unknown sessions.
+func (s *TranscriptStore) Labels(sessionID string) map[string]string {
+	s.mu.Lock()
+	t, ok := s.sessions[sessionID]
+	s.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	return t.session.Labels()
+}
+
+// transcriptBatch is the response of GET /sessions/{id}/transcripts.
+type transcriptBatch struct {
+	Pieces []StoredPiece     `json:"pieces"`
+	Cursor int64             `json:"cursor"`
+	Done   bool              `json:"done"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// transcriptLine is a line of GET /sessions/{id}/transcript.jsonl: a piece
+// with what identifies its session, so lines can be loaded on their own.
+type transcriptLine struct {
+	SessionID string `json:"session_id"`
+	TranscriptPiece
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// TranscriptPollEndpoint serves GET /sessions/{id}/transcripts?after=N&wait=D,
+// the long-polling view of a session's transcript (see the note above).
+func TranscriptPollEndpoint(store *TranscriptStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		var after int64
+		if v := r.URL.Query().Get("after"); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 0 {
+				http.Error(w, "after must be a sequence number", http.StatusBadRequest)
+				return
+			}
+			after = n
+		}
+		wait := pollDefaultWait
+		if v := r.URL.Query().Get("wait"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				http.Error(w, "wait must be a duration, e.g. 20s", http.StatusBadRequest)
+				return
+			}
+			wait = min(d, pollMaxWait)
+		}
+
+		timeout := time.NewTimer(wait)
+		defer timeout.Stop()
+		for {
+			pieces, done, changed, ok := store.After(id, after)
+			if !ok {
+				http.Error(w, "session not found", http.StatusNotFound)
+				return
+			}
+			if len(pieces) == 0 && !done {
+				select {
+				case <-changed:
+					continue
+				case <-timeout.C:
+				case <-r.Context().Done():
+					return
+				}
+			}
+			batch := transcriptBatch{Pieces: pieces, Cursor: after, Done: done, Labels: store.Labels(id)}
+			if len(pieces) > 0 {
+				batch.Cursor = pieces[len(pieces)-1].Seq
+			}
+			if batch.Pieces == nil {
+				batch.Pieces = []StoredPiece{}
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Cache-Control", "no-store")
+			if err := json.NewEncoder(w).Encode(batch); err != nil {
+				slog.Debug("http: poll write failed", slog.String("error", err.Error()))
+			}
+			return
+		}
+	}
+}
+
+// TranscriptDownloadEndpoint serves GET /sessions/{id}/transcript.jsonl: the
+// final pieces of an ended session as JSON Lines, one transcriptLine per
+// line. Running sessions answer 409; their transcript is at
+// /sessions/{id}/transcripts.
+func TranscriptDownloadEndpoint(store *TranscriptStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		pieces, done, _, ok := store.After(id, 0)
+		if !ok {
+			http.Error(w, "session not found", http.StatusNotFound)
+			return
+		}
+		if !done {
+			http.Error(w, "session is still running", http.StatusConflict)
+			return
+		}
+		w.Header().Set("Content-Type", "application/jsonl")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", id+".jsonl"))
+		enc := json.NewEncoder(w)
+		labels := store.Labels(id)
+		for _, p := range pieces {
+			if p.Partial {
+				continue
+			}
+			if err := enc.Encode(transcriptLine{SessionID: id, TranscriptPiece: p.TranscriptPiece, Labels: labels}); err != nil {
+				slog.Debug("http: transcript download failed", slog.String("session", id), slog.String("error", err.Error()))
+				return
+			}
+		}
+	}
+}
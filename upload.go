@@ -0,0 +1,513 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"os/exec"
+	"slices"
+	"sync"
+	"time"
+)
+
+/*
+Learning note: Transcribing uploaded files
+==========================================
+
+Transcribe Streaming is built for live audio: it expects roughly real-time
+input, so a whole file cannot simply be pushed as fast as it can be read. An
+upload therefore becomes a background job:
+
+	POST /upload --> temp file --> ffmpeg (decodeFile) --> paceAudio --> runTranscribeStream
+	                                                                          |
+	GET /jobs/{id}, GET /jobs/{id}/transcript  <--  Job (finals so far)  <----+
+
+paceAudio releases each chunk when its timestamp comes due, so a one-hour file
+takes an hour to transcribe, but the client does not have to stay connected:
+it gets a job ID right away and can poll the job or follow its transcript as
+newline-delimited JSON. Both need the API key the file was uploaded with, or
+the admin token (see requireJobAccess): a job ID alone reads nothing.
+*/
+
+// jobRetention is how long finished jobs stay available.
+const jobRetention = time.Hour
+
+// JobStatus is the state of an upload job.
+type JobStatus string
+
+const (
+	JobQueued  JobStatus = "queued"
+	JobRunning JobStatus = "running"
+	JobDone    JobStatus = "done"
+	JobFailed  JobStatus = "failed"
+)
+
+// Job is the transcription of one uploaded file. It is safe for concurrent
+// use.
+type Job struct {
+	ID       string
+	Filename string
+	Created  time.Time
+	Tenant   string // who may read it besides the admin; "" for the admin only
+
+	mu      sync.Mutex
+	status  JobStatus
+	err     string
+	finals  []string
+	changed chan struct{} // closed and replaced on every update
+}
+
+// JobSnapshot is the JSON view of a Job served by GET /jobs/{id}.
+type JobSnapshot struct {
+	ID         string    `json:"id"`
+	Filename   string    `json:"filename"`
+	Created    time.Time `json:"created"`
+	Status     JobStatus `json:"status"`
+	Error      string    `json:"error,omitempty"`
+	Transcript []string  `json:"transcript"`
+}
+
+// update applies fn under the lock and wakes up followers.
+func (j *Job) update(fn func()) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	fn()
+	close(j.changed)
+	j.changed = make(chan struct{})
+}
+
+// Snapshot returns a copy of the job's state.
+func (j *Job) Snapshot() JobSnapshot {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return JobSnapshot{ID: j.ID, Filename: j.Filename, Created: j.Created, Status: j.status, Error: j.err, Transcript: append([]string{}, j.finals...)}
+}
+
+// finalsAfter returns the final transcripts from index n on, whether the job
+// has ended, and a channel closed on the next update.
+func (j *Job) finalsAfter(n int) ([]string, bool, <-chan struct{}) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	ended := j.status == JobDone || j.status == JobFailed
+	return append([]string{}, j.finals[min(n, len(j.finals)):]...), ended, j.changed
+}
+
+// JobStore runs upload jobs and keeps them for jobRetention afterwards.
+type JobStore struct {
+	ctx      context.Context // canceled on server shutdown
+	client   *TranscribeClient
+	cfg      Config
+	sessions *SessionRegistry // uploads wait here for a session slot
+	sink     TranscriptSink
+
+	mu   sync.RWMutex
+	jobs map[string]*Job
+}
+
+func NewJobStore(ctx context.Context, client *TranscribeClient, cfg Config, sessions *SessionRegistry, sink TranscriptSink) *JobStore {
+	return &JobStore{ctx: ctx, client: client, cfg: cfg, sessions: sessions, sink: sink, jobs: make(map[string]*Job)}
+}
+
+// Get returns the job with the given ID.
+func (s *JobStore) Get(id string) (*Job, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	j, ok := s.jobs[id]
+	return j, ok
+}
+
+// Tenant returns the tenant job id was started for; ok is false for jobs it
+// does not know.
+func (s *JobStore) Tenant(id string) (tenant string, ok bool) {
+	job, ok := s.Get(id)
+	if !ok {
+		return "", false
+	}
+	return job.Tenant, true
+}
+
+// List returns the jobs, oldest first.
+func (s *JobStore) List() []*Job {
+	s.mu.RLock()
+	list := slices.Collect(maps.Values(s.jobs))
+	s.mu.RUnlock()
+	slices.SortFunc(list, func(a, b *Job) int { return a.Created.Compare(b.Created) })
+	return list
+}
+
+// add registers a new queued job for tenant. Besides uploads, server-side
+// sources such as the RTP listener use jobs to expose their transcripts.
+func (s *JobStore) add(name, tenant string) *Job {
+	job := &Job{ID: newSessionID(), Filename: name, Created: time.Now(), Tenant: tenant, status: JobQueued, changed: make(chan struct{})}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs[job.ID] = job
+	return job
+}
+
+// finish marks job as done, or failed with err, and forgets it after
+// jobRetention.
+func (s *JobStore) finish(job *Job, err error) {
+	job.update(func() {
+		if err != nil {
+			job.status, job.err = JobFailed, err.Error()
+		} else {
+			job.status = JobDone
+		}
+	})
+	slog.Info("jobs: job finished", slog.String("job", job.ID), slog.String("status", string(job.Snapshot().Status)))
+
+	time.AfterFunc(jobRetention, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.jobs, job.ID)
+	})
+}
+
+// addFinal appends a final transcript piece to the job.
+func (j *Job) addFinal(text string) {
+	j.update(func() { j.finals = append(j.finals, text) })
+}
+
+// setRunning marks the job as running.
+func (j *Job) setRunning() {
+	j.update(func() { j.status = JobRunning })
+}
+
+// start registers a job for the file at path and transcribes it in the
+// background, for the tenant of e within admission, which is released once
+// the job ends. The file is removed once the job ends.
+func (s *JobStore) start(filename, path string, e Entitlements, admission tenantAdmission) *Job {
+	job := s.add(filename, e.Tenant)
+	go func() {
+		defer os.Remove(path)
+		defer admission.release()
+		s.finish(job, s.run(job, path, e, admission))
+	}()
+	return job
+}
+
+// run transcribes the file at path into job.
+func (s *JobStore) run(job *Job, path string, e Entitlements, admission tenantAdmission) error {
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+
+	// An upload is not live: it stays queued until a session slot is free.
+	release, err := s.sessions.ReserveWait(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	audioIn, transcriptOut, errOut, err := runTranscribeStream(ctx, s.client)
+	if err != nil {
+		return fmt.Errorf("start transcription: %w", err)
+	}
+	job.setRunning()
+	slog.Info("upload: job started", slog.String("job", job.ID), slog.String("file", job.Filename))
+	if admission.finalsOnly {
+		transcriptOut = dropPartials(ctx, transcriptOut)
+	}
+
+	audio, decodeErr := decodeFile(ctx, s.cfg.FFmpegPath, path)
+	staged := paceAudio(ctx, audio)
+	staged = capAudioDuration(ctx, staged, budgetFor(s.cfg, e).withQuota(admission.remaining), func(reason closeReason) {
+		slog.Warn("upload: job truncated", slog.String("job", job.ID), slog.String("reason", reason.Message))
+	})
+	var drops dropCounters
+	go forwardAudio(ctx, staged, audioIn, DropPolicyBlock, overloadQueueLen, &drops, nil)
+
+	// Uploads have no session; their pieces are published under the job ID.
+	for piece := range publishTranscripts(ctx, transcriptOut, job.ID, s.sink) {
+		if !piece.Partial {
+			job.addFinal(piece.Text)
+		}
+	}
+	if err := <-errOut; err != nil {
+		return err
+	}
+	return <-decodeErr
+}
+
+// transcribe runs a Transcribe session over the audio on in and collects its
+// final transcript in job, for sources that have no client to talk back to
+// (RTP, SIPREC, ...). sequenced says whether in carries sequence numbers
+// that reorderAudio should restore the order of. The session is registered
+// under its ID while it runs, and admitted and limited as a session of the
+// tenant of e (zero for the server's own sources). in is drained until it is
+// closed, whatever happens to the session, so its producer never blocks.
+func (s *JobStore) transcribe(ctx context.Context, client *TranscribeClient, cfg Config, in <-chan AudioChunk, sequenced bool, session *Session, job *Job, sessions *SessionRegistry, e Entitlements) {
+	ctx, cancel := context.WithCancel(ctx)
+	sessions.Add(session)
+	defer sessions.Remove(session.ID)
+	defer func() {
+		cancel()
+		for ch := range in {
+			ch.Release()
+		}
+	}()
+
+	// Live sources cannot wait for a slot: their audio would pile up.
+	release, err := sessions.Reserve()
+	if err != nil {
+		slog.Warn("jobs: session limit reached; dropping source", slog.Any("session", session))
+		s.finish(job, err)
+		return
+	}
+	defer release()
+	admission, err := sessions.Admit(e)
+	if err != nil {
+		slog.Warn("jobs: tenant over quota; dropping source", slog.Any("session", session), slog.String("error", err.Error()))
+		s.finish(job, err)
+		return
+	}
+	defer admission.release()
+	audioIn, transcriptOut, errOut, err := startTranscribe(ctx, client, cfg)
+	if err != nil {
+		s.finish(job, fmt.Errorf("start transcription: %w", err))
+		return
+	}
+	job.setRunning()
+	if admission.finalsOnly {
+		transcriptOut = dropPartials(ctx, transcriptOut)
+	}
+
+	staged := endIdleAudio(ctx, in, cfg.IdleTimeout, nil, func(reason closeReason) {
+		slog.Warn("jobs: source idle; ending session", slog.Any("session", session), slog.String("reason", reason.Message))
+	})
+	if sequenced {
+		staged = reorderAudio(ctx, staged, session.Stats)
+	}
+	staged = trackAudioStats(ctx, staged, session.Stats)
+	truncated := func(reason closeReason) {
+		slog.Warn("jobs: session truncated", slog.Any("session", session), slog.String("reason", reason.Message))
+	}
+	staged = capAudioDuration(ctx, staged, budgetFor(cfg, e).withQuota(admission.remaining), truncated)
+	staged = capSessionDuration(ctx, staged, cfg, truncated)
+	staged = endOnKill(ctx, staged, session, truncated)
+	go forwardAudio(ctx, staged, audioIn, cfg.DropPolicy, overloadQueueLen, &session.Stats.Drops, nil)
+
+	for piece := range publishTranscripts(ctx, transcriptOut, session.ID, s.sink) {
+		session.AddPiece(piece)
+		if !piece.Partial {
+			job.addFinal(piece.Text)
+		}
+	}
+	err = <-errOut
+	if err != nil {
+		sessions.Fail(session.ID, err)
+	}
+	s.finish(job, err)
+}
+
+// decodeFile decodes the audio file at path to chunkMs chunks of s16le in the
+// session format with ffmpeg, ending with a Final chunk. The error channel
+// receives the outcome once the output is done.
+func decodeFile(ctx context.Context, ffmpegPath, path string) (<-chan AudioChunk, <-chan error) {
+	out := make(chan AudioChunk, 16)
+	errc := make(chan error, 1)
+
+	go func() {
+		defer close(out)
+		var tsMs int64
+		send := func(ch AudioChunk) bool {
+			select {
+			case out <- ch:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		finish := func(err error) {
+			errc <- err
+			send(AudioChunk{Final: true, TsMs: tsMs})
+		}
+
+		cmd := exec.CommandContext(ctx, ffmpegPath,
+			"-hide_banner", "-loglevel", "error", "-i", path,
+			"-f", "s16le", "-ac", fmt.Sprint(numChannels), "-ar", fmt.Sprint(sampleRateHz), "pipe:1")
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			finish(err)
+			return
+		}
+		if err := cmd.Start(); err != nil {
+			finish(fmt.Errorf("start ffmpeg: %w", err))
+			return
+		}
+
+		buf := make([]byte, sampleRateHz*bytesPerSample*numChannels*chunkMs/1000)
+		for {
+			n, err := io.ReadFull(stdout, buf)
+			if n > 0 && !send(newPooledChunk(buf[:n], tsMs)) {
+				_ = cmd.Wait()
+				errc <- ctx.Err()
+				return
+			}
+			tsMs += chunkMs
+			if err != nil {
+				break
+			}
+		}
+		if err := cmd.Wait(); err != nil {
+			finish(fmt.Errorf("decode audio file: %w", err))
+			return
+		}
+		finish(nil)
+	}()
+
+	return out, errc
+}
+
+// paceAudio releases every chunk once its TsMs is due relative to the first
+// chunk, turning a stream that is available all at once into a real-time one.
+func paceAudio(ctx context.Context, in <-chan AudioChunk) <-chan AudioChunk {
+	out := make(chan AudioChunk, cap(in))
+
+	go func() {
+		defer close(out)
+		var start time.Time
+		for ch := range in {
+			if start.IsZero() {
+				start = time.Now()
+			}
+			if wait := time.Until(start.Add(time.Duration(ch.TsMs) * time.Millisecond)); wait > 0 && !ch.Final {
+				timer := time.NewTimer(wait)
+				select {
+				case <-timer.C:
+				case <-ctx.Done():
+					timer.Stop()
+					return
+				}
+			}
+			select {
+			case out <- ch:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out
+}
+
+// UploadEndpoint serves POST /upload: a multipart form with the audio file in
+// the "file" field, in any format ffmpeg understands. It answers 202 with the
+// job ID; the transcript is available from GET /jobs/{id} and, as it grows,
+// GET /jobs/{id}/transcript.
+func UploadEndpoint(jobs *JobStore, cfg Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// An upload is a session of the key's tenant like any other; there is
+		// no point in reading the file of a tenant over its quota.
+		entitlements, err := cfg.APIKeys.Lookup(r)
+		if err != nil {
+			rejectAPIKey(w, err)
+			return
+		}
+		admission, err := jobs.sessions.Admit(entitlements)
+		if err != nil {
+			rejectQuota(w, err)
+			return
+		}
+		started := false
+		defer func() {
+			if !started {
+				admission.release()
+			}
+		}()
+
+		r.Body = http.MaxBytesReader(w, r.Body, cfg.MaxUploadBytes)
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			status := http.StatusBadRequest
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				status = http.StatusRequestEntityTooLarge
+			}
+			http.Error(w, "upload: "+err.Error(), status)
+			return
+		}
+		defer file.Close()
+
+		// The form's own temp file goes away with the request; the job needs a
+		// copy that outlives it.
+		tmp, err := os.CreateTemp("", "upload-*")
+		if err != nil {
+			slog.Error("upload: temp file", slog.String("error", err.Error()))
+			http.Error(w, "upload failed", http.StatusInternalServerError)
+			return
+		}
+		if _, err := io.Copy(tmp, file); err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			http.Error(w, "upload: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		tmp.Close()
+
+		job := jobs.start(header.Filename, tmp.Name(), entitlements, admission)
+		started = true
+		slog.Info("upload: job queued", slog.String("job", job.ID), slog.String("file", header.Filename), slog.Int64("bytes", header.Size))
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", "/jobs/"+job.ID)
+		w.WriteHeader(http.StatusAccepted)
+		_ = json.NewEncoder(w).Encode(map[string]string{"job_id": job.ID})
+	}
+}
+
+// JobEndpoint serves GET /jobs/{id}: the job's status and its transcript so far.
+func JobEndpoint(jobs *JobStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		job, ok := jobs.Get(r.PathValue("id"))
+		if !ok {
+			http.Error(w, "job not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(job.Snapshot()); err != nil {
+			slog.Error("http: job encode failed", slog.String("error", err.Error()))
+		}
+	}
+}
+
+// JobTranscriptEndpoint serves GET /jobs/{id}/transcript: the final transcript
+// pieces of a job as newline-delimited JSON, streamed as they are produced
+// until the job ends.
+func JobTranscriptEndpoint(jobs *JobStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		job, ok := jobs.Get(r.PathValue("id"))
+		if !ok {
+			http.Error(w, "job not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		rc := http.NewResponseController(w)
+		enc := json.NewEncoder(w)
+
+		sent := 0
+		for {
+			finals, ended, changed := job.finalsAfter(sent)
+			for _, text := range finals {
+				if err := enc.Encode(TranscriptEvent{Text: text}); err != nil {
+					return
+				}
+			}
+			sent += len(finals)
+			_ = rc.Flush()
+			if ended {
+				return
+			}
+			select {
+			case <-changed:
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+/*
+Learning note: Usage accounting
+===============================
+
+To bill tenants, or hold them to a quota, the server has to know what each
+used. UsageMeter is a SessionObserver that adds up, per tenant (of the API
+key a session was started with, see apikeys.go) and per UTC day:
+
+  - sessions: started sessions
+  - audio_seconds: audio sent to Transcribe, which is what AWS bills
+  - bytes_received: audio as the client sent it, before decoding
+
+A session is counted on the day it started, once it ended; the sessions
+still running are added in when usage is read, so a report never lags behind
+a long session. Sessions without an API key count for the tenant
+"anonymous". The silence the warm pool keeps its streams open with (see
+warm.go) is billed by AWS as well, and counts for the tenant "warm-pool",
+without sessions, whenever a pooled stream leaves the pool.
+
+Days are kept in memory and written to the -usage-file every
+-usage-flush-interval (and on shutdown), as one JSON document replaced
+atomically (write to a temporary file, then rename). A restart loads it back;
+what ended since the last flush is lost with a crash, which is why the
+interval should stay short.
+
+GET /usage?tenant=&from=&to= (admin) returns the totals of every tenant over
+the days from..to (YYYY-MM-DD, by default the current month), with the days
+they consist of and the estimated cost at -price-per-minute.
+
+The same estimate is in the summary that ends every session (cost_usd, from
+the audio it sent to Transcribe), and, per tenant, in the
+gochannels_estimated_cost_usd_total metric (see metrics.go). It is what the
+list price makes of the audio, not what AWS bills: free tiers, discounts and
+rounding are not known to the server.
+*/
+
+const (
+	// anonymousTenant is the tenant of sessions without an API key.
+	anonymousTenant = "anonymous"
+	// warmPoolTenant is the tenant the warm pool's streams count for.
+	warmPoolTenant = "warm-pool"
+	// usageDay is the layout of the days usage is kept by.
+	usageDay = time.DateOnly
+)
+
+// UsageTotals is the usage of a tenant over some time.
+type UsageTotals struct {
+	Sessions      int64   `json:"sessions"`
+	AudioSeconds  float64 `json:"audio_seconds"`
+	BytesReceived int64   `json:"bytes_received"`
+}
+
+func (u *UsageTotals) add(o UsageTotals) {
+	u.Sessions += o.Sessions
+	u.AudioSeconds += o.AudioSeconds
+	u.BytesReceived += o.BytesReceived
+}
+
+// estimatedCost returns the estimated cost of audioMs of audio sent to
+// Transcribe, in USD at pricePerMinute.
+func estimatedCost(audioMs int64, pricePerMinute float64) float64 {
+	return float64(audioMs) / float64(time.Minute/time.Millisecond) * pricePerMinute
+}
+
+// sessionUsage returns what session used so far.
+func sessionUsage(s *Session) UsageTotals {
+	stats := s.Stats.Snapshot()
+	return UsageTotals{Sessions: 1, AudioSeconds: float64(stats.AudioMs) / 1000, BytesReceived: stats.BytesReceived}
+}
+
+// usageTenant returns the tenant a session's usage counts for.
+func usageTenant(s *Session) string {
+	if s.Tenant == "" {
+		return anonymousTenant
+	}
+	return s.Tenant
+}
+
+// UsageMeter accounts the usage of sessions per tenant and day (see the
+// note above). It is a SessionObserver and safe for concurrent use.
+type UsageMeter struct {
+	path string // empty = not persisted
+
+	mu      sync.Mutex
+	days    map[string]map[string]*UsageTotals // tenant -> day -> totals
+	running map[string]*Session
+	dirty   bool // changed since the last flush
+}
+
+// NewUsageMeter returns a meter, with the usage in the file at path if
+// there is one, and writes it back there every interval until ctx is done.
+// An empty path keeps usage in memory only.
+func NewUsageMeter(ctx context.Context, path string, interval time.Duration) (*UsageMeter, error) {
+	m := &UsageMeter{path: path, days: make(map[string]map[string]*UsageTotals), running: make(map[string]*Session)}
+	if path == "" {
+		return m, nil
+	}
+	data, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		return nil, fmt.Errorf("usage: %w", err)
+	default:
+		if err := json.Unmarshal(data, &m.days); err != nil {
+			return nil, fmt.Errorf("usage: %s: %w", path, err)
+		}
+	}
+	go m.run(ctx, interval)
+	slog.Info("usage: accounting", slog.String("file", path), slog.Int("tenants", len(m.days)))
+	return m, nil
+}
+
+// run flushes every interval, and a last time when ctx is done.
+func (m *UsageMeter) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			m.flush()
+			return
+		}
+		m.flush()
+	}
+}
+
+// flush writes the usage to the file if it changed.
+func (m *UsageMeter) flush() {
+	m.mu.Lock()
+	if !m.dirty {
+		m.mu.Unlock()
+		return
+	}
+	data, err := json.Marshal(m.days)
+	m.dirty = false
+	m.mu.Unlock()
+	if err != nil {
+		return
+	}
+	tmp := m.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err == nil {
+		err = os.Rename(tmp, m.path)
+	}
+	if err != nil {
+		slog.Error("usage: flush failed", slog.String("file", m.path), slog.String("error", err.Error()))
+		m.mu.Lock()
+		m.dirty = true
+		m.mu.Unlock()
+	}
+}
+
+func (m *UsageMeter) SessionStarted(s *Session) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.running[s.ID] = s
+}
+
+func (m *UsageMeter) SessionEnded(s *Session) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.running, s.ID)
+	m.add(usageTenant(s), s.Started, sessionUsage(s))
+}
+
+// AddWarmAudio counts audioMs of silence a pooled stream was kept open with
+// (see warm.go) for warmPoolTenant, on the current day. A nil meter counts
+// nothing.
+func (m *UsageMeter) AddWarmAudio(audioMs int64) {
+	if m == nil || audioMs == 0 {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.add(warmPoolTenant, time.Now(), UsageTotals{AudioSeconds: float64(audioMs) / 1000})
+}
+
+// add adds used to the totals of tenant on the UTC day of t. m.mu must be
+// held.
+func (m *UsageMeter) add(tenant string, t time.Time, used UsageTotals) {
+	day := t.UTC().Format(usageDay)
+	if m.days[tenant] == nil {
+		m.days[tenant] = make(map[string]*UsageTotals)
+	}
+	if m.days[tenant][day] == nil {
+		m.days[tenant][day] = &UsageTotals{}
+	}
+	m.days[tenant][day].add(used)
+	m.dirty = true
+}
+
+// TenantUsage is the usage of a tenant over the days of a report.
+type TenantUsage struct {
+	UsageTotals
+	CostUSD float64                `json:"cost_usd"`
+	Running int                    `json:"running"` // sessions, included in the totals
+	Days    map[string]UsageTotals `json:"days"`
+}
+
+// Usage returns the usage of the tenant, or of all tenants if tenant is
+// empty, over the days from..to (UTC, inclusive), running sessions included.
+func (m *UsageMeter) Usage(tenant string, from, to time.Time) map[string]*TenantUsage {
+	first, last := from.UTC().Format(usageDay), to.UTC().Format(usageDay)
+	report := make(map[string]*TenantUsage)
+	account := func(t, day string, used UsageTotals) *TenantUsage {
+		if (tenant != "" && t != tenant) || day < first || day > last {
+			return nil
+		}
+		u := report[t]
+		if u == nil {
+			u = &TenantUsage{Days: make(map[string]UsageTotals)}
+			report[t] = u
+		}
+		u.add(used)
+		d := u.Days[day]
+		d.add(used)
+		u.Days[day] = d
+		return u
+	}
+
+	m.mu.Lock()
+	for t, days := range m.days {
+		for day, used := range days {
+			account(t, day, *used)
+		}
+	}
+	running := slices.Collect(maps.Values(m.running))
+	m.mu.Unlock()
+	for _, s := range running {
+		if u := account(usageTenant(s), s.Started.UTC().Format(usageDay), sessionUsage(s)); u != nil {
+			u.Running++
+		}
+	}
+	return report
+}
+
+// usageReport is the response of GET /usage.
+type usageReport struct {
+	From    string                  `json:"from"`
+	To      string                  `json:"to"`
+	Tenants map[string]*TenantUsage `json:"tenants"`
+}
+
+// UsageEndpoint serves GET /usage: the usage of every tenant, or of
+// ?tenant=, over ?from=..?to= (YYYY-MM-DD, UTC, inclusive; by default the
+// current month so far), with its estimated cost at pricePerMinute.
+func UsageEndpoint(meter *UsageMeter, pricePerMinute float64) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now().UTC()
+		from := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+		to := now
+		for name, t := range map[string]*time.Time{"from": &from, "to": &to} {
+			if v := r.URL.Query().Get(name); v != "" {
+				parsed, err := time.Parse(usageDay, v)
+				if err != nil {
+					http.Error(w, name+" must be a day (YYYY-MM-DD)", http.StatusBadRequest)
+					return
+				}
+				*t = parsed
+			}
+		}
+
+		report := usageReport{From: from.Format(usageDay), To: to.Format(usageDay), Tenants: meter.Usage(r.URL.Query().Get("tenant"), from, to)}
+		for _, u := range report.Tenants {
+			u.CostUSD = u.AudioSeconds / 60 * pricePerMinute
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(report); err != nil {
+			slog.Error("http: usage encode failed", slog.String("error", err.Error()))
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/aws/smithy-go"
+)
+
+/*
+Learning note: Waiting for Transcribe capacity
+==============================================
+
+An AWS account may run only so many Transcribe streams at once, across all
+servers using it. When it is reached, StartStreamTranscription fails with a
+LimitExceededException, and even after the retries of retry.go the client
+would be turned away while a stream elsewhere may end a second later. With
+-admission-queue N such a WebSocket connection waits in line instead:
+
+	client A --start: LimitExceeded--> [queue: A B C] --head retries--> Transcribe
+	          <--{"type":"queued","position":1,...}--
+
+  - The client gets a {"type":"queued","position":N,...} frame when it joins
+    and whenever it moves up, then the usual {"type":"session",...} frame
+    once its stream started. Audio it sends in between is read only then, so
+    a client should hold its audio until the session frame.
+  - Only the head of the queue tries again: every admissionRetry, and as soon
+    as a session of this server ends. Capacity freed elsewhere is not
+    announced, hence the polling.
+  - A full queue, or a wait longer than -admission-wait, ends the connection
+    as the LimitExceededException would have, with reason "quota_exceeded".
+
+Only the concurrency limit queues; any other failure to start ends the
+connection at once.
+*/
+
+// admissionRetry is how often the head of the queue tries to start its
+// stream.
+const admissionRetry = 5 * time.Second
+
+var (
+	errAdmissionQueueFull = fmt.Errorf("%w: Transcribe is at its limit of concurrent streams and the queue is full", ErrQuota)
+	errAdmissionTimeout   = fmt.Errorf("%w: no Transcribe capacity freed up in time", ErrQuota)
+)
+
+// QueuedEvent tells a client waiting for Transcribe capacity where it is in
+// line; position 1 is next.
+type QueuedEvent struct {
+	Type     string `json:"type"`
+	Position int    `json:"position"`
+	Message  string `json:"message"`
+}
+
+func (e QueuedEvent) EventType() string { return e.Type }
+
+// isConcurrencyLimit reports whether err is AWS refusing a stream because
+// the account runs as many as it may.
+func isConcurrencyLimit(err error) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == "LimitExceededException"
+}
+
+// admissionQueue lines up the connections waiting for Transcribe capacity
+// (see the note above). A nil queue waits for nothing. It is safe for
+// concurrent use.
+type admissionQueue struct {
+	size     int
+	maxWait  time.Duration
+	sessions *SessionRegistry
+
+	mu      sync.Mutex
+	waiting []*admissionTicket // in order of arrival
+	moved   chan struct{}      // closed and replaced whenever one leaves
+}
+
+// admissionTicket is the place of one connection in the queue.
+type admissionTicket struct{ _ byte } // not zero-sized, so every ticket is distinct
+
+// newAdmissionQueue returns a queue of at most size connections, each
+// waiting at most maxWait; nil if size is 0. A session of sessions ending
+// makes the head try again.
+func newAdmissionQueue(size int, maxWait time.Duration, sessions *SessionRegistry) *admissionQueue {
+	if size <= 0 {
+		return nil
+	}
+	return &admissionQueue{size: size, maxWait: maxWait, sessions: sessions, moved: make(chan struct{})}
+}
+
+// wait queues a connection whose stream could not start for lack of
+// capacity, and runs start whenever it is its turn to try again, until start
+// succeeds or fails otherwise. notify is told the position in line whenever
+// it changes. Without a queue, or when it is full, wait returns cause or
+// errAdmissionQueueFull without calling start.
+func (q *admissionQueue) wait(ctx context.Context, cause error, notify func(position int), start func() error) error {
+	if q == nil {
+		return cause
+	}
+	log := loggerFrom(ctx)
+	t := &admissionTicket{}
+	q.mu.Lock()
+	if len(q.waiting) >= q.size {
+		q.mu.Unlock()
+		log.Warn("admission: queue full; refusing connection", slog.Int("size", q.size))
+		return errAdmissionQueueFull
+	}
+	q.waiting = append(q.waiting, t)
+	q.mu.Unlock()
+	defer q.leave(t)
+
+	deadline := time.NewTimer(q.maxWait)
+	defer deadline.Stop()
+	waited := time.Now()
+	last := 0
+	for {
+		pos, moved := q.position(t)
+		if pos != last {
+			log.Info("admission: waiting for Transcribe capacity", slog.Int("position", pos))
+			notify(pos)
+			last = pos
+		}
+		var (
+			retry <-chan time.Time
+			freed <-chan struct{}
+		)
+		if pos == 1 {
+			retry = time.After(admissionRetry)
+			freed = q.sessions.Freed()
+		}
+		select {
+		case <-moved:
+			continue
+		case <-deadline.C:
+			log.Warn("admission: gave up waiting for Transcribe capacity", slog.Duration("waited", q.maxWait))
+			return errAdmissionTimeout
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-retry:
+		case <-freed:
+		}
+		err := start()
+		if !isConcurrencyLimit(err) {
+			if err == nil {
+				log.Info("admission: stream started after waiting", slog.Duration("waited", time.Since(waited)))
+			}
+			return err
+		}
+		log.Debug("admission: Transcribe still at its limit")
+	}
+}
+
+// position returns where t is in line, and a channel closed when that may
+// change.
+func (q *admissionQueue) position(t *admissionTicket) (int, <-chan struct{}) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, w := range q.waiting {
+		if w == t {
+			return i + 1, q.moved
+		}
+	}
+	return 0, q.moved
+}
+
+func (q *admissionQueue) leave(t *admissionTicket) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, w := range q.waiting {
+		if w == t {
+			q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+			break
+		}
+	}
+	close(q.moved)
+	q.moved = make(chan struct{})
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+/*
+Learning note: A pool of warm Transcribe streams
+================================================
+
+Opening a Transcribe stream takes an HTTP/2 handshake with AWS and the
+StartStreamTranscription round trip, a few hundred milliseconds the client
+waits through before its first words can be transcribed. With -warm-sessions
+N the server opens N streams ahead of time, and startTranscribe hands one to
+the next session instead of opening a new one:
+
+	warmer --> [stream] --keeper: silence every chunkMs--+
+	warmer --> [stream] --keeper: silence ...            +--> handoff --> session
+	                                                          |
+	                               refill: warmer opens the next one
+
+Every pooled stream has a keeper goroutine. An idle Transcribe stream is
+closed by AWS after 15 seconds, so the keeper feeds it silence (as a paused
+session does, see pause.go) until a session takes it over the unbuffered
+handoff channel, or until warmMaxAge, when it is replaced so no stream runs
+into AWS's 4 hour limit while waiting. The silence shifts the stream's clock:
+the session's transcript timestamps are moved back by the time it was kept.
+
+The pool belongs to the server, not to a session: its streams live on the
+server context. A session that takes one ties it to its own context by
+closing the audio input when that context ends.
+
+Warm streams count against the account's concurrent stream quota like any
+other, so -max-sessions plus -warm-sessions must stay below it. When the pool
+is empty, sessions open their stream as before.
+
+They are billed like any other too: AWS charges for the silence a pooled
+stream is fed, so N warm streams cost about N hours of audio per hour at
+-price-per-minute, whether sessions take them or not. The silence counts in
+the usage (tenant "warm-pool", see usage.go) and in the transcribed seconds
+and cost metrics once the stream leaves the pool; a session that takes a
+stream pays only for its own audio.
+*/
+
+const (
+	// warmMaxAge is how long a pooled stream waits for a session before it
+	// is replaced.
+	warmMaxAge = 30 * time.Minute
+	// warmRetry is the delay before opening a pooled stream again after AWS
+	// refused one.
+	warmRetry = 5 * time.Second
+)
+
+// warmStream is a pooled Transcribe stream and how long it has been fed
+// silence.
+type warmStream struct {
+	audioIn       chan<- AudioChunk
+	transcriptOut <-chan TranscriptPiece
+	errOut        <-chan error
+	silentMs      int64
+}
+
+// TranscribePool keeps size Transcribe streams open, ready to be taken by
+// sessions (see the note above). It is safe for concurrent use.
+type TranscribePool struct {
+	ctx     context.Context
+	client  *TranscribeClient
+	handoff chan warmStream
+	usage   *UsageMeter // counts the silence; nil if not kept
+	price   float64     // USD per minute of audio, for the cost metric
+}
+
+// NewTranscribePool starts size warmers, each keeping a stream ready until
+// ctx is done, and counts the silence they send in usage (which may be nil)
+// and in the metrics at pricePerMinute.
+func NewTranscribePool(ctx context.Context, client *TranscribeClient, size int, usage *UsageMeter, pricePerMinute float64) *TranscribePool {
+	p := &TranscribePool{ctx: ctx, client: client, handoff: make(chan warmStream), usage: usage, price: pricePerMinute}
+	for range size {
+		go p.warm()
+	}
+	slog.Info("warm: pool started", slog.Int("size", size))
+	return p
+}
+
+// warm keeps one pooled stream at a time open until ctx is done.
+func (p *TranscribePool) warm() {
+	for p.ctx.Err() == nil {
+		audioIn, transcriptOut, errOut, err := runTranscribeStream(p.ctx, p.client)
+		if err != nil {
+			slog.Warn("warm: stream failed to open; retrying", slog.String("error", err.Error()), slog.Duration("retry", warmRetry))
+			select {
+			case <-time.After(warmRetry):
+			case <-p.ctx.Done():
+			}
+			continue
+		}
+		p.keep(warmStream{audioIn: audioIn, transcriptOut: transcriptOut, errOut: errOut})
+	}
+}
+
+// keep feeds s silence until a session takes it, it gets too old, or it
+// fails, and then counts the silence.
+func (p *TranscribePool) keep(s warmStream) {
+	defer func() {
+		p.usage.AddWarmAudio(s.silentMs)
+		metrics.warmAudio(s.silentMs, p.price)
+	}()
+	ticker := time.NewTicker(chunkMs * time.Millisecond)
+	defer ticker.Stop()
+	expire := time.NewTimer(warmMaxAge)
+	defer expire.Stop()
+	for {
+		select {
+		case p.handoff <- s:
+			return
+		case <-ticker.C:
+			select {
+			case s.audioIn <- AudioChunk{PCM: silenceChunk, TsMs: s.silentMs}:
+				s.silentMs += chunkMs
+			default: // the sender is stuck or gone; errOut tells which
+			}
+		case err := <-s.errOut:
+			if err != nil {
+				slog.Warn("warm: pooled stream failed; replacing", slog.String("error", err.Error()))
+			}
+			close(s.audioIn)
+			return
+		case <-expire.C:
+			slog.Debug("warm: pooled stream expired; replacing")
+			close(s.audioIn) // the sender closes the AWS stream
+			return
+		case <-p.ctx.Done():
+			return
+		}
+	}
+}
+
+// take hands a warm stream to a session that runs until ctx is done, or
+// reports false if none is ready.
+func (p *TranscribePool) take(ctx context.Context) (chan<- AudioChunk, <-chan TranscriptPiece, <-chan error, bool) {
+	var s warmStream
+	select {
+	case s = <-p.handoff:
+	default:
+		return nil, nil, nil, false
+	}
+	slog.Debug("warm: stream taken", slog.Int64("silent_ms", s.silentMs))
+
+	// The session's audio goes in until it ends or ctx is done; closing the
+	// stream's input then makes it flush and finish.
+	audioIn := make(chan AudioChunk, 16)
+	go func() {
+		defer close(s.audioIn)
+		for {
+			select {
+			case ch, ok := <-audioIn:
+				if !ok {
+					return
+				}
+				select {
+				case s.audioIn <- ch:
+				case <-ctx.Done():
+					return
+				}
+				if ch.Final {
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	// The transcript's timestamps are moved back by the silence the stream
+	// got while pooled.
+	transcriptOut := make(chan TranscriptPiece, 32)
+	go func() {
+		defer close(transcriptOut)
+		for p := range s.transcriptOut {
+			p.StartMs = max(p.StartMs-s.silentMs, 0)
+			p.EndMs = max(p.EndMs-s.silentMs, 0)
+			select {
+			case transcriptOut <- p:
+			case <-ctx.Done(): // nobody reads anymore; drain until the stream ends
+			}
+		}
+	}()
+	return audioIn, transcriptOut, s.errOut, true
+}
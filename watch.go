@@ -0,0 +1,92 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// SessionWatchEndpoint serves GET /sessions/{id}/watch: a read-only WebSocket
+// on a running session, e.g. for a supervisor following an agent's call.
+//
+// The observer receives a {"type":"session",...} frame and from then on the
+// same transcript frames as the client that streams the audio (JSON, or
+// protobuf with the "gochannels.protobuf.v1" subprotocol). When the session
+// ends the server closes the connection with the reason "session_ended". Any
+// number of observers can watch a session; they get the pieces from a
+// transcriptHub, so an observer that cannot keep up misses pieces instead of
+// slowing the session down. Messages from the observer are ignored.
+func SessionWatchEndpoint(cfg Config, sessions *SessionRegistry, hub *transcriptHub) http.HandlerFunc {
+	upgrader := websocket.Upgrader{
+		CheckOrigin:  func(r *http.Request) bool { return true },
+		Subprotocols: []string{protobufSubprotocol},
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		// Subscribe before checking, so a session ending in between still
+		// closes pieces.
+		pieces, unsubscribe := hub.Subscribe(id)
+		defer unsubscribe()
+		if _, ok := sessions.Get(id); !ok {
+			http.Error(w, "session not found", http.StatusNotFound)
+			return
+		}
+
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			slog.Error("watch: upgrade failed", slog.String("error", err.Error()))
+			return
+		}
+		defer conn.Close()
+		// Observers have nothing to say beyond control frames.
+		conn.SetReadLimit(maxControlBytes)
+		codec := codecFor(conn)
+		frames := newFrameLog()
+		ctx := r.Context()
+		keepAlive(ctx, conn, cfg.PingInterval, cfg.PongTimeout)
+		slog.Info("watch: observer attached", slog.String("session", id), slog.String("remote", r.RemoteAddr))
+
+		// Reader: observers only send control frames, which the read loop
+		// handles; a read error means the observer is gone.
+		gone := make(chan struct{})
+		go func() {
+			defer close(gone)
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+				if cfg.PingInterval > 0 {
+					extendReadDeadline(conn, cfg.PongTimeout)
+				}
+			}
+		}()
+
+		if err := writeEvent(conn, codec, frames, SessionEvent{Type: "session", ID: id}); err != nil {
+			return
+		}
+		for {
+			select {
+			case piece, ok := <-pieces:
+				if !ok {
+					slog.Info("watch: session ended; detaching observer", slog.String("session", id))
+					_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "session_ended"), time.Now().Add(writeWait))
+					return
+				}
+				if err := writeEvent(conn, codec, frames, TranscriptEvent{Text: piece.Text, Partial: piece.Partial}); err != nil {
+					slog.Debug("watch: write failed", slog.String("error", err.Error()))
+					return
+				}
+			case <-gone:
+				slog.Info("watch: observer left", slog.String("session", id))
+				return
+			case <-ctx.Done():
+				if isServerShutdown(ctx) {
+					closeWithReason(slog.Default(), conn, codec, frames, closeReason{Code: "server_shutdown", Message: "the server is shutting down"})
+				}
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/webtransport-go"
+)
+
+/*
+Learning note: WebTransport (experimental)
+==========================================
+
+A WebSocket runs over TCP, which delivers every byte in order. On a lossy
+mobile link one lost packet holds back everything behind it until it is
+retransmitted, and the audio arrives in bursts, late. For live speech a lost
+20ms is better than a late second: Transcribe copes with a small gap, not with
+falling behind.
+
+WebTransport runs over QUIC (HTTP/3, UDP) and offers both: unreliable
+datagrams and reliable streams, on one connection. A client connects to
+https://<host><-webtransport-addr>/webtransport and then
+
+  - sends audio as datagrams in the ?framing=seq layout (see parseSeqFrame):
+    a sequence number, the capture time and the audio. Lost datagrams stay
+    lost; the jitter buffer (reorderAudio) puts the rest in order and counts
+    the gaps. A datagram must fit in one QUIC packet, so keep them around
+    20ms of audio (640 bytes of s16le).
+  - opens one bidirectional stream for everything that must not get lost:
+    it writes control messages (see control.go) as JSON lines, and reads the
+    same JSON events as on /ws, one per line. Closing the stream ends the audio
+    like {"type":"end"}.
+
+?format= and ?endian= work as on /ws. QUIC always uses TLS, so WebTransport
+needs -tls-cert or -autocert-domains, and browsers only allow it from secure
+pages anyway. It listens on its own UDP port, -webtransport-addr.
+*/
+
+// webTransportAcceptTimeout is how long a new session may take to open its
+// control stream.
+const webTransportAcceptTimeout = 10 * time.Second
+
+// ServeWebTransport serves the WebTransport endpoint on cfg.WebTransportAddr
+// until ctx is done.
+func ServeWebTransport(ctx context.Context, cfg Config, tlsConfig *tls.Config, client *TranscribeClient, sessions *SessionRegistry, sink TranscriptSink) error {
+	mux := http.NewServeMux()
+	server := &webtransport.Server{
+		H3:          http3.Server{Addr: cfg.WebTransportAddr, Handler: mux, TLSConfig: tlsConfig},
+		CheckOrigin: func(r *http.Request) bool { return true },
+	}
+	mux.HandleFunc("/webtransport", func(w http.ResponseWriter, r *http.Request) {
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = FormatS16LE
+		}
+		newDecoder, err := lookupDecoder(format)
+		if err != nil {
+			writeError(w, "unsupported_format", err)
+			return
+		}
+		endian, err := parseByteOrderMode(r.URL.Query().Get("endian"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		entitlements, err := cfg.APIKeys.Lookup(r)
+		if err != nil {
+			rejectAPIKey(w, err)
+			return
+		}
+		qos, err := qosFor(cfg, entitlements, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if wait, open := client.breaker.RetryAfter(); open {
+			slog.Warn("wt: Transcribe degraded; rejecting", slog.String("remote", r.RemoteAddr))
+			rejectServiceDegraded(w, wait)
+			return
+		}
+		admission, err := sessions.Admit(entitlements)
+		if err != nil {
+			rejectQuota(w, err)
+			return
+		}
+		defer admission.release()
+		release, err := sessions.ReserveQoS(qos.Class)
+		if err != nil {
+			slog.Warn("wt: session limit reached; rejecting", slog.String("remote", r.RemoteAddr), slog.String("qos", string(qos.Class)))
+			rejectTooManySessions(w)
+			return
+		}
+		defer release()
+		sess, err := server.Upgrade(w, r)
+		if err != nil {
+			slog.Error("wt: upgrade failed", slog.String("error", err.Error()))
+			return
+		}
+		serveWebTransportSession(ctx, sess, cfg, client, sessions, sink, newDecoder, DecoderOptions{ByteOrder: endian, FFmpegPath: cfg.FFmpegPath}, r.RemoteAddr, entitlements, qos, admission)
+	})
+
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+	}()
+	slog.Info("wt: server start", slog.String("addr", cfg.WebTransportAddr))
+	err := server.ListenAndServe()
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// serveWebTransportSession runs the transcription of one WebTransport
+// session (see the note above). serverCtx is the server's context.
+func serveWebTransportSession(serverCtx context.Context, sess *webtransport.Session, cfg Config, client *TranscribeClient, sessions *SessionRegistry, sink TranscriptSink, newDecoder DecoderFactory, decOpts DecoderOptions, remote string, entitlements Entitlements, qos qosTier, admission tenantAdmission) {
+	ctx, cancel := context.WithCancel(sess.Context())
+	defer cancel()
+	stop := context.AfterFunc(serverCtx, cancel)
+	defer stop()
+
+	acceptCtx, acceptCancel := context.WithTimeout(ctx, webTransportAcceptTimeout)
+	control, err := sess.AcceptStream(acceptCtx)
+	acceptCancel()
+	if err != nil {
+		slog.Warn("wt: no control stream", slog.String("remote", remote), slog.String("error", err.Error()))
+		_ = sess.CloseWithError(0, "no control stream")
+		return
+	}
+	defer sess.CloseWithError(0, "")
+	enc := json.NewEncoder(control)
+	write := func(ev Event) error {
+		_ = control.SetWriteDeadline(time.Now().Add(writeWait))
+		return enc.Encode(ev)
+	}
+
+	audioIn, transcriptOut, errOut, err := startTranscribe(ctx, client, cfg)
+	if err != nil {
+		slog.Error("wt: transcribe stream error", slog.String("error", err.Error()))
+		reason := awsCloseReason(err)
+		_ = write(reason.event())
+		return
+	}
+	decoder, err := newDecoder(ctx, decOpts)
+	if err != nil {
+		_ = write(closeReason{Code: "decoder_unavailable", Message: err.Error()}.event())
+		return
+	}
+
+	session := &Session{ID: newSessionID(), Remote: remote, Started: time.Now(), Stats: &AudioStats{}, Tenant: entitlements.Tenant, QoS: qos.Class}
+	sessions.Add(session)
+	defer sessions.Remove(session.ID)
+	if admission.finalsOnly {
+		transcriptOut = dropPartials(ctx, transcriptOut)
+	}
+	transcriptOut = deliverTranscripts(ctx, publishTranscripts(ctx, transcriptOut, session.ID, sink), cfg.TranscriptDelivery)
+	slog.Info("wt: session started", slog.Any("session", session), slog.String("remote", remote))
+	if err := write(SessionEvent{Type: "session", ID: session.ID}); err != nil {
+		return
+	}
+
+	raw := make(chan AudioChunk, qos.AudioBuffer)
+	events := make(chan Event, eventBuffer)
+	if admission.finalsOnly {
+		emitEvent(events, finalsOnlyWarning)
+	}
+	closing := make(chan closeReason, 1)
+	endSession := func(reason closeReason) {
+		select {
+		case closing <- reason:
+		default:
+		}
+	}
+
+	var paused atomic.Bool
+	staged := endIdleAudio(ctx, raw, cfg.IdleTimeout, &paused, endSession)
+	staged = reorderAudio(ctx, staged, session.Stats)
+	staged = decodeAudio(ctx, staged, decoder, session.Stats, events)
+	staged = trackAudioStats(ctx, staged, session.Stats)
+	staged = meterAudio(ctx, staged, events)
+	staged = checkAudioQuality(ctx, staged, events)
+	staged = capAudioDuration(ctx, staged, budgetFor(cfg, entitlements).withQuota(admission.remaining), endSession)
+	staged = capSessionDuration(ctx, staged, cfg, endSession)
+	staged = endOnKill(ctx, staged, session, endSession)
+	staged = recordSession(ctx, staged, cfg.Recorder, session)
+	staged = padPauses(ctx, staged, &paused)
+	go forwardAudio(ctx, staged, audioIn, qos.DropPolicy, qos.QueueLen, &session.Stats.Drops, func(ev SlowDownEvent) { emitEvent(events, ev) })
+
+	// Canceling audioCtx ends the audio: the datagram reader then sends the
+	// Final chunk.
+	audioCtx, endAudio := context.WithCancel(ctx)
+	defer endAudio()
+
+	// Control reader: JSON lines on the control stream.
+	go func() {
+		defer endAudio()
+		router := controlRouter{
+			ControlStart: func(ControlMessage) error { return nil },
+			ControlConfig: func(msg ControlMessage) error {
+				if msg.Stream != nil {
+					return fmt.Errorf("%w: stream requires framing=mux", errInvalidControl)
+				}
+				if msg.changesOptions() {
+					return fmt.Errorf("%w: options cannot change over WebTransport", errInvalidControl)
+				}
+				session.SetLabels(msg.Labels)
+				return nil
+			},
+			ControlPause:  func(ControlMessage) error { paused.Store(true); return nil },
+			ControlResume: func(ControlMessage) error { paused.Store(false); return nil },
+			ControlPing: func(msg ControlMessage) error {
+				emitEvent(events, PongEvent{Type: "pong", ID: msg.ID})
+				return nil
+			},
+			ControlEnd: func(msg ControlMessage) error {
+				if msg.Stream != nil {
+					return fmt.Errorf("%w: stream requires framing=mux", errInvalidControl)
+				}
+				return errStreamEnded
+			},
+		}
+		lines := bufio.NewScanner(control)
+		for lines.Scan() {
+			err := router.dispatch(lines.Bytes())
+			switch {
+			case err == nil:
+			case errors.Is(err, errStreamEnded):
+				slog.Info("wt-control: received end", slog.Any("session", session))
+				return
+			case errors.Is(err, errUnsupportedVersion):
+				endSession(closeReason{Code: "unsupported_version", Message: err.Error()})
+				return
+			default:
+				emitEvent(events, WarningEvent{Type: "warning", Code: "invalid_control", Message: err.Error()})
+			}
+		}
+		slog.Info("wt-control: stream closed; ending audio", slog.Any("session", session))
+	}()
+
+	// Datagram reader: sequenced audio frames.
+	go func() {
+		defer close(raw)
+		validator := newFrameValidator(cfg, decoder.Info().SampleSize)
+		var (
+			tsMs, captureBase int64
+			hasBase           bool
+		)
+		send := func(ch AudioChunk) bool {
+			return sendChunk(ctx, raw, ch)
+		}
+		for {
+			data, err := sess.ReceiveDatagram(audioCtx)
+			if err != nil {
+				send(AudioChunk{Final: true, TsMs: tsMs})
+				return
+			}
+			session.Stats.addFrame(len(data))
+			if reason, ok := validator.check(len(data), time.Now()); !ok {
+				slog.Warn("wt-reader: datagram rejected; signaling final", slog.String("reason", reason.Code), slog.Int("bytes", len(data)))
+				endSession(reason)
+				send(AudioChunk{Final: true, TsMs: tsMs})
+				return
+			}
+			if ev, ok := validator.backoffDue(); ok {
+				emitEvent(events, ev)
+			}
+			if paused.Load() {
+				continue
+			}
+			seq, captureMs, payload, err := parseSeqFrame(data)
+			if err != nil {
+				session.Stats.addDecodeError()
+				continue
+			}
+			if !hasBase {
+				captureBase, hasBase = captureMs, true
+			}
+			tsMs = captureMs - captureBase
+			chunk := newLiveChunk(payload, tsMs)
+			chunk.Seq, chunk.CaptureMs = seq, captureMs
+			if !send(chunk) {
+				return
+			}
+		}
+	}()
+
+	// Writer: transcripts and events -> control stream.
+	for {
+		select {
+		case piece, ok := <-transcriptOut:
+			if !ok {
+				_ = write(session.Summary())
+				select {
+				case reason := <-closing:
+					_ = write(reason.event())
+				default:
+				}
+				_ = control.Close()
+				slog.Info("wt: session finished", slog.Any("session", session))
+				return
+			}
+			session.AddPiece(piece)
+			if err := write(TranscriptEvent{Text: piece.Text, Partial: piece.Partial}); err != nil {
+				slog.Warn("wt-writer: write failed", slog.String("error", err.Error()))
+				return
+			}
+		case ev := <-events:
+			if err := write(ev); err != nil {
+				slog.Warn("wt-writer: write failed", slog.String("type", ev.EventType()), slog.String("error", err.Error()))
+				return
+			}
+		case err := <-errOut:
+			if err != nil {
+				slog.Error("wt-writer: transcribe error", slog.String("error", err.Error()))
+				sessions.Fail(session.ID, err)
+				_ = write(session.Summary())
+				reason := awsCloseReason(err)
+				_ = write(reason.event())
+				return
+			}
+			errOut = nil // the transcripts are still being drained
+		case <-ctx.Done():
+			if isServerShutdown(serverCtx) {
+				_ = write(closeReason{Code: "server_shutdown", Message: "the server is shutting down"}.event())
+			}
+			return
+		}
+	}
+}
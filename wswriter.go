@@ -0,0 +1,229 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+/*
+Learning note: One writer per connection
+========================================
+
+gorilla/websocket allows one concurrent reader and one concurrent writer per
+connection; two goroutines writing frames at the same time corrupt the
+stream. (Close and WriteControl are the exception, which is why keepAlive
+may send its pings from a goroutine of its own.) So every frame of a
+connection, transcripts, events, the summary and the closing frame, goes
+through a wsWriter: a goroutine that owns the connection's write side, fed
+by a bounded queue. Multiplexed connections (?framing=mux) have one for all
+their streams.
+
+	session loop --Send/Offer--> [queue: wsWriteQueue frames] --> writer goroutine --> conn
+
+The queue also decouples the session from its client: a write that takes a
+while (a congested mobile link) no longer holds up the session loop, and
+with it Transcribe's receiver, as long as the queue has room. When it is
+full, the client is slower than its transcript, and -slow-client decides:
+
+  - "block" (default): the session waits for the client, as it always did;
+    backpressure reaches Transcribe.
+  - "disconnect": once the queue has stayed full for writeWait, the
+    connection is closed with reason "slow_client" (4408), so one stuck
+    client cannot keep a Transcribe stream waiting. The grace period lets
+    bursts, such as a transcript replay, through.
+
+Every write has a deadline of writeWait too, so a write to a client whose
+TCP window stays closed fails, which drops the connection (a resumable
+session waits for the client to come back), even while the queue has room.
+
+Side events (levels, warnings, ...) are advisory either way: Offer drops
+them when the queue is full.
+*/
+
+// wsWriteQueue is how many frames may wait for a connection's writer.
+const wsWriteQueue = 64
+
+// SlowClientPolicy decides what happens when a client does not read its
+// frames as fast as they come (see the note above).
+type SlowClientPolicy string
+
+const (
+	SlowClientBlock      SlowClientPolicy = "block"
+	SlowClientDisconnect SlowClientPolicy = "disconnect"
+)
+
+// parseSlowClientPolicy validates a policy name given on the command line.
+func parseSlowClientPolicy(s string) (SlowClientPolicy, error) {
+	switch p := SlowClientPolicy(s); p {
+	case SlowClientBlock, SlowClientDisconnect:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown slow client policy %q (want %s or %s)", s, SlowClientBlock, SlowClientDisconnect)
+	}
+}
+
+var (
+	// errSlowClient is returned by Send when the queue stayed full and the
+	// policy is to disconnect.
+	errSlowClient = errors.New("client does not read its frames fast enough")
+	// errWriterStopped is returned by Send once the writer has stopped.
+	errWriterStopped = errors.New("writer stopped")
+)
+
+// wsFrame is one entry of a writer's queue: an event, or a close with reason.
+type wsFrame struct {
+	ev    Event
+	close *closeReason
+}
+
+// wsWriter owns the writes of a WebSocket connection (see the note above).
+// Send, Offer, Close and Stop must be called from a single goroutine, the
+// session's.
+type wsWriter struct {
+	conn    *websocket.Conn
+	codec   messageCodec
+	frames  *frameLog // numbers the frames, see sequence.go
+	policy  SlowClientPolicy
+	log     *slog.Logger // of the session, see logging.go
+	session *Session     // notes what is written, see dump.go; nil for a multiplexed connection
+	queue   chan wsFrame
+	done    chan struct{} // closed when the writer goroutine has exited
+	err     error         // why it exited early; read after done
+	once    sync.Once
+}
+
+// newWSWriter starts the writer of conn, numbering its frames in frames,
+// logging to log and noting the events it writes on session (which may be
+// nil).
+func newWSWriter(conn *websocket.Conn, codec messageCodec, frames *frameLog, policy SlowClientPolicy, log *slog.Logger, session *Session) *wsWriter {
+	w := &wsWriter{conn: conn, codec: codec, frames: frames, policy: policy, log: log, session: session, queue: make(chan wsFrame, wsWriteQueue), done: make(chan struct{})}
+	go w.run()
+	return w
+}
+
+func (w *wsWriter) run() {
+	defer close(w.done)
+	defer recoverPanic("ws-writer", func(err error) { w.err = err })
+	for f := range w.queue {
+		if f.close != nil {
+			if w.session != nil {
+				w.session.NoteEvent(f.close.event())
+			}
+			closeWithReason(w.log, w.conn, w.codec, w.frames, *f.close)
+			return
+		}
+		err := writeEvent(w.conn, w.codec, w.frames, f.ev)
+		if errors.Is(err, errNoProtobufMessage) {
+			w.log.Debug("ws-writer: event not sent; the codec has no encoding for it", slog.String("type", f.ev.EventType()))
+			continue
+		}
+		if err != nil {
+			w.log.Warn("ws-writer: write failed", slog.String("type", f.ev.EventType()), slog.String("error", err.Error()))
+			if w.session != nil {
+				w.session.NoteError(err)
+			}
+			w.err = err
+			return
+		}
+		if w.session != nil {
+			w.session.NoteEvent(f.ev)
+		}
+	}
+}
+
+// Done is closed once the writer has stopped; Err then says why.
+func (w *wsWriter) Done() <-chan struct{} { return w.done }
+
+// Err returns the error the writer stopped on, errWriterStopped if it was
+// stopped, or nil while it runs.
+func (w *wsWriter) Err() error {
+	select {
+	case <-w.done:
+		if w.err != nil {
+			return w.err
+		}
+		return errWriterStopped
+	default:
+		return nil
+	}
+}
+
+// Send queues ev. With a full queue it waits for room; under the disconnect
+// policy for at most writeWait, after which it fails with errSlowClient.
+// Once the writer has stopped it fails with Err.
+func (w *wsWriter) Send(ev Event) error {
+	select {
+	case w.queue <- wsFrame{ev: ev}:
+		return nil
+	case <-w.done:
+		return w.Err()
+	default:
+	}
+	var timeout <-chan time.Time
+	if w.policy == SlowClientDisconnect {
+		timer := time.NewTimer(writeWait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case w.queue <- wsFrame{ev: ev}:
+		return nil
+	case <-w.done:
+		return w.Err()
+	case <-timeout:
+		return errSlowClient
+	}
+}
+
+// Offer queues ev if there is room, and drops it otherwise.
+func (w *wsWriter) Offer(ev Event) {
+	select {
+	case w.queue <- wsFrame{ev: ev}:
+	default:
+		w.log.Debug("ws-writer: event dropped", slog.String("type", ev.EventType()))
+	}
+}
+
+// Close writes the frames queued so far, then tells the client why the
+// server ends the session (see closeWithReason), and stops the writer. A
+// client that has not made room in the queue within writeWait just has its
+// connection closed.
+func (w *wsWriter) Close(reason closeReason) {
+	timer := time.NewTimer(writeWait)
+	defer timer.Stop()
+	select {
+	case w.queue <- wsFrame{close: &reason}:
+	case <-w.done:
+	case <-timer.C:
+		w.conn.Close()
+	}
+	w.Stop()
+}
+
+// Stop lets the writer write what is queued, for at most writeWait, and
+// waits for it to exit. A client that does not take the frames in time has
+// its connection closed.
+func (w *wsWriter) Stop() {
+	w.once.Do(func() { close(w.queue) })
+	timer := time.NewTimer(writeWait)
+	defer timer.Stop()
+	select {
+	case <-w.done:
+	case <-timer.C:
+		w.conn.Close()
+		<-w.done
+	}
+}
+
+// Abort closes the connection with reason right away, whatever is queued.
+func (w *wsWriter) Abort(reason closeReason) {
+	_ = w.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(reason.closeCode(), reason.Code), time.Now().Add(writeWait))
+	w.conn.Close()
+	w.once.Do(func() { close(w.queue) })
+	<-w.done
+}